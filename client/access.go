@@ -0,0 +1,313 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// Status of an elevation or access request, as the server names them
+const (
+	RequestPending   = "pending"
+	RequestApproved  = "approved"
+	RequestDenied    = "denied"
+	RequestCancelled = "cancelled" // Only access requests
+)
+
+// Decisions on an access review item
+const (
+	ReviewKeep   = "keep"
+	ReviewRevoke = "revoke"
+)
+
+// RoleGrant is a role of a user with who granted it and until when
+type RoleGrant struct {
+	UserID      uint       `json:"userId"` // Set by GrantRole
+	Role        string     `json:"role"`
+	GrantedByID *uint      `json:"grantedById"`
+	GrantedAt   time.Time  `json:"grantedAt"`
+	ExpiresAt   *time.Time `json:"expiresAt"` // Nil for a permanent grant
+	Reason      string     `json:"reason"`
+}
+
+// Elevation is a request of a user for a role for a limited time
+type Elevation struct {
+	ID           uint       `json:"id"`
+	UserID       uint       `json:"userId"`
+	Username     string     `json:"username"`
+	Role         string     `json:"role"`
+	Duration     string     `json:"duration"` // e.g. "2h0m0s"
+	Reason       string     `json:"reason"`
+	Status       string     `json:"status"` // RequestPending, RequestApproved or RequestDenied
+	DecidedByID  *uint      `json:"decidedById"`
+	DecisionNote string     `json:"decisionNote"`
+	CreatedAt    time.Time  `json:"createdAt"`
+	DecidedAt    *time.Time `json:"decidedAt"`
+	ExpiresAt    *time.Time `json:"expiresAt"` // End of the grant of an approved request
+}
+
+// AccessRequest is a request of a user for a role or a group membership
+type AccessRequest struct {
+	ID            uint       `json:"id"`
+	RequesterID   uint       `json:"requesterId"`
+	Requester     string     `json:"requester"`
+	Role          string     `json:"role"`  // Set for role requests
+	Group         string     `json:"group"` // Set for group requests
+	Justification string     `json:"justification"`
+	Status        string     `json:"status"`
+	DecidedByID   *uint      `json:"decidedById"`
+	DecisionNote  string     `json:"decisionNote"`
+	CreatedAt     time.Time  `json:"createdAt"`
+	DecidedAt     *time.Time `json:"decidedAt"`
+}
+
+type AccessReviewData struct {
+	Name      string     `json:"name"`
+	DueAt     *time.Time `json:"dueAt,omitempty"`
+	Reviewers []string   `json:"reviewers,omitempty"` // Usernames reviewing the items no group manager reviews
+	Roles     []string   `json:"roles,omitempty"`     // Limit the review to these roles
+	Groups    []string   `json:"groups,omitempty"`    // Limit the review to these groups
+	Kinds     []string   `json:"kinds,omitempty"`     // "role" and/or "group", both by default
+}
+
+// AccessReview is a certification campaign with the number of items per decision
+type AccessReview struct {
+	ID          uint           `json:"id"`
+	Name        string         `json:"name"`
+	Status      string         `json:"status"` // "open" or "closed"
+	DueAt       *time.Time     `json:"dueAt"`
+	CreatedByID *uint          `json:"createdById"`
+	CreatedAt   time.Time      `json:"createdAt"`
+	ClosedByID  *uint          `json:"closedById"`
+	ClosedAt    *time.Time     `json:"closedAt"`
+	Progress    map[string]int `json:"progress"` // "total", ReviewKeep, ReviewRevoke and "undecided"
+}
+
+// AccessReviewItem is one membership under review
+type AccessReviewItem struct {
+	ID          uint       `json:"ID"`
+	ReviewID    uint       `json:"ReviewID"`
+	UserID      uint       `json:"UserID"`
+	Username    string     `json:"Username"`
+	Kind        string     `json:"Kind"` // "role" or "group"
+	TargetID    uint       `json:"TargetID"`
+	TargetName  string     `json:"TargetName"`
+	ReviewerID  *uint      `json:"ReviewerID"` // Nil when only admins decide
+	Decision    string     `json:"Decision"`   // ReviewKeep or ReviewRevoke, empty while undecided
+	Comment     string     `json:"Comment"`
+	DecidedByID *uint      `json:"DecidedByID"`
+	DecidedAt   *time.Time `json:"DecidedAt"`
+	AppliedAt   *time.Time `json:"AppliedAt"`
+}
+
+// AccessReviewReportRow is an item of the report, with the names of the reviewer and decider
+type AccessReviewReportRow struct {
+	ItemID    uint   `json:"itemId"`
+	UserID    uint   `json:"userId"`
+	Username  string `json:"username"`
+	Kind      string `json:"kind"`
+	Target    string `json:"target"`
+	Reviewer  string `json:"reviewer"`
+	Decision  string `json:"decision"` // ReviewKeep, ReviewRevoke or "undecided"
+	Comment   string `json:"comment"`
+	DecidedBy string `json:"decidedBy"`
+	DecidedAt string `json:"decidedAt"` // RFC 3339, empty while undecided
+	AppliedAt string `json:"appliedAt"`
+}
+
+// ReviewDecision keeps or revokes an item of a campaign
+type ReviewDecision struct {
+	ItemID   uint   `json:"itemId"`
+	Decision string `json:"decision"` // ReviewKeep or ReviewRevoke
+	Comment  string `json:"comment,omitempty"`
+}
+
+// GrantRole gives a user a role, permanently when duration is 0, an admin route
+func (c *Client) GrantRole(ctx context.Context, userID uint, role string, duration time.Duration, reason string) (RoleGrant, error) {
+	input := map[string]string{"role": role, "reason": reason}
+	if duration > 0 {
+		input["duration"] = duration.String()
+	}
+	var grant RoleGrant
+	err := c.do(ctx, http.MethodPost, fmt.Sprintf("/users/%d/grants", userID), input, &grant)
+	return grant, err
+}
+
+// ListRoleGrants retrieves the direct roles of a user with their grants, an admin route
+func (c *Client) ListRoleGrants(ctx context.Context, userID uint) ([]RoleGrant, error) {
+	var output struct {
+		Grants []RoleGrant `json:"grants"`
+	}
+	err := c.do(ctx, http.MethodGet, fmt.Sprintf("/users/%d/grants", userID), nil, &output)
+	return output.Grants, err
+}
+
+// RequestElevation asks for a role for a limited time, another admin decides
+func (c *Client) RequestElevation(ctx context.Context, role string, duration time.Duration, reason string) (Elevation, error) {
+	input := map[string]string{"role": role, "duration": duration.String(), "reason": reason}
+	var elevation Elevation
+	err := c.do(ctx, http.MethodPost, "/users/me/elevations", input, &elevation)
+	return elevation, err
+}
+
+// ListMyElevations retrieves the elevation requests of the current user
+func (c *Client) ListMyElevations(ctx context.Context) ([]Elevation, error) {
+	return c.listElevations(ctx, "/users/me/elevations")
+}
+
+// ListElevations retrieves the elevation requests of the organization, all when status is empty,
+// an admin route
+func (c *Client) ListElevations(ctx context.Context, status string) ([]Elevation, error) {
+	return c.listElevations(ctx, "/elevations"+statusQuery(status))
+}
+
+// ApproveElevation grants the requested role for the requested time, an admin route
+func (c *Client) ApproveElevation(ctx context.Context, id uint, note string) (Elevation, error) {
+	var elevation Elevation
+	err := c.do(ctx, http.MethodPost, fmt.Sprintf("/elevations/%d/approve", id), map[string]string{"note": note}, &elevation)
+	return elevation, err
+}
+
+// DenyElevation denies an elevation request, an admin route
+func (c *Client) DenyElevation(ctx context.Context, id uint, note string) (Elevation, error) {
+	var elevation Elevation
+	err := c.do(ctx, http.MethodPost, fmt.Sprintf("/elevations/%d/deny", id), map[string]string{"note": note}, &elevation)
+	return elevation, err
+}
+
+// RequestRole asks for a role, the users with the approver role decide
+func (c *Client) RequestRole(ctx context.Context, role, justification string) (AccessRequest, error) {
+	return c.createAccessRequest(ctx, map[string]string{"role": role, "justification": justification})
+}
+
+// RequestGroup asks to join a group, the approvers and the group's owners and managers decide
+func (c *Client) RequestGroup(ctx context.Context, group, justification string) (AccessRequest, error) {
+	return c.createAccessRequest(ctx, map[string]string{"group": group, "justification": justification})
+}
+
+// ListMyAccessRequests retrieves the access requests of the current user
+func (c *Client) ListMyAccessRequests(ctx context.Context) ([]AccessRequest, error) {
+	return c.listAccessRequests(ctx, "/users/me/access-requests")
+}
+
+// ListAccessRequests retrieves the access requests the current user can decide with the status, the
+// pending ones when status is empty
+func (c *Client) ListAccessRequests(ctx context.Context, status string) ([]AccessRequest, error) {
+	return c.listAccessRequests(ctx, "/access-requests/"+statusQuery(status))
+}
+
+// CancelAccessRequest withdraws a pending access request of the current user
+func (c *Client) CancelAccessRequest(ctx context.Context, id uint) (AccessRequest, error) {
+	var request AccessRequest
+	err := c.do(ctx, http.MethodDelete, fmt.Sprintf("/users/me/access-requests/%d", id), nil, &request)
+	return request, err
+}
+
+// ApproveAccessRequest gives the requester the role or adds them to the group
+func (c *Client) ApproveAccessRequest(ctx context.Context, id uint, note string) (AccessRequest, error) {
+	var request AccessRequest
+	err := c.do(ctx, http.MethodPost, fmt.Sprintf("/access-requests/%d/approve", id), map[string]string{"note": note}, &request)
+	return request, err
+}
+
+// DenyAccessRequest denies an access request
+func (c *Client) DenyAccessRequest(ctx context.Context, id uint, note string) (AccessRequest, error) {
+	var request AccessRequest
+	err := c.do(ctx, http.MethodPost, fmt.Sprintf("/access-requests/%d/deny", id), map[string]string{"note": note}, &request)
+	return request, err
+}
+
+// CreateAccessReview starts a campaign over the memberships of the organization, an admin route
+func (c *Client) CreateAccessReview(ctx context.Context, input AccessReviewData) (AccessReview, error) {
+	var review AccessReview
+	err := c.do(ctx, http.MethodPost, "/access-reviews/", input, &review)
+	return review, err
+}
+
+// ListAccessReviews retrieves the campaigns of the organization, an admin route
+func (c *Client) ListAccessReviews(ctx context.Context) ([]AccessReview, error) {
+	var output struct {
+		Reviews []AccessReview `json:"reviews"`
+	}
+	err := c.do(ctx, http.MethodGet, "/access-reviews/", nil, &output)
+	return output.Reviews, err
+}
+
+// GetAccessReview retrieves a campaign with its items, an admin route
+func (c *Client) GetAccessReview(ctx context.Context, id uint) (AccessReview, []AccessReviewItem, error) {
+	var output struct {
+		AccessReview
+		Items []AccessReviewItem `json:"items"`
+	}
+	err := c.do(ctx, http.MethodGet, fmt.Sprintf("/access-reviews/%d", id), nil, &output)
+	return output.AccessReview, output.Items, err
+}
+
+// CloseAccessReview closes a campaign and removes the revoked memberships, also the undecided ones
+// with revokeUndecided, an admin route
+func (c *Client) CloseAccessReview(ctx context.Context, id uint, revokeUndecided bool) (AccessReview, error) {
+	var review AccessReview
+	err := c.do(ctx, http.MethodPost, fmt.Sprintf("/access-reviews/%d/close", id), map[string]bool{"revokeUndecided": revokeUndecided}, &review)
+	return review, err
+}
+
+// AccessReviewReport retrieves the report of a campaign, an admin route
+func (c *Client) AccessReviewReport(ctx context.Context, id uint) (AccessReview, []AccessReviewReportRow, error) {
+	var output struct {
+		AccessReview
+		Items []AccessReviewReportRow `json:"items"`
+	}
+	err := c.do(ctx, http.MethodGet, fmt.Sprintf("/access-reviews/%d/report", id), nil, &output)
+	return output.AccessReview, output.Items, err
+}
+
+// ListMyReviewItems retrieves the undecided items of open campaigns assigned to the current user
+func (c *Client) ListMyReviewItems(ctx context.Context) ([]AccessReviewItem, error) {
+	var output struct {
+		Items []AccessReviewItem `json:"items"`
+	}
+	err := c.do(ctx, http.MethodGet, "/users/me/reviews", nil, &output)
+	return output.Items, err
+}
+
+// DecideReviewItems keeps or revokes items of a campaign assigned to the current user, all of them or none
+func (c *Client) DecideReviewItems(ctx context.Context, reviewID uint, decisions []ReviewDecision) ([]AccessReviewItem, error) {
+	var output struct {
+		Items []AccessReviewItem `json:"items"`
+	}
+	input := map[string][]ReviewDecision{"decisions": decisions}
+	err := c.do(ctx, http.MethodPost, fmt.Sprintf("/access-reviews/%d/decisions", reviewID), input, &output)
+	return output.Items, err
+}
+
+func (c *Client) listElevations(ctx context.Context, path string) ([]Elevation, error) {
+	var output struct {
+		Requests []Elevation `json:"requests"`
+	}
+	err := c.do(ctx, http.MethodGet, path, nil, &output)
+	return output.Requests, err
+}
+
+func (c *Client) createAccessRequest(ctx context.Context, input map[string]string) (AccessRequest, error) {
+	var request AccessRequest
+	err := c.do(ctx, http.MethodPost, "/access-requests/", input, &request)
+	return request, err
+}
+
+func (c *Client) listAccessRequests(ctx context.Context, path string) ([]AccessRequest, error) {
+	var output struct {
+		Requests []AccessRequest `json:"requests"`
+	}
+	err := c.do(ctx, http.MethodGet, path, nil, &output)
+	return output.Requests, err
+}
+
+// statusQuery returns the query filtering a list by status, empty for all
+func statusQuery(status string) string {
+	if status == "" {
+		return ""
+	}
+	return "?" + url.Values{"status": {status}}.Encode()
+}
@@ -0,0 +1,396 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Membership operations, as the server names them
+const (
+	MembershipAdd     = "add"
+	MembershipRemove  = "remove"
+	MembershipReplace = "replace"
+)
+
+// Methods of the per-user and per-role membership routes by operation
+var membershipMethods = map[string]string{
+	MembershipAdd:     http.MethodPost,
+	MembershipRemove:  http.MethodDelete,
+	MembershipReplace: http.MethodPut,
+}
+
+// Roles of a group manager, an owner can also appoint managers
+const (
+	GroupRoleOwner   = "owner"
+	GroupRoleManager = "manager"
+)
+
+// User is a user with roles and groups, without the credentials the server keeps
+type User struct {
+	ID             uint              `json:"ID"`
+	OrganizationID uint              `json:"OrganizationID"`
+	Name           string            `json:"Name"`
+	Email          string            `json:"Email"`
+	Roles          []Role            `json:"Roles"`
+	Groups         []Group           `json:"Groups"`
+	LDAPDN         string            `json:"LDAPDN"` // Set for users imported by the LDAP sync
+	Active         bool              `json:"Active"`
+	Attributes     map[string]string `json:"Attributes"`
+}
+
+// Role is a role, with its users and groups when retrieved alone
+type Role struct {
+	ID             uint    `json:"ID"`
+	OrganizationID uint    `json:"OrganizationID"`
+	Name           string  `json:"Name"`
+	Users          []User  `json:"Users"`
+	Groups         []Group `json:"Groups"`
+}
+
+// Group is a group, optionally below a parent group
+type Group struct {
+	ID             uint   `json:"ID"`
+	OrganizationID uint   `json:"OrganizationID"`
+	Name           string `json:"Name"`
+	ParentID       *uint  `json:"ParentID"`
+	LDAPDN         string `json:"LDAPDN"` // Set for groups imported by the LDAP sync
+	Members        []User `json:"Members"`
+}
+
+// PersonalAccessToken describes a personal access token, without the token itself
+type PersonalAccessToken struct {
+	ID         uint       `json:"ID"`
+	Name       string     `json:"Name"`
+	Prefix     string     `json:"Prefix"` // Leading characters of the token
+	Scopes     []string   `json:"Scopes"`
+	UserID     uint       `json:"UserID"`
+	CreatedAt  time.Time  `json:"CreatedAt"`
+	ExpiresAt  time.Time  `json:"ExpiresAt"`
+	LastUsedAt *time.Time `json:"LastUsedAt"`
+	RevokedAt  *time.Time `json:"RevokedAt"`
+}
+
+type CreateUserData struct {
+	Username   string            `json:"username"`
+	Email      string            `json:"email"`
+	Password   string            `json:"password"`
+	Roles      []string          `json:"roles,omitempty"`      // Role names
+	Groups     []string          `json:"groups,omitempty"`     // Group names
+	Attributes map[string]string `json:"attributes,omitempty"` // Free-form attributes for the policies
+}
+
+// UpdateUserData replaces the name and email of a user, both are required. Roles and groups are
+// replaced when given, the attributes when not nil.
+type UpdateUserData struct {
+	Username   string            `json:"username"`
+	Email      string            `json:"email"`
+	Roles      []string          `json:"roles,omitempty"`
+	Groups     []string          `json:"groups,omitempty"`
+	Attributes map[string]string `json:"attributes,omitempty"`
+}
+
+// CreatedUser is the summary of a new user
+type CreatedUser struct {
+	ID       uint   `json:"id"`
+	Username string `json:"username"`
+	Email    string `json:"email"`
+}
+
+// MembershipOperation changes the roles or groups of a user, or the groups of a role
+type MembershipOperation struct {
+	Op     string   `json:"op"`               // MembershipAdd, MembershipRemove or MembershipReplace
+	UserID uint     `json:"userId,omitempty"` // User to change, or
+	RoleID uint     `json:"roleId,omitempty"` // role to change
+	Roles  []string `json:"roles"`            // Role names, only for users, nil to leave them
+	Groups []string `json:"groups"`           // Group names, nil to leave them
+}
+
+// Membership is a user with its role and group names, or a role with its group names, after a change
+type Membership struct {
+	ID             uint              `json:"id"`
+	OrganizationID uint              `json:"organizationId"`
+	Username       string            `json:"username"` // Set for users
+	Email          string            `json:"email"`
+	Name           string            `json:"name"` // Set for roles
+	Roles          []string          `json:"roles"`
+	Groups         []string          `json:"groups"`
+	Attributes     map[string]string `json:"attributes"`
+}
+
+// CreatedAccessToken is a new personal access token. The token itself is only returned once.
+type CreatedAccessToken struct {
+	Token       string              `json:"token"`
+	AccessToken PersonalAccessToken `json:"accessToken"`
+}
+
+// Session is an active login of the current user
+type Session struct {
+	ID         uint      `json:"id"`
+	Device     string    `json:"device"`
+	UserAgent  string    `json:"userAgent"`
+	IP         string    `json:"ip"`
+	CreatedAt  time.Time `json:"createdAt"`
+	LastSeenAt time.Time `json:"lastSeenAt"`
+	ExpiresAt  time.Time `json:"expiresAt"`
+	Current    bool      `json:"current"` // Whether it is the session of the client's token
+}
+
+// GroupMember is a member of a group
+type GroupMember struct {
+	ID       uint   `json:"id"`
+	Username string `json:"username"`
+	Email    string `json:"email"`
+}
+
+// GroupManager is an owner or manager of a group
+type GroupManager struct {
+	UserID    uint      `json:"userId"`
+	Username  string    `json:"username"`
+	Role      string    `json:"role"` // GroupRoleOwner or GroupRoleManager
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// groupData is the body of the group routes, which bind the model itself
+type groupData struct {
+	Name     string `json:"Name"`
+	ParentID *uint  `json:"ParentID"`
+}
+
+// CreateUser creates a user, an admin route
+func (c *Client) CreateUser(ctx context.Context, input CreateUserData) (CreatedUser, error) {
+	var output struct {
+		User CreatedUser `json:"user"`
+	}
+	err := c.do(ctx, http.MethodPost, "/users/", input, &output)
+	return output.User, err
+}
+
+// GetUser retrieves a user with roles and groups, an admin route
+func (c *Client) GetUser(ctx context.Context, id uint) (User, error) {
+	var user User
+	err := c.do(ctx, http.MethodGet, fmt.Sprintf("/users/%d", id), nil, &user)
+	return user, err
+}
+
+// ListUsers retrieves the users of the organization with roles and groups, an admin route
+func (c *Client) ListUsers(ctx context.Context) ([]User, error) {
+	var output struct {
+		Users []User `json:"users"`
+	}
+	err := c.do(ctx, http.MethodGet, "/users/", nil, &output)
+	return output.Users, err
+}
+
+// UpdateUser updates a user, an admin route
+func (c *Client) UpdateUser(ctx context.Context, id uint, input UpdateUserData) (User, error) {
+	var user User
+	err := c.do(ctx, http.MethodPut, fmt.Sprintf("/users/%d", id), input, &user)
+	return user, err
+}
+
+// DeleteUser deletes a user, an admin route
+func (c *Client) DeleteUser(ctx context.Context, id uint) error {
+	return c.do(ctx, http.MethodDelete, fmt.Sprintf("/users/%d", id), nil, nil)
+}
+
+// CreateRole creates a role, an admin route
+func (c *Client) CreateRole(ctx context.Context, name string) (Role, error) {
+	var role Role
+	err := c.do(ctx, http.MethodPost, "/roles/", map[string]string{"Name": name}, &role)
+	return role, err
+}
+
+// GetRole retrieves a role with its users and groups
+func (c *Client) GetRole(ctx context.Context, id uint) (Role, error) {
+	var role Role
+	err := c.do(ctx, http.MethodGet, fmt.Sprintf("/roles/%d", id), nil, &role)
+	return role, err
+}
+
+// ListRoles retrieves the roles of the organization
+func (c *Client) ListRoles(ctx context.Context) ([]Role, error) {
+	var roles []Role
+	err := c.do(ctx, http.MethodGet, "/roles/", nil, &roles)
+	return roles, err
+}
+
+// RenameRole changes the name of a role
+func (c *Client) RenameRole(ctx context.Context, id uint, name string) (Role, error) {
+	var role Role
+	err := c.do(ctx, http.MethodPut, fmt.Sprintf("/roles/%d", id), map[string]string{"Name": name}, &role)
+	return role, err
+}
+
+// DeleteRole deletes a role
+func (c *Client) DeleteRole(ctx context.Context, id uint) error {
+	return c.do(ctx, http.MethodDelete, fmt.Sprintf("/roles/%d", id), nil, nil)
+}
+
+// CreateGroup creates a group, optionally below a parent group
+func (c *Client) CreateGroup(ctx context.Context, name string, parentID *uint) (Group, error) {
+	var group Group
+	err := c.do(ctx, http.MethodPost, "/groups/", groupData{Name: name, ParentID: parentID}, &group)
+	return group, err
+}
+
+// GetGroup retrieves a group
+func (c *Client) GetGroup(ctx context.Context, id uint) (Group, error) {
+	var group Group
+	err := c.do(ctx, http.MethodGet, fmt.Sprintf("/groups/%d", id), nil, &group)
+	return group, err
+}
+
+// ListGroups retrieves the groups of the organization
+func (c *Client) ListGroups(ctx context.Context) ([]Group, error) {
+	var groups []Group
+	err := c.do(ctx, http.MethodGet, "/groups/", nil, &groups)
+	return groups, err
+}
+
+// UpdateGroup replaces the name and the parent of a group, nil for none
+func (c *Client) UpdateGroup(ctx context.Context, id uint, name string, parentID *uint) (Group, error) {
+	var group Group
+	err := c.do(ctx, http.MethodPut, fmt.Sprintf("/groups/%d", id), groupData{Name: name, ParentID: parentID}, &group)
+	return group, err
+}
+
+// DeleteGroup deletes a group
+func (c *Client) DeleteGroup(ctx context.Context, id uint) error {
+	return c.do(ctx, http.MethodDelete, fmt.Sprintf("/groups/%d", id), nil, nil)
+}
+
+// ListGroupMembers retrieves the members of a group, for admins and the group's owners and managers
+func (c *Client) ListGroupMembers(ctx context.Context, groupID uint) ([]GroupMember, error) {
+	var output struct {
+		Members []GroupMember `json:"members"`
+	}
+	err := c.do(ctx, http.MethodGet, fmt.Sprintf("/groups/%d/members", groupID), nil, &output)
+	return output.Members, err
+}
+
+// AddGroupMember adds a user of the organization to a group
+func (c *Client) AddGroupMember(ctx context.Context, groupID, userID uint) error {
+	return c.do(ctx, http.MethodPost, fmt.Sprintf("/groups/%d/members", groupID), map[string]uint{"userId": userID}, nil)
+}
+
+// RemoveGroupMember removes a user from a group
+func (c *Client) RemoveGroupMember(ctx context.Context, groupID, userID uint) error {
+	return c.do(ctx, http.MethodDelete, fmt.Sprintf("/groups/%d/members/%d", groupID, userID), nil, nil)
+}
+
+// ListGroupManagers retrieves the owners and managers of a group
+func (c *Client) ListGroupManagers(ctx context.Context, groupID uint) ([]GroupManager, error) {
+	var output struct {
+		Managers []GroupManager `json:"managers"`
+	}
+	err := c.do(ctx, http.MethodGet, fmt.Sprintf("/groups/%d/managers", groupID), nil, &output)
+	return output.Managers, err
+}
+
+// SetGroupManager appoints a user as GroupRoleOwner or GroupRoleManager of a group, for admins and owners
+func (c *Client) SetGroupManager(ctx context.Context, groupID, userID uint, role string) (GroupManager, error) {
+	var manager GroupManager
+	err := c.do(ctx, http.MethodPut, fmt.Sprintf("/groups/%d/managers/%d", groupID, userID), map[string]string{"role": role}, &manager)
+	return manager, err
+}
+
+// RemoveGroupManager ends the appointment of an owner or manager of a group
+func (c *Client) RemoveGroupManager(ctx context.Context, groupID, userID uint) error {
+	return c.do(ctx, http.MethodDelete, fmt.Sprintf("/groups/%d/managers/%d", groupID, userID), nil, nil)
+}
+
+// ChangeUserRoles adds, removes or replaces roles of a user by name
+func (c *Client) ChangeUserRoles(ctx context.Context, userID uint, op string, roles []string) (Membership, error) {
+	return c.changeMemberships(ctx, fmt.Sprintf("/users/%d/roles", userID), op, map[string][]string{"roles": nonNil(roles)})
+}
+
+// ChangeUserGroups adds, removes or replaces groups of a user by name
+func (c *Client) ChangeUserGroups(ctx context.Context, userID uint, op string, groups []string) (Membership, error) {
+	return c.changeMemberships(ctx, fmt.Sprintf("/users/%d/groups", userID), op, map[string][]string{"groups": nonNil(groups)})
+}
+
+// ChangeRoleGroups adds, removes or replaces groups of a role by name
+func (c *Client) ChangeRoleGroups(ctx context.Context, roleID uint, op string, groups []string) (Membership, error) {
+	return c.changeMemberships(ctx, fmt.Sprintf("/roles/%d/groups", roleID), op, map[string][]string{"groups": nonNil(groups)})
+}
+
+// ApplyMemberships applies a batch of membership operations, all of them or none
+func (c *Client) ApplyMemberships(ctx context.Context, operations []MembershipOperation) ([]Membership, error) {
+	input := map[string][]MembershipOperation{"operations": operations}
+	// A single operation is answered with its result, several with a list
+	if len(operations) == 1 {
+		var result Membership
+		if err := c.do(ctx, http.MethodPost, "/memberships", input, &result); err != nil {
+			return nil, err
+		}
+		return []Membership{result}, nil
+	}
+	var output struct {
+		Results []Membership `json:"results"`
+	}
+	err := c.do(ctx, http.MethodPost, "/memberships", input, &output)
+	return output.Results, err
+}
+
+// CreateAccessToken creates a personal access token of the current user, which needs a sign-in
+// with a password: tokens cannot create tokens
+func (c *Client) CreateAccessToken(ctx context.Context, name string, scopes []string, expiresAt time.Time) (CreatedAccessToken, error) {
+	input := map[string]interface{}{"name": name, "scopes": scopes, "expiresAt": expiresAt}
+	var output CreatedAccessToken
+	err := c.do(ctx, http.MethodPost, "/users/me/tokens", input, &output)
+	return output, err
+}
+
+// ListAccessTokens retrieves the personal access tokens of the current user
+func (c *Client) ListAccessTokens(ctx context.Context) ([]PersonalAccessToken, error) {
+	var output struct {
+		Tokens []PersonalAccessToken `json:"tokens"`
+	}
+	err := c.do(ctx, http.MethodGet, "/users/me/tokens", nil, &output)
+	return output.Tokens, err
+}
+
+// RevokeAccessToken revokes a personal access token of the current user
+func (c *Client) RevokeAccessToken(ctx context.Context, id uint) error {
+	return c.do(ctx, http.MethodDelete, fmt.Sprintf("/users/me/tokens/%d", id), nil, nil)
+}
+
+// ListSessions retrieves the active sessions of the current user
+func (c *Client) ListSessions(ctx context.Context) ([]Session, error) {
+	var output struct {
+		Sessions []Session `json:"sessions"`
+	}
+	err := c.do(ctx, http.MethodGet, "/users/me/sessions", nil, &output)
+	return output.Sessions, err
+}
+
+// RevokeSession ends a session of the current user
+func (c *Client) RevokeSession(ctx context.Context, id uint) error {
+	return c.do(ctx, http.MethodDelete, fmt.Sprintf("/users/me/sessions/%d", id), nil, nil)
+}
+
+// RevokeUserSessions ends every session of a user, an admin route
+func (c *Client) RevokeUserSessions(ctx context.Context, userID uint) error {
+	return c.do(ctx, http.MethodDelete, fmt.Sprintf("/users/%d/sessions", userID), nil, nil)
+}
+
+// changeMemberships calls a per-user or per-role membership route with the method of the operation
+func (c *Client) changeMemberships(ctx context.Context, path, op string, input interface{}) (Membership, error) {
+	method, ok := membershipMethods[op]
+	if !ok {
+		return Membership{}, fmt.Errorf("invalid op %q, use add, remove or replace", op)
+	}
+	var result Membership
+	err := c.do(ctx, method, path, input, &result)
+	return result, err
+}
+
+// nonNil returns names, an empty list instead of nil so that the server sees the field
+func nonNil(names []string) []string {
+	if names == nil {
+		return []string{}
+	}
+	return names
+}
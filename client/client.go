@@ -0,0 +1,296 @@
+// Package client is a typed Go client of the management API: users, roles, groups and their members,
+// memberships, personal access tokens, sessions, role grants, elevations, access requests and reviews,
+// and policies. It signs in with an email and password, or uses a personal
+// access token, renews the JWT before it expires and retries requests that failed on the server.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Defaults of the Client settings
+const (
+	DefaultRetries       = 2                      // Retries after the first attempt
+	DefaultRetryWait     = 200 * time.Millisecond // Wait before the first retry, doubled for every further one
+	DefaultRefreshBefore = 5 * time.Minute        // Sign in again this long before the JWT expires
+)
+
+// userAgent identifies the client. The server only hands out the still valid JWT of a login again
+// to the same user agent.
+const userAgent = "jwt-client"
+
+// Error is an error response of the server
+type Error struct {
+	StatusCode int
+	Message    string                 // The "error" of the response
+	Unknown    []string               // Role or group names the membership routes did not find
+	Details    map[string]interface{} // The whole response, e.g. with the "constraint" and "roles" of a 409
+}
+
+func (e *Error) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("%d %s", e.StatusCode, http.StatusText(e.StatusCode))
+	}
+	return fmt.Sprintf("%d %s: %s", e.StatusCode, http.StatusText(e.StatusCode), e.Message)
+}
+
+// IsNotFound reports whether err is a 404 response
+func IsNotFound(err error) bool {
+	var apiErr *Error
+	return errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusNotFound
+}
+
+// IsConflict reports whether err is a 409 response, e.g. a violated separation of duties constraint
+func IsConflict(err error) bool {
+	var apiErr *Error
+	return errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusConflict
+}
+
+// Client calls the management API of one organization. Set the fields before the first request.
+type Client struct {
+	BaseURL      string // e.g. "https://auth.example"
+	Organization string // Calls /orgs/<organization>/..., the default organization when empty
+
+	Email       string // Credentials to sign in with, or
+	Password    string //
+	AccessToken string // a personal access token or JWT used as is
+
+	HTTPClient    *http.Client  // http.DefaultClient when nil
+	Retries       int           // DefaultRetries when 0, negative for none
+	RetryWait     time.Duration // DefaultRetryWait when 0
+	RefreshBefore time.Duration // DefaultRefreshBefore when 0
+
+	mu      sync.Mutex
+	jwt     string    // JWT of the last sign-in
+	expires time.Time // Expiry of the JWT, zero when unknown
+}
+
+// New returns a client for the server at baseURL
+func New(baseURL string) *Client {
+	return &Client{BaseURL: strings.TrimSuffix(baseURL, "/")}
+}
+
+// Token returns the token the requests are sent with, signing in when there is none or it is about
+// to expire. It is empty without credentials.
+func (c *Client) Token(ctx context.Context) (string, error) {
+	return c.token(ctx, false)
+}
+
+// Logout ends the session of the JWT on the server
+func (c *Client) Logout(ctx context.Context) error {
+	if err := c.do(ctx, http.MethodPost, "/users/logout", nil, nil); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	c.jwt, c.expires = "", time.Time{}
+	c.mu.Unlock()
+	return nil
+}
+
+// token returns a usable token; renew signs in again even when the current JWT is still valid
+func (c *Client) token(ctx context.Context, renew bool) (string, error) {
+	if c.AccessToken != "" {
+		return c.AccessToken, nil
+	}
+	if c.Email == "" {
+		return "", nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !renew && c.jwt != "" && (c.expires.IsZero() || time.Until(c.expires) > c.refreshBefore()) {
+		return c.jwt, nil
+	}
+
+	// A renewal needs a new token, the server would otherwise hand out the current one again
+	input := map[string]interface{}{"email": c.Email, "password": c.Password, "forceTokenGen": c.jwt != ""}
+	var output struct {
+		Token string `json:"token"`
+	}
+	if err := c.send(ctx, http.MethodPost, "/users/login", "", input, &output); err != nil {
+		return "", fmt.Errorf("sign-in failed: %w", err)
+	}
+	if output.Token == "" {
+		return "", errors.New("sign-in failed: the response has no token")
+	}
+
+	c.jwt, c.expires = output.Token, time.Time{}
+	if token, _, err := jwt.NewParser().ParseUnverified(output.Token, jwt.MapClaims{}); err == nil {
+		if exp, err := token.Claims.GetExpirationTime(); err == nil && exp != nil {
+			c.expires = exp.Time
+		}
+	}
+	return c.jwt, nil
+}
+
+// do sends an authenticated request. A 401 for a JWT of a sign-in, e.g. of a revoked session, signs
+// in again once.
+func (c *Client) do(ctx context.Context, method, path string, in, out interface{}) error {
+	token, err := c.token(ctx, false)
+	if err != nil {
+		return err
+	}
+	err = c.send(ctx, method, path, token, in, out)
+
+	var apiErr *Error
+	if errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusUnauthorized && c.AccessToken == "" && c.Email != "" {
+		if token, err = c.token(ctx, true); err != nil {
+			return err
+		}
+		return c.send(ctx, method, path, token, in, out)
+	}
+	return err
+}
+
+// send sends a request with a JSON body, retrying server errors: any 5xx and network errors for
+// idempotent methods, only the gateway errors for POST, which may have been applied already
+func (c *Client) send(ctx context.Context, method, path, token string, in, out interface{}) error {
+	var body []byte
+	if in != nil {
+		var err error
+		if body, err = json.Marshal(in); err != nil {
+			return err
+		}
+	}
+
+	wait := c.retryWait()
+	for attempt := 0; ; attempt++ {
+		resp, err := c.attempt(ctx, method, path, token, body)
+		retry := attempt < c.retries() && ctx.Err() == nil
+		if err != nil {
+			if !retry || method == http.MethodPost {
+				return err
+			}
+		} else if resp.StatusCode >= 500 && retry && retryable(method, resp.StatusCode) {
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		} else {
+			return decodeResponse(resp, out)
+		}
+
+		if err := sleep(ctx, wait); err != nil {
+			return err
+		}
+		wait *= 2
+	}
+}
+
+// attempt sends the request once
+func (c *Client) attempt(ctx context.Context, method, path, token string, body []byte) (*http.Response, error) {
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.url(path), reader)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("User-Agent", userAgent)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	client := c.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return client.Do(req)
+}
+
+// decodeResponse decodes a successful response into out, or an error response into an *Error
+func decodeResponse(resp *http.Response, out interface{}) error {
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode >= 300 {
+		apiErr := &Error{StatusCode: resp.StatusCode}
+		if json.Unmarshal(data, &apiErr.Details) == nil {
+			apiErr.Message, _ = apiErr.Details["error"].(string)
+			if unknown, ok := apiErr.Details["unknown"].([]interface{}); ok {
+				for _, name := range unknown {
+					apiErr.Unknown = append(apiErr.Unknown, fmt.Sprint(name))
+				}
+			}
+		} else {
+			apiErr.Message = strings.TrimSpace(string(data))
+		}
+		return apiErr
+	}
+
+	if out == nil || len(data) == 0 {
+		return nil
+	}
+	return json.Unmarshal(data, out)
+}
+
+// url returns the URL of a route of the organization
+func (c *Client) url(path string) string {
+	if c.Organization != "" {
+		path = "/orgs/" + url.PathEscape(c.Organization) + path
+	}
+	return strings.TrimSuffix(c.BaseURL, "/") + path
+}
+
+// retryable reports whether a failed request can be sent again
+func retryable(method string, status int) bool {
+	switch status {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return method != http.MethodPost
+}
+
+// sleep waits, unless the context ends first
+func sleep(ctx context.Context, wait time.Duration) error {
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+func (c *Client) retries() int {
+	switch {
+	case c.Retries < 0:
+		return 0
+	case c.Retries == 0:
+		return DefaultRetries
+	}
+	return c.Retries
+}
+
+func (c *Client) retryWait() time.Duration {
+	if c.RetryWait > 0 {
+		return c.RetryWait
+	}
+	return DefaultRetryWait
+}
+
+func (c *Client) refreshBefore() time.Duration {
+	if c.RefreshBefore > 0 {
+		return c.RefreshBefore
+	}
+	return DefaultRefreshBefore
+}
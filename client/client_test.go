@@ -0,0 +1,248 @@
+package client_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"jwt/client"
+	"jwt/controller"
+	"jwt/initializers"
+	"jwt/initializers/dbtest"
+	"jwt/models"
+	"jwt/router"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	adminEmail    = "admin@example.org"
+	adminPassword = "admin-password"
+)
+
+// flaky answers the next failures requests with status instead of passing them to the server
+type flaky struct {
+	handler  http.Handler
+	status   int
+	failures atomic.Int32
+	requests atomic.Int32 // Requests seen, failed or not
+}
+
+func (f *flaky) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.requests.Add(1)
+	if f.failures.Add(-1) >= 0 {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(f.status)
+		io.WriteString(w, `{"error": "Try again"}`)
+		return
+	}
+	f.handler.ServeHTTP(w, r)
+}
+
+// fail makes the next failures requests fail with status and resets the request count
+func (f *flaky) fail(status int, failures int32) {
+	f.status = status
+	f.failures.Store(failures)
+	f.requests.Store(0)
+}
+
+// newTestServer serves the real routes on a fresh database with an admin of the default organization
+func newTestServer(t *testing.T) (*httptest.Server, *flaky) {
+	t.Helper()
+	dbtest.Open(t)
+
+	var organization models.Organization
+	if err := initializers.DBConn.Where("name = ?", models.DefaultOrganization).First(&organization).Error; err != nil {
+		t.Fatal(err)
+	}
+	if _, err := controller.CreateUserAccount("test", organization.ID, "admin", adminEmail, adminPassword,
+		[]string{"admin"}, []string{"admin"}); err != nil {
+		t.Fatal(err)
+	}
+
+	gin.SetMode(gin.TestMode)
+	gin.DefaultWriter = io.Discard
+	handler := &flaky{handler: router.New()}
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	return server, handler
+}
+
+// newClient returns a client of the server signing in as the admin
+func newClient(server *httptest.Server) *client.Client {
+	c := client.New(server.URL)
+	c.Email, c.Password = adminEmail, adminPassword
+	c.RetryWait = time.Millisecond
+	return c
+}
+
+func TestLogin(t *testing.T) {
+	server, _ := newTestServer(t)
+	ctx := context.Background()
+	c := newClient(server)
+
+	token, err := c.Token(ctx)
+	if err != nil || token == "" {
+		t.Fatalf("Token() = %q, %v", token, err)
+	}
+	// The JWT is reused until it is about to expire
+	if again, err := c.Token(ctx); err != nil || again != token {
+		t.Errorf("second Token() = %q, %v, want the same token", again, err)
+	}
+
+	role, err := c.CreateRole(ctx, "auditor")
+	if err != nil {
+		t.Fatalf("CreateRole() = %v", err)
+	}
+	created, err := c.CreateUser(ctx, client.CreateUserData{Username: "jdoe", Email: "jdoe@example.org", Password: "jdoe-password"})
+	if err != nil {
+		t.Fatalf("CreateUser() = %v", err)
+	}
+	if _, err := c.ChangeUserRoles(ctx, created.ID, client.MembershipAdd, []string{role.Name}); err != nil {
+		t.Fatalf("ChangeUserRoles() = %v", err)
+	}
+	user, err := c.GetUser(ctx, created.ID)
+	if err != nil {
+		t.Fatalf("GetUser() = %v", err)
+	}
+	if user.Name != "jdoe" || user.Email != "jdoe@example.org" || len(user.Roles) != 1 || user.Roles[0].Name != "auditor" {
+		t.Errorf("GetUser() = %+v", user)
+	}
+
+	wrong := client.New(server.URL)
+	wrong.Email, wrong.Password = adminEmail, "wrong-password"
+	var apiErr *client.Error
+	if _, err := wrong.ListRoles(ctx); !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusUnauthorized {
+		t.Errorf("ListRoles() with a wrong password = %v, want a 401", err)
+	}
+}
+
+func TestRefreshOn401(t *testing.T) {
+	server, _ := newTestServer(t)
+	ctx := context.Background()
+	c := newClient(server)
+
+	sessions, err := c.ListSessions(ctx)
+	if err != nil {
+		t.Fatalf("ListSessions() = %v", err)
+	}
+	token, _ := c.Token(ctx)
+	for _, session := range sessions {
+		if session.Current {
+			if err := c.RevokeSession(ctx, session.ID); err != nil {
+				t.Fatalf("RevokeSession() = %v", err)
+			}
+		}
+	}
+
+	// The revoked JWT is answered with a 401, the client signs in again and repeats the request
+	if _, err := c.ListRoles(ctx); err != nil {
+		t.Fatalf("ListRoles() after the session was revoked = %v", err)
+	}
+	if renewed, _ := c.Token(ctx); renewed == token {
+		t.Error("the client kept the revoked token")
+	}
+
+	// A token set as AccessToken is never renewed
+	revoked := client.New(server.URL)
+	revoked.AccessToken = token
+	if _, err := revoked.ListRoles(ctx); err == nil {
+		t.Error("ListRoles() with a revoked token succeeded")
+	}
+}
+
+func TestRetry(t *testing.T) {
+	server, handler := newTestServer(t)
+	ctx := context.Background()
+	c := newClient(server)
+	if _, err := c.Token(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name         string
+		status       int
+		failures     int32
+		call         func() error
+		wantStatus   int // 0 for success
+		wantRequests int32
+	}{
+		{"GET after a 500", http.StatusInternalServerError, 2, func() error {
+			_, err := c.ListRoles(ctx)
+			return err
+		}, 0, 3},
+		{"GET failing every attempt", http.StatusInternalServerError, 5, func() error {
+			_, err := c.ListRoles(ctx)
+			return err
+		}, http.StatusInternalServerError, 3},
+		{"POST after a 503", http.StatusServiceUnavailable, 1, func() error {
+			_, err := c.CreateRole(ctx, "retried")
+			return err
+		}, 0, 2},
+		{"POST not after a 500", http.StatusInternalServerError, 1, func() error {
+			_, err := c.CreateRole(ctx, "not-retried")
+			return err
+		}, http.StatusInternalServerError, 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			handler.fail(test.status, test.failures)
+			err := test.call()
+
+			var apiErr *client.Error
+			switch {
+			case test.wantStatus == 0 && err != nil:
+				t.Errorf("call = %v, want success", err)
+			case test.wantStatus != 0 && (!errors.As(err, &apiErr) || apiErr.StatusCode != test.wantStatus):
+				t.Errorf("call = %v, want a %d", err, test.wantStatus)
+			}
+			if got := handler.requests.Load(); got != test.wantRequests {
+				t.Errorf("requests = %d, want %d", got, test.wantRequests)
+			}
+		})
+	}
+}
+
+func TestErrors(t *testing.T) {
+	server, _ := newTestServer(t)
+	ctx := context.Background()
+	c := newClient(server)
+
+	_, err := c.GetUser(ctx, 9999)
+	if !client.IsNotFound(err) {
+		t.Fatalf("GetUser() of an unknown user = %v, want a 404", err)
+	}
+	var apiErr *client.Error
+	errors.As(err, &apiErr)
+	if apiErr.Message != "User not found" {
+		t.Errorf("Message = %q", apiErr.Message)
+	}
+
+	created, err := c.CreateUser(ctx, client.CreateUserData{Username: "jdoe", Email: "jdoe@example.org", Password: "jdoe-password"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = c.ChangeUserRoles(ctx, created.ID, client.MembershipAdd, []string{"user", "ghost", "phantom"})
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusBadRequest {
+		t.Fatalf("ChangeUserRoles() with unknown roles = %v, want a 400", err)
+	}
+	if !reflect.DeepEqual(apiErr.Unknown, []string{"ghost", "phantom"}) || apiErr.Details["unknown"] == nil {
+		t.Errorf("Unknown = %v, Details = %v", apiErr.Unknown, apiErr.Details)
+	}
+
+	// Admin routes refuse other users
+	jdoe := client.New(server.URL)
+	jdoe.Email, jdoe.Password = "jdoe@example.org", "jdoe-password"
+	if _, err := jdoe.ListUsers(ctx); !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusForbidden || apiErr.Message != "Access denied" {
+		t.Errorf("ListUsers() as a user = %v, want a 403", err)
+	}
+	anonymous := client.New(server.URL)
+	if _, err := anonymous.CreateUser(ctx, client.CreateUserData{Username: "eve", Email: "eve@example.org", Password: "eve-password"}); !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusUnauthorized {
+		t.Errorf("CreateUser() without a sign-in = %v, want a 401", err)
+	}
+}
@@ -0,0 +1,78 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"jwt/policy"
+	"net/http"
+	"time"
+)
+
+// PolicyData is an access control policy, see the policy package for the conditions
+type PolicyData struct {
+	Name        string            `json:"name"`
+	Description string            `json:"description"`
+	Effect      string            `json:"effect"`    // policy.Allow or policy.Deny
+	Actions     []string          `json:"actions"`   // e.g. ["read"], "*" for all
+	Resources   []string          `json:"resources"` // Resource types, e.g. ["user"]
+	Condition   *policy.Condition `json:"condition,omitempty"`
+	Disabled    bool              `json:"disabled"`
+}
+
+// Policy is an access control policy of the organization
+type Policy struct {
+	ID uint `json:"id"`
+	PolicyData
+	CreatedAt time.Time `json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// AuthzCheck asks whether a user may take an action on a resource
+type AuthzCheck struct {
+	Action   string            `json:"action"`
+	Resource policy.Attributes `json:"resource"`          // "type", optionally "id", and further attributes
+	Context  policy.Attributes `json:"context,omitempty"` // Extra context, e.g. the "ip" of the end user
+	UserID   *uint             `json:"userId,omitempty"`  // Admins may ask for another user, the current user when nil
+}
+
+// CreatePolicy adds a policy to the organization, an admin route
+func (c *Client) CreatePolicy(ctx context.Context, input PolicyData) (Policy, error) {
+	var record Policy
+	err := c.do(ctx, http.MethodPost, "/policies/", input, &record)
+	return record, err
+}
+
+// GetPolicy retrieves a policy, an admin route
+func (c *Client) GetPolicy(ctx context.Context, id uint) (Policy, error) {
+	var record Policy
+	err := c.do(ctx, http.MethodGet, fmt.Sprintf("/policies/%d", id), nil, &record)
+	return record, err
+}
+
+// ListPolicies retrieves the policies of the organization, an admin route
+func (c *Client) ListPolicies(ctx context.Context) ([]Policy, error) {
+	var output struct {
+		Policies []Policy `json:"policies"`
+	}
+	err := c.do(ctx, http.MethodGet, "/policies/", nil, &output)
+	return output.Policies, err
+}
+
+// UpdatePolicy replaces a policy, an admin route
+func (c *Client) UpdatePolicy(ctx context.Context, id uint, input PolicyData) (Policy, error) {
+	var record Policy
+	err := c.do(ctx, http.MethodPut, fmt.Sprintf("/policies/%d", id), input, &record)
+	return record, err
+}
+
+// DeletePolicy deletes a policy, an admin route
+func (c *Client) DeletePolicy(ctx context.Context, id uint) error {
+	return c.do(ctx, http.MethodDelete, fmt.Sprintf("/policies/%d", id), nil, nil)
+}
+
+// CheckAuthorization asks the policies for a decision
+func (c *Client) CheckAuthorization(ctx context.Context, input AuthzCheck) (policy.Decision, error) {
+	var decision policy.Decision
+	err := c.do(ctx, http.MethodPost, "/authz/check", input, &decision)
+	return decision, err
+}
@@ -0,0 +1,801 @@
+// Command admin manages users, roles, groups and keys from the command line, directly in the
+// database or through the API of a running server. It bootstraps the first admin, POST /users needs
+// an admin. Results are printed as text, or as JSON with -json, errors then as {"error": "..."}.
+//
+//	go run ./cmd/admin migrate
+//	go run ./cmd/admin seed
+//	go run ./cmd/admin user create -username admin -email admin@example.com -roles admin -groups admin
+//	go run ./cmd/admin -json user list
+//	go run ./cmd/admin -url https://auth.example -org acme role assign -user 12 -roles auditor
+//
+// The database is configured like the server, with DSN in the environment or .env. With -url, or
+// ADMIN_API_URL, the user, role and group commands call the API instead, signed in with
+// ADMIN_API_TOKEN, or ADMIN_API_EMAIL and ADMIN_API_PASSWORD.
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"jwt/client"
+	"jwt/controller"
+	"jwt/initializers"
+	"jwt/models"
+	"jwt/utils"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// auditSource is the actor name of the audit events of the CLI
+const auditSource = "admin-cli"
+
+// command is a subcommand, implemented on the database, the API or both
+type command struct {
+	usage string // Flags of the command
+	help  string
+	db    func(cli *cli, args []string) (interface{}, string, error)
+	api   func(cli *cli, args []string) (interface{}, string, error)
+}
+
+// cli holds the global options and the connection of one run
+type cli struct {
+	ctx          context.Context
+	organization string
+	client       *client.Client // Set in API mode
+}
+
+// userView is a user without its credentials, as printed by the CLI
+type userView struct {
+	ID       uint     `json:"id"`
+	Username string   `json:"username"`
+	Email    string   `json:"email"`
+	Roles    []string `json:"roles"`
+	Groups   []string `json:"groups"`
+	Password string   `json:"password,omitempty"` // Only for generated passwords
+}
+
+type roleView struct {
+	ID   uint   `json:"id"`
+	Name string `json:"name"`
+}
+
+type groupView struct {
+	ID       uint   `json:"id"`
+	Name     string `json:"name"`
+	ParentID *uint  `json:"parentId"`
+}
+
+var commands = map[string]command{
+	"migrate": {
+		usage: "migrate",
+		help:  "create or update the tables",
+		db:    migrate,
+	},
+	"seed": {
+		usage: "seed",
+		help:  "create the organization with its admin and user roles and groups",
+		db:    seed,
+	},
+	"user create": {
+		usage: "user create -username NAME -email EMAIL [-password PW | -password-stdin] [-roles a,b] [-groups a,b]",
+		help:  "create a user, the password is generated when not given",
+		db:    createUserDB,
+		api:   createUserAPI,
+	},
+	"user list": {
+		usage: "user list",
+		help:  "list the users with their roles and groups",
+		db:    listUsersDB,
+		api:   listUsersAPI,
+	},
+	"role create": {
+		usage: "role create -name NAME",
+		help:  "create a role",
+		db:    createRoleDB,
+		api:   createRoleAPI,
+	},
+	"role list": {
+		usage: "role list",
+		help:  "list the roles",
+		db:    listRolesDB,
+		api:   listRolesAPI,
+	},
+	"role assign": {
+		usage: "role assign -user ID -roles a,b [-op add|remove|replace]",
+		help:  "change the roles of a user",
+		db:    func(cli *cli, args []string) (interface{}, string, error) { return assignDB(cli, "roles", args) },
+		api:   func(cli *cli, args []string) (interface{}, string, error) { return assignAPI(cli, "roles", args) },
+	},
+	"group create": {
+		usage: "group create -name NAME [-parent ID]",
+		help:  "create a group",
+		db:    createGroupDB,
+		api:   createGroupAPI,
+	},
+	"group list": {
+		usage: "group list",
+		help:  "list the groups",
+		db:    listGroupsDB,
+		api:   listGroupsAPI,
+	},
+	"group assign": {
+		usage: "group assign -user ID -groups a,b [-op add|remove|replace]",
+		help:  "change the groups of a user",
+		db:    func(cli *cli, args []string) (interface{}, string, error) { return assignDB(cli, "groups", args) },
+		api:   func(cli *cli, args []string) (interface{}, string, error) { return assignAPI(cli, "groups", args) },
+	},
+	"key rotate": {
+		usage: "key rotate -user ID",
+		help:  "replace the signing key of a user, ending the sessions",
+		db:    rotateKey,
+	},
+	"token revoke": {
+		usage: "token revoke (-id ID | -user ID)",
+		help:  "revoke a personal access token, or all tokens and sessions of a user",
+		db:    revokeTokens,
+	},
+}
+
+func main() {
+	organization := flag.String("org", models.DefaultOrganization, "organization to manage")
+	jsonOutput := flag.Bool("json", false, "print the result as JSON")
+	apiURL := flag.String("url", os.Getenv("ADMIN_API_URL"), "call the API of this server instead of the database")
+	flag.Usage = usage
+	flag.Parse()
+
+	name, args := commandName(flag.Args())
+	cmd, ok := commands[name]
+	if !ok {
+		usage()
+		if name != "" {
+			exit(*jsonOutput, 2, fmt.Errorf("unknown command %q", name))
+		}
+		exit(*jsonOutput, 2, errors.New("no command given"))
+	}
+
+	cli := &cli{ctx: context.Background(), organization: *organization}
+	run := cmd.db
+	if *apiURL != "" {
+		if cmd.api == nil {
+			exit(*jsonOutput, 1, fmt.Errorf("%s works on the database only, run it without -url", name))
+		}
+		cli.client = client.New(*apiURL)
+		if *organization != models.DefaultOrganization {
+			cli.client.Organization = *organization
+		}
+		cli.client.AccessToken = os.Getenv("ADMIN_API_TOKEN")
+		cli.client.Email, cli.client.Password = os.Getenv("ADMIN_API_EMAIL"), os.Getenv("ADMIN_API_PASSWORD")
+		run = cmd.api
+	} else if err := openDB(); err != nil {
+		exit(*jsonOutput, 1, err)
+	}
+
+	result, text, err := run(cli, args)
+	if err != nil {
+		exit(*jsonOutput, 1, err)
+	}
+	if *jsonOutput {
+		printJSON(result)
+		return
+	}
+	fmt.Print(text)
+}
+
+// exit reports err and ends the run with code. With -json the error is printed to stdout like a
+// result, {"error": "..."} with the "status" and "unknown" names of an API error.
+func exit(jsonOutput bool, code int, err error) {
+	if !jsonOutput {
+		log.Print("Error: ", err)
+		os.Exit(code)
+	}
+	output := map[string]interface{}{"error": err.Error()}
+	var apiErr *client.Error
+	if errors.As(err, &apiErr) {
+		output["status"] = apiErr.StatusCode
+		if len(apiErr.Unknown) > 0 {
+			output["unknown"] = apiErr.Unknown
+		}
+	}
+	printJSON(output)
+	os.Exit(code)
+}
+
+// printJSON prints a result as indented JSON
+func printJSON(value interface{}) {
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(value)
+}
+
+// usage prints the commands
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: admin [-org NAME] [-json] [-url URL] COMMAND [FLAGS]")
+	flag.PrintDefaults()
+	fmt.Fprintln(os.Stderr, "\ncommands:")
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %s\n      %s\n", commands[name].usage, commands[name].help)
+	}
+}
+
+// commandName splits the arguments into the command, e.g. "user create", and its flags
+func commandName(args []string) (string, []string) {
+	if len(args) == 0 {
+		return "", nil
+	}
+	if _, single := commands[args[0]]; single || len(args) == 1 {
+		return args[0], args[1:]
+	}
+	return args[0] + " " + args[1], args[2:]
+}
+
+// openDB connects to the database of the server. The SQL log goes to stderr, stdout is for the results.
+func openDB() error {
+	initializers.InitialierEnvVariable()
+	initializers.InitiazeDB()
+	// gorm hands out a handle also when the connection failed
+	if initializers.DBConn == nil {
+		return errors.New("no database connection, check DSN")
+	}
+	if sqlDB, err := initializers.DBConn.DB(); err != nil || sqlDB.Ping() != nil {
+		return errors.New("no database connection, check DSN")
+	}
+	initializers.DBConn.Logger = logger.New(log.New(os.Stderr, "\r\n", log.LstdFlags), logger.Config{
+		SlowThreshold:             200 * time.Millisecond,
+		LogLevel:                  logger.Warn,
+		IgnoreRecordNotFoundError: true,
+	})
+	// Separation of duties holds for the CLI as well
+	if err := controller.RegisterRoleConstraintChecks(initializers.DBConn); err != nil {
+		return fmt.Errorf("failed to register the role constraint checks: %w", err)
+	}
+	return nil
+}
+
+// organizationID looks up the organization of the -org option
+func (cli *cli) organizationID() (uint, error) {
+	var organization models.Organization
+	err := initializers.DBConn.Where("name = ?", cli.organization).First(&organization).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return 0, fmt.Errorf("organization %q not found, run seed first", cli.organization)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return organization.ID, nil
+}
+
+func migrate(cli *cli, args []string) (interface{}, string, error) {
+	if err := parseFlags("migrate", args, nil); err != nil {
+		return nil, "", err
+	}
+	initializers.MigrateDB()
+	return map[string]bool{"migrated": true}, "migrated\n", nil
+}
+
+func seed(cli *cli, args []string) (interface{}, string, error) {
+	if err := parseFlags("seed", args, nil); err != nil {
+		return nil, "", err
+	}
+	organization := initializers.SeedOrganizations()
+	if cli.organization != models.DefaultOrganization {
+		organization = models.Organization{Name: cli.organization, DisplayName: cli.organization}
+		if err := initializers.DBConn.FirstOrCreate(&organization, models.Organization{Name: cli.organization}).Error; err != nil {
+			return nil, "", err
+		}
+	}
+	if err := initializers.SeedOrganizationRoles(initializers.DBConn, organization); err != nil {
+		return nil, "", err
+	}
+	return organization, fmt.Sprintf("seeded organization %s (%d)\n", organization.Name, organization.ID), nil
+}
+
+// userFlags are the flags of "user create"
+type userFlags struct {
+	username, email, password string
+	passwordStdin             bool
+	roles, groups             string
+	generated                 bool // Whether the password was generated
+}
+
+func parseUserFlags(args []string) (userFlags, error) {
+	var input userFlags
+	err := parseFlags("user create", args, func(flags *flag.FlagSet) {
+		flags.StringVar(&input.username, "username", "", "name of the user")
+		flags.StringVar(&input.email, "email", "", "email of the user")
+		flags.StringVar(&input.password, "password", "", "password, generated and printed when not given")
+		flags.BoolVar(&input.passwordStdin, "password-stdin", false, "read the password from the first line of stdin")
+		flags.StringVar(&input.roles, "roles", "", "comma separated role names")
+		flags.StringVar(&input.groups, "groups", "", "comma separated group names")
+	})
+	if err != nil {
+		return input, err
+	}
+	if input.username == "" || input.email == "" {
+		return input, errors.New("-username and -email are required")
+	}
+	if input.passwordStdin {
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && line == "" {
+			return input, errors.New("no password on stdin")
+		}
+		input.password = strings.TrimRight(line, "\r\n")
+	}
+	if input.password == "" {
+		if input.password, err = utils.GenerateRandomString(16); err != nil {
+			return input, err
+		}
+		input.generated = true
+	}
+	return input, nil
+}
+
+func createUserDB(cli *cli, args []string) (interface{}, string, error) {
+	input, err := parseUserFlags(args)
+	if err != nil {
+		return nil, "", err
+	}
+	organizationID, err := cli.organizationID()
+	if err != nil {
+		return nil, "", err
+	}
+	user, err := controller.CreateUserAccount(auditSource, organizationID, input.username, input.email, input.password,
+		splitList(input.roles), splitList(input.groups))
+	if err != nil {
+		return nil, "", err
+	}
+	return createdUser(viewOfUser(user), input)
+}
+
+func createUserAPI(cli *cli, args []string) (interface{}, string, error) {
+	input, err := parseUserFlags(args)
+	if err != nil {
+		return nil, "", err
+	}
+	created, err := cli.client.CreateUser(cli.ctx, client.CreateUserData{
+		Username: input.username,
+		Email:    input.email,
+		Password: input.password,
+		Roles:    splitList(input.roles),
+		Groups:   splitList(input.groups),
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	view := userView{ID: created.ID, Username: created.Username, Email: created.Email,
+		Roles: nonNil(splitList(input.roles)), Groups: nonNil(splitList(input.groups))}
+	return createdUser(view, input)
+}
+
+// createdUser describes a new user, with the password when it was generated
+func createdUser(view userView, input userFlags) (interface{}, string, error) {
+	text := fmt.Sprintf("created user %d %s <%s>\n", view.ID, view.Username, view.Email)
+	if input.generated {
+		view.Password = input.password
+		text += "password: " + input.password + "\n"
+	}
+	return view, text, nil
+}
+
+func listUsersDB(cli *cli, args []string) (interface{}, string, error) {
+	if err := parseFlags("user list", args, nil); err != nil {
+		return nil, "", err
+	}
+	organizationID, err := cli.organizationID()
+	if err != nil {
+		return nil, "", err
+	}
+	var users []models.User
+	if err := initializers.DBConn.Where("organization_id = ?", organizationID).Preload("Roles").Preload("Groups").
+		Order("id").Find(&users).Error; err != nil {
+		return nil, "", err
+	}
+	views := []userView{}
+	for _, user := range users {
+		views = append(views, viewOfUser(user))
+	}
+	return usersResult(views)
+}
+
+func listUsersAPI(cli *cli, args []string) (interface{}, string, error) {
+	if err := parseFlags("user list", args, nil); err != nil {
+		return nil, "", err
+	}
+	users, err := cli.client.ListUsers(cli.ctx)
+	if err != nil {
+		return nil, "", err
+	}
+	views := []userView{}
+	for _, user := range users {
+		views = append(views, viewOfClientUser(user))
+	}
+	return usersResult(views)
+}
+
+func usersResult(views []userView) (interface{}, string, error) {
+	rows := [][]string{{"ID", "USERNAME", "EMAIL", "ROLES", "GROUPS"}}
+	for _, view := range views {
+		rows = append(rows, []string{strconv.FormatUint(uint64(view.ID), 10), view.Username, view.Email,
+			strings.Join(view.Roles, ","), strings.Join(view.Groups, ",")})
+	}
+	return views, table(rows), nil
+}
+
+func createRoleDB(cli *cli, args []string) (interface{}, string, error) {
+	name, err := parseName("role create", args)
+	if err != nil {
+		return nil, "", err
+	}
+	organizationID, err := cli.organizationID()
+	if err != nil {
+		return nil, "", err
+	}
+	role, err := controller.CreateRoleNamed(auditSource, organizationID, name)
+	if err != nil {
+		return nil, "", err
+	}
+	return roleView{role.ID, role.Name}, fmt.Sprintf("created role %d %s\n", role.ID, role.Name), nil
+}
+
+func createRoleAPI(cli *cli, args []string) (interface{}, string, error) {
+	name, err := parseName("role create", args)
+	if err != nil {
+		return nil, "", err
+	}
+	role, err := cli.client.CreateRole(cli.ctx, name)
+	if err != nil {
+		return nil, "", err
+	}
+	return roleView{role.ID, role.Name}, fmt.Sprintf("created role %d %s\n", role.ID, role.Name), nil
+}
+
+func listRolesDB(cli *cli, args []string) (interface{}, string, error) {
+	if err := parseFlags("role list", args, nil); err != nil {
+		return nil, "", err
+	}
+	organizationID, err := cli.organizationID()
+	if err != nil {
+		return nil, "", err
+	}
+	var roles []models.Role
+	if err := initializers.DBConn.Where("organization_id = ?", organizationID).Order("id").Find(&roles).Error; err != nil {
+		return nil, "", err
+	}
+	views := []roleView{}
+	for _, role := range roles {
+		views = append(views, roleView{role.ID, role.Name})
+	}
+	return rolesResult(views)
+}
+
+func listRolesAPI(cli *cli, args []string) (interface{}, string, error) {
+	if err := parseFlags("role list", args, nil); err != nil {
+		return nil, "", err
+	}
+	roles, err := cli.client.ListRoles(cli.ctx)
+	if err != nil {
+		return nil, "", err
+	}
+	views := []roleView{}
+	for _, role := range roles {
+		views = append(views, roleView{role.ID, role.Name})
+	}
+	return rolesResult(views)
+}
+
+func rolesResult(views []roleView) (interface{}, string, error) {
+	rows := [][]string{{"ID", "NAME"}}
+	for _, view := range views {
+		rows = append(rows, []string{strconv.FormatUint(uint64(view.ID), 10), view.Name})
+	}
+	return views, table(rows), nil
+}
+
+// parseGroupFlags parses the flags of "group create"
+func parseGroupFlags(args []string) (string, *uint, error) {
+	var name string
+	var parent uint
+	err := parseFlags("group create", args, func(flags *flag.FlagSet) {
+		flags.StringVar(&name, "name", "", "name of the group")
+		flags.UintVar(&parent, "parent", 0, "ID of the parent group")
+	})
+	if err == nil && name == "" {
+		err = errors.New("-name is required")
+	}
+	if parent == 0 {
+		return name, nil, err
+	}
+	return name, &parent, err
+}
+
+func createGroupDB(cli *cli, args []string) (interface{}, string, error) {
+	name, parentID, err := parseGroupFlags(args)
+	if err != nil {
+		return nil, "", err
+	}
+	organizationID, err := cli.organizationID()
+	if err != nil {
+		return nil, "", err
+	}
+	group, err := controller.CreateGroupNamed(auditSource, organizationID, name, parentID)
+	if err != nil {
+		return nil, "", err
+	}
+	return groupView{group.ID, group.Name, group.ParentID}, fmt.Sprintf("created group %d %s\n", group.ID, group.Name), nil
+}
+
+func createGroupAPI(cli *cli, args []string) (interface{}, string, error) {
+	name, parentID, err := parseGroupFlags(args)
+	if err != nil {
+		return nil, "", err
+	}
+	group, err := cli.client.CreateGroup(cli.ctx, name, parentID)
+	if err != nil {
+		return nil, "", err
+	}
+	return groupView{group.ID, group.Name, group.ParentID}, fmt.Sprintf("created group %d %s\n", group.ID, group.Name), nil
+}
+
+func listGroupsDB(cli *cli, args []string) (interface{}, string, error) {
+	if err := parseFlags("group list", args, nil); err != nil {
+		return nil, "", err
+	}
+	organizationID, err := cli.organizationID()
+	if err != nil {
+		return nil, "", err
+	}
+	var groups []models.Group
+	if err := initializers.DBConn.Where("organization_id = ?", organizationID).Order("id").Find(&groups).Error; err != nil {
+		return nil, "", err
+	}
+	views := []groupView{}
+	for _, group := range groups {
+		views = append(views, groupView{group.ID, group.Name, group.ParentID})
+	}
+	return groupsResult(views)
+}
+
+func listGroupsAPI(cli *cli, args []string) (interface{}, string, error) {
+	if err := parseFlags("group list", args, nil); err != nil {
+		return nil, "", err
+	}
+	groups, err := cli.client.ListGroups(cli.ctx)
+	if err != nil {
+		return nil, "", err
+	}
+	views := []groupView{}
+	for _, group := range groups {
+		views = append(views, groupView{group.ID, group.Name, group.ParentID})
+	}
+	return groupsResult(views)
+}
+
+func groupsResult(views []groupView) (interface{}, string, error) {
+	rows := [][]string{{"ID", "NAME", "PARENT"}}
+	for _, view := range views {
+		parent := ""
+		if view.ParentID != nil {
+			parent = strconv.FormatUint(uint64(*view.ParentID), 10)
+		}
+		rows = append(rows, []string{strconv.FormatUint(uint64(view.ID), 10), view.Name, parent})
+	}
+	return views, table(rows), nil
+}
+
+// parseAssignFlags parses the flags of "role assign" and "group assign", kind is "roles" or "groups"
+func parseAssignFlags(kind string, args []string) (uint, string, []string, error) {
+	var userID uint
+	var op, names string
+	err := parseFlags(strings.TrimSuffix(kind, "s")+" assign", args, func(flags *flag.FlagSet) {
+		flags.UintVar(&userID, "user", 0, "ID of the user")
+		flags.StringVar(&names, kind, "", "comma separated "+strings.TrimSuffix(kind, "s")+" names")
+		flags.StringVar(&op, "op", client.MembershipAdd, "add, remove or replace")
+	})
+	if err == nil && userID == 0 {
+		err = errors.New("-user is required")
+	}
+	return userID, op, nonNil(splitList(names)), err
+}
+
+func assignDB(cli *cli, kind string, args []string) (interface{}, string, error) {
+	userID, op, names, err := parseAssignFlags(kind, args)
+	if err != nil {
+		return nil, "", err
+	}
+	organizationID, err := cli.organizationID()
+	if err != nil {
+		return nil, "", err
+	}
+	operation := controller.MembershipOperation{Op: op, UserID: userID}
+	if kind == "roles" {
+		operation.Roles = names
+	} else {
+		operation.Groups = names
+	}
+	after, err := controller.ChangeMemberships(auditSource, organizationID, operation)
+	if err != nil {
+		return nil, "", err
+	}
+
+	// The snapshot of the user has the fields of the membership result of the API
+	var membership client.Membership
+	data, _ := json.Marshal(after)
+	if err := json.Unmarshal(data, &membership); err != nil {
+		return nil, "", err
+	}
+	return membershipResult(membership)
+}
+
+func assignAPI(cli *cli, kind string, args []string) (interface{}, string, error) {
+	userID, op, names, err := parseAssignFlags(kind, args)
+	if err != nil {
+		return nil, "", err
+	}
+	var membership client.Membership
+	if kind == "roles" {
+		membership, err = cli.client.ChangeUserRoles(cli.ctx, userID, op, names)
+	} else {
+		membership, err = cli.client.ChangeUserGroups(cli.ctx, userID, op, names)
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	return membershipResult(membership)
+}
+
+func membershipResult(membership client.Membership) (interface{}, string, error) {
+	view := userView{ID: membership.ID, Username: membership.Username, Email: membership.Email,
+		Roles: nonNil(membership.Roles), Groups: nonNil(membership.Groups)}
+	text := fmt.Sprintf("user %d %s: roles %s; groups %s\n", view.ID, view.Username,
+		strings.Join(view.Roles, ", "), strings.Join(view.Groups, ", "))
+	return view, text, nil
+}
+
+func rotateKey(cli *cli, args []string) (interface{}, string, error) {
+	var userID uint
+	err := parseFlags("key rotate", args, func(flags *flag.FlagSet) {
+		flags.UintVar(&userID, "user", 0, "ID of the user")
+	})
+	if err == nil && userID == 0 {
+		err = errors.New("-user is required")
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	organizationID, err := cli.organizationID()
+	if err != nil {
+		return nil, "", err
+	}
+	if err := controller.RotateUserKey(auditSource, organizationID, userID); err != nil {
+		return nil, "", err
+	}
+	return map[string]interface{}{"userId": userID, "rotated": true},
+		fmt.Sprintf("rotated the key of user %d, the user has to sign in again\n", userID), nil
+}
+
+func revokeTokens(cli *cli, args []string) (interface{}, string, error) {
+	var tokenID, userID uint
+	err := parseFlags("token revoke", args, func(flags *flag.FlagSet) {
+		flags.UintVar(&tokenID, "id", 0, "ID of the personal access token")
+		flags.UintVar(&userID, "user", 0, "ID of the user whose tokens and sessions to revoke")
+	})
+	if err == nil && (tokenID == 0) == (userID == 0) {
+		err = errors.New("exactly one of -id and -user is required")
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	organizationID, err := cli.organizationID()
+	if err != nil {
+		return nil, "", err
+	}
+
+	if tokenID != 0 {
+		if err := controller.RevokeAccessTokenByID(auditSource, organizationID, tokenID); err != nil {
+			return nil, "", err
+		}
+		return map[string]interface{}{"tokenId": tokenID, "revoked": true}, fmt.Sprintf("revoked token %d\n", tokenID), nil
+	}
+	revoked, err := controller.RevokeUserTokens(auditSource, organizationID, userID)
+	if err != nil {
+		return nil, "", err
+	}
+	return map[string]interface{}{"userId": userID, "revokedTokens": revoked},
+		fmt.Sprintf("revoked %d tokens and all sessions of user %d\n", revoked, userID), nil
+}
+
+// parseFlags parses the flags of a command, define adds them to the set
+func parseFlags(name string, args []string, define func(flags *flag.FlagSet)) error {
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	if define != nil {
+		define(flags)
+	}
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() > 0 {
+		return fmt.Errorf("unexpected argument %q", flags.Arg(0))
+	}
+	return nil
+}
+
+// parseName parses the -name flag of a create command
+func parseName(command string, args []string) (string, error) {
+	var name string
+	err := parseFlags(command, args, func(flags *flag.FlagSet) {
+		flags.StringVar(&name, "name", "", "name")
+	})
+	if err == nil && name == "" {
+		err = errors.New("-name is required")
+	}
+	return name, err
+}
+
+// viewOfUser describes a user with the names of its roles and groups
+func viewOfUser(user models.User) userView {
+	view := userView{ID: user.ID, Username: user.Name, Email: user.Email, Roles: []string{}, Groups: []string{}}
+	for _, role := range user.Roles {
+		view.Roles = append(view.Roles, role.Name)
+	}
+	for _, group := range user.Groups {
+		view.Groups = append(view.Groups, group.Name)
+	}
+	return view
+}
+
+// viewOfClientUser describes a user of the API with the names of its roles and groups
+func viewOfClientUser(user client.User) userView {
+	view := userView{ID: user.ID, Username: user.Name, Email: user.Email, Roles: []string{}, Groups: []string{}}
+	for _, role := range user.Roles {
+		view.Roles = append(view.Roles, role.Name)
+	}
+	for _, group := range user.Groups {
+		view.Groups = append(view.Groups, group.Name)
+	}
+	return view
+}
+
+// table formats rows as aligned columns
+func table(rows [][]string) string {
+	var out strings.Builder
+	writer := tabwriter.NewWriter(&out, 0, 4, 2, ' ', 0)
+	for _, row := range rows {
+		fmt.Fprintln(writer, strings.Join(row, "\t"))
+	}
+	writer.Flush()
+	return out.String()
+}
+
+// splitList splits a comma separated list, dropping empty entries
+func splitList(value string) []string {
+	var names []string
+	for _, name := range strings.Split(value, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// nonNil returns names, an empty list instead of nil
+func nonNil(names []string) []string {
+	if names == nil {
+		return []string{}
+	}
+	return names
+}
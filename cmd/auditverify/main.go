@@ -0,0 +1,51 @@
+// Command auditverify walks the audit log and checks its hash chain.
+// It exits with status 1 when an entry was modified, removed or reordered.
+//
+//	go run ./cmd/auditverify
+package main
+
+import (
+	"fmt"
+	"jwt/initializers"
+	"jwt/models"
+	"jwt/utils"
+	"log"
+	"os"
+
+	"gorm.io/gorm"
+)
+
+func main() {
+	initializers.InitialierEnvVariable()
+	initializers.InitiazeDB()
+
+	var batch []models.AuditEvent
+	var checked, problems int
+	prevHash := ""
+
+	err := initializers.DBConn.Order("id").FindInBatches(&batch, 500, func(tx *gorm.DB, _ int) error {
+		for _, event := range batch {
+			checked++
+			if event.PrevHash != prevHash {
+				problems++
+				fmt.Printf("entry %d: chain broken, expected previous hash %q but found %q\n", event.ID, prevHash, event.PrevHash)
+			}
+			if hash := utils.AuditHash(event); hash != event.Hash {
+				problems++
+				fmt.Printf("entry %d: content does not match its hash\n", event.ID)
+			}
+			prevHash = event.Hash
+		}
+		return nil
+	}).Error
+	if err != nil {
+		log.Fatal("Failed to read the audit log: ", err)
+	}
+
+	fmt.Printf("checked %d entries, %d problems\n", checked, problems)
+	// Keep the head hash somewhere safe, it also detects truncation of the log on the next run
+	fmt.Printf("head hash: %s\n", prevHash)
+	if problems > 0 {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,411 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"jwt/initializers"
+	"jwt/models"
+	"jwt/notify"
+	"log"
+	"net/http"
+	"os"
+	"reflect"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// RequestCancelled is the status of an access request withdrawn by the requester
+const RequestCancelled = "cancelled"
+
+// Notifier delivers the notifications about access requests, notify.FromEnv() when not set.
+// Replace it to notify through another channel.
+var Notifier notify.Notifier
+
+type AccessRequestData struct {
+	Role          string `json:"role"`  // Name of the requested role, or
+	Group         string `json:"group"` // name of the requested group
+	Justification string `json:"justification" binding:"required"`
+}
+
+// CreateAccessRequest handles a user asking for a role or a group membership. The approvers are notified.
+func CreateAccessRequest(c *gin.Context) {
+	var input AccessRequestData
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if (input.Role == "") == (input.Group == "") {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Exactly one of role and group is required"})
+		return
+	}
+
+	user, _ := CurrentUser(c)
+	request := models.AccessRequest{
+		OrganizationID: user.OrganizationID,
+		RequesterID:    user.ID,
+		Requester:      user,
+		Justification:  input.Justification,
+		Status:         RequestPending,
+	}
+
+	var count int64
+	if input.Role != "" {
+		var role models.Role
+		if err := tenantDB(c).Where("name = ?", input.Role).First(&role).Error; err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown role: " + input.Role})
+			return
+		}
+		request.RoleID, request.Role = &role.ID, &role
+		initializers.DBConn.Model(&models.UserRole{}).Where("user_id = ? AND role_id = ? AND expires_at IS NULL", user.ID, role.ID).Count(&count)
+	} else {
+		var group models.Group
+		if err := tenantDB(c).Where("name = ?", input.Group).First(&group).Error; err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown group: " + input.Group})
+			return
+		}
+		request.GroupID, request.Group = &group.ID, &group
+		initializers.DBConn.Table("user_groups").Where("user_id = ? AND group_id = ?", user.ID, group.ID).Count(&count)
+	}
+	if count > 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "You already have " + accessRequestTarget(request)})
+		return
+	}
+	initializers.DBConn.Model(&models.AccessRequest{}).
+		Where("requester_id = ? AND status = ? AND (role_id = ? OR group_id = ?)", user.ID, RequestPending, request.RoleID, request.GroupID).
+		Count(&count)
+	if count > 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "A request for " + accessRequestTarget(request) + " is already pending"})
+		return
+	}
+
+	err := initializers.DBConn.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Omit("Requester", "Role", "Group").Create(&request).Error; err != nil {
+			return err
+		}
+		if err := enqueueEvent(tx, "access_request.created", accessRequestSnapshot(request)); err != nil {
+			return err
+		}
+		return recordAuditTx(tx, c, "access_request.create", "access_request", request.ID, nil, accessRequestSnapshot(request))
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create request"})
+		return
+	}
+
+	sendNotification(notify.Message{
+		Event:   "access_request.created",
+		To:      accessRequestApprovers(request),
+		Subject: fmt.Sprintf("%s requests %s", user.Name, accessRequestTarget(request)),
+		Body:    fmt.Sprintf("%s requests %s:\n\n%s\n\nApprove or deny request %d with POST /access-requests/%d/approve or /deny.", user.Name, accessRequestTarget(request), request.Justification, request.ID, request.ID),
+		Data:    accessRequestSnapshot(request),
+	})
+	c.JSON(http.StatusOK, accessRequestSnapshot(request))
+}
+
+// ListMyAccessRequests retrieves the access requests of the current user
+func ListMyAccessRequests(c *gin.Context) {
+	user, _ := CurrentUser(c)
+
+	var requests []models.AccessRequest
+	accessRequestQuery().Where("requester_id = ?", user.ID).Find(&requests)
+	respondWithAccessRequests(c, requests)
+}
+
+// ListAccessRequests retrieves the requests of the organization the current user can decide,
+// the pending ones unless status is given
+func ListAccessRequests(c *gin.Context) {
+	status := c.DefaultQuery("status", RequestPending)
+
+	var requests []models.AccessRequest
+	accessRequestQuery().Where("organization_id = ? AND status = ?", tenantID(c), status).Find(&requests)
+
+	decidable := []models.AccessRequest{}
+	for _, request := range requests {
+		if canDecideAccessRequest(c, request) {
+			decidable = append(decidable, request)
+		}
+	}
+	respondWithAccessRequests(c, decidable)
+}
+
+// CancelAccessRequest handles the requester withdrawing a pending request
+func CancelAccessRequest(c *gin.Context) {
+	user, _ := CurrentUser(c)
+
+	var request models.AccessRequest
+	if err := accessRequestQuery().Where("requester_id = ?", user.ID).First(&request, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Request not found"})
+		return
+	}
+	if request.Status != RequestPending {
+		c.JSON(http.StatusConflict, gin.H{"error": "Request is already " + request.Status})
+		return
+	}
+
+	before := accessRequestSnapshot(request)
+	now := time.Now()
+	request.Status = RequestCancelled
+	request.DecidedAt = &now
+	err := initializers.DBConn.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&models.AccessRequest{}).Where("id = ? AND status = ?", request.ID, RequestPending).
+			Updates(map[string]interface{}{"status": request.Status, "decided_at": request.DecidedAt})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return errRequestDecided
+		}
+		return recordAuditTx(tx, c, "access_request.cancel", "access_request", request.ID, before, accessRequestSnapshot(request))
+	})
+	if errors.Is(err, errRequestDecided) {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to cancel request: " + err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, accessRequestSnapshot(request))
+}
+
+// ApproveAccessRequest handles granting the requested role or group membership
+func ApproveAccessRequest(c *gin.Context) {
+	decideAccessRequest(c, RequestApproved)
+}
+
+// DenyAccessRequest handles rejecting an access request
+func DenyAccessRequest(c *gin.Context) {
+	decideAccessRequest(c, RequestDenied)
+}
+
+// decideAccessRequest approves or denies a pending request the current user is an approver of
+func decideAccessRequest(c *gin.Context, status string) {
+	var input ElevationDecisionData
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&input); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	var request models.AccessRequest
+	if err := accessRequestQuery().Where("organization_id = ?", tenantID(c)).First(&request, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Request not found"})
+		return
+	}
+	if request.Status != RequestPending {
+		c.JSON(http.StatusConflict, gin.H{"error": "Request is already " + request.Status})
+		return
+	}
+	if !canDecideAccessRequest(c, request) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Access denied"})
+		return
+	}
+
+	approver, _ := CurrentUser(c)
+	requestBefore := accessRequestSnapshot(request)
+	now := time.Now()
+	request.Status = status
+	request.DecidedByID = &approver.ID
+	request.DecidedAt = &now
+	request.DecisionNote = input.Note
+
+	err := initializers.DBConn.Transaction(func(tx *gorm.DB) error {
+		// Only one approver decides, a concurrent decision leaves no pending row to update
+		result := tx.Model(&models.AccessRequest{}).Where("id = ? AND status = ?", request.ID, RequestPending).Updates(map[string]interface{}{
+			"status":        request.Status,
+			"decided_by_id": request.DecidedByID,
+			"decided_at":    request.DecidedAt,
+			"decision_note": request.DecisionNote,
+		})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return errRequestDecided
+		}
+		if err := enqueueEvent(tx, "access_request."+status, accessRequestSnapshot(request)); err != nil {
+			return err
+		}
+
+		action := "access_request.deny"
+		if status == RequestApproved {
+			action = "access_request.approve"
+			var before, after gin.H
+			var err error
+			reason := fmt.Sprintf("Access request %d: %s", request.ID, request.Justification)
+			if request.Role != nil {
+				before, after, err = applyRoleGrant(tx, request.RequesterID, *request.Role, &approver.ID, nil, reason)
+			} else {
+				before, after, err = applyGroupJoin(tx, request.RequesterID, *request.Group)
+			}
+			if err != nil {
+				return err
+			}
+			if !reflect.DeepEqual(before, after) {
+				if err := recordAuditTx(tx, c, "user.update", "user", request.RequesterID, before, after); err != nil {
+					return err
+				}
+			}
+		}
+		return recordAuditTx(tx, c, action, "access_request", request.ID, requestBefore, accessRequestSnapshot(request))
+	})
+	if errors.Is(err, errRequestDecided) {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+	if respondWithRoleConflict(c, err) {
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to decide request: " + err.Error()})
+		return
+	}
+
+	body := fmt.Sprintf("Your request for %s was %s by %s.", accessRequestTarget(request), status, approver.Name)
+	if request.DecisionNote != "" {
+		body += "\n\n" + request.DecisionNote
+	}
+	sendNotification(notify.Message{
+		Event:   "access_request." + status,
+		To:      []string{request.Requester.Email},
+		Subject: fmt.Sprintf("Request for %s %s", accessRequestTarget(request), status),
+		Body:    body,
+		Data:    accessRequestSnapshot(request),
+	})
+	c.JSON(http.StatusOK, accessRequestSnapshot(request))
+}
+
+// applyGroupJoin adds the user to the group inside the transaction and returns the user before and after
+func applyGroupJoin(tx *gorm.DB, userID uint, group models.Group) (gin.H, gin.H, error) {
+	var user models.User
+	if err := tx.Preload("Roles").Preload("Groups").First(&user, userID).Error; err != nil {
+		return nil, nil, err
+	}
+	before := userSnapshot(user)
+	for _, member := range user.Groups {
+		if member.ID == group.ID {
+			return before, before, nil
+		}
+	}
+
+	if err := tx.Model(&user).Association("Groups").Append(&group); err != nil {
+		return nil, nil, err
+	}
+	return before, userSnapshot(user), nil
+}
+
+// canDecideAccessRequest reports whether the current user approves requests of the kind: users with
+// the approver role (ACCESS_APPROVER_ROLE, default admin) and, for groups, the group's owners and managers.
+// Nobody decides their own request.
+func canDecideAccessRequest(c *gin.Context, request models.AccessRequest) bool {
+	user, _ := CurrentUser(c)
+	if user.ID == request.RequesterID {
+		return false
+	}
+	if hasRoleRights(c, accessApproverRole()) {
+		return true
+	}
+	return request.Group != nil && groupManagerRole(user.ID, *request.Group) != ""
+}
+
+// accessRequestApprovers returns the email addresses of the users that can decide the request
+func accessRequestApprovers(request models.AccessRequest) []string {
+	var emails []string
+	initializers.DBConn.Model(&models.User{}).
+		Joins("JOIN user_roles ON user_roles.user_id = users.id").
+		Joins("JOIN roles ON roles.id = user_roles.role_id").
+		Where("users.organization_id = ? AND roles.name = ?", request.OrganizationID, accessApproverRole()).
+		Where("user_roles.expires_at IS NULL OR user_roles.expires_at > ?", time.Now()).
+		Pluck("users.email", &emails)
+
+	if request.Group != nil {
+		var managers []string
+		initializers.DBConn.Model(&models.User{}).
+			Joins("JOIN group_managers ON group_managers.user_id = users.id").
+			Where("group_managers.group_id IN ?", groupAncestorIDs(*request.Group)).
+			Pluck("users.email", &managers)
+		emails = append(emails, managers...)
+	}
+
+	approvers := []string{}
+	for _, email := range uniqueStrings(emails) {
+		if email != request.Requester.Email {
+			approvers = append(approvers, email)
+		}
+	}
+	return approvers
+}
+
+// accessApproverRole returns the name of the role whose users approve all access requests
+func accessApproverRole() string {
+	if role := os.Getenv("ACCESS_APPROVER_ROLE"); role != "" {
+		return role
+	}
+	return "admin"
+}
+
+// sendNotification hands the message to the notifier in the background, failures are only logged
+func sendNotification(message notify.Message) {
+	notifier := Notifier
+	if notifier == nil {
+		notifier = notify.FromEnv()
+	}
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		if err := notifier.Notify(ctx, message); err != nil {
+			log.Println("Failed to send notification", message.Event, ":", err)
+		}
+	}()
+}
+
+// accessRequestQuery starts a query for access requests with their requester and target
+func accessRequestQuery() *gorm.DB {
+	return initializers.DBConn.Preload("Requester").Preload("Role").Preload("Group").Order("id DESC")
+}
+
+// respondWithAccessRequests responds with the snapshots of the requests
+func respondWithAccessRequests(c *gin.Context, requests []models.AccessRequest) {
+	list := []gin.H{}
+	for _, request := range requests {
+		list = append(list, accessRequestSnapshot(request))
+	}
+	c.JSON(http.StatusOK, gin.H{"requests": list})
+}
+
+// accessRequestTarget describes what was requested, e.g. "the role admin"
+func accessRequestTarget(request models.AccessRequest) string {
+	if request.Role != nil {
+		return "the role " + request.Role.Name
+	}
+	if request.Group != nil {
+		return "the group " + request.Group.Name
+	}
+	return "access"
+}
+
+// accessRequestSnapshot describes an access request for responses, events and the audit log
+func accessRequestSnapshot(request models.AccessRequest) gin.H {
+	snapshot := gin.H{
+		"id":            request.ID,
+		"requesterId":   request.RequesterID,
+		"requester":     request.Requester.Name,
+		"justification": request.Justification,
+		"status":        request.Status,
+		"decidedById":   request.DecidedByID,
+		"decisionNote":  request.DecisionNote,
+		"createdAt":     request.CreatedAt,
+		"decidedAt":     request.DecidedAt,
+	}
+	if request.Role != nil {
+		snapshot["role"] = request.Role.Name
+	}
+	if request.Group != nil {
+		snapshot["group"] = request.Group.Name
+	}
+	return snapshot
+}
@@ -0,0 +1,611 @@
+package controller
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"jwt/initializers"
+	"jwt/models"
+	"jwt/notify"
+	"log"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// Status of an access review campaign
+const (
+	ReviewOpen   = "open"
+	ReviewClosed = "closed"
+)
+
+// Decisions on an access review item
+const (
+	ReviewKeep   = "keep"
+	ReviewRevoke = "revoke"
+)
+
+type AccessReviewData struct {
+	Name      string     `json:"name" binding:"required"`
+	DueAt     *time.Time `json:"dueAt"`
+	Reviewers []string   `json:"reviewers"` // Usernames reviewing the items no group manager reviews
+	Roles     []string   `json:"roles"`     // Limit the review to these roles
+	Groups    []string   `json:"groups"`    // Limit the review to these groups
+	Kinds     []string   `json:"kinds"`     // "role" and/or "group", both by default
+}
+
+type ReviewDecisionData struct {
+	Decisions []struct {
+		ItemID   uint   `json:"itemId" binding:"required"`
+		Decision string `json:"decision" binding:"required"` // "keep" or "revoke"
+		Comment  string `json:"comment"`
+	} `json:"decisions" binding:"required"`
+}
+
+type CloseReviewData struct {
+	RevokeUndecided bool `json:"revokeUndecided"` // Treat items nobody decided as revoked
+}
+
+// reviewMembership is a membership read when a campaign starts
+type reviewMembership struct {
+	UserID     uint
+	Username   string
+	TargetID   uint
+	TargetName string
+}
+
+var errReviewClosed = errors.New("The access review is closed")
+
+// CreateAccessReview handles starting a campaign: the current role and group memberships are
+// copied into items and assigned to reviewers, who are notified
+func CreateAccessReview(c *gin.Context) {
+	var input AccessReviewData
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	kinds := map[string]bool{"role": len(input.Kinds) == 0, "group": len(input.Kinds) == 0}
+	for _, kind := range input.Kinds {
+		if kind != "role" && kind != "group" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid kind, use role or group: " + kind})
+			return
+		}
+		kinds[kind] = true
+	}
+
+	var reviewers []models.User
+	if len(input.Reviewers) > 0 {
+		tenantDB(c).Where("name IN ?", input.Reviewers).Order("name").Find(&reviewers)
+		found := map[string]bool{}
+		for _, reviewer := range reviewers {
+			found[reviewer.Name] = true
+		}
+		if err := unknownNames("reviewer", input.Reviewers, found); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	admin, _ := CurrentUser(c)
+	review := models.AccessReview{
+		OrganizationID: tenantID(c),
+		Name:           input.Name,
+		Status:         ReviewOpen,
+		DueAt:          input.DueAt,
+		CreatedByID:    &admin.ID,
+	}
+	if kinds["role"] {
+		for _, membership := range reviewMemberships(c, "user_roles", "roles", "role_id", input.Roles) {
+			review.Items = append(review.Items, reviewItem(membership, "role"))
+		}
+	}
+	if kinds["group"] {
+		for _, membership := range reviewMemberships(c, "user_groups", "groups", "group_id", input.Groups) {
+			review.Items = append(review.Items, reviewItem(membership, "group"))
+		}
+	}
+	assignReviewers(review.Items, reviewers)
+
+	err := initializers.DBConn.Transaction(func(tx *gorm.DB) error {
+		// Large organizations have many memberships, the items are inserted in batches
+		if err := tx.Session(&gorm.Session{CreateBatchSize: 500}).Create(&review).Error; err != nil {
+			return err
+		}
+		return recordAuditTx(tx, c, "access_review.create", "access_review", review.ID, nil, accessReviewSnapshot(review))
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create access review"})
+		return
+	}
+
+	notifyReviewers(review)
+	c.JSON(http.StatusOK, accessReviewSnapshot(review))
+}
+
+// ListAccessReviews retrieves the campaigns of the organization with their progress
+func ListAccessReviews(c *gin.Context) {
+	var reviews []models.AccessReview
+	tenantDB(c).Preload("Items").Order("id DESC").Find(&reviews)
+
+	list := []gin.H{}
+	for _, review := range reviews {
+		list = append(list, accessReviewSnapshot(review))
+	}
+	c.JSON(http.StatusOK, gin.H{"reviews": list})
+}
+
+// GetAccessReview retrieves a campaign with all its items
+func GetAccessReview(c *gin.Context) {
+	review, ok := loadAccessReview(c)
+	if !ok {
+		return
+	}
+
+	response := accessReviewSnapshot(review)
+	response["items"] = review.Items
+	c.JSON(http.StatusOK, response)
+}
+
+// ListMyReviewItems retrieves the undecided items of open campaigns assigned to the current user
+func ListMyReviewItems(c *gin.Context) {
+	user, _ := CurrentUser(c)
+
+	var items []models.AccessReviewItem
+	initializers.DBConn.Joins("JOIN access_reviews ON access_reviews.id = access_review_items.review_id").
+		Where("access_reviews.status = ? AND access_review_items.reviewer_id = ? AND access_review_items.decision = ''", ReviewOpen, user.ID).
+		Order("access_review_items.review_id, access_review_items.id").
+		Find(&items)
+	c.JSON(http.StatusOK, gin.H{"items": items})
+}
+
+// DecideReviewItems handles keep or revoke decisions on items of an open campaign. Reviewers decide
+// their items, admins any item, nobody their own memberships. All decisions are saved or none.
+func DecideReviewItems(c *gin.Context) {
+	var input ReviewDecisionData
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var review models.AccessReview
+	if err := tenantDB(c).First(&review, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Access review not found"})
+		return
+	}
+	if review.Status != ReviewOpen {
+		c.JSON(http.StatusConflict, gin.H{"error": errReviewClosed.Error()})
+		return
+	}
+
+	user, _ := CurrentUser(c)
+	isAdmin := hasAdminRights(c)
+	now := time.Now()
+	var decided []models.AccessReviewItem
+	err := initializers.DBConn.Transaction(func(tx *gorm.DB) error {
+		for _, decision := range input.Decisions {
+			if decision.Decision != ReviewKeep && decision.Decision != ReviewRevoke {
+				return membershipError{status: http.StatusBadRequest, message: "Invalid decision, use keep or revoke: " + decision.Decision}
+			}
+			var item models.AccessReviewItem
+			if err := tx.Where("review_id = ?", review.ID).First(&item, decision.ItemID).Error; err != nil {
+				return membershipError{status: http.StatusNotFound, message: fmt.Sprintf("Item %d not found", decision.ItemID)}
+			}
+			if item.UserID == user.ID {
+				return membershipError{status: http.StatusForbidden, message: fmt.Sprintf("Item %d is your own membership", item.ID)}
+			}
+			if !isAdmin && (item.ReviewerID == nil || *item.ReviewerID != user.ID) {
+				return membershipError{status: http.StatusForbidden, message: fmt.Sprintf("Item %d is not assigned to you", item.ID)}
+			}
+
+			item.Decision = decision.Decision
+			item.Comment = decision.Comment
+			item.DecidedByID = &user.ID
+			item.DecidedAt = &now
+			if err := tx.Model(&item).Select("decision", "comment", "decided_by_id", "decided_at").Updates(&item).Error; err != nil {
+				return err
+			}
+			decided = append(decided, item)
+		}
+		// The campaign may have been closed meanwhile, the decisions would not be applied then
+		var status string
+		if err := tx.Model(&models.AccessReview{}).Where("id = ?", review.ID).Pluck("status", &status).Error; err != nil {
+			return err
+		}
+		if status != ReviewOpen {
+			return errReviewClosed
+		}
+		return recordAuditTx(tx, c, "access_review.decide", "access_review", review.ID, nil, gin.H{"items": decided})
+	})
+
+	var failed membershipError
+	if errors.As(err, &failed) {
+		c.JSON(failed.status, gin.H{"error": failed.message})
+		return
+	}
+	if errors.Is(err, errReviewClosed) {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save decisions: " + err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"items": decided})
+}
+
+// CloseAccessReview handles ending a campaign: the memberships decided to be revoked are removed,
+// with revokeUndecided also those nobody decided on. Sessions of affected users are revoked.
+func CloseAccessReview(c *gin.Context) {
+	var input CloseReviewData
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&input); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	review, ok := loadAccessReview(c)
+	if !ok {
+		return
+	}
+	if review.Status != ReviewOpen {
+		c.JSON(http.StatusConflict, gin.H{"error": errReviewClosed.Error()})
+		return
+	}
+
+	// Group the revoked items by user, so each user gets one event and audit entry
+	revoked := map[uint][]models.AccessReviewItem{}
+	for _, item := range review.Items {
+		if item.Decision == ReviewRevoke || (item.Decision == "" && input.RevokeUndecided) {
+			revoked[item.UserID] = append(revoked[item.UserID], item)
+		}
+	}
+
+	admin, _ := CurrentUser(c)
+	reviewBefore := accessReviewSnapshot(review)
+	now := time.Now()
+	var changedUserIDs []uint
+	err := initializers.DBConn.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&models.AccessReview{}).Where("id = ? AND status = ?", review.ID, ReviewOpen).
+			Updates(map[string]interface{}{"status": ReviewClosed, "closed_by_id": admin.ID, "closed_at": now})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return errReviewClosed
+		}
+
+		for userID, items := range revoked {
+			before, after, err := revokeReviewedMemberships(tx, userID, items)
+			if err != nil {
+				return err
+			}
+			var ids []uint
+			for _, item := range items {
+				ids = append(ids, item.ID)
+			}
+			if err := tx.Model(&models.AccessReviewItem{}).Where("id IN ?", ids).Update("applied_at", now).Error; err != nil {
+				return err
+			}
+			if before == nil || reflect.DeepEqual(before, after) {
+				continue
+			}
+			if err := recordAuditTx(tx, c, "user.update", "user", userID, before, after); err != nil {
+				return err
+			}
+			changedUserIDs = append(changedUserIDs, userID)
+		}
+
+		if err := tx.Preload("Items").First(&review, review.ID).Error; err != nil {
+			return err
+		}
+		return recordAuditTx(tx, c, "access_review.close", "access_review", review.ID, reviewBefore, accessReviewSnapshot(review))
+	})
+	if errors.Is(err, errReviewClosed) {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to close access review: " + err.Error()})
+		return
+	}
+
+	// The tokens of the users still list the removed roles and groups
+	for _, userID := range changedUserIDs {
+		if err := revokeSessions(userID, ""); err != nil {
+			log.Println("Failed to revoke sessions of user", userID, ":", err)
+		}
+	}
+
+	c.JSON(http.StatusOK, accessReviewSnapshot(review))
+}
+
+// AccessReviewReport exports a campaign with all items and decisions, as JSON or with format=csv as CSV
+func AccessReviewReport(c *gin.Context) {
+	review, ok := loadAccessReview(c)
+	if !ok {
+		return
+	}
+
+	// Resolve the reviewers and deciders, deleted users stay as IDs
+	var userIDs []uint
+	for _, item := range review.Items {
+		for _, id := range []*uint{item.ReviewerID, item.DecidedByID} {
+			if id != nil {
+				userIDs = append(userIDs, *id)
+			}
+		}
+	}
+	names := map[uint]string{}
+	if len(userIDs) > 0 {
+		var users []models.User
+		initializers.DBConn.Select("id", "name").Where("id IN ?", uniqueIDs(userIDs)).Find(&users)
+		for _, user := range users {
+			names[user.ID] = user.Name
+		}
+	}
+	name := func(id *uint) string {
+		if id == nil {
+			return ""
+		}
+		if name, ok := names[*id]; ok {
+			return name
+		}
+		return fmt.Sprint(*id)
+	}
+	timestamp := func(t *time.Time) string {
+		if t == nil {
+			return ""
+		}
+		return t.UTC().Format(time.RFC3339)
+	}
+
+	rows := []gin.H{}
+	for _, item := range review.Items {
+		decision := item.Decision
+		if decision == "" {
+			decision = "undecided"
+		}
+		rows = append(rows, gin.H{
+			"itemId":    item.ID,
+			"userId":    item.UserID,
+			"username":  item.Username,
+			"kind":      item.Kind,
+			"target":    item.TargetName,
+			"reviewer":  name(item.ReviewerID),
+			"decision":  decision,
+			"comment":   item.Comment,
+			"decidedBy": name(item.DecidedByID),
+			"decidedAt": timestamp(item.DecidedAt),
+			"appliedAt": timestamp(item.AppliedAt),
+		})
+	}
+
+	if c.Query("format") != "csv" {
+		report := accessReviewSnapshot(review)
+		report["items"] = rows
+		c.JSON(http.StatusOK, report)
+		return
+	}
+
+	columns := []string{"itemId", "userId", "username", "kind", "target", "reviewer", "decision", "comment", "decidedBy", "decidedAt", "appliedAt"}
+	filename := strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' {
+			return r
+		}
+		return '_'
+	}, review.Name)
+	c.Header("Content-Type", "text/csv; charset=utf-8")
+	c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="access-review-%d-%s.csv"`, review.ID, filename))
+	writer := csv.NewWriter(c.Writer)
+	writer.Write(columns)
+	for _, row := range rows {
+		record := make([]string, len(columns))
+		for i, column := range columns {
+			record[i] = fmt.Sprint(row[column])
+		}
+		writer.Write(record)
+	}
+	writer.Flush()
+}
+
+// revokeReviewedMemberships removes the memberships of the items from the user inside the transaction
+// and returns the user before and after, nil when the user no longer exists
+func revokeReviewedMemberships(tx *gorm.DB, userID uint, items []models.AccessReviewItem) (gin.H, gin.H, error) {
+	var user models.User
+	if err := tx.Preload("Roles").Preload("Groups").Limit(1).Find(&user, userID).Error; err != nil || user.ID == 0 {
+		return nil, nil, err
+	}
+	before := userSnapshot(user)
+
+	var roleIDs, groupIDs []uint
+	for _, item := range items {
+		if item.Kind == "role" {
+			roleIDs = append(roleIDs, item.TargetID)
+		} else {
+			groupIDs = append(groupIDs, item.TargetID)
+		}
+	}
+	if len(roleIDs) > 0 {
+		if err := tx.Where("user_id = ? AND role_id IN ?", userID, roleIDs).Delete(&models.UserRole{}).Error; err != nil {
+			return nil, nil, err
+		}
+	}
+	if len(groupIDs) > 0 {
+		if err := tx.Exec("DELETE FROM user_groups WHERE user_id = ? AND group_id IN ?", userID, groupIDs).Error; err != nil {
+			return nil, nil, err
+		}
+	}
+
+	user.Roles, user.Groups = nil, nil
+	if err := tx.Model(&user).Association("Roles").Find(&user.Roles); err != nil {
+		return nil, nil, err
+	}
+	if err := tx.Model(&user).Association("Groups").Find(&user.Groups); err != nil {
+		return nil, nil, err
+	}
+	after := userSnapshot(user)
+	sortSnapshotNames(before)
+	sortSnapshotNames(after)
+	if !reflect.DeepEqual(before["roles"], after["roles"]) {
+		err := enqueueEvent(tx, "user.roles_changed", gin.H{
+			"user":     after,
+			"oldRoles": before["roles"],
+			"newRoles": after["roles"],
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	return before, after, nil
+}
+
+// reviewMemberships reads the memberships of the organization from a join table, optionally
+// limited to the named roles or groups
+func reviewMemberships(c *gin.Context, joinTable, targetTable, targetColumn string, names []string) []reviewMembership {
+	query := initializers.DBConn.Table(joinTable).
+		Select(fmt.Sprintf("users.id AS user_id, users.name AS username, %[1]s.id AS target_id, %[1]s.name AS target_name", targetTable)).
+		Joins(fmt.Sprintf("JOIN users ON users.id = %s.user_id", joinTable)).
+		Joins(fmt.Sprintf("JOIN %[1]s ON %[1]s.id = %[2]s.%[3]s", targetTable, joinTable, targetColumn)).
+		Where("users.organization_id = ?", tenantID(c)).
+		Order(fmt.Sprintf("%s.name, users.name", targetTable))
+	if len(names) > 0 {
+		query = query.Where(targetTable+".name IN ?", names)
+	}
+
+	var memberships []reviewMembership
+	query.Scan(&memberships)
+	return memberships
+}
+
+// reviewItem turns a membership into an undecided item
+func reviewItem(membership reviewMembership, kind string) models.AccessReviewItem {
+	return models.AccessReviewItem{
+		UserID:     membership.UserID,
+		Username:   membership.Username,
+		Kind:       kind,
+		TargetID:   membership.TargetID,
+		TargetName: membership.TargetName,
+	}
+}
+
+// assignReviewers gives group items to an owner or manager of the group or its parents and the
+// other items in turn to the given reviewers. Nobody reviews their own membership; items without
+// a possible reviewer are left to the admins.
+func assignReviewers(items []models.AccessReviewItem, reviewers []models.User) {
+	groupReviewers := map[uint][]models.GroupManager{}
+	next := 0
+	for i := range items {
+		item := &items[i]
+		if item.Kind == "group" {
+			managers, ok := groupReviewers[item.TargetID]
+			if !ok {
+				initializers.DBConn.Where("group_id IN ?", groupAncestorIDs(loadGroupParents(item.TargetID))).Find(&managers)
+				// Owners first, then by appointment
+				sort.SliceStable(managers, func(a, b int) bool {
+					return managers[a].Role == GroupRoleOwner && managers[b].Role != GroupRoleOwner
+				})
+				groupReviewers[item.TargetID] = managers
+			}
+			for _, manager := range managers {
+				if manager.UserID != item.UserID {
+					reviewerID := manager.UserID
+					item.ReviewerID = &reviewerID
+					break
+				}
+			}
+			if item.ReviewerID != nil {
+				continue
+			}
+		}
+
+		for tries := 0; tries < len(reviewers); tries++ {
+			reviewer := reviewers[next%len(reviewers)]
+			next++
+			if reviewer.ID != item.UserID {
+				reviewerID := reviewer.ID
+				item.ReviewerID = &reviewerID
+				break
+			}
+		}
+	}
+}
+
+// loadGroupParents loads the ID and parent of a group for groupAncestorIDs
+func loadGroupParents(groupID uint) models.Group {
+	group := models.Group{ID: groupID}
+	initializers.DBConn.Select("id", "parent_id").Limit(1).Find(&group, groupID)
+	return group
+}
+
+// notifyReviewers tells every reviewer of a new campaign how many items wait for them
+func notifyReviewers(review models.AccessReview) {
+	counts := map[uint]int{}
+	for _, item := range review.Items {
+		if item.ReviewerID != nil {
+			counts[*item.ReviewerID]++
+		}
+	}
+	if len(counts) == 0 {
+		return
+	}
+
+	var ids []uint
+	for id := range counts {
+		ids = append(ids, id)
+	}
+	var reviewers []models.User
+	initializers.DBConn.Select("id", "name", "email").Where("id IN ?", ids).Find(&reviewers)
+	due := ""
+	if review.DueAt != nil {
+		due = " by " + review.DueAt.Format("2006-01-02")
+	}
+	for _, reviewer := range reviewers {
+		sendNotification(notify.Message{
+			Event:   "access_review.created",
+			To:      []string{reviewer.Email},
+			Subject: fmt.Sprintf("Access review %s: %d memberships to review", review.Name, counts[reviewer.ID]),
+			Body:    fmt.Sprintf("Please decide to keep or revoke %d memberships of the access review %s%s.\nGET /users/me/reviews lists them.", counts[reviewer.ID], review.Name, due),
+			Data:    gin.H{"reviewId": review.ID, "name": review.Name, "items": counts[reviewer.ID]},
+		})
+	}
+}
+
+// loadAccessReview loads the campaign of the route with its items, responding with 404 if it is missing
+func loadAccessReview(c *gin.Context) (models.AccessReview, bool) {
+	var review models.AccessReview
+	if err := tenantDB(c).Preload("Items", func(db *gorm.DB) *gorm.DB { return db.Order("id") }).First(&review, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Access review not found"})
+		return review, false
+	}
+	return review, true
+}
+
+// accessReviewSnapshot describes a campaign with the number of items per decision
+func accessReviewSnapshot(review models.AccessReview) gin.H {
+	progress := gin.H{"total": len(review.Items), ReviewKeep: 0, ReviewRevoke: 0, "undecided": 0}
+	for _, item := range review.Items {
+		decision := item.Decision
+		if decision == "" {
+			decision = "undecided"
+		}
+		progress[decision] = progress[decision].(int) + 1
+	}
+	return gin.H{
+		"id":          review.ID,
+		"name":        review.Name,
+		"status":      review.Status,
+		"dueAt":       review.DueAt,
+		"createdById": review.CreatedByID,
+		"createdAt":   review.CreatedAt,
+		"closedById":  review.ClosedByID,
+		"closedAt":    review.ClosedAt,
+		"progress":    progress,
+	}
+}
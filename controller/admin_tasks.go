@@ -0,0 +1,185 @@
+package controller
+
+import (
+	"errors"
+	"fmt"
+	"jwt/initializers"
+	"jwt/models"
+	"jwt/utils"
+	"log"
+	"reflect"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// The functions below perform admin tasks outside of requests, e.g. from the admin CLI. They have
+// the same effects as the routes, including the outbox events, and record the audit event without
+// an actor, under the name of the source instead.
+
+// RecordSystemAudit appends an event performed outside of a request to the audit log
+func RecordSystemAudit(source, action, targetType string, targetID interface{}, before, after interface{}) error {
+	return appendAuditEvent(initializers.DBConn, models.AuditEvent{
+		ActorName:  source,
+		Action:     action,
+		TargetType: targetType,
+		TargetID:   fmt.Sprint(targetID),
+		Before:     toJSON(before),
+		After:      toJSON(after),
+		Diff:       diffJSON(before, after),
+	})
+}
+
+// CreateUserAccount creates a user of the organization with roles and groups by name
+func CreateUserAccount(source string, organizationID uint, username, email, password string, roles, groups []string) (models.User, error) {
+	hashedPassword, err := utils.HashPassword(password)
+	if err != nil {
+		return models.User{}, errors.New("failed to hash password")
+	}
+	user := models.User{OrganizationID: organizationID, Name: username, Email: email, Password: hashedPassword}
+	if user.Roles, err = findRolesByName(initializers.DBConn, organizationID, roles); err != nil {
+		return models.User{}, err
+	}
+	if user.Groups, err = findGroupsByName(initializers.DBConn, organizationID, groups); err != nil {
+		return models.User{}, err
+	}
+
+	if err := saveNewUser(initializers.DBConn, &user); err != nil {
+		return models.User{}, err
+	}
+	auditOrLog(source, "user.create", "user", user.ID, nil, userSnapshot(user))
+	return user, nil
+}
+
+// CreateRoleNamed creates a role of the organization
+func CreateRoleNamed(source string, organizationID uint, name string) (models.Role, error) {
+	role := models.Role{OrganizationID: organizationID, Name: name}
+	err := initializers.DBConn.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&role).Error; err != nil {
+			return err
+		}
+		return enqueueEvent(tx, "role.created", roleSnapshot(role))
+	})
+	if err != nil {
+		return models.Role{}, err
+	}
+	auditOrLog(source, "role.create", "role", role.ID, nil, roleSnapshot(role))
+	return role, nil
+}
+
+// CreateGroupNamed creates a group of the organization, optionally below a parent group
+func CreateGroupNamed(source string, organizationID uint, name string, parentID *uint) (models.Group, error) {
+	group := models.Group{OrganizationID: organizationID, Name: name, ParentID: parentID}
+	if err := checkGroupReferences(group); err != nil {
+		return models.Group{}, errors.New("group " + err.Error())
+	}
+	if err := initializers.DBConn.Create(&group).Error; err != nil {
+		return models.Group{}, err
+	}
+	auditOrLog(source, "group.create", "group", group.ID, nil, groupSnapshot(group))
+	return group, nil
+}
+
+// ChangeMemberships applies a membership operation and returns the changed user or role
+func ChangeMemberships(source string, organizationID uint, operation MembershipOperation) (gin.H, error) {
+	var audit membershipAudit
+	err := initializers.DBConn.Transaction(func(tx *gorm.DB) error {
+		var err error
+		audit, err = applyMembershipOperation(tx, organizationID, operation)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !reflect.DeepEqual(audit.before, audit.after) {
+		auditOrLog(source, audit.targetType+".update", audit.targetType, audit.targetID, audit.before, audit.after)
+	}
+	return audit.after, nil
+}
+
+// RotateUserKey replaces the signing key of a user. The JWTs signed with the old key stop working,
+// their sessions are revoked.
+func RotateUserKey(source string, organizationID, userID uint) error {
+	var user models.User
+	if err := initializers.DBConn.Where("organization_id = ?", organizationID).First(&user, userID).Error; err != nil {
+		return fmt.Errorf("user %d not found", userID)
+	}
+	privateKeyPEM, publicKeyPEM, expiresAt, err := utils.GenerateRSAKeys()
+	if err != nil {
+		return errors.New("failed to generate RSA keys")
+	}
+
+	key := models.RSAKeyPair{UserID: user.ID}
+	err = initializers.DBConn.Transaction(func(tx *gorm.DB) error {
+		err := tx.Where(models.RSAKeyPair{UserID: user.ID}).Assign(models.RSAKeyPair{
+			PrivateKey:     privateKeyPEM,
+			PublicKey:      publicKeyPEM,
+			OrganizationID: user.OrganizationID,
+			CreatedAt:      time.Now(),
+			ExpiresAt:      expiresAt,
+			IsActive:       true,
+		}).FirstOrCreate(&key).Error
+		if err != nil {
+			return err
+		}
+		// The stored token would otherwise be handed out again at the next login
+		if err := tx.Model(&user).Update("jwt_token", "").Error; err != nil {
+			return err
+		}
+		return tx.Model(&models.Session{}).Where("user_id = ? AND revoked_at IS NULL", user.ID).
+			Update("revoked_at", time.Now()).Error
+	})
+	if err != nil {
+		return err
+	}
+	auditOrLog(source, "user.key_rotate", "user", user.ID, nil, gin.H{"keyId": key.ID, "expiresAt": expiresAt})
+	return nil
+}
+
+// RevokeUserTokens revokes the personal access tokens and ends the sessions of a user, returning
+// the number of revoked tokens
+func RevokeUserTokens(source string, organizationID, userID uint) (int64, error) {
+	var user models.User
+	if err := initializers.DBConn.Where("organization_id = ?", organizationID).First(&user, userID).Error; err != nil {
+		return 0, fmt.Errorf("user %d not found", userID)
+	}
+
+	var revoked int64
+	err := initializers.DBConn.Transaction(func(tx *gorm.DB) error {
+		var err error
+		revoked, err = revokeCredentials(tx, user.ID)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	auditOrLog(source, "user.tokens_revoke", "user", user.ID, nil, gin.H{"accessTokens": revoked})
+	return revoked, nil
+}
+
+// RevokeAccessTokenByID revokes a personal access token of a user of the organization
+func RevokeAccessTokenByID(source string, organizationID, tokenID uint) error {
+	var token models.PersonalAccessToken
+	err := initializers.DBConn.Joins("JOIN users ON users.id = personal_access_tokens.user_id").
+		Where("users.organization_id = ?", organizationID).First(&token, tokenID).Error
+	if err != nil {
+		return fmt.Errorf("token %d not found", tokenID)
+	}
+	if token.RevokedAt != nil {
+		return nil
+	}
+	now := time.Now()
+	if err := initializers.DBConn.Model(&token).Update("revoked_at", now).Error; err != nil {
+		return err
+	}
+	auditOrLog(source, "token.revoke", "token", token.ID, nil, gin.H{"userId": token.UserID, "name": token.Name})
+	return nil
+}
+
+// auditOrLog records an audit event, the change is made already when that fails
+func auditOrLog(source, action, targetType string, targetID interface{}, before, after interface{}) {
+	if err := RecordSystemAudit(source, action, targetType, targetID, before, after); err != nil {
+		log.Println("Failed to write audit event", action, ":", err)
+	}
+}
@@ -0,0 +1,207 @@
+package controller
+
+import (
+	"encoding/json"
+	"fmt"
+	"jwt/initializers"
+	"jwt/models"
+	"jwt/utils"
+	"log"
+	"net/http"
+	"reflect"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// auditLockKey serialises writers of the audit chain through a Postgres advisory lock
+const auditLockKey = 7_236_110_001
+
+// recordAudit appends an event performed by the current user to the audit log.
+// Failures are logged but never fail the request, the audited change has already been made.
+// Handlers that make their change in a transaction use recordAuditTx instead.
+func recordAudit(c *gin.Context, action, targetType string, targetID interface{}, before, after interface{}) {
+	var actor *models.User
+	if user, ok := CurrentUser(c); ok {
+		actor = &user
+	}
+	recordAuditAs(c, actor, action, targetType, targetID, before, after)
+}
+
+// recordAuditAs appends an event performed by the given actor (nil if anonymous) to the audit log
+func recordAuditAs(c *gin.Context, actor *models.User, action, targetType string, targetID interface{}, before, after interface{}) {
+	event := newAuditEvent(c, actor, action, targetType, targetID, before, after)
+	if err := appendAuditEvent(initializers.DBConn, event); err != nil {
+		log.Println("Failed to write audit event", action, ":", err)
+	}
+}
+
+// recordAuditTx appends an event performed by the current user inside the transaction of the
+// change, so that the change is only committed together with its audit event
+func recordAuditTx(tx *gorm.DB, c *gin.Context, action, targetType string, targetID interface{}, before, after interface{}) error {
+	var actor *models.User
+	if user, ok := CurrentUser(c); ok {
+		actor = &user
+	}
+	return appendAuditEvent(tx, newAuditEvent(c, actor, action, targetType, targetID, before, after))
+}
+
+// newAuditEvent builds an audit event from the request, the hash is filled in by appendAuditEvent
+func newAuditEvent(c *gin.Context, actor *models.User, action, targetType string, targetID interface{}, before, after interface{}) models.AuditEvent {
+	event := models.AuditEvent{
+		Action:     action,
+		TargetType: targetType,
+		TargetID:   fmt.Sprint(targetID),
+		Before:     toJSON(before),
+		After:      toJSON(after),
+		Diff:       diffJSON(before, after),
+		IP:         c.ClientIP(),
+		RequestID:  c.GetString(RequestIDContextKey),
+	}
+	if actor != nil {
+		event.ActorID = &actor.ID
+		event.ActorName = actor.Name
+	}
+	return event
+}
+
+// appendAuditEvent links the event to the last entry of the chain and stores it.
+// The advisory lock keeps concurrent writers from forking the chain.
+func appendAuditEvent(db *gorm.DB, event models.AuditEvent) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Exec("SELECT pg_advisory_xact_lock(?)", auditLockKey).Error; err != nil {
+			return err
+		}
+
+		var last models.AuditEvent
+		err := tx.Order("id DESC").Limit(1).Find(&last).Error
+		if err != nil {
+			return err
+		}
+
+		event.PrevHash = last.Hash
+		// Postgres keeps microseconds, truncate so the stored time hashes the same when read back
+		event.CreatedAt = time.Now().UTC().Truncate(time.Microsecond)
+		event.Hash = utils.AuditHash(event)
+		return tx.Create(&event).Error
+	})
+}
+
+// toJSON encodes a snapshot for the audit log, nil snapshots are stored as an empty string
+func toJSON(value interface{}) string {
+	if value == nil {
+		return ""
+	}
+	data, err := json.Marshal(value)
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
+
+// diffJSON returns the fields that differ between two snapshots as {"field": {"before": x, "after": y}}
+func diffJSON(before, after interface{}) string {
+	var beforeMap, afterMap map[string]interface{}
+	json.Unmarshal([]byte(toJSON(before)), &beforeMap)
+	json.Unmarshal([]byte(toJSON(after)), &afterMap)
+
+	diff := map[string]gin.H{}
+	for key, value := range beforeMap {
+		if !reflect.DeepEqual(value, afterMap[key]) {
+			diff[key] = gin.H{"before": value, "after": afterMap[key]}
+		}
+	}
+	for key, value := range afterMap {
+		if _, seen := beforeMap[key]; !seen {
+			diff[key] = gin.H{"before": nil, "after": value}
+		}
+	}
+	if len(diff) == 0 {
+		return ""
+	}
+	return toJSON(diff)
+}
+
+// userSnapshot describes a user for the audit log without credentials
+func userSnapshot(user models.User) gin.H {
+	roles := []string{}
+	for _, role := range user.Roles {
+		roles = append(roles, role.Name)
+	}
+	groups := []string{}
+	for _, group := range user.Groups {
+		groups = append(groups, group.Name)
+	}
+	return gin.H{
+		"id":             user.ID,
+		"organizationId": user.OrganizationID,
+		"username":       user.Name,
+		"email":          user.Email,
+		"roles":          roles,
+		"groups":         groups,
+		"attributes":     user.Attributes,
+		"active":         user.Active,
+	}
+}
+
+// roleSnapshot describes a role for the audit log
+func roleSnapshot(role models.Role) gin.H {
+	return gin.H{"id": role.ID, "organizationId": role.OrganizationID, "name": role.Name}
+}
+
+// groupSnapshot describes a group for the audit log
+func groupSnapshot(group models.Group) gin.H {
+	return gin.H{"id": group.ID, "organizationId": group.OrganizationID, "name": group.Name, "parentId": group.ParentID}
+}
+
+// ListAuditEvents retrieves audit events, optionally filtered by
+// actor, action, targetType, targetId, requestId, from and to (RFC 3339)
+func ListAuditEvents(c *gin.Context) {
+	db := initializers.DBConn.Model(&models.AuditEvent{})
+
+	if actor := c.Query("actor"); actor != "" {
+		db = db.Where("actor_id = ?", actor)
+	}
+	if action := c.Query("action"); action != "" {
+		db = db.Where("action = ?", action)
+	}
+	if targetType := c.Query("targetType"); targetType != "" {
+		db = db.Where("target_type = ?", targetType)
+	}
+	if targetID := c.Query("targetId"); targetID != "" {
+		db = db.Where("target_id = ?", targetID)
+	}
+	if requestID := c.Query("requestId"); requestID != "" {
+		db = db.Where("request_id = ?", requestID)
+	}
+	for param, condition := range map[string]string{"from": "created_at >= ?", "to": "created_at < ?"} {
+		if value := c.Query(param); value != "" {
+			t, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid " + param + " time: " + value})
+				return
+			}
+			db = db.Where(condition, t)
+		}
+	}
+
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "100"))
+	if err != nil || limit < 1 || limit > 1000 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "limit must be between 1 and 1000"})
+		return
+	}
+	offset, err := strconv.Atoi(c.DefaultQuery("offset", "0"))
+	if err != nil || offset < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "offset must not be negative"})
+		return
+	}
+
+	var events []models.AuditEvent
+	if err := db.Order("id DESC").Limit(limit).Offset(offset).Find(&events).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve audit events"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"events": events})
+}
@@ -0,0 +1,93 @@
+package controller
+
+import (
+	"jwt/models"
+	"os"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Keys used to share the authenticated identity between the middleware and the handlers
+const (
+	UserContextKey         = "user"         // The authenticated models.User
+	ScopesContextKey       = "scopes"       // Scopes of the personal access token, only set for token requests
+	SessionContextKey      = "session_id"   // ID of the session of the JWT, only set for JWT requests
+	RequestIDContextKey    = "request_id"   // ID of the request, set by the RequestID middleware
+	OrganizationContextKey = "organization" // The models.Organization of the route, set by the Tenant middleware
+	ForwardAuthContextKey  = "forward_auth" // Set by the ForwardAuth middleware, the request describes another one
+)
+
+// CurrentUser returns the user authenticated by the middleware for this request
+func CurrentUser(c *gin.Context) (models.User, bool) {
+	value, exists := c.Get(UserContextKey)
+	if !exists {
+		return models.User{}, false
+	}
+	user, ok := value.(models.User)
+	return user, ok
+}
+
+// CurrentScopes returns the scopes of the personal access token used for this request.
+// The second value is false when the request was authenticated with a JWT instead.
+func CurrentScopes(c *gin.Context) ([]string, bool) {
+	value, exists := c.Get(ScopesContextKey)
+	if !exists {
+		return nil, false
+	}
+	scopes, ok := value.([]string)
+	return scopes, ok
+}
+
+// CurrentSessionID returns the ID of the session the request's JWT belongs to
+func CurrentSessionID(c *gin.Context) (uint, bool) {
+	value, exists := c.Get(SessionContextKey)
+	if !exists {
+		return 0, false
+	}
+	id, ok := value.(uint)
+	return id, ok
+}
+
+// CurrentOrganization returns the organization the request's route belongs to
+func CurrentOrganization(c *gin.Context) (models.Organization, bool) {
+	value, exists := c.Get(OrganizationContextKey)
+	if !exists {
+		return models.Organization{}, false
+	}
+	organization, ok := value.(models.Organization)
+	return organization, ok
+}
+
+// ForwardAuthMethodHeader returns the header in which the reverse proxy sends the method of the original
+// request: FORWARD_AUTH_METHOD_HEADER, X-Forwarded-Method by default. Only this header is trusted, the
+// proxy must overwrite it since clients could otherwise claim a safe method.
+func ForwardAuthMethodHeader() string {
+	if header := os.Getenv("FORWARD_AUTH_METHOD_HEADER"); header != "" {
+		return header
+	}
+	return "X-Forwarded-Method"
+}
+
+// RequestMethod returns the method of the request. Forward-auth requests of a reverse proxy are about
+// another request, whose method the proxy sends in the ForwardAuthMethodHeader. Without it the method is
+// empty, which is not a safe method: the CSRF token and the write scope are required.
+func RequestMethod(c *gin.Context) string {
+	if c.GetBool(ForwardAuthContextKey) {
+		return strings.ToUpper(c.GetHeader(ForwardAuthMethodHeader()))
+	}
+	return c.Request.Method
+}
+
+// RequestURI returns the path and query of the request, for forward-auth requests the one of the
+// original request from X-Forwarded-Uri (Traefik) or X-Original-URI (nginx)
+func RequestURI(c *gin.Context) string {
+	if c.GetBool(ForwardAuthContextKey) {
+		for _, header := range []string{"X-Forwarded-Uri", "X-Original-URI"} {
+			if uri := c.GetHeader(header); uri != "" {
+				return uri
+			}
+		}
+	}
+	return c.Request.URL.RequestURI()
+}
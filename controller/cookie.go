@@ -0,0 +1,83 @@
+package controller
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"jwt/utils"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Names of the cookies and header used by browser sessions
+const (
+	SessionCookieName = "session"      // HttpOnly cookie holding the JWT
+	CSRFCookieName    = "csrf_token"   // Readable cookie holding the double-submit CSRF token
+	CSRFHeaderName    = "X-CSRF-Token" // Header the frontend echoes the CSRF token in
+
+	OIDCStateCookieName   = "oidc_state"   // HttpOnly cookie binding an OIDC login to the browser that started it
+	SAMLRequestCookieName = "saml_request" // HttpOnly cookie binding a SAML login to the browser that started it
+)
+
+// setSessionCookies stores the JWT in an HttpOnly cookie and issues a fresh CSRF token.
+// The CSRF token is returned so it can also be handed to the frontend in the response body.
+func setSessionCookies(c *gin.Context, token string) (string, error) {
+	csrfToken, err := utils.GenerateRandomString(32)
+	if err != nil {
+		return "", err
+	}
+
+	maxAge := int(TokenLifetime.Seconds())
+	c.SetSameSite(http.SameSiteStrictMode)
+	c.SetCookie(SessionCookieName, token, maxAge, "/", "", true, true)
+	// The CSRF cookie must be readable by JavaScript for the double-submit pattern
+	c.SetCookie(CSRFCookieName, csrfToken, maxAge, "/", "", true, false)
+	return csrfToken, nil
+}
+
+// clearSessionCookies expires the session and CSRF cookies
+func clearSessionCookies(c *gin.Context) {
+	c.SetSameSite(http.SameSiteStrictMode)
+	c.SetCookie(SessionCookieName, "", -1, "/", "", true, true)
+	c.SetCookie(CSRFCookieName, "", -1, "/", "", true, false)
+}
+
+// bindLogin ties a federated login to the browser that starts it with a short-lived cookie holding
+// the hash of the state or request ID. Without it, a callback an attacker started could sign the
+// victim's browser in to the attacker's account (login CSRF).
+func bindLogin(c *gin.Context, name, value string, sameSite http.SameSite, lifetime time.Duration) {
+	c.SetSameSite(sameSite)
+	c.SetCookie(name, loginBindingHash(value), int(lifetime.Seconds()), "/", "", true, true)
+}
+
+// boundLogin reports whether the browser holds the cookie of bindLogin for value, and expires it
+func boundLogin(c *gin.Context, name, value string, sameSite http.SameSite) bool {
+	cookie, err := c.Cookie(name)
+	c.SetSameSite(sameSite)
+	c.SetCookie(name, "", -1, "/", "", true, true)
+	if err != nil || value == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(cookie), []byte(loginBindingHash(value))) == 1
+}
+
+func loginBindingHash(value string) string {
+	sum := sha256.Sum256([]byte(value))
+	return hex.EncodeToString(sum[:])
+}
+
+// LogoutUser handles ending the current session, including a cookie based browser session
+func LogoutUser(c *gin.Context) {
+	if user, ok := CurrentUser(c); ok {
+		if sessionID, ok := CurrentSessionID(c); ok {
+			if err := revokeSessions(user.ID, "id = ?", sessionID); err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke session"})
+				return
+			}
+		}
+	}
+	clearSessionCookies(c)
+	c.JSON(http.StatusOK, gin.H{"message": "Logged out"})
+}
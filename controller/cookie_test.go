@@ -0,0 +1,52 @@
+package controller
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestBoundLogin(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(http.MethodGet, "/login", nil)
+	bindLogin(c, OIDCStateCookieName, "state-of-the-victim", http.SameSiteLaxMode, oidcLoginTimeout)
+
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || !cookies[0].HttpOnly || cookies[0].SameSite != http.SameSiteLaxMode || cookies[0].Value == "state-of-the-victim" {
+		t.Fatalf("cookies = %+v, want one HttpOnly Lax cookie with the hash of the state", cookies)
+	}
+
+	tests := []struct {
+		name   string
+		cookie *http.Cookie
+		state  string
+		want   bool
+	}{
+		{"same browser", cookies[0], "state-of-the-victim", true},
+		{"other browser", nil, "state-of-the-victim", false},
+		{"state of another login", cookies[0], "state-of-the-attacker", false},
+		{"no state", cookies[0], "", false},
+		{"cookie holding the state itself", &http.Cookie{Name: OIDCStateCookieName, Value: "state-of-the-victim"}, "state-of-the-victim", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+			c.Request = httptest.NewRequest(http.MethodGet, "/callback", nil)
+			if test.cookie != nil {
+				c.Request.AddCookie(test.cookie)
+			}
+			if got := boundLogin(c, OIDCStateCookieName, test.state, http.SameSiteLaxMode); got != test.want {
+				t.Errorf("boundLogin() = %v, want %v", got, test.want)
+			}
+			// The cookie is single use
+			if expired := w.Result().Cookies(); len(expired) != 1 || expired[0].MaxAge >= 0 {
+				t.Errorf("cookies = %+v, want the cookie expired", expired)
+			}
+		})
+	}
+}
@@ -0,0 +1,160 @@
+package controller
+
+import (
+	"jwt/initializers"
+	"jwt/models"
+	"jwt/utils"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// CredentialError tells why a credential was rejected and with which HTTP status
+type CredentialError struct {
+	Status int    // http.StatusUnauthorized or http.StatusForbidden
+	Reason string // For the log, e.g. "Access token has expired"
+}
+
+func (e *CredentialError) Error() string {
+	if e.Status == http.StatusForbidden {
+		return "Forbidden: " + e.Reason
+	}
+	return "Unauthorized: " + e.Reason
+}
+
+// VerifyCredential resolves a JWT or personal access token to its user in the organization of the
+// route. Only the roles that count for the credential are kept: ended time-bound grants are dropped,
+// and for JWTs only the roles activated for the session remain. The session ID or the token scopes
+// are stored in the context.
+func VerifyCredential(c *gin.Context, tokenString string) (models.User, error) {
+	var user models.User
+	var err error
+	if strings.HasPrefix(tokenString, utils.AccessTokenPrefix) {
+		user, err = verifyAccessToken(c, tokenString)
+	} else {
+		user, err = verifyJWT(c, tokenString)
+	}
+	if err != nil {
+		return models.User{}, err
+	}
+	// Deactivation ends the credentials, also the ones issued before
+	if !user.Active {
+		return models.User{}, &CredentialError{http.StatusUnauthorized, "User is deactivated"}
+	}
+	// Time-bound roles end on time, also before the expiry job removed them
+	DropExpiredRoles(&user)
+
+	// Credentials only count in the organization of their user, an admin of one tenant is nobody in another
+	organization, _ := CurrentOrganization(c)
+	if user.OrganizationID != organization.ID {
+		return models.User{}, &CredentialError{http.StatusForbidden, "User belongs to another organization"}
+	}
+	return user, nil
+}
+
+// verifyJWT validates a JWT against the public key of the user it was issued for
+func verifyJWT(c *gin.Context, tokenString string) (models.User, error) {
+	// Decode the token to extract claims without validating
+	claims, _ := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
+		// We are not validating the token here; just decoding it
+		return nil, nil
+	})
+	if claims == nil {
+		return models.User{}, &CredentialError{http.StatusUnauthorized, "Malformed token"}
+	}
+
+	// Extract user ID from claims
+	userIDFloat, ok := claims.Claims.(jwt.MapClaims)["user_id"].(float64)
+	if !ok {
+		return models.User{}, &CredentialError{http.StatusUnauthorized, "Invalid user ID in claims"}
+	}
+	userID := uint(userIDFloat)
+
+	// Fetch the user along with the RSA public key and roles
+	var user models.User
+	if err := initializers.DBConn.Preload("RSAKey").Preload("Roles").First(&user, userID).Error; err != nil {
+		return models.User{}, &CredentialError{http.StatusUnauthorized, "User not found: " + err.Error()}
+	}
+
+	// Check if the user has a valid public key
+	if user.RSAKey.PublicKey == "" {
+		return models.User{}, &CredentialError{http.StatusUnauthorized, "User does not have a valid public key"}
+	}
+
+	// Validate the token using the user's public key
+	validatedClaims, err := ValidateJWT(tokenString, string(user.RSAKey.PublicKey)) // Validate with actual public key
+	if err != nil {
+		return models.User{}, &CredentialError{http.StatusUnauthorized, "Token validation with public key failed: " + err.Error()}
+	}
+
+	// Here, you can use the validatedClaims if needed
+	log.Println(validatedClaims.GetIssuer())
+	// For instance, you could log or check additional claims.
+
+	// The token has to be issued for the organization of the route with a key of that organization
+	orgClaim, _ := validatedClaims["org"].(string)
+	if orgClaim == "" {
+		return models.User{}, &CredentialError{http.StatusUnauthorized, "Token has no organization, it was issued before multi-tenancy"}
+	}
+	organization, _ := CurrentOrganization(c)
+	if orgClaim != organization.Name || user.RSAKey.OrganizationID != user.OrganizationID {
+		return models.User{}, &CredentialError{http.StatusForbidden, "Token was issued for another organization"}
+	}
+
+	// The token is only valid while its session is active
+	session, ok := ActiveSession(validatedClaims)
+	if !ok {
+		return models.User{}, &CredentialError{http.StatusUnauthorized, "Session of the token is revoked or unknown"}
+	}
+	initializers.DBConn.Model(&session).Update("last_seen_at", time.Now())
+	// Only the roles activated for the session count
+	ApplyRoleActivation(&user, session.Roles)
+
+	c.Set(SessionContextKey, session.ID)
+	return user, nil
+}
+
+// verifyAccessToken looks up a personal access token by its hash and checks its scopes
+func verifyAccessToken(c *gin.Context, tokenString string) (models.User, error) {
+	var token models.PersonalAccessToken
+	if err := initializers.DBConn.Where("token_hash = ?", utils.HashToken(tokenString)).First(&token).Error; err != nil {
+		return models.User{}, &CredentialError{http.StatusUnauthorized, "Unknown access token"}
+	}
+
+	if token.RevokedAt != nil {
+		return models.User{}, &CredentialError{http.StatusUnauthorized, "Access token has been revoked"}
+	}
+
+	now := time.Now()
+	if now.After(token.ExpiresAt) {
+		return models.User{}, &CredentialError{http.StatusUnauthorized, "Access token has expired"}
+	}
+
+	// Safe requests need the read scope, everything else needs the write scope. The admin scope
+	// includes both, so that a token with only the admin scope can use the admin routes.
+	required := "write"
+	if method := RequestMethod(c); method == http.MethodGet || method == http.MethodHead {
+		required = "read"
+	}
+	if !tokenHasScope(token.Scopes, required) {
+		return models.User{}, &CredentialError{http.StatusForbidden, "Access token does not have the " + required + " scope"}
+	}
+
+	// Fetch the owner of the token along with the roles
+	var user models.User
+	if err := initializers.DBConn.Preload("Roles").First(&user, token.UserID).Error; err != nil {
+		return models.User{}, &CredentialError{http.StatusUnauthorized, "User not found: " + err.Error()}
+	}
+
+	// Record the usage without touching the other columns
+	initializers.DBConn.Model(&token).Update("last_used_at", now)
+	// Roles conflicting under a dynamic constraint are never active for tokens
+	ApplyRoleActivation(&user, nil)
+
+	c.Set(ScopesContextKey, token.Scopes)
+	return user, nil
+}
@@ -0,0 +1,473 @@
+package controller
+
+import (
+	"errors"
+	"fmt"
+	"jwt/initializers"
+	"jwt/models"
+	"log"
+	"net/http"
+	"os"
+	"reflect"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// Status of an elevation or access request
+const (
+	RequestPending  = "pending"
+	RequestApproved = "approved"
+	RequestDenied   = "denied"
+)
+
+// grantExpiryInterval is how often the expiry job removes ended grants. Requests in between
+// already ignore them, see DropExpiredRoles.
+const grantExpiryInterval = time.Minute
+
+type RoleGrantData struct {
+	Role     string `json:"role" binding:"required"`
+	Duration string `json:"duration"` // e.g. "2h", permanent when empty
+	Reason   string `json:"reason"`
+}
+
+type ElevationData struct {
+	Role     string `json:"role" binding:"required"`
+	Duration string `json:"duration" binding:"required"` // e.g. "2h"
+	Reason   string `json:"reason" binding:"required"`
+}
+
+type ElevationDecisionData struct {
+	Note string `json:"note"`
+}
+
+// GrantRole handles giving a user a role, permanently or for a duration
+func GrantRole(c *gin.Context) {
+	var input RoleGrantData
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var expiresAt *time.Time
+	if input.Duration != "" {
+		duration, err := parseGrantDuration(input.Duration)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		end := time.Now().Add(duration)
+		expiresAt = &end
+	}
+
+	var user models.User
+	if err := tenantDB(c).First(&user, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+	var role models.Role
+	if err := tenantDB(c).Where("name = ?", input.Role).First(&role).Error; err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown role: " + input.Role})
+		return
+	}
+
+	admin, _ := CurrentUser(c)
+	err := initializers.DBConn.Transaction(func(tx *gorm.DB) error {
+		before, after, err := applyRoleGrant(tx, user.ID, role, &admin.ID, expiresAt, input.Reason)
+		if err != nil {
+			return err
+		}
+		if !reflect.DeepEqual(before, after) {
+			if err := recordAuditTx(tx, c, "user.update", "user", user.ID, before, after); err != nil {
+				return err
+			}
+		}
+		return recordAuditTx(tx, c, "role.grant", "user", user.ID, nil, gin.H{"role": role.Name, "expiresAt": expiresAt, "reason": input.Reason})
+	})
+	if respondWithRoleConflict(c, err) {
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to grant role: " + err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"userId": user.ID, "role": role.Name, "expiresAt": expiresAt})
+}
+
+// ListRoleGrants retrieves the roles of a user with who granted them and until when
+func ListRoleGrants(c *gin.Context) {
+	var user models.User
+	if err := tenantDB(c).First(&user, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+
+	var grants []struct {
+		models.UserRole
+		RoleName string
+	}
+	initializers.DBConn.Model(&models.UserRole{}).
+		Select("user_roles.*, roles.name AS role_name").
+		Joins("JOIN roles ON roles.id = user_roles.role_id").
+		Where("user_roles.user_id = ?", user.ID).
+		Order("roles.name").
+		Scan(&grants)
+
+	list := []gin.H{}
+	for _, grant := range grants {
+		list = append(list, gin.H{
+			"role":        grant.RoleName,
+			"grantedById": grant.GrantedByID,
+			"grantedAt":   grant.GrantedAt,
+			"expiresAt":   grant.ExpiresAt,
+			"reason":      grant.Reason,
+		})
+	}
+	c.JSON(http.StatusOK, gin.H{"grants": list})
+}
+
+// RequestElevation handles a user asking for a role for a limited time
+func RequestElevation(c *gin.Context) {
+	var input ElevationData
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	duration, err := parseGrantDuration(input.Duration)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	user, _ := CurrentUser(c)
+	var role models.Role
+	if err := tenantDB(c).Where("name = ?", input.Role).First(&role).Error; err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown role: " + input.Role})
+		return
+	}
+
+	var count int64
+	initializers.DBConn.Model(&models.UserRole{}).Where("user_id = ? AND role_id = ? AND expires_at IS NULL", user.ID, role.ID).Count(&count)
+	if count > 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "You already have the role " + role.Name})
+		return
+	}
+	initializers.DBConn.Model(&models.ElevationRequest{}).Where("user_id = ? AND role_id = ? AND status = ?", user.ID, role.ID, RequestPending).Count(&count)
+	if count > 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "A request for the role " + role.Name + " is already pending"})
+		return
+	}
+
+	request := models.ElevationRequest{
+		OrganizationID: user.OrganizationID,
+		UserID:         user.ID,
+		User:           user,
+		RoleID:         role.ID,
+		Role:           role,
+		Duration:       int64(duration / time.Second),
+		Reason:         input.Reason,
+		Status:         RequestPending,
+	}
+	err = initializers.DBConn.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Omit("User", "Role").Create(&request).Error; err != nil {
+			return err
+		}
+		return recordAuditTx(tx, c, "elevation.request", "elevation_request", request.ID, nil, elevationSnapshot(request))
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create request"})
+		return
+	}
+
+	c.JSON(http.StatusOK, elevationSnapshot(request))
+}
+
+// ListMyElevations retrieves the elevation requests of the current user
+func ListMyElevations(c *gin.Context) {
+	user, _ := CurrentUser(c)
+	listElevations(c, initializers.DBConn.Where("user_id = ?", user.ID))
+}
+
+// ListElevations retrieves the elevation requests of the organization, optionally filtered by status
+func ListElevations(c *gin.Context) {
+	db := tenantDB(c)
+	if status := c.Query("status"); status != "" {
+		db = db.Where("status = ?", status)
+	}
+	listElevations(c, db)
+}
+
+// ApproveElevation handles granting the requested role until the requested duration has passed.
+// Users cannot approve their own requests.
+func ApproveElevation(c *gin.Context) {
+	decideElevation(c, RequestApproved)
+}
+
+// DenyElevation handles rejecting an elevation request
+func DenyElevation(c *gin.Context) {
+	decideElevation(c, RequestDenied)
+}
+
+// decideElevation approves or denies a pending request of the organization
+func decideElevation(c *gin.Context, status string) {
+	var input ElevationDecisionData
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&input); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	var request models.ElevationRequest
+	if err := tenantDB(c).Preload("User").Preload("Role").First(&request, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Request not found"})
+		return
+	}
+	if request.Status != RequestPending {
+		c.JSON(http.StatusConflict, gin.H{"error": "Request is already " + request.Status})
+		return
+	}
+	admin, _ := CurrentUser(c)
+	if request.UserID == admin.ID {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Requests have to be decided by another admin"})
+		return
+	}
+
+	requestBefore := elevationSnapshot(request)
+	now := time.Now()
+	request.Status = status
+	request.DecidedByID = &admin.ID
+	request.DecidedAt = &now
+	request.DecisionNote = input.Note
+	if status == RequestApproved {
+		expiresAt := now.Add(time.Duration(request.Duration) * time.Second)
+		request.ExpiresAt = &expiresAt
+	}
+
+	err := initializers.DBConn.Transaction(func(tx *gorm.DB) error {
+		// Only one admin decides, a concurrent decision leaves no pending row to update
+		result := tx.Model(&models.ElevationRequest{}).Where("id = ? AND status = ?", request.ID, RequestPending).Updates(map[string]interface{}{
+			"status":        request.Status,
+			"decided_by_id": request.DecidedByID,
+			"decided_at":    request.DecidedAt,
+			"decision_note": request.DecisionNote,
+			"expires_at":    request.ExpiresAt,
+		})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return errRequestDecided
+		}
+		action := "elevation.deny"
+		if status == RequestApproved {
+			action = "elevation.approve"
+			before, after, err := applyRoleGrant(tx, request.UserID, request.Role, &admin.ID, request.ExpiresAt, request.Reason)
+			if err != nil {
+				return err
+			}
+			if !reflect.DeepEqual(before, after) {
+				if err := recordAuditTx(tx, c, "user.update", "user", request.UserID, before, after); err != nil {
+					return err
+				}
+			}
+		}
+		return recordAuditTx(tx, c, action, "elevation_request", request.ID, requestBefore, elevationSnapshot(request))
+	})
+	if errors.Is(err, errRequestDecided) {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+	if respondWithRoleConflict(c, err) {
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to decide request: " + err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, elevationSnapshot(request))
+}
+
+var errRequestDecided = errors.New("Request has already been decided")
+
+// applyRoleGrant grants the role inside the transaction and returns the user before and after.
+// A user.roles_changed event is written when the user did not have the role yet.
+func applyRoleGrant(tx *gorm.DB, userID uint, role models.Role, grantedBy *uint, expiresAt *time.Time, reason string) (gin.H, gin.H, error) {
+	var user models.User
+	if err := tx.Preload("Roles").Preload("Groups").First(&user, userID).Error; err != nil {
+		return nil, nil, err
+	}
+	before := userSnapshot(user)
+
+	added, err := grantRole(tx, userID, role.ID, grantedBy, expiresAt, reason)
+	if err != nil || !added {
+		return before, before, err
+	}
+
+	user.Roles = append(user.Roles, role)
+	after := userSnapshot(user)
+	sortSnapshotNames(before)
+	sortSnapshotNames(after)
+	err = enqueueEvent(tx, "user.roles_changed", gin.H{
+		"user":     after,
+		"oldRoles": before["roles"],
+		"newRoles": after["roles"],
+	})
+	return before, after, err
+}
+
+// grantRole creates the user_roles row of the grant and reports whether it is new. An existing
+// permanent grant stays, an existing time-bound grant is made permanent or extended.
+func grantRole(tx *gorm.DB, userID, roleID uint, grantedBy *uint, expiresAt *time.Time, reason string) (bool, error) {
+	var grant models.UserRole
+	if err := tx.Where("user_id = ? AND role_id = ?", userID, roleID).Limit(1).Find(&grant).Error; err != nil {
+		return false, err
+	}
+	if grant.UserID == 0 {
+		grant = models.UserRole{UserID: userID, RoleID: roleID, GrantedByID: grantedBy, ExpiresAt: expiresAt, Reason: reason}
+		return true, tx.Create(&grant).Error
+	}
+
+	if grant.ExpiresAt == nil || (expiresAt != nil && !expiresAt.After(*grant.ExpiresAt)) {
+		return false, nil
+	}
+	return false, tx.Model(&models.UserRole{}).Where("user_id = ? AND role_id = ?", userID, roleID).
+		Updates(map[string]interface{}{"granted_by_id": grantedBy, "expires_at": expiresAt, "reason": reason}).Error
+}
+
+// DropExpiredRoles removes the roles whose grant ended from the loaded roles of the user,
+// so they stop counting before the expiry job has deleted them
+func DropExpiredRoles(user *models.User) {
+	var expired []uint
+	initializers.DBConn.Model(&models.UserRole{}).Where("user_id = ? AND expires_at <= ?", user.ID, time.Now()).Pluck("role_id", &expired)
+	if len(expired) == 0 {
+		return
+	}
+
+	isExpired := map[uint]bool{}
+	for _, id := range expired {
+		isExpired[id] = true
+	}
+	roles := []models.Role{}
+	for _, role := range user.Roles {
+		if !isExpired[role.ID] {
+			roles = append(roles, role)
+		}
+	}
+	user.Roles = roles
+}
+
+// RunGrantExpiry removes ended time-bound grants every minute, forever
+func RunGrantExpiry() {
+	ticker := time.NewTicker(grantExpiryInterval)
+	defer ticker.Stop()
+	for ; true; <-ticker.C {
+		if err := ExpireRoleGrants(); err != nil {
+			log.Println("Failed to expire role grants:", err)
+		}
+	}
+}
+
+// ExpireRoleGrants deletes the grants that have ended. The sessions of the affected users are
+// revoked, since their tokens still list the roles. Users that fail are logged and retried on the next run.
+func ExpireRoleGrants() error {
+	now := time.Now()
+	var userIDs []uint
+	if err := initializers.DBConn.Model(&models.UserRole{}).Where("expires_at <= ?", now).Distinct().Pluck("user_id", &userIDs).Error; err != nil {
+		return err
+	}
+
+	for _, userID := range userIDs {
+		err := initializers.DBConn.Transaction(func(tx *gorm.DB) error {
+			var user models.User
+			if err := tx.Preload("Roles").Preload("Groups").First(&user, userID).Error; err != nil {
+				return err
+			}
+			before := userSnapshot(user)
+			if err := tx.Where("user_id = ? AND expires_at <= ?", userID, now).Delete(&models.UserRole{}).Error; err != nil {
+				return err
+			}
+			if err := tx.Model(&user).Association("Roles").Find(&user.Roles); err != nil {
+				return err
+			}
+			after := userSnapshot(user)
+			sortSnapshotNames(before)
+			sortSnapshotNames(after)
+			if err := enqueueEvent(tx, "user.roles_changed", gin.H{
+				"user":     after,
+				"oldRoles": before["roles"],
+				"newRoles": after["roles"],
+			}); err != nil {
+				return err
+			}
+			return appendAuditEvent(tx, models.AuditEvent{
+				Action:     "role.expire",
+				TargetType: "user",
+				TargetID:   fmt.Sprint(userID),
+				Before:     toJSON(before),
+				After:      toJSON(after),
+				Diff:       diffJSON(before, after),
+			})
+		})
+		if err != nil {
+			// One user that fails must not keep the grants of the others alive
+			log.Println("Failed to expire the role grants of user", userID, ":", err)
+			continue
+		}
+
+		if err := revokeSessions(userID, ""); err != nil {
+			log.Println("Failed to revoke sessions of user", userID, ":", err)
+		}
+	}
+	return nil
+}
+
+// parseGrantDuration parses the duration of a time-bound grant, which ELEVATION_MAX_DURATION limits (default 8h)
+func parseGrantDuration(value string) (time.Duration, error) {
+	duration, err := time.ParseDuration(value)
+	if err != nil || duration <= 0 {
+		return 0, errors.New("Invalid duration, use e.g. 30m or 2h: " + value)
+	}
+
+	maximum := 8 * time.Hour
+	if configured, err := time.ParseDuration(os.Getenv("ELEVATION_MAX_DURATION")); err == nil && configured > 0 {
+		maximum = configured
+	}
+	if duration > maximum {
+		return 0, errors.New("Duration exceeds the maximum of " + maximum.String())
+	}
+	return duration, nil
+}
+
+// listElevations responds with the requests of the query, newest first
+func listElevations(c *gin.Context, db *gorm.DB) {
+	var requests []models.ElevationRequest
+	db.Preload("User").Preload("Role").Order("id DESC").Find(&requests)
+
+	list := []gin.H{}
+	for _, request := range requests {
+		list = append(list, elevationSnapshot(request))
+	}
+	c.JSON(http.StatusOK, gin.H{"requests": list})
+}
+
+// elevationSnapshot describes an elevation request for responses and the audit log
+func elevationSnapshot(request models.ElevationRequest) gin.H {
+	return gin.H{
+		"id":           request.ID,
+		"userId":       request.UserID,
+		"username":     request.User.Name,
+		"role":         request.Role.Name,
+		"duration":     (time.Duration(request.Duration) * time.Second).String(),
+		"reason":       request.Reason,
+		"status":       request.Status,
+		"decidedById":  request.DecidedByID,
+		"decisionNote": request.DecisionNote,
+		"createdAt":    request.CreatedAt,
+		"decidedAt":    request.DecidedAt,
+		"expiresAt":    request.ExpiresAt,
+	}
+}
@@ -0,0 +1,83 @@
+package controller
+
+import (
+	"errors"
+	"fmt"
+	"jwt/initializers"
+	"jwt/models"
+	"jwt/utils"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+var usernameCleaner = regexp.MustCompile(`[^a-zA-Z0-9._-]+`)
+
+// provisionFederatedUser creates a user in the default organization for a first login through an
+// upstream identity provider, with the provider's default roles and groups. The random password is
+// never handed out.
+func provisionFederatedUser(email, preferredUsername string, defaultRoles, defaultGroups []string) (models.User, error) {
+	organization, err := defaultOrganization()
+	if err != nil {
+		return models.User{}, err
+	}
+	password, err := utils.GenerateRandomString(32)
+	if err != nil {
+		return models.User{}, err
+	}
+	hashedPassword, err := utils.HashPassword(password)
+	if err != nil {
+		return models.User{}, err
+	}
+
+	user := models.User{OrganizationID: organization.ID, Email: email, Password: hashedPassword}
+	if len(defaultRoles) > 0 {
+		initializers.DBConn.Where("organization_id = ? AND name IN ?", organization.ID, defaultRoles).Find(&user.Roles)
+	}
+	if len(defaultGroups) > 0 {
+		initializers.DBConn.Where("organization_id = ? AND name IN ?", organization.ID, defaultGroups).Find(&user.Groups)
+	}
+
+	// Usernames are unique within the organization, a taken one gets a number appended
+	base := federatedUsername(preferredUsername, email)
+	for i := 1; i <= 100; i++ {
+		user.Name = base
+		if i > 1 {
+			user.Name = fmt.Sprintf("%s%d", base, i)
+		}
+		var count int64
+		initializers.DBConn.Model(&models.User{}).Where("organization_id = ? AND name = ?", organization.ID, user.Name).Count(&count)
+		if count == 0 {
+			return user, saveNewUser(initializers.DBConn, &user)
+		}
+	}
+	return user, errors.New("no free username for " + base)
+}
+
+// federatedUsername picks a username from the name the provider suggests or the email
+func federatedUsername(preferredUsername, email string) string {
+	name := preferredUsername
+	if name == "" || strings.Contains(name, "@") {
+		name = strings.SplitN(email, "@", 2)[0]
+	}
+	name = strings.Trim(usernameCleaner.ReplaceAllString(name, "-"), "-")
+	if name == "" {
+		name = "user"
+	}
+	return name
+}
+
+// publicBaseURL is the URL of this service as seen by browsers and identity providers.
+// PUBLIC_BASE_URL sets it, otherwise it is derived from the request.
+func publicBaseURL(c *gin.Context) string {
+	if base := strings.TrimSuffix(os.Getenv("PUBLIC_BASE_URL"), "/"); base != "" {
+		return base
+	}
+	scheme := "http"
+	if c.Request.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + c.Request.Host
+}
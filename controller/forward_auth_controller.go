@@ -0,0 +1,121 @@
+package controller
+
+import (
+	"jwt/initializers"
+	"jwt/models"
+	"jwt/policy"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// VerifyAuth handles the forward-auth requests of reverse proxies like nginx (auth_request) and Traefik
+// (forwardAuth). The ForwardAuth middleware has authenticated the credential of the original request;
+// the query can add requirements for the route:
+//
+//	role=a,b          the user has one of the roles
+//	group=a,b         the user is a direct member of one of the groups
+//	scope=read        a personal access token has all of the scopes
+//	action=read&resource=user[&resourceId=12]   the policies allow the action
+//
+// It answers 200 with the identity in X-Auth-* headers for the proxy to pass on, or 403.
+func VerifyAuth(c *gin.Context) {
+	user, _ := CurrentUser(c)
+
+	roles := []string{}
+	for _, role := range user.Roles {
+		roles = append(roles, role.Name)
+	}
+	var memberships []models.Group
+	initializers.DBConn.Model(&user).Association("Groups").Find(&memberships)
+	groups := []string{}
+	for _, group := range memberships {
+		groups = append(groups, group.Name)
+	}
+
+	if required := queryList(c, "role"); len(required) > 0 && !containsAny(roles, required) {
+		forwardAuthDenied(c, "missing one of the roles "+strings.Join(required, ", "))
+		return
+	}
+	if required := queryList(c, "group"); len(required) > 0 && !containsAny(groups, required) {
+		forwardAuthDenied(c, "not a member of one of the groups "+strings.Join(required, ", "))
+		return
+	}
+	if scopes, isToken := CurrentScopes(c); isToken {
+		for _, required := range queryList(c, "scope") {
+			if !tokenHasScope(scopes, required) {
+				forwardAuthDenied(c, "token is missing the scope "+required)
+				return
+			}
+		}
+	}
+	if action, resourceType := c.Query("action"), c.Query("resource"); action != "" || resourceType != "" {
+		if action == "" || resourceType == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "action and resource are required together"})
+			return
+		}
+
+		// The policies see the original request, not the forward-auth one
+		context := requestContext(c)
+		context["method"] = RequestMethod(c)
+		context["path"], _, _ = strings.Cut(RequestURI(c), "?")
+		if host := c.GetHeader("X-Forwarded-Host"); host != "" {
+			context["host"] = host
+		}
+
+		decision := Policies.Evaluate(tenantID(c), policy.Request{
+			Action:       action,
+			ResourceType: resourceType,
+			Subject:      subjectAttributes(c, user),
+			Resource:     ResourceAttributes(c, resourceType, c.Query("resourceId")),
+			Context:      context,
+		})
+		if !decision.Allowed {
+			forwardAuthDenied(c, decision.Reason)
+			return
+		}
+	}
+
+	organization, _ := CurrentOrganization(c)
+	c.Header("X-Auth-User", user.Name)
+	c.Header("X-Auth-User-Id", strconv.FormatUint(uint64(user.ID), 10))
+	c.Header("X-Auth-Email", user.Email)
+	c.Header("X-Auth-Organization", organization.Name)
+	c.Header("X-Auth-Roles", strings.Join(roles, ","))
+	c.Header("X-Auth-Groups", strings.Join(groups, ","))
+	c.JSON(http.StatusOK, gin.H{"user": user.Name, "roles": roles, "groups": groups})
+}
+
+// forwardAuthDenied answers a forward-auth request whose user does not meet the requirements
+func forwardAuthDenied(c *gin.Context, reason string) {
+	log.Println("Forbidden: Forward auth for", RequestMethod(c), RequestURI(c)+":", reason)
+	c.JSON(http.StatusForbidden, gin.H{"error": "Access denied", "reason": reason})
+}
+
+// queryList collects the values of a query parameter, given repeatedly or separated by commas
+func queryList(c *gin.Context, name string) []string {
+	var values []string
+	for _, value := range c.QueryArray(name) {
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				values = append(values, item)
+			}
+		}
+	}
+	return values
+}
+
+// containsAny reports whether the values hold one of the wanted ones
+func containsAny(values, wanted []string) bool {
+	for _, value := range values {
+		for _, want := range wanted {
+			if value == want {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -16,10 +16,22 @@ func CreateGroup(c *gin.Context) {
 		return
 	}
 
+	// Groups are created in the organization of the route, whatever the body says
+	group.OrganizationID = tenantID(c)
+	if err := checkGroupReferences(group); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Group " + err.Error()})
+		return
+	}
+
 	if err := initializers.DBConn.Create(&group).Error; err != nil {
+		if respondWithRoleConflict(c, err) {
+			return
+		}
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
+
+	recordAudit(c, "group.create", "group", group.ID, nil, groupSnapshot(group))
 	c.JSON(http.StatusOK, group)
 }
 
@@ -28,7 +40,7 @@ func GetGroup(c *gin.Context) {
 	var group models.Group
 	id := c.Param("id")
 
-	if err := initializers.DBConn.Preload("Members").First(&group, id).Error; err != nil {
+	if err := tenantDB(c).Preload("Members").First(&group, id).Error; err != nil {
 		c.JSON(http.StatusNotFound, gin.H{"error": "Group not found"})
 		return
 	}
@@ -40,36 +52,75 @@ func UpdateGroup(c *gin.Context) {
 	var group models.Group
 	id := c.Param("id")
 
-	if err := initializers.DBConn.First(&group, id).Error; err != nil {
+	if err := tenantDB(c).First(&group, id).Error; err != nil {
 		c.JSON(http.StatusNotFound, gin.H{"error": "Group not found"})
 		return
 	}
 
+	before := groupSnapshot(group)
+	groupID := group.ID
+
 	if err := c.ShouldBindJSON(&group); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
-	initializers.DBConn.Save(&group)
+	// A group cannot be moved to another organization
+	group.ID = groupID
+	group.OrganizationID = tenantID(c)
+	if err := checkGroupReferences(group); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Group " + err.Error()})
+		return
+	}
+
+	if err := initializers.DBConn.Save(&group).Error; err != nil {
+		if respondWithRoleConflict(c, err) {
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	recordAudit(c, "group.update", "group", group.ID, before, groupSnapshot(group))
 	c.JSON(http.StatusOK, group)
 }
 
 // DeleteGroup handles deleting a group by ID
 func DeleteGroup(c *gin.Context) {
+	var group models.Group
 	id := c.Param("id")
 
-	if err := initializers.DBConn.Delete(&models.Group{}, id).Error; err != nil {
+	// Fetch the group for the audit log
+	if err := tenantDB(c).First(&group, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Group not found"})
+		return
+	}
+
+	if err := initializers.DBConn.Delete(&models.Group{}, group.ID).Error; err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
+	recordAudit(c, "group.delete", "group", group.ID, groupSnapshot(group), nil)
+
 	c.JSON(http.StatusOK, gin.H{"message": "Group deleted"})
 }
 
-// ListGroups retrieves all groups
+// ListGroups retrieves all groups of the organization
 func ListGroups(c *gin.Context) {
 	var groups []models.Group
 
-	initializers.DBConn.Preload("Members").Find(&groups)
+	tenantDB(c).Preload("Members").Find(&groups)
 	c.JSON(http.StatusOK, groups)
 }
+
+// checkGroupReferences makes sure the members and the parent of a group belong to its organization
+func checkGroupReferences(group models.Group) error {
+	var parents []models.Group
+	if group.ParentID != nil {
+		parents = append(parents, models.Group{ID: *group.ParentID})
+	}
+	if group.Parent != nil {
+		parents = append(parents, *group.Parent)
+	}
+	return checkTenantReferences(group.OrganizationID, group.Members, parents)
+}
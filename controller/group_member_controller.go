@@ -0,0 +1,265 @@
+package controller
+
+import (
+	"jwt/initializers"
+	"jwt/models"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Roles of a group manager, an owner can do everything a manager can
+const (
+	GroupRoleOwner   = "owner"
+	GroupRoleManager = "manager"
+)
+
+type GroupMemberData struct {
+	UserID uint `json:"userId" binding:"required"`
+}
+
+type GroupManagerData struct {
+	Role string `json:"role" binding:"required"` // "owner" or "manager"
+}
+
+// ListGroupMembers retrieves the members of a group, for admins and the group's managers
+func ListGroupMembers(c *gin.Context) {
+	group, ok := loadManagedGroup(c, GroupRoleManager)
+	if !ok {
+		return
+	}
+
+	var members []models.User
+	if err := initializers.DBConn.Model(&group).Association("Members").Find(&members); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve members"})
+		return
+	}
+
+	list := []gin.H{}
+	for _, member := range members {
+		list = append(list, gin.H{"id": member.ID, "username": member.Name, "email": member.Email})
+	}
+	c.JSON(http.StatusOK, gin.H{"members": list})
+}
+
+// AddGroupMember handles adding a user of the organization to a group
+func AddGroupMember(c *gin.Context) {
+	group, ok := loadManagedGroup(c, GroupRoleManager)
+	if !ok {
+		return
+	}
+
+	var input GroupMemberData
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var member models.User
+	if err := tenantDB(c).First(&member, input.UserID).Error; err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "User not found"})
+		return
+	}
+
+	if err := initializers.DBConn.Model(&group).Association("Members").Append(&member); err != nil {
+		if respondWithRoleConflict(c, err) {
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to add member"})
+		return
+	}
+
+	recordAudit(c, "group.member_add", "group", group.ID, nil, memberSnapshot(group, member))
+	c.JSON(http.StatusOK, gin.H{"message": "Member added"})
+}
+
+// RemoveGroupMember handles removing a user from a group
+func RemoveGroupMember(c *gin.Context) {
+	group, ok := loadManagedGroup(c, GroupRoleManager)
+	if !ok {
+		return
+	}
+
+	var member models.User
+	if err := initializers.DBConn.Model(&group).Association("Members").Find(&member, "users.id = ?", c.Param("userId")); err != nil || member.ID == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User is not a member of the group"})
+		return
+	}
+
+	if err := initializers.DBConn.Model(&group).Association("Members").Delete(&member); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to remove member"})
+		return
+	}
+
+	recordAudit(c, "group.member_remove", "group", group.ID, memberSnapshot(group, member), nil)
+	c.JSON(http.StatusOK, gin.H{"message": "Member removed"})
+}
+
+// ListGroupManagers retrieves the owners and managers appointed for a group
+func ListGroupManagers(c *gin.Context) {
+	group, ok := loadManagedGroup(c, GroupRoleManager)
+	if !ok {
+		return
+	}
+
+	var managers []models.GroupManager
+	initializers.DBConn.Preload("User").Where("group_id = ?", group.ID).Order("id").Find(&managers)
+
+	list := []gin.H{}
+	for _, manager := range managers {
+		list = append(list, gin.H{
+			"userId":    manager.UserID,
+			"username":  manager.User.Name,
+			"role":      manager.Role,
+			"createdAt": manager.CreatedAt,
+		})
+	}
+	c.JSON(http.StatusOK, gin.H{"managers": list})
+}
+
+// SetGroupManager handles appointing a user of the organization as owner or manager of a group.
+// Only admins and owners can appoint.
+func SetGroupManager(c *gin.Context) {
+	group, ok := loadManagedGroup(c, GroupRoleOwner)
+	if !ok {
+		return
+	}
+
+	var input GroupManagerData
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if input.Role != GroupRoleOwner && input.Role != GroupRoleManager {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid role, use owner or manager: " + input.Role})
+		return
+	}
+
+	var user models.User
+	if err := tenantDB(c).First(&user, c.Param("userId")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+
+	manager := models.GroupManager{GroupID: group.ID, UserID: user.ID}
+	initializers.DBConn.Where(&manager).First(&manager)
+	before := manager.Role
+	manager.Role = input.Role
+	if err := initializers.DBConn.Save(&manager).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save manager"})
+		return
+	}
+
+	var beforeSnapshot interface{}
+	if before != "" {
+		beforeSnapshot = gin.H{"groupId": group.ID, "userId": user.ID, "role": before}
+	}
+	recordAudit(c, "group.manager_set", "group", group.ID, beforeSnapshot, gin.H{"groupId": group.ID, "userId": user.ID, "role": manager.Role})
+	c.JSON(http.StatusOK, gin.H{"userId": user.ID, "username": user.Name, "role": manager.Role})
+}
+
+// RemoveGroupManager handles revoking the owner or manager role of a user for a group
+func RemoveGroupManager(c *gin.Context) {
+	group, ok := loadManagedGroup(c, GroupRoleOwner)
+	if !ok {
+		return
+	}
+
+	var manager models.GroupManager
+	if err := initializers.DBConn.Where("group_id = ? AND user_id = ?", group.ID, c.Param("userId")).First(&manager).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User is not a manager of the group"})
+		return
+	}
+
+	if err := initializers.DBConn.Delete(&manager).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to remove manager"})
+		return
+	}
+
+	recordAudit(c, "group.manager_remove", "group", group.ID, gin.H{"groupId": group.ID, "userId": manager.UserID, "role": manager.Role}, nil)
+	c.JSON(http.StatusOK, gin.H{"message": "Manager removed"})
+}
+
+// loadManagedGroup loads the group of the route and checks that the current user administers it
+// with at least the given role. It responds with 404 or 403 otherwise.
+func loadManagedGroup(c *gin.Context, required string) (models.Group, bool) {
+	var group models.Group
+	if err := tenantDB(c).First(&group, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Group not found"})
+		return group, false
+	}
+
+	user, _ := CurrentUser(c)
+	role := groupManagerRole(user.ID, group)
+	if !hasAdminRights(c) && role != GroupRoleOwner && role != required {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Access denied"})
+		return group, false
+	}
+	return group, true
+}
+
+// groupManagerRole returns the strongest role the user holds for the group or one of its parents,
+// or an empty string
+func groupManagerRole(userID uint, group models.Group) string {
+	var managers []models.GroupManager
+	initializers.DBConn.Where("user_id = ? AND group_id IN ?", userID, groupAncestorIDs(group)).Find(&managers)
+	role := ""
+	for _, manager := range managers {
+		if manager.Role == GroupRoleOwner {
+			return GroupRoleOwner
+		}
+		role = manager.Role
+	}
+	return role
+}
+
+// groupAncestorIDs returns the IDs of the group and its parents, stopping at a cycle
+func groupAncestorIDs(group models.Group) []uint {
+	ids := []uint{group.ID}
+	seen := map[uint]bool{group.ID: true}
+	for parentID := group.ParentID; parentID != nil && !seen[*parentID]; {
+		seen[*parentID] = true
+		ids = append(ids, *parentID)
+		var parent models.Group
+		if err := initializers.DBConn.Select("id", "parent_id").First(&parent, *parentID).Error; err != nil {
+			break
+		}
+		parentID = parent.ParentID
+	}
+	return ids
+}
+
+// hasAdminRights reports whether the current user has the admin role, and with a personal access
+// token also the admin scope, like the AdminRequired middleware demands
+func hasAdminRights(c *gin.Context) bool {
+	return hasRoleRights(c, "admin")
+}
+
+// hasRoleRights reports whether the current user has the role, and with a personal access token
+// also the admin scope
+func hasRoleRights(c *gin.Context, name string) bool {
+	user, ok := CurrentUser(c)
+	if !ok {
+		return false
+	}
+	if scopes, isToken := CurrentScopes(c); isToken {
+		hasScope := false
+		for _, scope := range scopes {
+			hasScope = hasScope || scope == "admin"
+		}
+		if !hasScope {
+			return false
+		}
+	}
+	for _, role := range user.Roles {
+		if role.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// memberSnapshot describes a group membership for the audit log
+func memberSnapshot(group models.Group, user models.User) gin.H {
+	return gin.H{"groupId": group.ID, "group": group.Name, "userId": user.ID, "username": user.Name}
+}
@@ -2,18 +2,28 @@ package controller
 
 import (
 	"crypto/rsa"
+	"crypto/sha256"
 	"crypto/x509"
+	"encoding/base64"
 	"encoding/pem"
 	"errors"
 	"fmt"
+	"jwt/initializers"
 	"jwt/models"
+	"math/big"
+	"net/http"
 	"time"
 
+	"github.com/gin-gonic/gin"
 	"github.com/golang-jwt/jwt/v5"
 )
 
-// GenerateJWT generates a JWT token for the user using RSA private key
-func GenerateJWT(user models.User, rsa models.RSAKeyPair) (string, error) {
+// TokenLifetime is how long an issued JWT stays valid
+const TokenLifetime = time.Hour * 72
+
+// GenerateJWT generates a JWT token for the user using RSA private key, tied to the given session.
+// user.Organization has to be loaded, its name goes into the "org" claim.
+func GenerateJWT(user models.User, rsa models.RSAKeyPair, sessionID uint) (string, error) {
 	privateKeyBlock, _ := pem.Decode([]byte(rsa.PrivateKey))
 	if privateKeyBlock == nil {
 		return "", errors.New("failed to decode PEM block containing private key")
@@ -28,9 +38,13 @@ func GenerateJWT(user models.User, rsa models.RSAKeyPair) (string, error) {
 		"email":    user.Email,
 		"roles":    user.Roles,
 		"groups":   user.Groups,
-		"exp":      time.Now().Add(time.Hour * 72).Unix(), // Token expires in 72 hours
+		"sid":      sessionID,
+		"org":      user.Organization.Name,
+		"exp":      time.Now().Add(TokenLifetime).Unix(), // Token expires in 72 hours
 	}
 	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	// Verifiers pick the key of the user from the JWKS by its ID
+	token.Header["kid"] = KeyID(&privateKey.PublicKey)
 	tokenString, err := token.SignedString(privateKey)
 	if err != nil {
 		return "", err
@@ -38,6 +52,58 @@ func GenerateJWT(user models.User, rsa models.RSAKeyPair) (string, error) {
 	return tokenString, nil
 }
 
+// KeyID returns the JWK thumbprint (RFC 7638) of an RSA public key, the "kid" of the JWTs it verifies
+func KeyID(key *rsa.PublicKey) string {
+	thumbprint := fmt.Sprintf(`{"e":"%s","kty":"RSA","n":"%s"}`,
+		base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		base64.RawURLEncoding.EncodeToString(key.N.Bytes()))
+	sum := sha256.Sum256([]byte(thumbprint))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// hasKeyID reports whether the header of a token names its key
+func hasKeyID(tokenString string) bool {
+	token, _, err := jwt.NewParser().ParseUnverified(tokenString, jwt.MapClaims{})
+	if err != nil {
+		return false
+	}
+	kid, _ := token.Header["kid"].(string)
+	return kid != ""
+}
+
+// JWKS retrieves the public keys of the organization's users as a JSON Web Key Set, for services
+// verifying the JWTs themselves, e.g. with the verifier package. Each key names its owner in
+// "user_id" and "org", verifiers reject tokens of other users signed with it.
+func JWKS(c *gin.Context) {
+	var pairs []models.RSAKeyPair
+	if err := initializers.DBConn.Select("public_key", "user_id").
+		Where("organization_id = ? AND is_active = ?", tenantID(c), true).Find(&pairs).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve keys"})
+		return
+	}
+	organization, _ := CurrentOrganization(c)
+
+	keys := []gin.H{}
+	for _, pair := range pairs {
+		key, err := jwt.ParseRSAPublicKeyFromPEM([]byte(pair.PublicKey))
+		if err != nil {
+			continue
+		}
+		keys = append(keys, gin.H{
+			"kty":     "RSA",
+			"use":     "sig",
+			"alg":     "RS256",
+			"kid":     KeyID(key),
+			"n":       base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":       base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			"user_id": pair.UserID,
+			"org":     organization.Name,
+		})
+	}
+	c.Header("Cache-Control", "public, max-age=300")
+	c.JSON(http.StatusOK, gin.H{"keys": keys})
+}
+
 // ParseJWT parses a JWT token and verifies it using the provided RSA public key.
 func ParseJWT(tokenString string, publicKeyPEM string) (jwt.MapClaims, error) {
 	// Parse the public key
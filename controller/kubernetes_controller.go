@@ -0,0 +1,144 @@
+package controller
+
+import (
+	"crypto/subtle"
+	"jwt/initializers"
+	"jwt/models"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Prefix of the user and group names Kubernetes reserves for itself
+const kubernetesReservedPrefix = "system:"
+
+// API versions of the authentication.k8s.io TokenReview the webhook understands
+var tokenReviewVersions = map[string]bool{
+	"authentication.k8s.io/v1":      true,
+	"authentication.k8s.io/v1beta1": true,
+}
+
+// TokenReviewData is the TokenReview the Kubernetes API server sends to a webhook token authenticator
+type TokenReviewData struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+	Spec       struct {
+		Token     string   `json:"token"`
+		Audiences []string `json:"audiences"`
+	} `json:"spec"`
+}
+
+// TokenReview handles the webhook token authentication of Kubernetes: the API server asks who the
+// bearer token of a kubectl request belongs to. The user's group and role names become the
+// Kubernetes groups, prefixed with K8S_GROUP_PREFIX and K8S_ROLE_PREFIX, so that cluster RBAC can be
+// bound to them. The API server has to send K8S_WEBHOOK_TOKEN as bearer token, without it the
+// webhook is off: anyone could otherwise find out who a token belongs to.
+func TokenReview(c *gin.Context) {
+	secret := os.Getenv("K8S_WEBHOOK_TOKEN")
+	if secret == "" {
+		log.Println("Refusing a TokenReview: set K8S_WEBHOOK_TOKEN to enable the Kubernetes webhook")
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "The Kubernetes webhook is not configured"})
+		return
+	}
+	if subtle.ConstantTimeCompare([]byte(c.GetHeader("Authorization")), []byte("Bearer "+secret)) != 1 {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	var review TokenReviewData
+	if err := c.ShouldBindJSON(&review); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if review.APIVersion == "" {
+		review.APIVersion = "authentication.k8s.io/v1"
+	}
+	if !tokenReviewVersions[review.APIVersion] || (review.Kind != "" && review.Kind != "TokenReview") {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Expected a TokenReview of authentication.k8s.io/v1 or v1beta1"})
+		return
+	}
+
+	response := gin.H{"apiVersion": review.APIVersion, "kind": "TokenReview"}
+	if review.Spec.Token == "" {
+		response["status"] = gin.H{"authenticated": false, "error": "No token"}
+		c.JSON(http.StatusOK, response)
+		return
+	}
+
+	user, err := VerifyCredential(c, review.Spec.Token)
+	if err != nil {
+		response["status"] = gin.H{"authenticated": false, "error": err.Error()}
+		c.JSON(http.StatusOK, response)
+		return
+	}
+	// Kubernetes reserves the system: names for its own components
+	if strings.HasPrefix(user.Name, kubernetesReservedPrefix) {
+		response["status"] = gin.H{"authenticated": false, "error": "The username is reserved by Kubernetes"}
+		c.JSON(http.StatusOK, response)
+		return
+	}
+
+	organization, _ := CurrentOrganization(c)
+	status := gin.H{
+		"authenticated": true,
+		"user": gin.H{
+			"username": user.Name,
+			"uid":      strconv.FormatUint(uint64(user.ID), 10),
+			"groups":   kubernetesGroups(user),
+			"extra": gin.H{
+				"organization": []string{organization.Name},
+				"email":        []string{user.Email},
+			},
+		},
+	}
+	// The tokens are not bound to an audience, they are good for whichever the API server asks for
+	if len(review.Spec.Audiences) > 0 {
+		status["audiences"] = review.Spec.Audiences
+	}
+	response["status"] = status
+	c.JSON(http.StatusOK, response)
+}
+
+// kubernetesGroups returns the Kubernetes groups of the user: the names of the groups the user is a
+// direct member of and of the roles that count for the token
+func kubernetesGroups(user models.User) []string {
+	var memberships []models.Group
+	initializers.DBConn.Model(&user).Association("Groups").Find(&memberships)
+
+	var groupNames, roleNames []string
+	for _, group := range memberships {
+		groupNames = append(groupNames, group.Name)
+	}
+	for _, role := range user.Roles {
+		roleNames = append(roleNames, role.Name)
+	}
+	return kubernetesGroupNames(groupNames, roleNames)
+}
+
+// kubernetesGroupNames prefixes the group and role names, with "group:" and "role:" unless
+// K8S_GROUP_PREFIX and K8S_ROLE_PREFIX say otherwise. Names in the system: namespace are left out,
+// a local group must not become e.g. system:masters.
+func kubernetesGroupNames(groupNames, roleNames []string) []string {
+	groupPrefix := envOrDefault("K8S_GROUP_PREFIX", "group:")
+	rolePrefix := envOrDefault("K8S_ROLE_PREFIX", "role:")
+
+	groups := []string{}
+	for _, name := range groupNames {
+		groups = append(groups, groupPrefix+name)
+	}
+	for _, name := range roleNames {
+		groups = append(groups, rolePrefix+name)
+	}
+
+	allowed := []string{}
+	for _, group := range uniqueStrings(groups) {
+		if !strings.HasPrefix(group, kubernetesReservedPrefix) {
+			allowed = append(allowed, group)
+		}
+	}
+	return allowed
+}
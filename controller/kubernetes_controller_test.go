@@ -0,0 +1,71 @@
+package controller
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestKubernetesGroupNames(t *testing.T) {
+	tests := []struct {
+		name        string
+		groupPrefix string
+		rolePrefix  string
+		groups      []string
+		roles       []string
+		want        []string
+	}{
+		{"default prefixes", "", "", []string{"finance"}, []string{"admin"}, []string{"group:finance", "role:admin"}},
+		{"configured prefixes", "acme:", "acme-role:", []string{"finance"}, []string{"admin"}, []string{"acme:finance", "acme-role:admin"}},
+		{"same name as group and role", "", "", []string{"admin"}, []string{"admin"}, []string{"group:admin", "role:admin"}},
+		{"reserved names", "system:", "", []string{"masters"}, []string{"admin"}, []string{"role:admin"}},
+		{"reserved prefix spelled out by the name", "", "", []string{"x"}, []string{"system:masters"}, []string{"group:x", "role:system:masters"}},
+		{"none", "", "", nil, nil, []string{}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv("K8S_GROUP_PREFIX", test.groupPrefix)
+			t.Setenv("K8S_ROLE_PREFIX", test.rolePrefix)
+			if got := kubernetesGroupNames(test.groups, test.roles); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("kubernetesGroupNames() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestTokenReviewNeedsTheWebhookToken(t *testing.T) {
+	tests := []struct {
+		name          string
+		secret        string
+		authorization string
+		want          int
+	}{
+		{"not configured", "", "", http.StatusServiceUnavailable},
+		{"not configured with any token", "", "Bearer ", http.StatusServiceUnavailable},
+		{"missing token", "webhook-secret", "", http.StatusUnauthorized},
+		{"wrong token", "webhook-secret", "Bearer other", http.StatusUnauthorized},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv("K8S_WEBHOOK_TOKEN", test.secret)
+			gin.SetMode(gin.TestMode)
+			r := gin.New()
+			r.POST("/k8s/tokenreview", TokenReview)
+
+			body := `{"apiVersion": "authentication.k8s.io/v1", "kind": "TokenReview", "spec": {"token": "x"}}`
+			req := httptest.NewRequest(http.MethodPost, "/k8s/tokenreview", strings.NewReader(body))
+			if test.authorization != "" {
+				req.Header.Set("Authorization", test.authorization)
+			}
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+			if w.Code != test.want {
+				t.Errorf("TokenReview() = %d %s, want %d", w.Code, w.Body, test.want)
+			}
+		})
+	}
+}
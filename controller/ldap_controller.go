@@ -0,0 +1,402 @@
+package controller
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"jwt/initializers"
+	"jwt/ldap"
+	"jwt/models"
+	"jwt/utils"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// LDAPConfig describes the directory to synchronise from and to authenticate against
+type LDAPConfig struct {
+	URL                string        // ldap:// or ldaps:// URL, LDAP is disabled when empty
+	BindDN             string        // Service account used for searches, anonymous when empty
+	BindPassword       string        // Password of the service account
+	UserBaseDN         string        // Subtree holding the users
+	UserFilter         string        // Filter selecting the users
+	UsernameAttribute  string        // Attribute mapped to User.Name
+	EmailAttribute     string        // Attribute mapped to User.Email
+	GroupBaseDN        string        // Subtree holding the groups, groups are not synchronised when empty
+	GroupFilter        string        // Filter selecting the groups
+	GroupNameAttribute string        // Attribute mapped to Group.Name
+	MemberAttribute    string        // Attribute listing the DNs of the members, users or nested groups
+	SyncInterval       time.Duration // Interval of the background sync, disabled when zero
+	BindAuth           bool          // Verify passwords of imported users with an LDAP bind instead of bcrypt
+	LinkByEmail        bool          // Link directory entries to local users with the same email, and their password to LDAP
+	InsecureSkipVerify bool          // Skip certificate verification for ldaps://
+}
+
+// Outcomes of synchronising one directory entry
+const (
+	ldapCreated   = "created"
+	ldapUpdated   = "updated"
+	ldapUnchanged = "unchanged"
+)
+
+// LDAPSyncResult counts what a sync changed
+type LDAPSyncResult struct {
+	UsersCreated   int      `json:"usersCreated"`
+	UsersUpdated   int      `json:"usersUpdated"`
+	GroupsCreated  int      `json:"groupsCreated"`
+	GroupsUpdated  int      `json:"groupsUpdated"`
+	GroupsNested   int      `json:"groupsNested"`
+	MembershipsSet int      `json:"membershipsSet"`
+	Skipped        []string `json:"skipped"` // DNs of entries that could not be imported, with the reason
+}
+
+// LoadLDAPConfig reads the LDAP settings from the environment
+func LoadLDAPConfig() LDAPConfig {
+	interval, _ := time.ParseDuration(os.Getenv("LDAP_SYNC_INTERVAL"))
+	return LDAPConfig{
+		URL:                os.Getenv("LDAP_URL"),
+		BindDN:             os.Getenv("LDAP_BIND_DN"),
+		BindPassword:       os.Getenv("LDAP_BIND_PASSWORD"),
+		UserBaseDN:         os.Getenv("LDAP_USER_BASE_DN"),
+		UserFilter:         envOrDefault("LDAP_USER_FILTER", "(objectClass=inetOrgPerson)"),
+		UsernameAttribute:  envOrDefault("LDAP_USERNAME_ATTR", "uid"),
+		EmailAttribute:     envOrDefault("LDAP_EMAIL_ATTR", "mail"),
+		GroupBaseDN:        os.Getenv("LDAP_GROUP_BASE_DN"),
+		GroupFilter:        envOrDefault("LDAP_GROUP_FILTER", "(objectClass=groupOfNames)"),
+		GroupNameAttribute: envOrDefault("LDAP_GROUP_NAME_ATTR", "cn"),
+		MemberAttribute:    envOrDefault("LDAP_MEMBER_ATTR", "member"),
+		SyncInterval:       interval,
+		BindAuth:           os.Getenv("LDAP_AUTH") == "true",
+		LinkByEmail:        os.Getenv("LDAP_LINK_BY_EMAIL") == "true",
+		InsecureSkipVerify: os.Getenv("LDAP_INSECURE_SKIP_VERIFY") == "true",
+	}
+}
+
+// envOrDefault returns the environment variable or the fallback when it is unset
+func envOrDefault(name, fallback string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return fallback
+}
+
+// dial opens a connection to the directory without binding
+func (cfg LDAPConfig) dial() (*ldap.Conn, error) {
+	if cfg.URL == "" {
+		return nil, errors.New("LDAP is not configured")
+	}
+	return ldap.Dial(cfg.URL, &tls.Config{InsecureSkipVerify: cfg.InsecureSkipVerify})
+}
+
+// ldapBind checks a password by binding as the user's DN on a fresh connection
+func ldapBind(cfg LDAPConfig, dn, password string) error {
+	conn, err := cfg.dial()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	return conn.Bind(dn, password)
+}
+
+// verifyPassword checks the password of a login. Users imported from the directory bind against it
+// when LDAP_AUTH is enabled, everyone else is checked against the bcrypt hash.
+// An error means the directory could not be asked, not that the password is wrong. Deactivated users
+// have no valid password.
+func verifyPassword(user models.User, password string) (bool, error) {
+	if !user.Active {
+		return false, nil
+	}
+	cfg := LoadLDAPConfig()
+	if !cfg.BindAuth || user.LDAPDN == "" {
+		return utils.CheckPasswordHash(user.Password, password), nil
+	}
+
+	err := ldapBind(cfg, user.LDAPDN, password)
+	if ldap.IsInvalidCredentials(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// SyncLDAP imports the users and groups of the directory.
+// Users are matched by DN, with LinkByEmail also by email to link an existing account, and are never
+// deleted. Groups are matched by DN only, a local group of the same name is left alone and the entry
+// skipped. Memberships of synchronised groups are replaced by the directory's, members that were not
+// imported from the directory are kept.
+// A group that is a member of another group gets that group as its parent, unless it has a local parent.
+// The directory is imported into the default organization.
+func SyncLDAP(cfg LDAPConfig) (LDAPSyncResult, error) {
+	result := LDAPSyncResult{Skipped: []string{}}
+
+	organization, err := defaultOrganization()
+	if err != nil {
+		return result, err
+	}
+
+	conn, err := cfg.dial()
+	if err != nil {
+		return result, err
+	}
+	defer conn.Close()
+	if cfg.BindDN != "" {
+		if err := conn.Bind(cfg.BindDN, cfg.BindPassword); err != nil {
+			return result, fmt.Errorf("service bind failed: %w", err)
+		}
+	}
+
+	userEntries, err := conn.Search(cfg.UserBaseDN, ldap.ScopeWholeSubtree, cfg.UserFilter,
+		[]string{cfg.UsernameAttribute, cfg.EmailAttribute})
+	if err != nil {
+		return result, fmt.Errorf("user search failed: %w", err)
+	}
+
+	// Users by normalised DN, for resolving group members
+	users := map[string]models.User{}
+	for _, entry := range userEntries {
+		user, change, err := syncLDAPUser(cfg, organization.ID, entry)
+		if err != nil {
+			result.Skipped = append(result.Skipped, entry.DN+": "+err.Error())
+			continue
+		}
+		switch change {
+		case ldapCreated:
+			result.UsersCreated++
+		case ldapUpdated:
+			result.UsersUpdated++
+		}
+		users[ldap.NormalizeDN(entry.DN)] = user
+	}
+
+	if cfg.GroupBaseDN == "" {
+		return result, nil
+	}
+
+	groupEntries, err := conn.Search(cfg.GroupBaseDN, ldap.ScopeWholeSubtree, cfg.GroupFilter,
+		[]string{cfg.GroupNameAttribute, cfg.MemberAttribute})
+	if err != nil {
+		return result, fmt.Errorf("group search failed: %w", err)
+	}
+
+	// Create or update all groups first, so nested groups can be resolved in any order
+	groups := map[string]models.Group{}
+	for _, entry := range groupEntries {
+		group, change, err := syncLDAPGroup(cfg, organization.ID, entry)
+		if err != nil {
+			result.Skipped = append(result.Skipped, entry.DN+": "+err.Error())
+			continue
+		}
+		switch change {
+		case ldapCreated:
+			result.GroupsCreated++
+		case ldapUpdated:
+			result.GroupsUpdated++
+		}
+		groups[ldap.NormalizeDN(entry.DN)] = group
+	}
+
+	for _, entry := range groupEntries {
+		group, ok := groups[ldap.NormalizeDN(entry.DN)]
+		if !ok {
+			continue
+		}
+
+		var members []models.User
+		for _, memberDN := range entry.GetAttributeValues(cfg.MemberAttribute) {
+			memberDN = ldap.NormalizeDN(memberDN)
+			if user, ok := users[memberDN]; ok {
+				members = append(members, user)
+				continue
+			}
+			// A group can only have one parent, the first group listing it wins
+			if child, ok := groups[memberDN]; ok && child.ParentID == nil && !isLDAPAncestor(groups, child.ID, group) {
+				child.ParentID = &group.ID
+				if err := initializers.DBConn.Model(&child).Update("parent_id", group.ID).Error; err != nil {
+					result.Skipped = append(result.Skipped, child.LDAPDN+": "+err.Error())
+					continue
+				}
+				groups[memberDN] = child
+				result.GroupsNested++
+			}
+		}
+
+		if err := replaceLDAPMembers(group, members); err != nil {
+			result.Skipped = append(result.Skipped, entry.DN+": "+err.Error())
+			continue
+		}
+		result.MembershipsSet += len(members)
+	}
+
+	return result, nil
+}
+
+// isLDAPAncestor reports whether the group with ancestorID is group itself or one of its parents,
+// nesting it below group would create a cycle
+func isLDAPAncestor(groups map[string]models.Group, ancestorID uint, group models.Group) bool {
+	for seen := 0; seen <= len(groups); seen++ {
+		if group.ID == ancestorID {
+			return true
+		}
+		if group.ParentID == nil {
+			return false
+		}
+		parentID := *group.ParentID
+		found := false
+		for _, candidate := range groups {
+			if candidate.ID == parentID {
+				group, found = candidate, true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// syncLDAPUser creates or updates the user of a directory entry in the organization
+func syncLDAPUser(cfg LDAPConfig, organizationID uint, entry ldap.Entry) (models.User, string, error) {
+	username := entry.GetAttributeValue(cfg.UsernameAttribute)
+	email := entry.GetAttributeValue(cfg.EmailAttribute)
+	if username == "" || email == "" {
+		return models.User{}, "", fmt.Errorf("missing %s or %s", cfg.UsernameAttribute, cfg.EmailAttribute)
+	}
+
+	var user models.User
+	err := initializers.DBConn.Where("organization_id = ? AND ldap_dn = ?", organizationID, entry.DN).First(&user).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		// Linking hands the password of the account to the directory with LDAP_AUTH, e.g. of a seeded admin
+		err = initializers.DBConn.Where("organization_id = ? AND email = ?", organizationID, email).First(&user).Error
+		if err == nil && !cfg.LinkByEmail {
+			return models.User{}, "", errors.New("a local user has this email, set LDAP_LINK_BY_EMAIL to link it")
+		}
+	}
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		// The local password is never used with LDAP_AUTH, without it the user has to set one
+		password, err := utils.GenerateRandomString(32)
+		if err != nil {
+			return user, "", err
+		}
+		hashedPassword, err := utils.HashPassword(password)
+		if err != nil {
+			return user, "", err
+		}
+		user = models.User{OrganizationID: organizationID, Name: username, Email: email, Password: hashedPassword, LDAPDN: entry.DN}
+		if err := saveNewUser(initializers.DBConn, &user); err != nil {
+			return user, "", err
+		}
+		return user, ldapCreated, nil
+	}
+	if err != nil {
+		return user, "", err
+	}
+
+	if user.Name == username && user.Email == email && user.LDAPDN == entry.DN {
+		return user, ldapUnchanged, nil
+	}
+	user.Name, user.Email, user.LDAPDN = username, email, entry.DN
+	err = initializers.DBConn.Model(&user).Updates(map[string]interface{}{
+		"name":    username,
+		"email":   email,
+		"ldap_dn": entry.DN,
+	}).Error
+	return user, ldapUpdated, err
+}
+
+// syncLDAPGroup creates or updates the group of a directory entry in the organization
+func syncLDAPGroup(cfg LDAPConfig, organizationID uint, entry ldap.Entry) (models.Group, string, error) {
+	name := entry.GetAttributeValue(cfg.GroupNameAttribute)
+	if name == "" {
+		return models.Group{}, "", fmt.Errorf("missing %s", cfg.GroupNameAttribute)
+	}
+
+	var group models.Group
+	err := initializers.DBConn.Preload("Parent").Where("organization_id = ? AND ldap_dn = ?", organizationID, entry.DN).First(&group).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		// Local groups, e.g. the seeded admin group, are never taken over by the directory
+		var local int64
+		initializers.DBConn.Model(&models.Group{}).Where("organization_id = ? AND name = ?", organizationID, name).Count(&local)
+		if local > 0 {
+			return models.Group{}, "", errors.New("a local group has this name")
+		}
+		group = models.Group{OrganizationID: organizationID, Name: name, LDAPDN: entry.DN}
+		return group, ldapCreated, initializers.DBConn.Create(&group).Error
+	}
+	if err != nil {
+		return group, "", err
+	}
+
+	updates := map[string]interface{}{"name": name}
+	change := ldapUnchanged
+	if group.Name != name {
+		change = ldapUpdated
+	}
+	// Nesting below directory groups is derived from the directory on every run, it is set again while
+	// resolving members. A parent chosen locally stays.
+	if group.Parent != nil && group.Parent.LDAPDN != "" {
+		updates["parent_id"] = nil
+		group.ParentID = nil
+	}
+	group.Name, group.Parent = name, nil
+	return group, change, initializers.DBConn.Model(&group).Updates(updates).Error
+}
+
+// replaceLDAPMembers sets the directory members of a group and keeps its local members
+func replaceLDAPMembers(group models.Group, members []models.User) error {
+	return initializers.DBConn.Transaction(func(tx *gorm.DB) error {
+		var local []models.User
+		if err := tx.Model(&group).Association("Members").Find(&local, "ldap_dn = ? OR ldap_dn IS NULL", ""); err != nil {
+			return err
+		}
+		return tx.Model(&group).Association("Members").Replace(append(local, members...))
+	})
+}
+
+// RunLDAPSync synchronises the directory every LDAP_SYNC_INTERVAL, forever.
+// It returns immediately when LDAP or the interval is not configured.
+func RunLDAPSync() {
+	cfg := LoadLDAPConfig()
+	if cfg.URL == "" || cfg.SyncInterval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(cfg.SyncInterval)
+	defer ticker.Stop()
+	for ; true; <-ticker.C {
+		result, err := SyncLDAP(cfg)
+		if err != nil {
+			log.Println("LDAP sync failed:", err)
+			continue
+		}
+		event := models.AuditEvent{Action: "ldap.sync", TargetType: "ldap", TargetID: cfg.URL, After: toJSON(result)}
+		if err := appendAuditEvent(initializers.DBConn, event); err != nil {
+			log.Println("Failed to write audit event ldap.sync:", err)
+		}
+	}
+}
+
+// TriggerLDAPSync handles running the directory sync on demand
+func TriggerLDAPSync(c *gin.Context) {
+	cfg := LoadLDAPConfig()
+	if cfg.URL == "" {
+		c.JSON(http.StatusNotFound, gin.H{"error": "LDAP is not configured"})
+		return
+	}
+
+	result, err := SyncLDAP(cfg)
+	if err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": "LDAP sync failed: " + strings.TrimPrefix(err.Error(), "ldap: ")})
+		return
+	}
+
+	recordAudit(c, "ldap.sync", "ldap", cfg.URL, nil, result)
+	c.JSON(http.StatusOK, result)
+}
@@ -0,0 +1,243 @@
+package controller
+
+import (
+	"jwt/initializers"
+	"jwt/initializers/dbtest"
+	"jwt/ldap"
+	"jwt/ldap/ldaptest"
+	"jwt/models"
+	"jwt/utils"
+	"strings"
+	"testing"
+)
+
+// newTestDirectory starts a directory with two people, one of them using the email of a local
+// account, and groups named ops, oncall (nested in ops) and admin (like the seeded local group)
+func newTestDirectory(t *testing.T) (*ldaptest.Server, LDAPConfig) {
+	t.Helper()
+	server, err := ldaptest.NewServer(
+		ldaptest.Entry("uid=jdoe,ou=people,dc=example,dc=org",
+			"objectClass", "inetOrgPerson", "uid", "jdoe", "mail", "jdoe@example.org", "userPassword", "secret"),
+		ldaptest.Entry("uid=asmith,ou=people,dc=example,dc=org",
+			"objectClass", "inetOrgPerson", "uid", "asmith", "mail", "asmith@example.org", "userPassword", "hunter2"),
+		ldaptest.Entry("uid=root,ou=people,dc=example,dc=org",
+			"objectClass", "inetOrgPerson", "uid", "root", "mail", "admin@example.org", "userPassword", "toor"),
+		ldaptest.Entry("cn=ops,ou=groups,dc=example,dc=org",
+			"objectClass", "groupOfNames", "cn", "ops",
+			"member", "uid=jdoe,ou=people,dc=example,dc=org", "member", "cn=oncall,ou=groups,dc=example,dc=org"),
+		ldaptest.Entry("cn=oncall,ou=groups,dc=example,dc=org",
+			"objectClass", "groupOfNames", "cn", "oncall", "member", "uid=asmith,ou=people,dc=example,dc=org"),
+		ldaptest.Entry("cn=admin,ou=groups,dc=example,dc=org",
+			"objectClass", "groupOfNames", "cn", "admin", "member", "uid=jdoe,ou=people,dc=example,dc=org"),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { server.Close() })
+
+	cfg := LDAPConfig{
+		URL:                server.URL(),
+		UserBaseDN:         "ou=people,dc=example,dc=org",
+		UserFilter:         "(objectClass=inetOrgPerson)",
+		UsernameAttribute:  "uid",
+		EmailAttribute:     "mail",
+		GroupBaseDN:        "ou=groups,dc=example,dc=org",
+		GroupFilter:        "(objectClass=groupOfNames)",
+		GroupNameAttribute: "cn",
+		MemberAttribute:    "member",
+	}
+	return server, cfg
+}
+
+func TestVerifyPasswordWithLDAPBind(t *testing.T) {
+	server, _ := newTestDirectory(t)
+	t.Setenv("LDAP_URL", server.URL())
+	t.Setenv("LDAP_AUTH", "true")
+
+	hash, err := utils.HashPassword("local")
+	if err != nil {
+		t.Fatal(err)
+	}
+	imported := models.User{Active: true, Password: hash, LDAPDN: "uid=jdoe,ou=people,dc=example,dc=org"}
+	local := models.User{Active: true, Password: hash}
+	deactivated := imported
+	deactivated.Active = false
+
+	tests := []struct {
+		name     string
+		user     models.User
+		password string
+		want     bool
+	}{
+		{"directory password", imported, "secret", true},
+		{"wrong directory password", imported, "hunter2", false},
+		{"local password of an imported user", imported, "local", false},
+		{"local user", local, "local", true},
+		{"local user with the directory password", local, "secret", false},
+		{"deactivated user", deactivated, "secret", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := verifyPassword(test.user, test.password)
+			if err != nil {
+				t.Fatalf("verifyPassword() error = %v", err)
+			}
+			if got != test.want {
+				t.Errorf("verifyPassword() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestVerifyPasswordDirectoryUnavailable(t *testing.T) {
+	server, _ := newTestDirectory(t)
+	t.Setenv("LDAP_URL", server.URL())
+	t.Setenv("LDAP_AUTH", "true")
+	server.Close()
+
+	_, err := verifyPassword(models.User{Active: true, LDAPDN: "uid=jdoe,ou=people,dc=example,dc=org"}, "secret")
+	if err == nil {
+		t.Fatal("verifyPassword() without a directory succeeded, want an error")
+	}
+}
+
+func TestSyncLDAP(t *testing.T) {
+	dbtest.Open(t)
+	_, cfg := newTestDirectory(t)
+	organization, err := defaultOrganization()
+	if err != nil {
+		t.Fatal(err)
+	}
+	admin := createTestUser(t, organization.ID, "admin", "admin@example.org")
+
+	result, err := SyncLDAP(cfg)
+	if err != nil {
+		t.Fatalf("SyncLDAP() = %v", err)
+	}
+	if result.UsersCreated != 2 || result.GroupsCreated != 2 || result.GroupsNested != 1 {
+		t.Errorf("result = %+v, want 2 users, 2 groups and 1 nesting", result)
+	}
+	assertSkipped(t, result, "uid=root,ou=people,dc=example,dc=org", "cn=admin,ou=groups,dc=example,dc=org")
+
+	// The local account and the seeded group are not taken over
+	if user := findUser(t, "admin@example.org"); user.LDAPDN != "" || user.ID != admin.ID {
+		t.Errorf("local admin was linked to %q", user.LDAPDN)
+	}
+	adminGroup := findGroup(t, "admin")
+	if adminGroup.LDAPDN != "" {
+		t.Errorf("local admin group was linked to %q", adminGroup.LDAPDN)
+	}
+	if members := groupMemberNames(t, adminGroup); len(members) != 0 {
+		t.Errorf("local admin group members = %v, want none", members)
+	}
+
+	ops, oncall := findGroup(t, "ops"), findGroup(t, "oncall")
+	if oncall.ParentID == nil || *oncall.ParentID != ops.ID {
+		t.Errorf("oncall parent = %v, want ops (%d)", oncall.ParentID, ops.ID)
+	}
+	if members := groupMemberNames(t, ops); len(members) != 1 || members[0] != "jdoe" {
+		t.Errorf("ops members = %v, want [jdoe]", members)
+	}
+
+	// A parent chosen locally survives the next run
+	platform := models.Group{OrganizationID: organization.ID, Name: "platform"}
+	if err := initializers.DBConn.Create(&platform).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := initializers.DBConn.Model(&ops).Update("parent_id", platform.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+	result, err = SyncLDAP(cfg)
+	if err != nil {
+		t.Fatalf("second SyncLDAP() = %v", err)
+	}
+	if result.UsersCreated != 0 || result.GroupsCreated != 0 {
+		t.Errorf("second result = %+v, want nothing created", result)
+	}
+	if ops = findGroup(t, "ops"); ops.ParentID == nil || *ops.ParentID != platform.ID {
+		t.Errorf("ops parent = %v, want the local platform group (%d)", ops.ParentID, platform.ID)
+	}
+	if oncall = findGroup(t, "oncall"); oncall.ParentID == nil || *oncall.ParentID != ops.ID {
+		t.Errorf("oncall parent after the second run = %v, want ops (%d)", oncall.ParentID, ops.ID)
+	}
+}
+
+func TestSyncLDAPLinkByEmail(t *testing.T) {
+	dbtest.Open(t)
+	_, cfg := newTestDirectory(t)
+	cfg.LinkByEmail = true
+	organization, err := defaultOrganization()
+	if err != nil {
+		t.Fatal(err)
+	}
+	admin := createTestUser(t, organization.ID, "admin", "admin@example.org")
+
+	result, err := SyncLDAP(cfg)
+	if err != nil {
+		t.Fatalf("SyncLDAP() = %v", err)
+	}
+	if result.UsersCreated != 2 || result.UsersUpdated != 1 {
+		t.Errorf("result = %+v, want 2 users created and 1 linked", result)
+	}
+	user := findUser(t, "admin@example.org")
+	if user.ID != admin.ID || user.LDAPDN != "uid=root,ou=people,dc=example,dc=org" {
+		t.Errorf("local admin = %d linked to %q, want it linked to the root entry", user.ID, user.LDAPDN)
+	}
+}
+
+func createTestUser(t *testing.T, organizationID uint, name, email string) models.User {
+	t.Helper()
+	hash, err := utils.HashPassword("password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	user := models.User{OrganizationID: organizationID, Name: name, Email: email, Password: hash}
+	if err := saveNewUser(initializers.DBConn, &user); err != nil {
+		t.Fatal(err)
+	}
+	return user
+}
+
+func findUser(t *testing.T, email string) models.User {
+	t.Helper()
+	var user models.User
+	if err := initializers.DBConn.Where("email = ?", email).First(&user).Error; err != nil {
+		t.Fatalf("user %s: %v", email, err)
+	}
+	return user
+}
+
+func findGroup(t *testing.T, name string) models.Group {
+	t.Helper()
+	var group models.Group
+	if err := initializers.DBConn.Where("name = ?", name).First(&group).Error; err != nil {
+		t.Fatalf("group %s: %v", name, err)
+	}
+	return group
+}
+
+func groupMemberNames(t *testing.T, group models.Group) []string {
+	t.Helper()
+	var members []models.User
+	if err := initializers.DBConn.Model(&group).Association("Members").Find(&members); err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, member := range members {
+		names = append(names, member.Name)
+	}
+	return names
+}
+
+func assertSkipped(t *testing.T, result LDAPSyncResult, dns ...string) {
+	t.Helper()
+	for _, dn := range dns {
+		found := false
+		for _, skipped := range result.Skipped {
+			found = found || strings.HasPrefix(ldap.NormalizeDN(skipped), ldap.NormalizeDN(dn)+":")
+		}
+		if !found {
+			t.Errorf("skipped = %v, want %s among them", result.Skipped, dn)
+		}
+	}
+}
@@ -0,0 +1,383 @@
+package controller
+
+import (
+	"errors"
+	"fmt"
+	"jwt/initializers"
+	"jwt/models"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// Membership operations: add keeps the current memberships, remove only drops the named ones
+// and replace sets exactly the named ones, an empty list removes all
+const (
+	MembershipAdd     = "add"
+	MembershipRemove  = "remove"
+	MembershipReplace = "replace"
+)
+
+type MembershipData struct {
+	Roles  []string `json:"roles"`
+	Groups []string `json:"groups"`
+}
+
+// MembershipOperation changes the roles or groups of a user, or the groups of a role
+type MembershipOperation struct {
+	Op     string   `json:"op"`     // "add", "remove" or "replace"
+	UserID uint     `json:"userId"` // User to change, or
+	RoleID uint     `json:"roleId"` // role to change
+	Roles  []string `json:"roles"`  // Role names, only for users
+	Groups []string `json:"groups"` // Group names
+}
+
+type MembershipBatchData struct {
+	Operations []MembershipOperation `json:"operations" binding:"required"`
+}
+
+// membershipError is a failed membership operation with the response status to use
+type membershipError struct {
+	status  int
+	message string
+	unknown []string // Names that do not exist in the organization
+}
+
+func (e membershipError) Error() string { return e.message }
+
+// membershipAudit is an audit entry of a membership change, written once the transaction committed
+type membershipAudit struct {
+	targetType string
+	targetID   uint
+	before     gin.H
+	after      gin.H
+}
+
+// UpdateUserRoles handles adding (POST), removing (DELETE) or replacing (PUT) roles of a user by name
+func UpdateUserRoles(c *gin.Context) {
+	var input MembershipData
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	applyMembershipOperations(c, []MembershipOperation{{Op: membershipOpOfMethod(c), UserID: parseID(c.Param("id")), Roles: nonNil(input.Roles)}})
+}
+
+// UpdateUserGroups handles adding (POST), removing (DELETE) or replacing (PUT) groups of a user by name
+func UpdateUserGroups(c *gin.Context) {
+	var input MembershipData
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	applyMembershipOperations(c, []MembershipOperation{{Op: membershipOpOfMethod(c), UserID: parseID(c.Param("id")), Groups: nonNil(input.Groups)}})
+}
+
+// UpdateRoleGroups handles adding (POST), removing (DELETE) or replacing (PUT) groups of a role by name
+func UpdateRoleGroups(c *gin.Context) {
+	var input MembershipData
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	applyMembershipOperations(c, []MembershipOperation{{Op: membershipOpOfMethod(c), RoleID: parseID(c.Param("id")), Groups: nonNil(input.Groups)}})
+}
+
+// ApplyMemberships handles a batch of membership operations, all of them are applied or none
+func ApplyMemberships(c *gin.Context) {
+	var input MembershipBatchData
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	applyMembershipOperations(c, input.Operations)
+}
+
+// applyMembershipOperations runs the operations in one transaction and responds with the changed
+// users and roles, or with the error of the first failed operation
+func applyMembershipOperations(c *gin.Context, operations []MembershipOperation) {
+	var audits []membershipAudit
+	err := initializers.DBConn.Transaction(func(tx *gorm.DB) error {
+		for i, operation := range operations {
+			audit, err := applyMembershipOperation(tx, tenantID(c), operation)
+			if err != nil {
+				var failed membershipError
+				if len(operations) > 1 && errors.As(err, &failed) {
+					failed.message = fmt.Sprintf("Operation %d: %s", i+1, failed.message)
+					return failed
+				}
+				return err
+			}
+			audits = append(audits, audit)
+		}
+		for _, audit := range audits {
+			if reflect.DeepEqual(audit.before, audit.after) {
+				continue
+			}
+			if err := recordAuditTx(tx, c, audit.targetType+".update", audit.targetType, audit.targetID, audit.before, audit.after); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	var failed membershipError
+	if errors.As(err, &failed) {
+		response := gin.H{"error": failed.message}
+		if len(failed.unknown) > 0 {
+			response["unknown"] = failed.unknown
+		}
+		c.JSON(failed.status, response)
+		return
+	}
+	if respondWithRoleConflict(c, err) {
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to change memberships: " + err.Error()})
+		return
+	}
+
+	results := []gin.H{}
+	for _, audit := range audits {
+		results = append(results, audit.after)
+	}
+	if len(operations) == 1 {
+		c.JSON(http.StatusOK, results[0])
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"results": results})
+}
+
+// applyMembershipOperation applies one operation inside the transaction
+func applyMembershipOperation(tx *gorm.DB, organizationID uint, operation MembershipOperation) (membershipAudit, error) {
+	if operation.Op != MembershipAdd && operation.Op != MembershipRemove && operation.Op != MembershipReplace {
+		return membershipAudit{}, membershipError{status: http.StatusBadRequest, message: "Invalid op, use add, remove or replace: " + operation.Op}
+	}
+	if (operation.UserID == 0) == (operation.RoleID == 0) {
+		return membershipAudit{}, membershipError{status: http.StatusBadRequest, message: "Exactly one of userId and roleId is required"}
+	}
+	if operation.RoleID != 0 {
+		if operation.Roles != nil {
+			return membershipAudit{}, membershipError{status: http.StatusBadRequest, message: "Roles can only be given to users, not to roles"}
+		}
+		return applyRoleGroups(tx, organizationID, operation)
+	}
+	if operation.Roles == nil && operation.Groups == nil {
+		return membershipAudit{}, membershipError{status: http.StatusBadRequest, message: "roles or groups are required"}
+	}
+
+	var user models.User
+	if err := tx.Where("organization_id = ?", organizationID).Preload("Roles").Preload("Groups").First(&user, operation.UserID).Error; err != nil {
+		return membershipAudit{}, membershipError{status: http.StatusNotFound, message: fmt.Sprintf("User %d not found", operation.UserID)}
+	}
+	before := userSnapshot(user)
+
+	if operation.Roles != nil {
+		roles, err := findRolesByName(tx, organizationID, operation.Roles)
+		if err != nil {
+			return membershipAudit{}, err
+		}
+		user.Roles = mergeRoles(user.Roles, roles, operation.Op)
+		if err := tx.Model(&user).Association("Roles").Replace(user.Roles); err != nil {
+			return membershipAudit{}, err
+		}
+	}
+	if operation.Groups != nil {
+		groups, err := findGroupsByName(tx, organizationID, operation.Groups)
+		if err != nil {
+			return membershipAudit{}, err
+		}
+		user.Groups = mergeGroups(user.Groups, groups, operation.Op)
+		if err := tx.Model(&user).Association("Groups").Replace(user.Groups); err != nil {
+			return membershipAudit{}, err
+		}
+	}
+
+	after := userSnapshot(user)
+	sortSnapshotNames(before)
+	sortSnapshotNames(after)
+	if !reflect.DeepEqual(before["roles"], after["roles"]) {
+		err := enqueueEvent(tx, "user.roles_changed", gin.H{
+			"user":     after,
+			"oldRoles": before["roles"],
+			"newRoles": after["roles"],
+		})
+		if err != nil {
+			return membershipAudit{}, err
+		}
+	}
+	return membershipAudit{targetType: "user", targetID: user.ID, before: before, after: after}, nil
+}
+
+// applyRoleGroups changes the groups of a role
+func applyRoleGroups(tx *gorm.DB, organizationID uint, operation MembershipOperation) (membershipAudit, error) {
+	var role models.Role
+	if err := tx.Where("organization_id = ?", organizationID).Preload("Groups").First(&role, operation.RoleID).Error; err != nil {
+		return membershipAudit{}, membershipError{status: http.StatusNotFound, message: fmt.Sprintf("Role %d not found", operation.RoleID)}
+	}
+	before := roleGroupsSnapshot(role)
+
+	groups, err := findGroupsByName(tx, organizationID, nonNil(operation.Groups))
+	if err != nil {
+		return membershipAudit{}, err
+	}
+	role.Groups = mergeGroups(role.Groups, groups, operation.Op)
+	if err := tx.Model(&role).Association("Groups").Replace(role.Groups); err != nil {
+		return membershipAudit{}, err
+	}
+
+	after := roleGroupsSnapshot(role)
+	if !reflect.DeepEqual(before, after) {
+		if err := enqueueEvent(tx, "role.updated", gin.H{"before": before, "after": after}); err != nil {
+			return membershipAudit{}, err
+		}
+	}
+	return membershipAudit{targetType: "role", targetID: role.ID, before: before, after: after}, nil
+}
+
+// findRolesByName loads the roles of the organization with the given names, failing with all unknown names
+func findRolesByName(tx *gorm.DB, organizationID uint, names []string) ([]models.Role, error) {
+	var roles []models.Role
+	if len(names) == 0 {
+		return roles, nil
+	}
+	if err := tx.Where("organization_id = ? AND name IN ?", organizationID, names).Find(&roles).Error; err != nil {
+		return nil, err
+	}
+	found := map[string]bool{}
+	for _, role := range roles {
+		found[role.Name] = true
+	}
+	return roles, unknownNames("role", names, found)
+}
+
+// findGroupsByName loads the groups of the organization with the given names, failing with all unknown names
+func findGroupsByName(tx *gorm.DB, organizationID uint, names []string) ([]models.Group, error) {
+	var groups []models.Group
+	if len(names) == 0 {
+		return groups, nil
+	}
+	if err := tx.Where("organization_id = ? AND name IN ?", organizationID, names).Find(&groups).Error; err != nil {
+		return nil, err
+	}
+	found := map[string]bool{}
+	for _, group := range groups {
+		found[group.Name] = true
+	}
+	return groups, unknownNames("group", names, found)
+}
+
+// unknownNames returns a membershipError listing the names that were not found, or nil
+func unknownNames(kind string, names []string, found map[string]bool) error {
+	var unknown []string
+	for _, name := range uniqueStrings(names) {
+		if !found[name] {
+			unknown = append(unknown, name)
+		}
+	}
+	if len(unknown) == 0 {
+		return nil
+	}
+	return membershipError{
+		status:  http.StatusBadRequest,
+		message: "Unknown " + kind + " names: " + strings.Join(unknown, ", "),
+		unknown: unknown,
+	}
+}
+
+// mergeRoles applies a membership operation to the current roles
+func mergeRoles(current, changes []models.Role, op string) []models.Role {
+	changed := map[uint]bool{}
+	for _, role := range changes {
+		changed[role.ID] = true
+	}
+	result := []models.Role{}
+	if op != MembershipReplace {
+		for _, role := range current {
+			if op == MembershipAdd || !changed[role.ID] {
+				result = append(result, role)
+				delete(changed, role.ID)
+			}
+		}
+	}
+	if op != MembershipRemove {
+		for _, role := range changes {
+			if changed[role.ID] {
+				result = append(result, role)
+				delete(changed, role.ID)
+			}
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Name < result[j].Name })
+	return result
+}
+
+// mergeGroups applies a membership operation to the current groups
+func mergeGroups(current, changes []models.Group, op string) []models.Group {
+	changed := map[uint]bool{}
+	for _, group := range changes {
+		changed[group.ID] = true
+	}
+	result := []models.Group{}
+	if op != MembershipReplace {
+		for _, group := range current {
+			if op == MembershipAdd || !changed[group.ID] {
+				result = append(result, group)
+				delete(changed, group.ID)
+			}
+		}
+	}
+	if op != MembershipRemove {
+		for _, group := range changes {
+			if changed[group.ID] {
+				result = append(result, group)
+				delete(changed, group.ID)
+			}
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Name < result[j].Name })
+	return result
+}
+
+// roleGroupsSnapshot describes a role with its groups for the audit log
+func roleGroupsSnapshot(role models.Role) gin.H {
+	snapshot := roleSnapshot(role)
+	groups := []string{}
+	for _, group := range role.Groups {
+		groups = append(groups, group.Name)
+	}
+	sort.Strings(groups)
+	snapshot["groups"] = groups
+	return snapshot
+}
+
+// membershipOpOfMethod maps the HTTP method of the per-user and per-role routes to an operation
+func membershipOpOfMethod(c *gin.Context) string {
+	switch c.Request.Method {
+	case http.MethodPut:
+		return MembershipReplace
+	case http.MethodDelete:
+		return MembershipRemove
+	}
+	return MembershipAdd
+}
+
+// parseID parses an ID route parameter, invalid IDs become 0 and are not found
+func parseID(value string) uint {
+	var id uint
+	fmt.Sscan(value, &id)
+	return id
+}
+
+// nonNil turns a missing name list into an empty one, so that replace with no names removes all
+func nonNil(names []string) []string {
+	if names == nil {
+		return []string{}
+	}
+	return names
+}
@@ -0,0 +1,304 @@
+package controller
+
+import (
+	"errors"
+	"jwt/initializers"
+	"jwt/models"
+	"jwt/utils"
+	"net/http"
+	"net/url"
+	"regexp"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+type IdentityProviderData struct {
+	Name          string   `json:"name" binding:"required"`
+	DisplayName   string   `json:"displayName"`
+	Issuer        string   `json:"issuer" binding:"required"`
+	ClientID      string   `json:"clientId" binding:"required"`
+	ClientSecret  string   `json:"clientSecret" binding:"required"`
+	Scopes        []string `json:"scopes"`
+	AutoProvision bool     `json:"autoProvision"`
+	DefaultRoles  []string `json:"defaultRoles"`
+	DefaultGroups []string `json:"defaultGroups"`
+}
+
+var (
+	providerNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]*$`)
+
+	errOIDCUnverifiedEmail = errors.New("the identity provider did not confirm the email address")
+	errOIDCNoAccount       = errors.New("no account exists for this email address")
+)
+
+// CreateIdentityProvider handles adding an upstream OIDC provider
+func CreateIdentityProvider(c *gin.Context) {
+	var input IdentityProviderData
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if !providerNamePattern.MatchString(input.Name) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid provider name, use lower-case letters, digits and dashes: " + input.Name})
+		return
+	}
+	if u, err := url.Parse(input.Issuer); err != nil || u.Host == "" || (u.Scheme != "https" && !isLoopbackHost(u.Hostname())) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid issuer, an https URL is required: " + input.Issuer})
+		return
+	}
+
+	// Default roles and groups have to exist, a typo would silently provision users without them
+	for _, roleName := range input.DefaultRoles {
+		if err := tenantDB(c).Where("name = ?", roleName).First(&models.Role{}).Error; err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid role name: " + roleName})
+			return
+		}
+	}
+	for _, groupName := range input.DefaultGroups {
+		if err := tenantDB(c).Where("name = ?", groupName).First(&models.Group{}).Error; err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid group name: " + groupName})
+			return
+		}
+	}
+
+	if input.DisplayName == "" {
+		input.DisplayName = input.Name
+	}
+	provider := models.IdentityProvider{
+		Name:          input.Name,
+		DisplayName:   input.DisplayName,
+		Issuer:        input.Issuer,
+		ClientID:      input.ClientID,
+		ClientSecret:  input.ClientSecret,
+		Scopes:        input.Scopes,
+		AutoProvision: input.AutoProvision,
+		DefaultRoles:  input.DefaultRoles,
+		DefaultGroups: input.DefaultGroups,
+	}
+	if err := initializers.DBConn.Create(&provider).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	recordAudit(c, "identity_provider.create", "identity_provider", provider.ID, nil, provider)
+
+	c.JSON(http.StatusOK, gin.H{
+		"provider":    provider,
+		"redirectUri": oidcRedirectURI(c, provider),
+	})
+}
+
+// ListIdentityProviders retrieves all upstream OIDC providers
+func ListIdentityProviders(c *gin.Context) {
+	var providers []models.IdentityProvider
+
+	initializers.DBConn.Find(&providers)
+	c.JSON(http.StatusOK, providers)
+}
+
+// DeleteIdentityProvider handles deleting an upstream OIDC provider and the identities linked through it
+func DeleteIdentityProvider(c *gin.Context) {
+	var provider models.IdentityProvider
+	id := c.Param("id")
+
+	if err := initializers.DBConn.First(&provider, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Identity provider not found"})
+		return
+	}
+
+	if err := initializers.DBConn.Delete(&provider).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	recordAudit(c, "identity_provider.delete", "identity_provider", provider.ID, provider, nil)
+
+	c.JSON(http.StatusOK, gin.H{"message": "Identity provider deleted"})
+}
+
+// ListLoginProviders retrieves the providers users can sign in with, for rendering login buttons
+func ListLoginProviders(c *gin.Context) {
+	var providers []models.IdentityProvider
+	initializers.DBConn.Order("name").Find(&providers)
+
+	list := []gin.H{}
+	for _, provider := range providers {
+		list = append(list, gin.H{
+			"name":        provider.Name,
+			"displayName": provider.DisplayName,
+			"loginUrl":    "/auth/oidc/" + provider.Name + "/login",
+		})
+	}
+	c.JSON(http.StatusOK, list)
+}
+
+// StartOIDCLogin handles redirecting the user to the provider's login page.
+// Optional query parameters: device (session name) and cookie=true (cookie mode login).
+func StartOIDCLogin(c *gin.Context) {
+	provider, ok := loadIdentityProvider(c)
+	if !ok {
+		return
+	}
+
+	discovery, err := discoverOIDC(provider)
+	if err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Identity provider is unavailable: " + err.Error()})
+		return
+	}
+
+	loginState := models.OIDCLoginState{
+		ProviderID: provider.ID,
+		Device:     c.Query("device"),
+		Cookie:     c.Query("cookie") == "true",
+		ExpiresAt:  time.Now().Add(oidcLoginTimeout),
+	}
+	for _, value := range []*string{&loginState.State, &loginState.Nonce, &loginState.CodeVerifier} {
+		if *value, err = utils.GenerateRandomString(32); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate login state"})
+			return
+		}
+	}
+
+	// Logins that were abandoned at the provider are cleaned up here
+	initializers.DBConn.Where("expires_at < ?", time.Now()).Delete(&models.OIDCLoginState{})
+	if err := initializers.DBConn.Create(&loginState).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save login state"})
+		return
+	}
+
+	// The provider sends the browser back with a top-level GET, which carries Lax cookies
+	bindLogin(c, OIDCStateCookieName, loginState.State, http.SameSiteLaxMode, oidcLoginTimeout)
+	c.Redirect(http.StatusFound, oidcAuthorizationURL(provider, discovery, oidcRedirectURI(c, provider), loginState))
+}
+
+// OIDCCallback handles the redirect back from the provider: it exchanges the code, links or
+// provisions the user and responds with a JWT of this service like LoginUser
+func OIDCCallback(c *gin.Context) {
+	provider, ok := loadIdentityProvider(c)
+	if !ok {
+		return
+	}
+
+	if providerError := c.Query("error"); providerError != "" {
+		recordAuditAs(c, nil, "login.failure", "identity_provider", provider.ID, nil, gin.H{"provider": provider.Name, "reason": providerError})
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Login was not completed: " + providerError, "description": c.Query("error_description")})
+		return
+	}
+
+	// Only the browser that started the login may finish it
+	if !boundLogin(c, OIDCStateCookieName, c.Query("state"), http.SameSiteLaxMode) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "The login was not started in this browser, start the login again"})
+		return
+	}
+
+	// The state is single use, deleting it makes a replayed callback fail
+	var loginState models.OIDCLoginState
+	err := initializers.DBConn.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("state = ? AND provider_id = ?", c.Query("state"), provider.ID).First(&loginState).Error; err != nil {
+			return err
+		}
+		return tx.Delete(&loginState).Error
+	})
+	if err != nil || time.Now().After(loginState.ExpiresAt) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid or expired login state, start the login again"})
+		return
+	}
+
+	discovery, err := discoverOIDC(provider)
+	if err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Identity provider is unavailable: " + err.Error()})
+		return
+	}
+
+	identity, err := exchangeOIDCCode(provider, discovery, oidcRedirectURI(c, provider), c.Query("code"), loginState)
+	if err != nil {
+		recordAuditAs(c, nil, "login.failure", "identity_provider", provider.ID, nil, gin.H{"provider": provider.Name, "reason": err.Error()})
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Login failed: " + err.Error()})
+		return
+	}
+
+	user, err := linkOIDCIdentity(provider, identity)
+	if errors.Is(err, errOIDCUnverifiedEmail) || errors.Is(err, errOIDCNoAccount) {
+		recordAuditAs(c, nil, "login.failure", "identity_provider", provider.ID, nil, gin.H{"provider": provider.Name, "email": identity.Email, "reason": err.Error()})
+		enqueueLoginFailure(c, identity.Email, err.Error())
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to link the external identity: " + err.Error()})
+		return
+	}
+
+	recordAuditAs(c, &user, "login.success", "user", user.ID, nil, gin.H{"provider": provider.Name})
+	issueLoginToken(c, user, loginState.Device, loginState.Cookie, nil)
+}
+
+// loadIdentityProvider loads the provider named in the URL or responds with 404
+func loadIdentityProvider(c *gin.Context) (models.IdentityProvider, bool) {
+	var provider models.IdentityProvider
+	if err := initializers.DBConn.Where("name = ?", c.Param("provider")).First(&provider).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Identity provider not found"})
+		return provider, false
+	}
+	return provider, true
+}
+
+// linkOIDCIdentity returns the user of an external identity. Unknown identities are linked to the
+// user of the default organization with the same verified email, or provisioned when the provider allows it.
+func linkOIDCIdentity(provider models.IdentityProvider, identity oidcIdentity) (models.User, error) {
+	var user models.User
+	var link models.ExternalIdentity
+	err := initializers.DBConn.Where("provider_id = ? AND subject = ?", provider.ID, identity.Subject).First(&link).Error
+	if err == nil {
+		if err := initializers.DBConn.First(&user, link.UserID).Error; err != nil {
+			return user, err
+		}
+		link.Email, link.LastLoginAt = identity.Email, time.Now()
+		return user, initializers.DBConn.Save(&link).Error
+	}
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return user, err
+	}
+
+	// Linking by email hands over the account, so only an address the provider verified will do
+	if identity.Email == "" || !identity.EmailVerified {
+		return user, errOIDCUnverifiedEmail
+	}
+
+	organization, err := defaultOrganization()
+	if err != nil {
+		return user, err
+	}
+	err = initializers.DBConn.Where("organization_id = ? AND LOWER(email) = LOWER(?)", organization.ID, identity.Email).First(&user).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		if !provider.AutoProvision {
+			return user, errOIDCNoAccount
+		}
+		user, err = provisionFederatedUser(identity.Email, identity.PreferredUsername, provider.DefaultRoles, provider.DefaultGroups)
+	}
+	if err != nil {
+		return user, err
+	}
+
+	link = models.ExternalIdentity{
+		ProviderID:  provider.ID,
+		Subject:     identity.Subject,
+		UserID:      user.ID,
+		Email:       identity.Email,
+		LastLoginAt: time.Now(),
+	}
+	return user, initializers.DBConn.Create(&link).Error
+}
+
+// oidcRedirectURI is the callback URL to register at the provider
+func oidcRedirectURI(c *gin.Context, provider models.IdentityProvider) string {
+	return publicBaseURL(c) + "/auth/oidc/" + provider.Name + "/callback"
+}
+
+// isLoopbackHost reports whether a host name refers to the local machine, for testing with a local provider
+func isLoopbackHost(host string) bool {
+	return host == "localhost" || host == "127.0.0.1" || host == "::1"
+}
@@ -0,0 +1,387 @@
+package controller
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"jwt/models"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	oidcDiscoveryTTL   = time.Hour        // How long discovery documents and key sets are cached
+	oidcKeyRefreshWait = time.Minute      // Minimum time between key set refreshes for unknown key IDs
+	oidcClockSkew      = time.Minute      // Leeway for the time based claims of ID tokens
+	oidcMaxResponse    = 1 << 20          // Upper bound for documents read from a provider
+	oidcLoginTimeout   = 10 * time.Minute // Time a user has to finish a login at the provider
+)
+
+var oidcClient = &http.Client{Timeout: 10 * time.Second}
+
+// oidcDiscovery is the part of a provider's discovery document used here
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	UserinfoEndpoint      string `json:"userinfo_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// oidcProviderCache holds the discovery document and signing keys of one issuer
+type oidcProviderCache struct {
+	discovery   oidcDiscovery
+	fetchedAt   time.Time
+	keys        map[string]interface{}
+	keysFetched time.Time
+}
+
+var (
+	oidcCacheMu sync.Mutex
+	oidcCache   = map[string]*oidcProviderCache{}
+)
+
+// oidcIdentity is what a verified login tells about the user
+type oidcIdentity struct {
+	Subject           string
+	Email             string
+	EmailVerified     bool
+	Name              string
+	PreferredUsername string
+}
+
+// discoverOIDC returns the discovery document of a provider, fetching it if the cached one is stale
+func discoverOIDC(provider models.IdentityProvider) (oidcDiscovery, error) {
+	oidcCacheMu.Lock()
+	defer oidcCacheMu.Unlock()
+
+	cached := oidcCache[provider.Issuer]
+	if cached != nil && time.Since(cached.fetchedAt) < oidcDiscoveryTTL {
+		return cached.discovery, nil
+	}
+
+	var discovery oidcDiscovery
+	if err := getJSON(strings.TrimSuffix(provider.Issuer, "/")+"/.well-known/openid-configuration", &discovery); err != nil {
+		return discovery, fmt.Errorf("discovery failed: %w", err)
+	}
+	// The issuer has to match exactly, otherwise tokens of another issuer could be accepted (OIDC Discovery 4.3)
+	if discovery.Issuer != provider.Issuer {
+		return discovery, fmt.Errorf("discovery document is for issuer %q", discovery.Issuer)
+	}
+	if discovery.AuthorizationEndpoint == "" || discovery.TokenEndpoint == "" || discovery.JWKSURI == "" {
+		return discovery, errors.New("discovery document is incomplete")
+	}
+
+	oidcCache[provider.Issuer] = &oidcProviderCache{discovery: discovery, fetchedAt: time.Now()}
+	return discovery, nil
+}
+
+// oidcSigningKey returns the public key with the given key ID, refreshing the key set when it is unknown
+func oidcSigningKey(provider models.IdentityProvider, discovery oidcDiscovery, kid string) (interface{}, error) {
+	oidcCacheMu.Lock()
+	defer oidcCacheMu.Unlock()
+
+	cached := oidcCache[provider.Issuer]
+	if cached == nil {
+		cached = &oidcProviderCache{discovery: discovery, fetchedAt: time.Now()}
+		oidcCache[provider.Issuer] = cached
+	}
+	if key, ok := lookupKey(cached.keys, kid); ok && time.Since(cached.keysFetched) < oidcDiscoveryTTL {
+		return key, nil
+	}
+	if time.Since(cached.keysFetched) < oidcKeyRefreshWait {
+		if key, ok := lookupKey(cached.keys, kid); ok {
+			return key, nil
+		}
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := getJSON(discovery.JWKSURI, &set); err != nil {
+		return nil, fmt.Errorf("fetching signing keys failed: %w", err)
+	}
+	keys := map[string]interface{}{}
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		if key, err := jwk.publicKey(); err == nil {
+			keys[jwk.Kid] = key
+		}
+	}
+	cached.keys, cached.keysFetched = keys, time.Now()
+
+	if key, ok := lookupKey(keys, kid); ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown signing key %q", kid)
+}
+
+// lookupKey finds a key by ID, a token without key ID may use the only key of the set
+func lookupKey(keys map[string]interface{}, kid string) (interface{}, bool) {
+	if key, ok := keys[kid]; ok {
+		return key, true
+	}
+	if kid == "" && len(keys) == 1 {
+		for _, key := range keys {
+			return key, true
+		}
+	}
+	return nil, false
+}
+
+// jsonWebKey is an RSA or EC public key of a JWK set (RFC 7517)
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// publicKey decodes the key into an *rsa.PublicKey or *ecdsa.PublicKey
+func (k jsonWebKey) publicKey() (interface{}, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil || len(e) == 0 || len(e) > 4 {
+			return nil, errors.New("invalid RSA exponent")
+		}
+		exponent := 0
+		for _, b := range e {
+			exponent = exponent<<8 | int(b)
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: exponent}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := base64.RawURLEncoding.DecodeString(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		key := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !curve.IsOnCurve(key.X, key.Y) {
+			return nil, errors.New("EC point is not on the curve")
+		}
+		return key, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
+
+// oidcAuthorizationURL builds the URL the user is redirected to for logging in at the provider
+func oidcAuthorizationURL(provider models.IdentityProvider, discovery oidcDiscovery, redirectURI string, loginState models.OIDCLoginState) string {
+	scopes := append([]string{"openid", "email", "profile"}, provider.Scopes...)
+	query := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {provider.ClientID},
+		"redirect_uri":          {redirectURI},
+		"scope":                 {strings.Join(uniqueStrings(scopes), " ")},
+		"state":                 {loginState.State},
+		"nonce":                 {loginState.Nonce},
+		"code_challenge":        {pkceChallenge(loginState.CodeVerifier)},
+		"code_challenge_method": {"S256"},
+	}
+	separator := "?"
+	if strings.Contains(discovery.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+	return discovery.AuthorizationEndpoint + separator + query.Encode()
+}
+
+// pkceChallenge derives the S256 code challenge of a verifier (RFC 7636)
+func pkceChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// exchangeOIDCCode trades the authorization code for tokens and returns the verified identity
+func exchangeOIDCCode(provider models.IdentityProvider, discovery oidcDiscovery, redirectURI, code string, loginState models.OIDCLoginState) (oidcIdentity, error) {
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {redirectURI},
+		"code_verifier": {loginState.CodeVerifier},
+	}
+	req, err := http.NewRequest(http.MethodPost, discovery.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return oidcIdentity{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(url.QueryEscape(provider.ClientID), url.QueryEscape(provider.ClientSecret))
+
+	var tokens struct {
+		AccessToken string `json:"access_token"`
+		IDToken     string `json:"id_token"`
+		Error       string `json:"error"`
+	}
+	if err := doJSON(req, &tokens); err != nil {
+		return oidcIdentity{}, fmt.Errorf("code exchange failed: %w", err)
+	}
+	if tokens.IDToken == "" {
+		return oidcIdentity{}, errors.New("code exchange returned no ID token")
+	}
+
+	identity, err := verifyIDToken(provider, discovery, tokens.IDToken, loginState.Nonce)
+	if err != nil {
+		return identity, err
+	}
+
+	// Some providers only put the email into the userinfo response
+	if identity.Email == "" && discovery.UserinfoEndpoint != "" && tokens.AccessToken != "" {
+		if err := fetchOIDCUserinfo(discovery, tokens.AccessToken, &identity); err != nil {
+			return identity, err
+		}
+	}
+	return identity, nil
+}
+
+// verifyIDToken checks the signature, issuer, audience, expiry and nonce of an ID token
+func verifyIDToken(provider models.IdentityProvider, discovery oidcDiscovery, idToken, nonce string) (oidcIdentity, error) {
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(idToken, claims, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		return oidcSigningKey(provider, discovery, kid)
+	},
+		jwt.WithValidMethods([]string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512"}),
+		jwt.WithIssuer(provider.Issuer),
+		jwt.WithAudience(provider.ClientID),
+		jwt.WithExpirationRequired(),
+		jwt.WithLeeway(oidcClockSkew),
+	)
+	if err != nil {
+		return oidcIdentity{}, fmt.Errorf("invalid ID token: %w", err)
+	}
+
+	if claimNonce, _ := claims["nonce"].(string); claimNonce != nonce {
+		return oidcIdentity{}, errors.New("invalid ID token: nonce mismatch")
+	}
+	// With several audiences the token has to be meant for us as authorized party (OIDC Core 3.1.3.7)
+	if azp, ok := claims["azp"].(string); ok && azp != provider.ClientID {
+		return oidcIdentity{}, errors.New("invalid ID token: issued to another client")
+	}
+
+	identity := identityFromClaims(claims)
+	if identity.Subject == "" {
+		return identity, errors.New("invalid ID token: missing subject")
+	}
+	return identity, nil
+}
+
+// fetchOIDCUserinfo fills in the email from the userinfo endpoint, the subject has to match the ID token
+func fetchOIDCUserinfo(discovery oidcDiscovery, accessToken string, identity *oidcIdentity) error {
+	req, err := http.NewRequest(http.MethodGet, discovery.UserinfoEndpoint, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	req.Header.Set("Accept", "application/json")
+
+	claims := map[string]interface{}{}
+	if err := doJSON(req, &claims); err != nil {
+		return fmt.Errorf("userinfo request failed: %w", err)
+	}
+	info := identityFromClaims(claims)
+	if info.Subject != identity.Subject {
+		return errors.New("userinfo is for another subject")
+	}
+	identity.Email, identity.EmailVerified = info.Email, info.EmailVerified
+	if identity.PreferredUsername == "" {
+		identity.PreferredUsername = info.PreferredUsername
+	}
+	if identity.Name == "" {
+		identity.Name = info.Name
+	}
+	return nil
+}
+
+// identityFromClaims reads the standard claims, email_verified may be a boolean or a string
+func identityFromClaims(claims map[string]interface{}) oidcIdentity {
+	identity := oidcIdentity{}
+	identity.Subject, _ = claims["sub"].(string)
+	identity.Email, _ = claims["email"].(string)
+	identity.Name, _ = claims["name"].(string)
+	identity.PreferredUsername, _ = claims["preferred_username"].(string)
+	switch verified := claims["email_verified"].(type) {
+	case bool:
+		identity.EmailVerified = verified
+	case string:
+		identity.EmailVerified = verified == "true"
+	}
+	return identity
+}
+
+// getJSON fetches a JSON document
+func getJSON(rawURL string, out interface{}) error {
+	req, err := http.NewRequest(http.MethodGet, rawURL, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	return doJSON(req, out)
+}
+
+// doJSON sends a request and decodes the JSON response, non-2xx responses are errors
+func doJSON(req *http.Request, out interface{}) error {
+	resp, err := oidcClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, oidcMaxResponse))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s returned %d: %s", req.URL.Host, resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	return json.Unmarshal(body, out)
+}
+
+// uniqueStrings removes duplicates and keeps the order
+func uniqueStrings(values []string) []string {
+	seen := map[string]bool{}
+	unique := []string{}
+	for _, value := range values {
+		if value != "" && !seen[value] {
+			seen[value] = true
+			unique = append(unique, value)
+		}
+	}
+	return unique
+}
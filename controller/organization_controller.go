@@ -0,0 +1,218 @@
+package controller
+
+import (
+	"errors"
+	"jwt/initializers"
+	"jwt/models"
+	"jwt/utils"
+	"net/http"
+	"regexp"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+type OrganizationData struct {
+	Name        string `json:"name" binding:"required"`
+	DisplayName string `json:"displayName"`
+	Admin       *struct {
+		Username string `json:"username" binding:"required"`
+		Email    string `json:"email" binding:"required"`
+		Password string `json:"password" binding:"required"`
+	} `json:"admin"` // Optional first admin of the organization
+}
+
+var organizationNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]*$`)
+
+var errForeignReference = errors.New("references a user or group outside of the organization")
+
+// CreateOrganization handles creating a tenant with its admin and user roles and groups,
+// and optionally its first admin
+func CreateOrganization(c *gin.Context) {
+	var input OrganizationData
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if !organizationNamePattern.MatchString(input.Name) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid organization name, use lower-case letters, digits and dashes: " + input.Name})
+		return
+	}
+	if input.DisplayName == "" {
+		input.DisplayName = input.Name
+	}
+
+	organization := models.Organization{Name: input.Name, DisplayName: input.DisplayName}
+	var admin *models.User
+	if input.Admin != nil {
+		hashedPassword, err := utils.HashPassword(input.Admin.Password)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to hash password"})
+			return
+		}
+		admin = &models.User{Name: input.Admin.Username, Email: input.Admin.Email, Password: hashedPassword}
+	}
+
+	err := initializers.DBConn.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&organization).Error; err != nil {
+			return err
+		}
+		if err := initializers.SeedOrganizationRoles(tx, organization); err != nil {
+			return err
+		}
+		if admin != nil {
+			admin.OrganizationID = organization.ID
+			tx.Where("organization_id = ? AND name = ?", organization.ID, "admin").Find(&admin.Roles)
+			tx.Where("organization_id = ? AND name = ?", organization.ID, "admin").Find(&admin.Groups)
+			if err := saveNewUser(tx, admin); err != nil {
+				return err
+			}
+			if err := recordAuditTx(tx, c, "user.create", "user", admin.ID, nil, userSnapshot(*admin)); err != nil {
+				return err
+			}
+		}
+		if err := enqueueEvent(tx, "organization.created", organizationSnapshot(organization)); err != nil {
+			return err
+		}
+		return recordAuditTx(tx, c, "organization.create", "organization", organization.ID, nil, organizationSnapshot(organization))
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	response := gin.H{"organization": organization}
+	if admin != nil {
+		response["admin"] = gin.H{"id": admin.ID, "username": admin.Name, "email": admin.Email}
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+// ListOrganizations retrieves all organizations
+func ListOrganizations(c *gin.Context) {
+	var organizations []models.Organization
+
+	initializers.DBConn.Order("name").Find(&organizations)
+	c.JSON(http.StatusOK, organizations)
+}
+
+// DeleteOrganization handles deleting an organization with all its users, roles and groups.
+// The default organization cannot be deleted.
+func DeleteOrganization(c *gin.Context) {
+	var organization models.Organization
+	id := c.Param("id")
+
+	if err := initializers.DBConn.First(&organization, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Organization not found"})
+		return
+	}
+	if organization.Name == models.DefaultOrganization {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "The default organization cannot be deleted"})
+		return
+	}
+
+	err := initializers.DBConn.Transaction(func(tx *gorm.DB) error {
+		// The join tables do not cascade, the rows of the tenant go first
+		users := tx.Model(&models.User{}).Select("id").Where("organization_id = ?", organization.ID)
+		roles := tx.Model(&models.Role{}).Select("id").Where("organization_id = ?", organization.ID)
+		for _, cleanup := range []struct {
+			statement string
+			ids       *gorm.DB
+		}{
+			{"DELETE FROM user_roles WHERE user_id IN (?)", users},
+			{"DELETE FROM user_groups WHERE user_id IN (?)", users},
+			{"DELETE FROM role_groups WHERE role_id IN (?)", roles},
+		} {
+			if err := tx.Exec(cleanup.statement, cleanup.ids).Error; err != nil {
+				return err
+			}
+		}
+		// Users, roles, groups and with the users their keys, tokens and sessions cascade
+		if err := tx.Delete(&organization).Error; err != nil {
+			return err
+		}
+		if err := enqueueEvent(tx, "organization.deleted", organizationSnapshot(organization)); err != nil {
+			return err
+		}
+		return recordAuditTx(tx, c, "organization.delete", "organization", organization.ID, organizationSnapshot(organization), nil)
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Organization deleted"})
+}
+
+// organizationSnapshot describes an organization for the audit log and events
+func organizationSnapshot(organization models.Organization) gin.H {
+	return gin.H{"id": organization.ID, "name": organization.Name, "displayName": organization.DisplayName}
+}
+
+// tenantDB starts a query limited to the organization of the request
+func tenantDB(c *gin.Context) *gorm.DB {
+	organization, _ := CurrentOrganization(c)
+	return initializers.DBConn.Where("organization_id = ?", organization.ID)
+}
+
+// tenantID returns the ID of the organization of the request
+func tenantID(c *gin.Context) uint {
+	organization, _ := CurrentOrganization(c)
+	return organization.ID
+}
+
+// tenantPrefix returns the route prefix of the request's organization, empty for the unprefixed routes
+func tenantPrefix(c *gin.Context) string {
+	if name := c.Param("org"); name != "" {
+		return "/orgs/" + name
+	}
+	return ""
+}
+
+// defaultOrganization loads the organization that federated and directory users are provisioned in
+func defaultOrganization() (models.Organization, error) {
+	var organization models.Organization
+	err := initializers.DBConn.Where("name = ?", models.DefaultOrganization).First(&organization).Error
+	return organization, err
+}
+
+// checkTenantReferences makes sure the users and groups sent along with a role or group
+// belong to the organization, gorm would otherwise link them across tenants
+func checkTenantReferences(organizationID uint, users []models.User, groups []models.Group) error {
+	var userIDs, groupIDs []uint
+	for _, user := range users {
+		userIDs = append(userIDs, user.ID)
+	}
+	for _, group := range groups {
+		groupIDs = append(groupIDs, group.ID)
+	}
+
+	for _, check := range []struct {
+		model interface{}
+		ids   []uint
+	}{{&models.User{}, userIDs}, {&models.Group{}, groupIDs}} {
+		if len(check.ids) == 0 {
+			continue
+		}
+		var count int64
+		initializers.DBConn.Model(check.model).Where("id IN ? AND organization_id = ?", check.ids, organizationID).Count(&count)
+		if count != int64(len(uniqueIDs(check.ids))) {
+			return errForeignReference
+		}
+	}
+	return nil
+}
+
+// uniqueIDs removes duplicate IDs
+func uniqueIDs(ids []uint) []uint {
+	seen := map[uint]bool{}
+	var unique []uint
+	for _, id := range ids {
+		if !seen[id] {
+			seen[id] = true
+			unique = append(unique, id)
+		}
+	}
+	return unique
+}
@@ -0,0 +1,400 @@
+package controller
+
+import (
+	"errors"
+	"fmt"
+	"jwt/initializers"
+	"jwt/models"
+	"jwt/policy"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Policies evaluates the attribute-based access control policies of all organizations. It is
+// reloaded when a policy changes here and every POLICY_RELOAD_INTERVAL for changes of other instances.
+var Policies = policy.NewEngine()
+
+type PolicyData struct {
+	Name        string            `json:"name" binding:"required"`
+	Description string            `json:"description"`
+	Effect      string            `json:"effect" binding:"required"`    // "allow" or "deny"
+	Actions     []string          `json:"actions" binding:"required"`   // e.g. ["read"], "*" for all
+	Resources   []string          `json:"resources" binding:"required"` // Resource types, e.g. ["user"]
+	Condition   *policy.Condition `json:"condition"`                    // Optional, see the policy package
+	Disabled    bool              `json:"disabled"`
+}
+
+type AuthzCheckData struct {
+	Action   string            `json:"action" binding:"required"`
+	Resource policy.Attributes `json:"resource" binding:"required"` // "type", optionally "id", and further attributes
+	Context  policy.Attributes `json:"context"`                     // Extra context, e.g. the "ip" of the end user
+	UserID   *uint             `json:"userId"`                      // Admins may ask for another user of the organization
+}
+
+// CreatePolicy handles adding a policy to the organization
+func CreatePolicy(c *gin.Context) {
+	var input PolicyData
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := validatePolicy(input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	record := models.Policy{OrganizationID: tenantID(c)}
+	applyPolicyData(&record, input)
+	if err := initializers.DBConn.Create(&record).Error; err != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "A policy with this name already exists"})
+		return
+	}
+	reloadPoliciesOrLog()
+
+	recordAudit(c, "policy.create", "policy", record.ID, nil, policySnapshot(record))
+	c.JSON(http.StatusOK, policySnapshot(record))
+}
+
+// ListPolicies retrieves the policies of the organization
+func ListPolicies(c *gin.Context) {
+	var records []models.Policy
+	if err := tenantDB(c).Order("name").Find(&records).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve policies"})
+		return
+	}
+
+	list := []gin.H{}
+	for _, record := range records {
+		list = append(list, policySnapshot(record))
+	}
+	c.JSON(http.StatusOK, gin.H{"policies": list})
+}
+
+// GetPolicy retrieves a single policy
+func GetPolicy(c *gin.Context) {
+	var record models.Policy
+	if err := tenantDB(c).First(&record, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Policy not found"})
+		return
+	}
+	c.JSON(http.StatusOK, policySnapshot(record))
+}
+
+// UpdatePolicy handles replacing a policy
+func UpdatePolicy(c *gin.Context) {
+	var record models.Policy
+	if err := tenantDB(c).First(&record, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Policy not found"})
+		return
+	}
+
+	var input PolicyData
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := validatePolicy(input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	before := policySnapshot(record)
+	applyPolicyData(&record, input)
+	if err := initializers.DBConn.Save(&record).Error; err != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "A policy with this name already exists"})
+		return
+	}
+	reloadPoliciesOrLog()
+
+	recordAudit(c, "policy.update", "policy", record.ID, before, policySnapshot(record))
+	c.JSON(http.StatusOK, policySnapshot(record))
+}
+
+// DeletePolicy handles removing a policy
+func DeletePolicy(c *gin.Context) {
+	var record models.Policy
+	if err := tenantDB(c).First(&record, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Policy not found"})
+		return
+	}
+
+	if err := initializers.DBConn.Delete(&record).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	reloadPoliciesOrLog()
+
+	recordAudit(c, "policy.delete", "policy", record.ID, policySnapshot(record), nil)
+	c.JSON(http.StatusOK, gin.H{"message": "Policy deleted"})
+}
+
+// CheckAuthorization handles the decision endpoint: may the current user, or for admins the given
+// user, perform the action on the resource
+func CheckAuthorization(c *gin.Context) {
+	var input AuthzCheckData
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	resourceType, _ := input.Resource["type"].(string)
+	if resourceType == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "The resource needs a type"})
+		return
+	}
+
+	user, _ := CurrentUser(c)
+	if input.UserID != nil && *input.UserID != user.ID {
+		if !hasAdminRights(c) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Only admins can check for other users"})
+			return
+		}
+		user = models.User{}
+		if err := tenantDB(c).Preload("Roles").First(&user, *input.UserID).Error; err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+			return
+		}
+		DropExpiredRoles(&user)
+		ApplyRoleActivation(&user, nil)
+	}
+
+	// Stored attributes of known resources fill in what the caller did not describe
+	resource := policy.Attributes{}
+	if id, hasID := input.Resource["id"]; hasID {
+		for key, value := range ResourceAttributes(c, resourceType, stringOf(id)) {
+			resource[key] = value
+		}
+	}
+	for key, value := range input.Resource {
+		resource[key] = value
+	}
+
+	context := requestContext(c)
+	for key, value := range input.Context {
+		if !policyTimeKeys[key] {
+			context[key] = value
+		}
+	}
+
+	decision := Policies.Evaluate(tenantID(c), policy.Request{
+		Action:       input.Action,
+		ResourceType: resourceType,
+		Subject:      subjectAttributes(c, user),
+		Resource:     resource,
+		Context:      context,
+	})
+	c.JSON(http.StatusOK, decision)
+}
+
+// EvaluatePolicies decides whether the current user may perform the action on the resource of the
+// request, for the Authorize middleware
+func EvaluatePolicies(c *gin.Context, action, resourceType string, resource policy.Attributes) policy.Decision {
+	user, _ := CurrentUser(c)
+	return Policies.Evaluate(tenantID(c), policy.Request{
+		Action:       action,
+		ResourceType: resourceType,
+		Subject:      subjectAttributes(c, user),
+		Resource:     resource,
+		Context:      requestContext(c),
+	})
+}
+
+// ResourceAttributes describes a resource of the organization for the policies. Users, groups and
+// roles are loaded with their attributes, other types only carry the type and the ID.
+func ResourceAttributes(c *gin.Context, resourceType, id string) policy.Attributes {
+	attributes := policy.Attributes{"type": resourceType, "id": id}
+	if id == "" {
+		return attributes
+	}
+
+	switch resourceType {
+	case "user":
+		var user models.User
+		if err := tenantDB(c).Preload("Roles").First(&user, id).Error; err == nil {
+			for key, value := range userAttributes(c, user) {
+				attributes[key] = value
+			}
+			attributes["type"] = resourceType
+		}
+	case "group":
+		var group models.Group
+		if err := tenantDB(c).First(&group, id).Error; err == nil {
+			attributes["name"] = group.Name
+			if group.ParentID != nil {
+				attributes["parentId"] = *group.ParentID
+			}
+		}
+	case "role":
+		var role models.Role
+		if err := tenantDB(c).First(&role, id).Error; err == nil {
+			attributes["name"] = role.Name
+		}
+	}
+	return attributes
+}
+
+// ReloadPolicies loads the enabled policies of all organizations into the engine
+func ReloadPolicies() error {
+	var records []models.Policy
+	if err := initializers.DBConn.Where("disabled = ?", false).Find(&records).Error; err != nil {
+		return err
+	}
+
+	rules := make([]policy.Rule, 0, len(records))
+	for _, record := range records {
+		rules = append(rules, policy.Rule{
+			ID:             record.ID,
+			OrganizationID: record.OrganizationID,
+			Name:           record.Name,
+			Effect:         record.Effect,
+			Actions:        record.Actions,
+			Resources:      record.Resources,
+			Condition:      record.Condition,
+		})
+	}
+	Policies.Load(rules)
+	return nil
+}
+
+// RunPolicyReload reloads the policies every POLICY_RELOAD_INTERVAL (default 30s), forever, so that
+// changes made through other instances take effect
+func RunPolicyReload() {
+	interval := 30 * time.Second
+	if configured, err := time.ParseDuration(os.Getenv("POLICY_RELOAD_INTERVAL")); err == nil && configured > 0 {
+		interval = configured
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for ; true; <-ticker.C {
+		reloadPoliciesOrLog()
+	}
+}
+
+// reloadPoliciesOrLog reloads the policies, keeping the previous ones on failure
+func reloadPoliciesOrLog() {
+	if err := ReloadPolicies(); err != nil {
+		log.Println("Failed to reload policies:", err)
+	}
+}
+
+// Context attributes derived from the clock, the caller of the decision endpoint cannot set them
+var policyTimeKeys = map[string]bool{"time": true, "date": true, "hour": true, "minute": true, "weekday": true}
+
+// requestContext describes the request for the policies. Times are in POLICY_TIMEZONE, UTC by default.
+func requestContext(c *gin.Context) policy.Attributes {
+	location := time.UTC
+	if configured, err := time.LoadLocation(os.Getenv("POLICY_TIMEZONE")); err == nil {
+		location = configured
+	}
+	now := time.Now().In(location)
+
+	return policy.Attributes{
+		"time":    now.Format(time.RFC3339),
+		"date":    now.Format(time.DateOnly),
+		"hour":    now.Hour(),
+		"minute":  now.Minute(),
+		"weekday": strings.ToLower(now.Weekday().String()),
+		"ip":      c.ClientIP(),
+		"method":  c.Request.Method,
+		"path":    c.Request.URL.Path,
+	}
+}
+
+// subjectAttributes describes the user asking, with the scopes when the current user authenticated
+// with a personal access token
+func subjectAttributes(c *gin.Context, user models.User) policy.Attributes {
+	attributes := userAttributes(c, user)
+	if current, _ := CurrentUser(c); current.ID == user.ID {
+		if scopes, isToken := CurrentScopes(c); isToken {
+			attributes["scopes"] = scopes
+		}
+	}
+	return attributes
+}
+
+// userAttributes describes a user for the policies: the built-in attributes win over the free-form
+// ones of the same name
+func userAttributes(c *gin.Context, user models.User) policy.Attributes {
+	attributes := policy.Attributes{}
+	for key, value := range user.Attributes {
+		attributes[key] = value
+	}
+
+	roles := []string{}
+	for _, role := range user.Roles {
+		roles = append(roles, role.Name)
+	}
+	groups := []string{}
+	var memberships []models.Group
+	if user.ID != 0 && initializers.DBConn.Model(&user).Association("Groups").Find(&memberships) == nil {
+		for _, group := range memberships {
+			groups = append(groups, group.Name)
+		}
+	}
+	organization, _ := CurrentOrganization(c)
+
+	attributes["id"] = user.ID
+	attributes["username"] = user.Name
+	attributes["email"] = user.Email
+	attributes["organization"] = organization.Name
+	attributes["roles"] = roles
+	attributes["groups"] = groups
+	return attributes
+}
+
+// validatePolicy checks the effect and the condition of a policy
+func validatePolicy(input PolicyData) error {
+	if input.Effect != policy.Allow && input.Effect != policy.Deny {
+		return errors.New("Invalid effect, use allow or deny: " + input.Effect)
+	}
+	if len(input.Actions) == 0 || len(input.Resources) == 0 {
+		return errors.New("A policy needs at least one action and one resource type")
+	}
+	if input.Condition != nil {
+		if err := input.Condition.Validate(); err != nil {
+			return errors.New("Invalid condition: " + err.Error())
+		}
+	}
+	return nil
+}
+
+// applyPolicyData copies the input onto the stored policy
+func applyPolicyData(record *models.Policy, input PolicyData) {
+	record.Name = input.Name
+	record.Description = input.Description
+	record.Effect = input.Effect
+	record.Actions = uniqueStrings(input.Actions)
+	record.Resources = uniqueStrings(input.Resources)
+	record.Condition = input.Condition
+	record.Disabled = input.Disabled
+}
+
+// stringOf formats an attribute from JSON, where numbers arrive as float64, as text
+func stringOf(value interface{}) string {
+	if number, isNumber := value.(float64); isNumber {
+		return strconv.FormatFloat(number, 'f', -1, 64)
+	}
+	return fmt.Sprint(value)
+}
+
+// policySnapshot describes a policy for the API and the audit log
+func policySnapshot(record models.Policy) gin.H {
+	return gin.H{
+		"id":          record.ID,
+		"name":        record.Name,
+		"description": record.Description,
+		"effect":      record.Effect,
+		"actions":     nonNil(record.Actions),
+		"resources":   nonNil(record.Resources),
+		"condition":   record.Condition,
+		"disabled":    record.Disabled,
+		"createdAt":   record.CreatedAt,
+		"updatedAt":   record.UpdatedAt,
+	}
+}
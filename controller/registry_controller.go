@@ -0,0 +1,432 @@
+package controller
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base32"
+	"encoding/pem"
+	"errors"
+	"jwt/initializers"
+	"jwt/models"
+	"jwt/utils"
+	"math/big"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+type RegistryRuleData struct {
+	Type    string   `json:"type"`                       // "repository" by default, or "registry"
+	Name    string   `json:"name" binding:"required"`    // Pattern, e.g. "team-a/*" or "${username}/*"
+	Role    string   `json:"role"`                       // Name of the role whose holders get the actions
+	Group   string   `json:"group"`                      // Name of the group whose members get the actions
+	Actions []string `json:"actions" binding:"required"` // e.g. ["pull", "push"], "*" for all
+}
+
+// registryAccess is an entry of the "access" claim of a registry token
+type registryAccess struct {
+	Type    string   `json:"type"`
+	Name    string   `json:"name"`
+	Actions []string `json:"actions"`
+}
+
+// The signing key of the registry tokens, loaded once from REGISTRY_TOKEN_KEY
+var (
+	registryKeyOnce sync.Once
+	registryKey     *rsa.PrivateKey
+	registryKeyErr  error
+)
+
+// CreateRegistryRule handles granting registry actions to a role, a group or every user
+func CreateRegistryRule(c *gin.Context) {
+	var input RegistryRuleData
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if input.Type == "" {
+		input.Type = "repository"
+	}
+	if input.Type != "repository" && input.Type != "registry" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid type, use repository or registry: " + input.Type})
+		return
+	}
+	if input.Role != "" && input.Group != "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "A rule applies to a role or a group, not both"})
+		return
+	}
+
+	rule := models.RegistryRule{
+		OrganizationID: tenantID(c),
+		Type:           input.Type,
+		Name:           input.Name,
+		Actions:        uniqueStrings(input.Actions),
+	}
+	if input.Role != "" {
+		var role models.Role
+		if err := tenantDB(c).Where("name = ?", input.Role).First(&role).Error; err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid role name: " + input.Role})
+			return
+		}
+		rule.RoleID, rule.Role = &role.ID, &role
+	}
+	if input.Group != "" {
+		var group models.Group
+		if err := tenantDB(c).Where("name = ?", input.Group).First(&group).Error; err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid group name: " + input.Group})
+			return
+		}
+		rule.GroupID, rule.Group = &group.ID, &group
+	}
+
+	if err := initializers.DBConn.Omit("Role", "Group").Create(&rule).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	recordAudit(c, "registry_rule.create", "registry_rule", rule.ID, nil, registryRuleSnapshot(rule))
+	c.JSON(http.StatusOK, registryRuleSnapshot(rule))
+}
+
+// ListRegistryRules retrieves the registry rules of the organization
+func ListRegistryRules(c *gin.Context) {
+	var rules []models.RegistryRule
+	tenantDB(c).Preload("Role").Preload("Group").Order("type, name, id").Find(&rules)
+
+	list := []gin.H{}
+	for _, rule := range rules {
+		list = append(list, registryRuleSnapshot(rule))
+	}
+	c.JSON(http.StatusOK, gin.H{"rules": list})
+}
+
+// DeleteRegistryRule handles removing a registry rule
+func DeleteRegistryRule(c *gin.Context) {
+	var rule models.RegistryRule
+	if err := tenantDB(c).Preload("Role").Preload("Group").First(&rule, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Rule not found"})
+		return
+	}
+
+	if err := initializers.DBConn.Delete(&rule).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	recordAudit(c, "registry_rule.delete", "registry_rule", rule.ID, registryRuleSnapshot(rule), nil)
+	c.JSON(http.StatusOK, gin.H{"message": "Rule deleted"})
+}
+
+// RegistryToken handles the token authentication of the Docker registry: the client asks for a
+// token for the scopes of its request and gets the actions its user may perform. Users sign in with
+// Basic auth (password or personal access token) or a bearer JWT; anonymous clients get no access.
+func RegistryToken(c *gin.Context) {
+	key, err := registrySigningKey()
+	if err != nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Registry tokens are not configured: " + err.Error()})
+		return
+	}
+
+	service := c.Query("service")
+	if expected := os.Getenv("REGISTRY_SERVICE"); expected != "" && service != expected {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown service: " + service})
+		return
+	}
+
+	user, writable, authenticated, ok := registryUser(c)
+	if !ok {
+		c.Header("WWW-Authenticate", `Basic realm="registry"`)
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid credentials"})
+		return
+	}
+
+	access := []registryAccess{}
+	if authenticated {
+		var rules []models.RegistryRule
+		tenantDB(c).Find(&rules)
+		var groupIDs []uint
+		initializers.DBConn.Table("user_groups").Where("user_id = ?", user.ID).Pluck("group_id", &groupIDs)
+
+		for _, scope := range c.QueryArray("scope") {
+			requested, err := parseRegistryScope(scope)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+			requested.Actions = registryActions(rules, user, groupIDs, requested)
+			if !writable {
+				requested.Actions = onlyPull(requested.Actions)
+			}
+			access = append(access, requested)
+		}
+	}
+
+	lifetime := 5 * time.Minute
+	if configured, err := time.ParseDuration(os.Getenv("REGISTRY_TOKEN_LIFETIME")); err == nil && configured > 0 {
+		lifetime = configured
+	}
+	jti, _ := utils.GenerateRandomString(16)
+	now := time.Now()
+	claims := jwt.MapClaims{
+		"iss":    registryIssuer(),
+		"sub":    user.Name,
+		"aud":    service,
+		"iat":    now.Unix(),
+		"nbf":    now.Add(-time.Minute).Unix(),
+		"exp":    now.Add(lifetime).Unix(),
+		"jti":    jti,
+		"access": access,
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = libtrustKeyID(&key.PublicKey)
+	signed, err := token.SignedString(key)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to sign the token"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"token":        signed,
+		"access_token": signed,
+		"expires_in":   int(lifetime.Seconds()),
+		"issued_at":    now.UTC().Format(time.RFC3339),
+	})
+}
+
+// RegistryCertificate retrieves a self-signed certificate of the token signing key for the
+// rootcertbundle setting of the registry
+func RegistryCertificate(c *gin.Context) {
+	key, err := registrySigningKey()
+	if err != nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Registry tokens are not configured: " + err.Error()})
+		return
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(now.Unix()),
+		Subject:               pkix.Name{CommonName: registryIssuer()},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.AddDate(10, 0, 0),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create the certificate"})
+		return
+	}
+	c.Data(http.StatusOK, "application/x-pem-file", pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+}
+
+// registryUser resolves the credentials of a token request. It reports whether the user may get
+// write actions, whether a user signed in at all and false on invalid credentials.
+func registryUser(c *gin.Context) (models.User, bool, bool, bool) {
+	header := c.GetHeader("Authorization")
+	if header == "" {
+		return models.User{}, false, false, true
+	}
+
+	// Bearer JWTs and personal access tokens are checked like for the API
+	if strings.HasPrefix(header, "Bearer ") {
+		user, err := VerifyCredential(c, strings.TrimPrefix(header, "Bearer "))
+		return user, tokenWritable(c), err == nil, err == nil
+	}
+
+	name, password, hasBasic := c.Request.BasicAuth()
+	if !hasBasic {
+		return models.User{}, false, false, false
+	}
+	// Like at login, a name with an @ is an email address, so that the username of one user cannot
+	// match the email address of another
+	column := "name"
+	if strings.Contains(name, "@") {
+		column = "email"
+	}
+	var user models.User
+	if err := tenantDB(c).Where(column+" = ?", name).First(&user).Error; err != nil {
+		recordAuditAs(c, nil, "login.failure", "user", "", nil, gin.H{"username": name, "reason": "unknown user", "via": "registry"})
+		enqueueLoginFailure(c, name, "unknown user")
+		return models.User{}, false, false, false
+	}
+
+	// CI jobs use a personal access token of the user as password
+	if strings.HasPrefix(password, utils.AccessTokenPrefix) {
+		owner, err := VerifyCredential(c, password)
+		if err != nil || owner.ID != user.ID {
+			recordAuditAs(c, nil, "login.failure", "user", user.ID, nil, gin.H{"reason": "invalid access token", "via": "registry"})
+			return models.User{}, false, false, false
+		}
+		return owner, tokenWritable(c), true, true
+	}
+
+	valid, err := verifyPassword(user, password)
+	if err != nil || !valid {
+		recordAuditAs(c, nil, "login.failure", "user", user.ID, nil, gin.H{"reason": "wrong password", "via": "registry"})
+		enqueueLoginFailure(c, user.Email, "wrong password")
+		return models.User{}, false, false, false
+	}
+
+	initializers.DBConn.Preload("Roles").First(&user, user.ID)
+	DropExpiredRoles(&user)
+	ApplyRoleActivation(&user, nil)
+	return user, true, true, true
+}
+
+// tokenWritable reports whether the credential verified for the request allows changes: JWTs do,
+// personal access tokens with the write scope
+func tokenWritable(c *gin.Context) bool {
+	scopes, isToken := CurrentScopes(c)
+	return !isToken || tokenHasScope(scopes, "write")
+}
+
+// parseRegistryScope parses a scope like "repository:team-a/app:pull,push". The name can contain
+// colons, e.g. for a registry host with a port.
+func parseRegistryScope(scope string) (registryAccess, error) {
+	first := strings.Index(scope, ":")
+	last := strings.LastIndex(scope, ":")
+	if first < 0 || first == last {
+		return registryAccess{}, errors.New("Invalid scope, use type:name:actions: " + scope)
+	}
+	return registryAccess{
+		Type:    scope[:first],
+		Name:    scope[first+1 : last],
+		Actions: uniqueStrings(strings.Split(scope[last+1:], ",")),
+	}, nil
+}
+
+// registryActions returns the requested actions the rules grant the user
+func registryActions(rules []models.RegistryRule, user models.User, groupIDs []uint, requested registryAccess) []string {
+	roleIDs := map[uint]bool{}
+	for _, role := range user.Roles {
+		roleIDs[role.ID] = true
+	}
+	inGroup := map[uint]bool{}
+	for _, id := range groupIDs {
+		inGroup[id] = true
+	}
+
+	allowed := map[string]bool{}
+	for _, rule := range rules {
+		if rule.Type != requested.Type || !matchRegistryName(rule.Name, user.Name, requested.Name) {
+			continue
+		}
+		if (rule.RoleID != nil && !roleIDs[*rule.RoleID]) || (rule.GroupID != nil && !inGroup[*rule.GroupID]) {
+			continue
+		}
+		for _, action := range rule.Actions {
+			allowed[action] = true
+		}
+	}
+
+	granted := []string{}
+	for _, action := range requested.Actions {
+		if allowed[action] || allowed["*"] {
+			granted = append(granted, action)
+		}
+	}
+	return granted
+}
+
+// matchRegistryName matches a name against a rule pattern, where "*" stands for any text
+// and "${username}" for the name of the user
+func matchRegistryName(pattern, username, name string) bool {
+	parts := strings.Split(pattern, "*")
+	for i, part := range parts {
+		parts[i] = strings.ReplaceAll(regexp.QuoteMeta(part), regexp.QuoteMeta("${username}"), regexp.QuoteMeta(username))
+	}
+	matched, _ := regexp.MatchString("^"+strings.Join(parts, ".*")+"$", name)
+	return matched
+}
+
+// onlyPull drops the actions other than pull, for read-only credentials
+func onlyPull(actions []string) []string {
+	pull := []string{}
+	for _, action := range actions {
+		if action == "pull" {
+			pull = append(pull, action)
+		}
+	}
+	return pull
+}
+
+// registryIssuer returns the issuer of the registry tokens, REGISTRY_TOKEN_ISSUER or "jwt"
+func registryIssuer() string {
+	if issuer := os.Getenv("REGISTRY_TOKEN_ISSUER"); issuer != "" {
+		return issuer
+	}
+	return "jwt"
+}
+
+// registrySigningKey loads the RSA key of the PEM file REGISTRY_TOKEN_KEY
+func registrySigningKey() (*rsa.PrivateKey, error) {
+	registryKeyOnce.Do(func() {
+		path := os.Getenv("REGISTRY_TOKEN_KEY")
+		if path == "" {
+			registryKeyErr = errors.New("REGISTRY_TOKEN_KEY is not set")
+			return
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			registryKeyErr = err
+			return
+		}
+		block, _ := pem.Decode(data)
+		if block == nil {
+			registryKeyErr = errors.New("REGISTRY_TOKEN_KEY holds no PEM block")
+			return
+		}
+		if registryKey, registryKeyErr = x509.ParsePKCS1PrivateKey(block.Bytes); registryKeyErr == nil {
+			return
+		}
+		parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if key, isRSA := parsed.(*rsa.PrivateKey); err == nil && isRSA {
+			registryKey, registryKeyErr = key, nil
+			return
+		}
+		registryKeyErr = errors.New("REGISTRY_TOKEN_KEY holds no RSA private key")
+	})
+	return registryKey, registryKeyErr
+}
+
+// libtrustKeyID returns the key ID the registry derives from the keys of its rootcertbundle: the
+// first 240 bits of the SHA-256 of the public key, base32 encoded in groups of four
+func libtrustKeyID(key *rsa.PublicKey) string {
+	der, _ := x509.MarshalPKIXPublicKey(key)
+	sum := sha256.Sum256(der)
+	encoded := base32.StdEncoding.EncodeToString(sum[:30])
+
+	groups := make([]string, 0, len(encoded)/4)
+	for i := 0; i < len(encoded); i += 4 {
+		groups = append(groups, encoded[i:i+4])
+	}
+	return strings.Join(groups, ":")
+}
+
+// registryRuleSnapshot describes a registry rule for the API and the audit log
+func registryRuleSnapshot(rule models.RegistryRule) gin.H {
+	snapshot := gin.H{
+		"id":        rule.ID,
+		"type":      rule.Type,
+		"name":      rule.Name,
+		"actions":   nonNil(rule.Actions),
+		"createdAt": rule.CreatedAt,
+	}
+	if rule.Role != nil {
+		snapshot["role"] = rule.Role.Name
+	}
+	if rule.Group != nil {
+		snapshot["group"] = rule.Group.Name
+	}
+	return snapshot
+}
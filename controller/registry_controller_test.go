@@ -0,0 +1,137 @@
+package controller
+
+import (
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"jwt/initializers/dbtest"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestMatchRegistryName(t *testing.T) {
+	tests := []struct {
+		pattern  string
+		username string
+		name     string
+		want     bool
+	}{
+		{"team-a/app", "jdoe", "team-a/app", true},
+		{"team-a/app", "jdoe", "team-a/app2", false},
+		{"team-a/*", "jdoe", "team-a/app", true},
+		{"team-a/*", "jdoe", "team-a/tools/lint", true},
+		{"team-a/*", "jdoe", "team-b/app", false},
+		{"team-a/*", "jdoe", "team-a", false},
+		{"*", "jdoe", "anything/at/all", true},
+		{"*/base", "jdoe", "team-a/base", true},
+		{"team-?/app", "jdoe", "team-a/app", false}, // Only * is a wildcard
+		{"team.a/app", "jdoe", "teamXa/app", false},
+		{"${username}/*", "jdoe", "jdoe/app", true},
+		{"${username}/*", "jdoe", "asmith/app", false},
+		{"${username}/*", "jdoe", "jdoe2/app", false},
+		{"users/${username}", "jdoe", "users/jdoe", true},
+		{"${username}-*/${username}", "jdoe", "jdoe-ci/jdoe", true},
+		{"${username}/*", "j.doe", "jxdoe/app", false}, // The username is no pattern
+		{"${username}/*", "*", "jdoe/app", false},
+	}
+	for _, test := range tests {
+		if got := matchRegistryName(test.pattern, test.username, test.name); got != test.want {
+			t.Errorf("matchRegistryName(%q, %q, %q) = %v, want %v", test.pattern, test.username, test.name, got, test.want)
+		}
+	}
+}
+
+func TestParseRegistryScope(t *testing.T) {
+	tests := []struct {
+		scope   string
+		want    registryAccess
+		wantErr bool
+	}{
+		{"repository:team-a/app:pull,push", registryAccess{Type: "repository", Name: "team-a/app", Actions: []string{"pull", "push"}}, false},
+		{"repository:team-a/app:pull", registryAccess{Type: "repository", Name: "team-a/app", Actions: []string{"pull"}}, false},
+		{"registry:catalog:*", registryAccess{Type: "registry", Name: "catalog", Actions: []string{"*"}}, false},
+		// A registry host with a port in the name
+		{"repository:localhost:5000/app:pull", registryAccess{Type: "repository", Name: "localhost:5000/app", Actions: []string{"pull"}}, false},
+		{"repository:app:pull,,pull,push", registryAccess{Type: "repository", Name: "app", Actions: []string{"pull", "push"}}, false},
+		{"repository:app:", registryAccess{Type: "repository", Name: "app", Actions: []string{}}, false},
+		{"repository:app", registryAccess{}, true},
+		{"repository", registryAccess{}, true},
+		{"", registryAccess{}, true},
+	}
+	for _, test := range tests {
+		got, err := parseRegistryScope(test.scope)
+		if (err != nil) != test.wantErr {
+			t.Errorf("parseRegistryScope(%q) error = %v, want an error: %v", test.scope, err, test.wantErr)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("parseRegistryScope(%q) = %+v, want %+v", test.scope, got, test.want)
+		}
+	}
+}
+
+func TestLibtrustKeyID(t *testing.T) {
+	// The expected ID was computed with openssl: the SHA-256 of the DER public key, its first 30
+	// bytes in base32
+	const publicKey = `-----BEGIN PUBLIC KEY-----
+MIGfMA0GCSqGSIb3DQEBAQUAA4GNADCBiQKBgQCi8JKIo+/oWBB8zSLa3vauq6r6
+RnX9Fz2ke1SX+GvMe1cxngi4i71qcIZ7a/JGvbDzDzQMPdxxNWfGA4dardvb95VV
+zJ4G0pX5SsV3d1FXhZJV3GZvodDFaqj+yUX0Y7rFVDIT4gPq6g8nN+ofirEDfoyD
+AoEc8sLV2ek7PfcxdwIDAQAB
+-----END PUBLIC KEY-----`
+	block, _ := pem.Decode([]byte(publicKey))
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id := libtrustKeyID(key.(*rsa.PublicKey)); id != "52WX:E7CF:MGRE:EUAJ:D3Q3:EPAU:KT46:CILM:ZSM3:F2IJ:SXA5:AZP5" {
+		t.Errorf("libtrustKeyID() = %s", id)
+	}
+}
+
+func TestRegistryUser(t *testing.T) {
+	dbtest.Open(t)
+	organization, err := defaultOrganization()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A user named like the email address of another, created first
+	impostor := createTestUser(t, organization.ID, "jdoe@example.org", "mallory@example.org")
+	user := createTestUser(t, organization.ID, "jdoe", "jdoe@example.org")
+
+	tests := []struct {
+		name     string
+		username string
+		password string
+		wantID   uint
+		wantOK   bool
+	}{
+		{"by name", "jdoe", "password", user.ID, true},
+		{"by email", "jdoe@example.org", "password", user.ID, true},
+		{"local part of an email", "mallory", "password", 0, false},
+		{"impostor by email", "mallory@example.org", "password", impostor.ID, true},
+		{"wrong password", "jdoe", "wrong", 0, false},
+		{"unknown user", "nobody", "password", 0, false},
+	}
+	gin.SetMode(gin.TestMode)
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c, _ := gin.CreateTestContext(httptest.NewRecorder())
+			c.Request = httptest.NewRequest(http.MethodGet, "/v2/token", nil)
+			c.Request.SetBasicAuth(test.username, test.password)
+			c.Set(OrganizationContextKey, organization)
+
+			got, writable, authenticated, ok := registryUser(c)
+			if ok != test.wantOK || authenticated != test.wantOK || got.ID != test.wantID {
+				t.Errorf("registryUser() = user %d, ok %v, want user %d, ok %v", got.ID, ok, test.wantID, test.wantOK)
+			}
+			if ok && !writable {
+				t.Error("a password sign-in is read-only")
+			}
+		})
+	}
+}
@@ -0,0 +1,478 @@
+package controller
+
+import (
+	"errors"
+	"fmt"
+	"jwt/initializers"
+	"jwt/models"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// Kinds of role constraints
+const (
+	ConstraintStatic  = "static"
+	ConstraintDynamic = "dynamic"
+)
+
+type RoleConstraintData struct {
+	Name        string   `json:"name" binding:"required"`
+	Kind        string   `json:"kind" binding:"required"`  // "static" or "dynamic"
+	Roles       []string `json:"roles" binding:"required"` // Names of the mutually exclusive roles
+	MaxRoles    int      `json:"maxRoles"`                 // How many of the roles may be combined, 1 by default
+	Description string   `json:"description"`
+}
+
+// RoleConflictError is the error of a change or login that would combine roles a constraint forbids
+type RoleConflictError struct {
+	UserID     uint
+	Username   string
+	Constraint string
+	Kind       string
+	MaxRoles   int
+	Roles      []string // Roles of the constraint the user would combine
+}
+
+func (e *RoleConflictError) Error() string {
+	return fmt.Sprintf("%s cannot combine the roles %s: the %s constraint %s allows %d of them",
+		e.Username, strings.Join(e.Roles, ", "), e.Kind, e.Constraint, e.MaxRoles)
+}
+
+// CreateRoleConstraint handles declaring roles as mutually exclusive. Existing violations are not
+// removed, the violations report lists them.
+func CreateRoleConstraint(c *gin.Context) {
+	var input RoleConstraintData
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if input.Kind != ConstraintStatic && input.Kind != ConstraintDynamic {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid kind, use static or dynamic: " + input.Kind})
+		return
+	}
+	if input.MaxRoles == 0 {
+		input.MaxRoles = 1
+	}
+	names := uniqueStrings(input.Roles)
+	if len(names) < 2 || input.MaxRoles < 1 || input.MaxRoles >= len(names) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "A constraint needs at least two roles and maxRoles between 1 and the number of roles minus one"})
+		return
+	}
+
+	roles, err := findRolesByName(initializers.DBConn, tenantID(c), names)
+	var unknown membershipError
+	if errors.As(err, &unknown) {
+		c.JSON(unknown.status, gin.H{"error": unknown.message, "unknown": unknown.unknown})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	constraint := models.RoleConstraint{
+		OrganizationID: tenantID(c),
+		Name:           input.Name,
+		Kind:           input.Kind,
+		MaxRoles:       input.MaxRoles,
+		Description:    input.Description,
+	}
+	for _, role := range roles {
+		constraint.RoleIDs = append(constraint.RoleIDs, role.ID)
+	}
+	if err := initializers.DBConn.Create(&constraint).Error; err != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "A constraint with this name already exists"})
+		return
+	}
+
+	snapshot := roleConstraintSnapshot(constraint, roleNamesByID(constraint.RoleIDs))
+	recordAudit(c, "role_constraint.create", "role_constraint", constraint.ID, nil, snapshot)
+	c.JSON(http.StatusOK, snapshot)
+}
+
+// ListRoleConstraints retrieves the constraints of the organization
+func ListRoleConstraints(c *gin.Context) {
+	var constraints []models.RoleConstraint
+	tenantDB(c).Order("name").Find(&constraints)
+
+	var roleIDs []uint
+	for _, constraint := range constraints {
+		roleIDs = append(roleIDs, constraint.RoleIDs...)
+	}
+	names := roleNamesByID(roleIDs)
+
+	list := []gin.H{}
+	for _, constraint := range constraints {
+		list = append(list, roleConstraintSnapshot(constraint, names))
+	}
+	c.JSON(http.StatusOK, gin.H{"constraints": list})
+}
+
+// DeleteRoleConstraint handles removing a constraint
+func DeleteRoleConstraint(c *gin.Context) {
+	var constraint models.RoleConstraint
+	if err := tenantDB(c).First(&constraint, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Constraint not found"})
+		return
+	}
+
+	if err := initializers.DBConn.Delete(&constraint).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	recordAudit(c, "role_constraint.delete", "role_constraint", constraint.ID, roleConstraintSnapshot(constraint, roleNamesByID(constraint.RoleIDs)), nil)
+	c.JSON(http.StatusOK, gin.H{"message": "Constraint deleted"})
+}
+
+// RoleConstraintViolations reports the users of the organization that combine roles of a constraint.
+// Static violations existed before the constraint was declared; users listed for a dynamic
+// constraint hold the roles and only get some of them active per session.
+func RoleConstraintViolations(c *gin.Context) {
+	var constraints []models.RoleConstraint
+	tenantDB(c).Order("name").Find(&constraints)
+
+	var users []models.User
+	tenantDB(c).Select("id", "name").Order("name").Find(&users)
+	var userIDs []uint
+	for _, user := range users {
+		userIDs = append(userIDs, user.ID)
+	}
+	held, err := effectiveRoleIDs(initializers.DBConn, userIDs)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load the roles of the users"})
+		return
+	}
+
+	var roleIDs []uint
+	for _, constraint := range constraints {
+		roleIDs = append(roleIDs, constraint.RoleIDs...)
+	}
+	names := roleNamesByID(roleIDs)
+
+	violations := []gin.H{}
+	for _, user := range users {
+		for _, constraint := range constraints {
+			if conflict := roleConflict(constraint, held[user.ID]); conflict != nil {
+				roles := []string{}
+				for _, id := range conflict {
+					roles = append(roles, names[id])
+				}
+				sort.Strings(roles)
+				violations = append(violations, gin.H{
+					"userId":     user.ID,
+					"username":   user.Name,
+					"constraint": constraint.Name,
+					"kind":       constraint.Kind,
+					"maxRoles":   constraint.MaxRoles,
+					"roles":      roles,
+				})
+			}
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{"violations": violations})
+}
+
+// RegisterRoleConstraintChecks makes every write to user_roles, user_groups and role_groups check the
+// static constraints of the affected users in the same transaction, whatever code path writes them.
+// The check runs before gorm commits the transaction of a create, a conflict then rolls it back.
+func RegisterRoleConstraintChecks(db *gorm.DB) error {
+	return db.Callback().Create().After("gorm:save_after_associations").Before("gorm:commit_or_rollback_transaction").
+		Register("role_constraints:check", checkRoleConstraintsCallback)
+}
+
+// checkRoleConstraintsCallback fails the create when a new membership combines conflicting roles
+func checkRoleConstraintsCallback(db *gorm.DB) {
+	if db.Error != nil || db.Statement.Schema == nil {
+		return
+	}
+
+	tx := db.Session(&gorm.Session{NewDB: true})
+	var userIDs []uint
+	switch db.Statement.Table {
+	case "user_roles", "user_groups":
+		userIDs = joinRowIDs(db, "UserID")
+	case "role_groups":
+		// Members of the groups inherit the role
+		if groupIDs := joinRowIDs(db, "GroupID"); len(groupIDs) > 0 {
+			if err := tx.Table("user_groups").Where("group_id IN ?", groupIDs).Distinct().Pluck("user_id", &userIDs).Error; err != nil {
+				db.AddError(err)
+				return
+			}
+		}
+	default:
+		return
+	}
+
+	if err := checkStaticConstraints(tx, userIDs); err != nil {
+		db.AddError(err)
+	}
+}
+
+// joinRowIDs collects a foreign key from the rows of a join table create
+func joinRowIDs(db *gorm.DB, name string) []uint {
+	field := db.Statement.Schema.LookUpField(name)
+	if field == nil {
+		return nil
+	}
+
+	var ids []uint
+	collect := func(row reflect.Value) {
+		if value, zero := field.ValueOf(db.Statement.Context, row); !zero {
+			if id, ok := value.(uint); ok {
+				ids = append(ids, id)
+			}
+		}
+	}
+	switch rows := db.Statement.ReflectValue; rows.Kind() {
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < rows.Len(); i++ {
+			collect(reflect.Indirect(rows.Index(i)))
+		}
+	case reflect.Struct:
+		collect(rows)
+	}
+	return uniqueIDs(ids)
+}
+
+// checkStaticConstraints returns a RoleConflictError for the first of the users that holds more roles
+// of a static constraint than it allows
+func checkStaticConstraints(db *gorm.DB, userIDs []uint) error {
+	if len(userIDs) == 0 {
+		return nil
+	}
+
+	var users []models.User
+	if err := db.Select("id", "name", "organization_id").Where("id IN ?", userIDs).Order("id").Find(&users).Error; err != nil {
+		return err
+	}
+	var organizationIDs []uint
+	for _, user := range users {
+		organizationIDs = append(organizationIDs, user.OrganizationID)
+	}
+	var constraints []models.RoleConstraint
+	if err := db.Where("kind = ? AND organization_id IN ?", ConstraintStatic, uniqueIDs(organizationIDs)).Order("name").Find(&constraints).Error; err != nil {
+		return err
+	}
+	if len(constraints) == 0 {
+		return nil
+	}
+
+	held, err := effectiveRoleIDs(db, userIDs)
+	if err != nil {
+		return err
+	}
+	for _, user := range users {
+		for _, constraint := range constraints {
+			if constraint.OrganizationID != user.OrganizationID {
+				continue
+			}
+			if conflict := roleConflict(constraint, held[user.ID]); conflict != nil {
+				return &RoleConflictError{
+					UserID:     user.ID,
+					Username:   user.Name,
+					Constraint: constraint.Name,
+					Kind:       constraint.Kind,
+					MaxRoles:   constraint.MaxRoles,
+					Roles:      namesOfRoles(db, conflict),
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// checkDynamicConstraints returns a RoleConflictError when the roles activated together break a dynamic constraint
+func checkDynamicConstraints(user models.User, roles []models.Role) error {
+	held := map[uint]bool{}
+	for _, role := range roles {
+		held[role.ID] = true
+	}
+	for _, constraint := range dynamicConstraints(user.OrganizationID) {
+		if conflict := roleConflict(constraint, held); conflict != nil {
+			return &RoleConflictError{
+				UserID:     user.ID,
+				Username:   user.Name,
+				Constraint: constraint.Name,
+				Kind:       constraint.Kind,
+				MaxRoles:   constraint.MaxRoles,
+				Roles:      namesOfRoles(initializers.DBConn, conflict),
+			}
+		}
+	}
+	return nil
+}
+
+// ApplyRoleActivation limits the loaded roles of the user to those active in the session: the roles
+// chosen at login, or else all roles except those the user combines against a dynamic constraint
+func ApplyRoleActivation(user *models.User, activated []string) {
+	keep := map[uint]bool{}
+	if activated != nil {
+		names := map[string]bool{}
+		for _, name := range activated {
+			names[name] = true
+		}
+		for _, role := range user.Roles {
+			keep[role.ID] = names[role.Name]
+		}
+	} else {
+		for _, role := range user.Roles {
+			keep[role.ID] = true
+		}
+		for _, constraint := range dynamicConstraints(user.OrganizationID) {
+			for _, id := range roleConflict(constraint, keep) {
+				keep[id] = false
+			}
+		}
+	}
+
+	roles := []models.Role{}
+	for _, role := range user.Roles {
+		if keep[role.ID] {
+			roles = append(roles, role)
+		}
+	}
+	user.Roles = roles
+}
+
+// activateRoles checks the roles a user chose at login: the user has to hold them and they have
+// to satisfy the dynamic constraints. The loaded roles are limited to them.
+func activateRoles(user *models.User, requested []string) error {
+	held := map[string]models.Role{}
+	for _, role := range user.Roles {
+		held[role.Name] = role
+	}
+	var roles []models.Role
+	for _, name := range uniqueStrings(requested) {
+		role, ok := held[name]
+		if !ok {
+			return membershipError{status: http.StatusBadRequest, message: "You do not have the role " + name}
+		}
+		roles = append(roles, role)
+	}
+	if err := checkDynamicConstraints(*user, roles); err != nil {
+		return err
+	}
+	ApplyRoleActivation(user, requested)
+	return nil
+}
+
+// dynamicConstraints loads the dynamic constraints of an organization
+func dynamicConstraints(organizationID uint) []models.RoleConstraint {
+	var constraints []models.RoleConstraint
+	initializers.DBConn.Where("kind = ? AND organization_id = ?", ConstraintDynamic, organizationID).Order("name").Find(&constraints)
+	return constraints
+}
+
+// roleConflict returns the roles of the constraint among the held ones when there are more than it allows, or nil
+func roleConflict(constraint models.RoleConstraint, held map[uint]bool) []uint {
+	var conflict []uint
+	for _, id := range constraint.RoleIDs {
+		if held[id] {
+			conflict = append(conflict, id)
+		}
+	}
+	if len(conflict) <= constraint.MaxRoles {
+		return nil
+	}
+	return conflict
+}
+
+// effectiveRoleIDs returns the roles of each user, those granted directly and those of the user's groups.
+// Ended time-bound grants are left out.
+func effectiveRoleIDs(db *gorm.DB, userIDs []uint) (map[uint]map[uint]bool, error) {
+	held := map[uint]map[uint]bool{}
+	if len(userIDs) == 0 {
+		return held, nil
+	}
+
+	var rows []struct {
+		UserID uint
+		RoleID uint
+	}
+	if err := db.Table("user_roles").Select("user_id, role_id").
+		Where("user_id IN ? AND (expires_at IS NULL OR expires_at > ?)", userIDs, time.Now()).
+		Scan(&rows).Error; err != nil {
+		return nil, err
+	}
+	var inherited []struct {
+		UserID uint
+		RoleID uint
+	}
+	if err := db.Table("user_groups").Select("user_groups.user_id, role_groups.role_id").
+		Joins("JOIN role_groups ON role_groups.group_id = user_groups.group_id").
+		Where("user_groups.user_id IN ?", userIDs).
+		Scan(&inherited).Error; err != nil {
+		return nil, err
+	}
+
+	for _, row := range append(rows, inherited...) {
+		if held[row.UserID] == nil {
+			held[row.UserID] = map[uint]bool{}
+		}
+		held[row.UserID][row.RoleID] = true
+	}
+	return held, nil
+}
+
+// respondWithRoleConflict answers 409 when err is a separation-of-duties violation and reports whether it did
+func respondWithRoleConflict(c *gin.Context, err error) bool {
+	var conflict *RoleConflictError
+	if !errors.As(err, &conflict) {
+		return false
+	}
+	c.JSON(http.StatusConflict, gin.H{
+		"error":      conflict.Error(),
+		"userId":     conflict.UserID,
+		"constraint": conflict.Constraint,
+		"roles":      conflict.Roles,
+	})
+	return true
+}
+
+// roleNamesByID loads the names of roles
+func roleNamesByID(ids []uint) map[uint]string {
+	names := map[uint]string{}
+	if len(ids) == 0 {
+		return names
+	}
+	var roles []models.Role
+	initializers.DBConn.Select("id", "name").Where("id IN ?", uniqueIDs(ids)).Find(&roles)
+	for _, role := range roles {
+		names[role.ID] = role.Name
+	}
+	return names
+}
+
+// namesOfRoles returns the sorted names of roles
+func namesOfRoles(db *gorm.DB, ids []uint) []string {
+	names := []string{}
+	db.Model(&models.Role{}).Where("id IN ?", ids).Order("name").Pluck("name", &names)
+	return names
+}
+
+// roleConstraintSnapshot describes a constraint for responses and the audit log, deleted roles are left out
+func roleConstraintSnapshot(constraint models.RoleConstraint, names map[uint]string) gin.H {
+	roles := []string{}
+	for _, id := range constraint.RoleIDs {
+		if name, ok := names[id]; ok {
+			roles = append(roles, name)
+		}
+	}
+	sort.Strings(roles)
+	return gin.H{
+		"id":          constraint.ID,
+		"name":        constraint.Name,
+		"kind":        constraint.Kind,
+		"roles":       roles,
+		"maxRoles":    constraint.MaxRoles,
+		"description": constraint.Description,
+		"createdAt":   constraint.CreatedAt,
+	}
+}
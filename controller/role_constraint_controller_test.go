@@ -0,0 +1,275 @@
+package controller
+
+import (
+	"encoding/json"
+	"errors"
+	"jwt/initializers"
+	"jwt/initializers/dbtest"
+	"jwt/models"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// newConstraintTest registers the constraint checks and creates the roles payments-create and
+// payments-approve with a constraint of the kind allowing one of them
+func newConstraintTest(t *testing.T, kind string) (models.Organization, models.Role, models.Role) {
+	t.Helper()
+	dbtest.Open(t)
+	if err := RegisterRoleConstraintChecks(initializers.DBConn); err != nil {
+		t.Fatal(err)
+	}
+	organization, err := defaultOrganization()
+	if err != nil {
+		t.Fatal(err)
+	}
+	create := createTestRole(t, organization.ID, "payments-create")
+	approve := createTestRole(t, organization.ID, "payments-approve")
+	constraint := models.RoleConstraint{OrganizationID: organization.ID, Name: "payments", Kind: kind, RoleIDs: []uint{create.ID, approve.ID}, MaxRoles: 1}
+	if err := initializers.DBConn.Create(&constraint).Error; err != nil {
+		t.Fatal(err)
+	}
+	return organization, create, approve
+}
+
+func createTestRole(t *testing.T, organizationID uint, name string) models.Role {
+	t.Helper()
+	role := models.Role{OrganizationID: organizationID, Name: name}
+	if err := initializers.DBConn.Create(&role).Error; err != nil {
+		t.Fatal(err)
+	}
+	return role
+}
+
+func createTestGroup(t *testing.T, organizationID uint, name string) models.Group {
+	t.Helper()
+	group := models.Group{OrganizationID: organizationID, Name: name}
+	if err := initializers.DBConn.Create(&group).Error; err != nil {
+		t.Fatal(err)
+	}
+	return group
+}
+
+// grantTestRole writes a user_roles row outside of any transaction, like a single create in a handler
+func grantTestRole(user models.User, role models.Role, expiresAt *time.Time) error {
+	return initializers.DBConn.Create(&models.UserRole{UserID: user.ID, RoleID: role.ID, ExpiresAt: expiresAt}).Error
+}
+
+// assertRoleConflict checks that err is a conflict of the payments constraint
+func assertRoleConflict(t *testing.T, err error) {
+	t.Helper()
+	var conflict *RoleConflictError
+	if !errors.As(err, &conflict) {
+		t.Fatalf("err = %v, want a RoleConflictError", err)
+	}
+	if conflict.Constraint != "payments" || !reflect.DeepEqual(conflict.Roles, []string{"payments-approve", "payments-create"}) {
+		t.Errorf("conflict = %+v", conflict)
+	}
+}
+
+// heldRoleIDs returns the roles a user holds, the rolled back writes must not show up
+func heldRoleIDs(t *testing.T, user models.User) map[uint]bool {
+	t.Helper()
+	held, err := effectiveRoleIDs(initializers.DBConn, []uint{user.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return held[user.ID]
+}
+
+func TestStaticRoleConstraintDirectGrants(t *testing.T) {
+	organization, create, approve := newConstraintTest(t, ConstraintStatic)
+	user := createTestUser(t, organization.ID, "jdoe", "jdoe@example.org")
+
+	if err := grantTestRole(user, create, nil); err != nil {
+		t.Fatalf("first grant = %v", err)
+	}
+	assertRoleConflict(t, grantTestRole(user, approve, nil))
+	// The conflicting row was rolled back, not committed before the check
+	if held := heldRoleIDs(t, user); held[approve.ID] {
+		t.Errorf("held roles = %v, the conflicting grant was kept", held)
+	}
+
+	// A user without the other role is not affected
+	other := createTestUser(t, organization.ID, "asmith", "asmith@example.org")
+	if err := grantTestRole(other, approve, nil); err != nil {
+		t.Errorf("grant to another user = %v", err)
+	}
+}
+
+func TestStaticRoleConstraintThroughGroups(t *testing.T) {
+	organization, create, approve := newConstraintTest(t, ConstraintStatic)
+	user := createTestUser(t, organization.ID, "jdoe", "jdoe@example.org")
+	if err := grantTestRole(user, create, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// The group gets the other role while the user is a member
+	approvers := createTestGroup(t, organization.ID, "approvers")
+	if err := initializers.DBConn.Model(&approvers).Association("Members").Append(&user); err != nil {
+		t.Fatal(err)
+	}
+	assertRoleConflict(t, initializers.DBConn.Model(&approve).Association("Groups").Append(&approvers))
+	if held := heldRoleIDs(t, user); held[approve.ID] {
+		t.Errorf("held roles = %v, the role_groups row was kept", held)
+	}
+
+	// The user joins a group that has the other role
+	finance := createTestGroup(t, organization.ID, "finance")
+	other := createTestUser(t, organization.ID, "asmith", "asmith@example.org")
+	if err := initializers.DBConn.Model(&approve).Association("Groups").Append(&finance); err != nil {
+		t.Fatal(err)
+	}
+	if err := initializers.DBConn.Model(&finance).Association("Members").Append(&other); err != nil {
+		t.Fatalf("member without the other role = %v", err)
+	}
+	assertRoleConflict(t, initializers.DBConn.Model(&finance).Association("Members").Append(&user))
+	if members := groupMemberNames(t, finance); !reflect.DeepEqual(members, []string{"asmith"}) {
+		t.Errorf("finance members = %v, want [asmith]", members)
+	}
+}
+
+func TestStaticRoleConstraintTimeBoundGrants(t *testing.T) {
+	organization, create, approve := newConstraintTest(t, ConstraintStatic)
+	future, past := time.Now().Add(time.Hour), time.Now().Add(-time.Hour)
+
+	user := createTestUser(t, organization.ID, "jdoe", "jdoe@example.org")
+	if err := grantTestRole(user, create, &future); err != nil {
+		t.Fatal(err)
+	}
+	assertRoleConflict(t, grantTestRole(user, approve, nil))
+
+	// An ended grant that the expiry job has not removed yet does not count
+	ended := createTestUser(t, organization.ID, "asmith", "asmith@example.org")
+	if err := grantTestRole(ended, create, &past); err != nil {
+		t.Fatal(err)
+	}
+	if err := grantTestRole(ended, approve, nil); err != nil {
+		t.Errorf("grant next to an ended grant = %v", err)
+	}
+	if err := checkStaticConstraints(initializers.DBConn, []uint{user.ID, ended.ID}); err != nil {
+		t.Errorf("checkStaticConstraints() = %v", err)
+	}
+}
+
+func TestRoleConstraintViolations(t *testing.T) {
+	dbtest.Open(t)
+	organization, err := defaultOrganization()
+	if err != nil {
+		t.Fatal(err)
+	}
+	create := createTestRole(t, organization.ID, "payments-create")
+	approve := createTestRole(t, organization.ID, "payments-approve")
+
+	// The user combined the roles before the constraint was declared
+	user := createTestUser(t, organization.ID, "jdoe", "jdoe@example.org")
+	for _, role := range []models.Role{create, approve} {
+		if err := grantTestRole(user, role, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	createTestUser(t, organization.ID, "asmith", "asmith@example.org")
+	constraint := models.RoleConstraint{OrganizationID: organization.ID, Name: "payments", Kind: ConstraintStatic, RoleIDs: []uint{create.ID, approve.ID}, MaxRoles: 1}
+	if err := initializers.DBConn.Create(&constraint).Error; err != nil {
+		t.Fatal(err)
+	}
+	assertRoleConflict(t, checkStaticConstraints(initializers.DBConn, []uint{user.ID}))
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(func(c *gin.Context) { c.Set(OrganizationContextKey, organization) })
+	r.GET("/role-constraints/violations", RoleConstraintViolations)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/role-constraints/violations", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("violations = %d %s", w.Code, w.Body)
+	}
+
+	var output struct {
+		Violations []struct {
+			UserID     uint     `json:"userId"`
+			Constraint string   `json:"constraint"`
+			Roles      []string `json:"roles"`
+		} `json:"violations"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &output); err != nil {
+		t.Fatal(err)
+	}
+	if len(output.Violations) != 1 || output.Violations[0].UserID != user.ID || output.Violations[0].Constraint != "payments" ||
+		!reflect.DeepEqual(output.Violations[0].Roles, []string{"payments-approve", "payments-create"}) {
+		t.Errorf("violations = %+v, want jdoe for payments", output.Violations)
+	}
+}
+
+func TestDynamicRoleConstraint(t *testing.T) {
+	organization, create, approve := newConstraintTest(t, ConstraintDynamic)
+	auditor := createTestRole(t, organization.ID, "auditor")
+
+	// A dynamic constraint lets the user hold both roles, only not in one session
+	user := createTestUser(t, organization.ID, "jdoe", "jdoe@example.org")
+	for _, role := range []models.Role{create, approve, auditor} {
+		if err := grantTestRole(user, role, nil); err != nil {
+			t.Fatalf("grant of %s = %v", role.Name, err)
+		}
+	}
+
+	withRoles := func() models.User {
+		loaded := user
+		loaded.Roles = []models.Role{create, approve, auditor}
+		return loaded
+	}
+	roleNames := func(user models.User) []string {
+		names := []string{}
+		for _, role := range user.Roles {
+			names = append(names, role.Name)
+		}
+		return names
+	}
+
+	// Without a choice the conflicting roles stay inactive
+	all := withRoles()
+	ApplyRoleActivation(&all, nil)
+	if names := roleNames(all); !reflect.DeepEqual(names, []string{"auditor"}) {
+		t.Errorf("default roles = %v, want [auditor]", names)
+	}
+	chosen := withRoles()
+	if err := activateRoles(&chosen, []string{"payments-create", "auditor"}); err != nil {
+		t.Fatalf("activateRoles() = %v", err)
+	}
+	if names := roleNames(chosen); !reflect.DeepEqual(names, []string{"payments-create", "auditor"}) {
+		t.Errorf("chosen roles = %v", names)
+	}
+	both := withRoles()
+	assertRoleConflict(t, activateRoles(&both, []string{"payments-create", "payments-approve"}))
+
+	// The same through the login
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(func(c *gin.Context) { c.Set(OrganizationContextKey, organization) })
+	r.POST("/users/login", LoginUser)
+	tests := []struct {
+		name  string
+		roles string
+		want  int
+	}{
+		{"all roles", "", http.StatusOK},
+		{"one of the roles", `, "roles": ["payments-approve"]`, http.StatusOK},
+		{"both roles", `, "roles": ["payments-create", "payments-approve"]`, http.StatusConflict},
+		{"role the user does not hold", `, "roles": ["admin"]`, http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			body := `{"email": "jdoe@example.org", "password": "password", "forceTokenGen": true` + test.roles + `}`
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/users/login", strings.NewReader(body)))
+			if w.Code != test.want {
+				t.Errorf("login = %d %s, want %d", w.Code, w.Body, test.want)
+			}
+		})
+	}
+}
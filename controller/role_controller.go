@@ -6,6 +6,7 @@ import (
 	"net/http"
 
 	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
 )
 
 // CreateRole handles creating a new role
@@ -16,10 +17,30 @@ func CreateRole(c *gin.Context) {
 		return
 	}
 
-	if err := initializers.DBConn.Create(&role).Error; err != nil {
+	// Roles are created in the organization of the route, whatever the body says
+	role.OrganizationID = tenantID(c)
+	if err := checkTenantReferences(role.OrganizationID, role.Users, role.Groups); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Role " + err.Error()})
+		return
+	}
+
+	err := initializers.DBConn.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&role).Error; err != nil {
+			return err
+		}
+		if err := enqueueEvent(tx, "role.created", roleSnapshot(role)); err != nil {
+			return err
+		}
+		return recordAuditTx(tx, c, "role.create", "role", role.ID, nil, roleSnapshot(role))
+	})
+	if respondWithRoleConflict(c, err) {
+		return
+	}
+	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
+
 	c.JSON(http.StatusOK, role)
 }
 
@@ -28,7 +49,7 @@ func GetRole(c *gin.Context) {
 	var role models.Role
 	id := c.Param("id")
 
-	if err := initializers.DBConn.Preload("Users").Preload("Groups").First(&role, id).Error; err != nil {
+	if err := tenantDB(c).Preload("Users").Preload("Groups").First(&role, id).Error; err != nil {
 		c.JSON(http.StatusNotFound, gin.H{"error": "Role not found"})
 		return
 	}
@@ -40,25 +61,68 @@ func UpdateRole(c *gin.Context) {
 	var role models.Role
 	id := c.Param("id")
 
-	if err := initializers.DBConn.First(&role, id).Error; err != nil {
+	if err := tenantDB(c).First(&role, id).Error; err != nil {
 		c.JSON(http.StatusNotFound, gin.H{"error": "Role not found"})
 		return
 	}
 
+	before := roleSnapshot(role)
+	roleID := role.ID
+
 	if err := c.ShouldBindJSON(&role); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
-	initializers.DBConn.Save(&role)
+	// A role cannot be moved to another organization
+	role.ID = roleID
+	role.OrganizationID = tenantID(c)
+	if err := checkTenantReferences(role.OrganizationID, role.Users, role.Groups); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Role " + err.Error()})
+		return
+	}
+
+	err := initializers.DBConn.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Save(&role).Error; err != nil {
+			return err
+		}
+		if err := enqueueEvent(tx, "role.updated", gin.H{"before": before, "after": roleSnapshot(role)}); err != nil {
+			return err
+		}
+		return recordAuditTx(tx, c, "role.update", "role", role.ID, before, roleSnapshot(role))
+	})
+	if respondWithRoleConflict(c, err) {
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
 	c.JSON(http.StatusOK, role)
 }
 
 // DeleteRole handles deleting a role by ID
 func DeleteRole(c *gin.Context) {
+	var role models.Role
 	id := c.Param("id")
 
-	if err := initializers.DBConn.Delete(&models.Role{}, id).Error; err != nil {
+	// Fetch the role for the audit log
+	if err := tenantDB(c).First(&role, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Role not found"})
+		return
+	}
+
+	err := initializers.DBConn.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Delete(&models.Role{}, role.ID).Error; err != nil {
+			return err
+		}
+		if err := enqueueEvent(tx, "role.deleted", roleSnapshot(role)); err != nil {
+			return err
+		}
+		return recordAuditTx(tx, c, "role.delete", "role", role.ID, roleSnapshot(role), nil)
+	})
+	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
@@ -66,10 +130,10 @@ func DeleteRole(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{"message": "Role deleted"})
 }
 
-// ListRoles retrieves all roles
+// ListRoles retrieves all roles of the organization
 func ListRoles(c *gin.Context) {
 	var roles []models.Role
 
-	initializers.DBConn.Preload("Users").Preload("Groups").Find(&roles)
+	tenantDB(c).Preload("Users").Preload("Groups").Find(&roles)
 	c.JSON(http.StatusOK, roles)
 }
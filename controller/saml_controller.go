@@ -0,0 +1,425 @@
+package controller
+
+import (
+	"errors"
+	"jwt/initializers"
+	"jwt/models"
+	"jwt/saml"
+	"net/http"
+	"net/url"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+type SAMLProviderData struct {
+	Name              string   `json:"name" binding:"required"`
+	DisplayName       string   `json:"displayName"`
+	EntityID          string   `json:"entityId" binding:"required"`
+	SSOURL            string   `json:"ssoUrl" binding:"required"`
+	Certificate       string   `json:"certificate" binding:"required"`
+	EmailAttribute    string   `json:"emailAttribute"`
+	UsernameAttribute string   `json:"usernameAttribute"`
+	RolesAttribute    string   `json:"rolesAttribute"`
+	GroupsAttribute   string   `json:"groupsAttribute"`
+	AutoProvision     bool     `json:"autoProvision"`
+	DefaultRoles      []string `json:"defaultRoles"`
+	DefaultGroups     []string `json:"defaultGroups"`
+}
+
+// samlLoginTimeout is the time a user has to finish a login at the identity provider
+const samlLoginTimeout = 10 * time.Minute
+
+var errSAMLNoAccount = errors.New("no account exists for this user")
+
+// CreateSAMLProvider handles adding an upstream SAML identity provider
+func CreateSAMLProvider(c *gin.Context) {
+	var input SAMLProviderData
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if !providerNamePattern.MatchString(input.Name) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid provider name, use lower-case letters, digits and dashes: " + input.Name})
+		return
+	}
+	if u, err := url.Parse(input.SSOURL); err != nil || u.Host == "" || (u.Scheme != "https" && !isLoopbackHost(u.Hostname())) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid SSO URL, an https URL is required: " + input.SSOURL})
+		return
+	}
+	if _, err := saml.ParseCertificates(input.Certificate); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid certificate: " + err.Error()})
+		return
+	}
+
+	// Default roles and groups have to exist, a typo would silently provision users without them
+	for _, roleName := range input.DefaultRoles {
+		if err := tenantDB(c).Where("name = ?", roleName).First(&models.Role{}).Error; err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid role name: " + roleName})
+			return
+		}
+	}
+	for _, groupName := range input.DefaultGroups {
+		if err := tenantDB(c).Where("name = ?", groupName).First(&models.Group{}).Error; err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid group name: " + groupName})
+			return
+		}
+	}
+
+	if input.DisplayName == "" {
+		input.DisplayName = input.Name
+	}
+	provider := models.SAMLProvider{
+		Name:              input.Name,
+		DisplayName:       input.DisplayName,
+		EntityID:          input.EntityID,
+		SSOURL:            input.SSOURL,
+		Certificate:       input.Certificate,
+		EmailAttribute:    input.EmailAttribute,
+		UsernameAttribute: input.UsernameAttribute,
+		RolesAttribute:    input.RolesAttribute,
+		GroupsAttribute:   input.GroupsAttribute,
+		AutoProvision:     input.AutoProvision,
+		DefaultRoles:      input.DefaultRoles,
+		DefaultGroups:     input.DefaultGroups,
+	}
+	if err := initializers.DBConn.Create(&provider).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	recordAudit(c, "saml_provider.create", "saml_provider", provider.ID, nil, provider)
+
+	sp, _ := samlServiceProvider(c, provider)
+	c.JSON(http.StatusOK, gin.H{
+		"provider":    provider,
+		"entityId":    sp.EntityID,
+		"acsUrl":      sp.ACSURL,
+		"metadataUrl": sp.EntityID,
+	})
+}
+
+// ListSAMLProviders retrieves all upstream SAML identity providers
+func ListSAMLProviders(c *gin.Context) {
+	var providers []models.SAMLProvider
+
+	initializers.DBConn.Find(&providers)
+	c.JSON(http.StatusOK, providers)
+}
+
+// DeleteSAMLProvider handles deleting a SAML identity provider and the identities linked through it
+func DeleteSAMLProvider(c *gin.Context) {
+	var provider models.SAMLProvider
+	id := c.Param("id")
+
+	if err := initializers.DBConn.First(&provider, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "SAML provider not found"})
+		return
+	}
+
+	if err := initializers.DBConn.Delete(&provider).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	recordAudit(c, "saml_provider.delete", "saml_provider", provider.ID, provider, nil)
+
+	c.JSON(http.StatusOK, gin.H{"message": "SAML provider deleted"})
+}
+
+// ListSAMLLoginProviders retrieves the SAML providers users can sign in with, for rendering login buttons
+func ListSAMLLoginProviders(c *gin.Context) {
+	var providers []models.SAMLProvider
+	initializers.DBConn.Order("name").Find(&providers)
+
+	list := []gin.H{}
+	for _, provider := range providers {
+		list = append(list, gin.H{
+			"name":        provider.Name,
+			"displayName": provider.DisplayName,
+			"loginUrl":    "/auth/saml/" + provider.Name + "/login",
+		})
+	}
+	c.JSON(http.StatusOK, list)
+}
+
+// SAMLMetadata serves the service provider metadata to register at the identity provider
+func SAMLMetadata(c *gin.Context) {
+	provider, ok := loadSAMLProvider(c)
+	if !ok {
+		return
+	}
+	sp, err := samlServiceProvider(c, provider)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	metadata, err := sp.Metadata()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate metadata"})
+		return
+	}
+	c.Data(http.StatusOK, "application/samlmetadata+xml", metadata)
+}
+
+// StartSAMLLogin handles redirecting the user to the identity provider with an AuthnRequest.
+// Optional query parameters: device (session name) and cookie=true (cookie mode login).
+func StartSAMLLogin(c *gin.Context) {
+	provider, ok := loadSAMLProvider(c)
+	if !ok {
+		return
+	}
+	sp, err := samlServiceProvider(c, provider)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	redirectURL, requestID, err := sp.AuthnRequestURL("")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create the AuthnRequest"})
+		return
+	}
+
+	// Logins that were abandoned at the provider are cleaned up here
+	initializers.DBConn.Where("expires_at < ?", time.Now()).Delete(&models.SAMLRequest{})
+	request := models.SAMLRequest{
+		RequestID:  requestID,
+		ProviderID: provider.ID,
+		Device:     c.Query("device"),
+		Cookie:     c.Query("cookie") == "true",
+		ExpiresAt:  time.Now().Add(samlLoginTimeout),
+	}
+	if err := initializers.DBConn.Create(&request).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save the AuthnRequest"})
+		return
+	}
+
+	// The identity provider POSTs the response from its own site, only SameSite=None cookies come along
+	bindLogin(c, SAMLRequestCookieName, requestID, http.SameSiteNoneMode, samlLoginTimeout)
+	c.Redirect(http.StatusFound, redirectURL)
+}
+
+// SAMLACS handles the SAMLResponse POSTed back by the identity provider: it validates the signed
+// assertion, links or provisions the user, maps the attributes and responds with a JWT like LoginUser
+func SAMLACS(c *gin.Context) {
+	provider, ok := loadSAMLProvider(c)
+	if !ok {
+		return
+	}
+	sp, err := samlServiceProvider(c, provider)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	assertion, err := sp.ParseResponse(c.PostForm("SAMLResponse"), time.Now())
+	if err != nil {
+		recordAuditAs(c, nil, "login.failure", "saml_provider", provider.ID, nil, gin.H{"provider": provider.Name, "reason": err.Error()})
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Login failed: " + strings.TrimPrefix(err.Error(), "saml: ")})
+		return
+	}
+
+	// Only the browser that started the login may finish it
+	if !boundLogin(c, SAMLRequestCookieName, assertion.InResponseTo, http.SameSiteNoneMode) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "The login was not started in this browser, start the login again"})
+		return
+	}
+
+	// Only answers to our own requests are accepted, each one once
+	var request models.SAMLRequest
+	err = initializers.DBConn.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("request_id = ? AND provider_id = ?", assertion.InResponseTo, provider.ID).First(&request).Error; err != nil {
+			return err
+		}
+		return tx.Delete(&request).Error
+	})
+	if assertion.InResponseTo == "" || err != nil || time.Now().After(request.ExpiresAt) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown or expired login request, start the login again"})
+		return
+	}
+
+	email := assertion.Attribute(provider.EmailAttribute)
+	if provider.EmailAttribute == "" {
+		email = assertion.NameID
+	}
+
+	user, err := linkSAMLIdentity(provider, assertion, email)
+	if errors.Is(err, errSAMLNoAccount) {
+		recordAuditAs(c, nil, "login.failure", "saml_provider", provider.ID, nil, gin.H{"provider": provider.Name, "email": email, "reason": err.Error()})
+		enqueueLoginFailure(c, email, err.Error())
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to link the SAML identity: " + err.Error()})
+		return
+	}
+
+	if err := applySAMLAttributes(c, provider, assertion, &user); err != nil {
+		if respondWithRoleConflict(c, err) {
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to map the SAML attributes: " + err.Error()})
+		return
+	}
+
+	recordAuditAs(c, &user, "login.success", "user", user.ID, nil, gin.H{"provider": provider.Name})
+	issueLoginToken(c, user, request.Device, request.Cookie, nil)
+}
+
+// loadSAMLProvider loads the provider named in the URL or responds with 404
+func loadSAMLProvider(c *gin.Context) (models.SAMLProvider, bool) {
+	var provider models.SAMLProvider
+	if err := initializers.DBConn.Where("name = ?", c.Param("provider")).First(&provider).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "SAML provider not found"})
+		return provider, false
+	}
+	return provider, true
+}
+
+// samlServiceProvider describes this service towards one identity provider.
+// The metadata URL is the SP entity ID, the ACS URL receives the responses.
+func samlServiceProvider(c *gin.Context, provider models.SAMLProvider) (*saml.ServiceProvider, error) {
+	base := publicBaseURL(c) + "/auth/saml/" + provider.Name
+	sp := &saml.ServiceProvider{
+		EntityID:    base + "/metadata",
+		ACSURL:      base + "/acs",
+		IdPEntityID: provider.EntityID,
+		IdPSSOURL:   provider.SSOURL,
+	}
+	certificates, err := saml.ParseCertificates(provider.Certificate)
+	if err != nil {
+		return sp, errors.New("invalid certificate of SAML provider " + provider.Name)
+	}
+	sp.IdPCertificate = certificates
+	return sp, nil
+}
+
+// linkSAMLIdentity returns the user of a NameID. Unknown NameIDs are linked to the user of the
+// default organization with the same email, or provisioned when the provider allows it.
+func linkSAMLIdentity(provider models.SAMLProvider, assertion *saml.Assertion, email string) (models.User, error) {
+	var user models.User
+	var link models.SAMLIdentity
+	err := initializers.DBConn.Where("provider_id = ? AND name_id = ?", provider.ID, assertion.NameID).First(&link).Error
+	if err == nil {
+		if err := initializers.DBConn.First(&user, link.UserID).Error; err != nil {
+			return user, err
+		}
+		link.LastLoginAt = time.Now()
+		return user, initializers.DBConn.Save(&link).Error
+	}
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return user, err
+	}
+
+	if !strings.Contains(email, "@") {
+		return user, errSAMLNoAccount
+	}
+	organization, err := defaultOrganization()
+	if err != nil {
+		return user, err
+	}
+	err = initializers.DBConn.Where("organization_id = ? AND LOWER(email) = LOWER(?)", organization.ID, email).First(&user).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		if !provider.AutoProvision {
+			return user, errSAMLNoAccount
+		}
+		user, err = provisionFederatedUser(email, assertion.Attribute(provider.UsernameAttribute), provider.DefaultRoles, provider.DefaultGroups)
+	}
+	if err != nil {
+		return user, err
+	}
+
+	link = models.SAMLIdentity{
+		ProviderID:  provider.ID,
+		NameID:      assertion.NameID,
+		UserID:      user.ID,
+		LastLoginAt: time.Now(),
+	}
+	return user, initializers.DBConn.Create(&link).Error
+}
+
+// applySAMLAttributes sets the roles and groups of the user from the configured attributes.
+// Values name roles and groups, unknown names are ignored and the provider's defaults are kept.
+// A missing attribute leaves the user unchanged.
+func applySAMLAttributes(c *gin.Context, provider models.SAMLProvider, assertion *saml.Assertion, user *models.User) error {
+	roleNames, hasRoles := assertion.Attributes[provider.RolesAttribute]
+	groupNames, hasGroups := assertion.Attributes[provider.GroupsAttribute]
+	hasRoles = hasRoles && provider.RolesAttribute != ""
+	hasGroups = hasGroups && provider.GroupsAttribute != ""
+	if !hasRoles && !hasGroups {
+		return nil
+	}
+
+	if err := initializers.DBConn.Preload("Roles").Preload("Groups").First(user, user.ID).Error; err != nil {
+		return err
+	}
+	before := userSnapshot(*user)
+
+	var roles []models.Role
+	var groups []models.Group
+	if hasRoles {
+		initializers.DBConn.Where("organization_id = ? AND name IN ?", user.OrganizationID, append(roleNames, provider.DefaultRoles...)).Order("name").Find(&roles)
+	}
+	if hasGroups {
+		initializers.DBConn.Where("organization_id = ? AND name IN ?", user.OrganizationID, append(groupNames, provider.DefaultGroups...)).Order("name").Find(&groups)
+	}
+
+	updated := *user
+	if hasRoles {
+		updated.Roles = roles
+	}
+	if hasGroups {
+		updated.Groups = groups
+	}
+	after := userSnapshot(updated)
+	sortSnapshotNames(before)
+	sortSnapshotNames(after)
+	if reflect.DeepEqual(before, after) {
+		return nil
+	}
+
+	// Replace the associations and announce role changes in one transaction
+	err := initializers.DBConn.Transaction(func(tx *gorm.DB) error {
+		if hasRoles {
+			if err := tx.Model(user).Association("Roles").Replace(roles); err != nil {
+				return err
+			}
+		}
+		if hasGroups {
+			if err := tx.Model(user).Association("Groups").Replace(groups); err != nil {
+				return err
+			}
+		}
+		if !reflect.DeepEqual(before["roles"], after["roles"]) {
+			return enqueueEvent(tx, "user.roles_changed", gin.H{
+				"user":     after,
+				"oldRoles": before["roles"],
+				"newRoles": after["roles"],
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	recordAuditAs(c, user, "user.update", "user", user.ID, before, after)
+	return nil
+}
+
+// sortSnapshotNames orders the role and group names of a user snapshot, so snapshots compare by content
+func sortSnapshotNames(snapshot gin.H) {
+	for _, key := range []string{"roles", "groups"} {
+		if names, ok := snapshot[key].([]string); ok {
+			sort.Strings(names)
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package controller
+
+import (
+	"jwt/initializers"
+	"jwt/initializers/dbtest"
+	"jwt/models"
+	"jwt/saml/samltest"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+const samlTestBaseURL = "https://sp.test"
+
+// newSAMLTestServer adds a provider for a generated identity provider and serves the SAML login routes
+func newSAMLTestServer(t *testing.T) (*samltest.IdentityProvider, *gin.Engine) {
+	t.Helper()
+	dbtest.Open(t)
+	t.Setenv("PUBLIC_BASE_URL", samlTestBaseURL)
+
+	idp, err := samltest.NewIdentityProvider("https://idp.test", "https://idp.test/sso")
+	if err != nil {
+		t.Fatal(err)
+	}
+	provider := models.SAMLProvider{
+		Name:          "idp",
+		EntityID:      idp.EntityID,
+		SSOURL:        idp.SSOURL,
+		Certificate:   idp.CertificatePEM(),
+		AutoProvision: true,
+	}
+	if err := initializers.DBConn.Create(&provider).Error; err != nil {
+		t.Fatal(err)
+	}
+	organization, err := defaultOrganization()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(func(c *gin.Context) { c.Set(OrganizationContextKey, organization) })
+	r.GET("/auth/saml/:provider/login", StartSAMLLogin)
+	r.POST("/auth/saml/:provider/acs", SAMLACS)
+	return idp, r
+}
+
+// startSAMLLogin follows the redirect to the identity provider and returns the ID of the AuthnRequest
+// with the cookie binding it to the browser
+func startSAMLLogin(t *testing.T, idp *samltest.IdentityProvider, r *gin.Engine) (string, *http.Cookie) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/auth/saml/idp/login", nil))
+	if w.Code != http.StatusFound {
+		t.Fatalf("login = %d %s, want a redirect", w.Code, w.Body)
+	}
+	requestID, _, err := idp.ParseAuthnRequest(w.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, cookie := range w.Result().Cookies() {
+		if cookie.Name == SAMLRequestCookieName {
+			return requestID, cookie
+		}
+	}
+	t.Fatal("login set no request cookie")
+	return "", nil
+}
+
+// postSAMLResponse posts a response to the ACS from a browser with the cookie, nil for another browser
+func postSAMLResponse(t *testing.T, idp *samltest.IdentityProvider, r *gin.Engine, inResponseTo string, cookie *http.Cookie) *httptest.ResponseRecorder {
+	t.Helper()
+	response, err := idp.Response(samltest.Login{
+		SPEntityID:   samlTestBaseURL + "/auth/saml/idp/metadata",
+		ACSURL:       samlTestBaseURL + "/auth/saml/idp/acs",
+		InResponseTo: inResponseTo,
+		NameID:       "jdoe@example.org",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	form := url.Values{"SAMLResponse": {response}}
+	req := httptest.NewRequest(http.MethodPost, "/auth/saml/idp/acs", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if cookie != nil {
+		req.AddCookie(cookie)
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func TestSAMLACS(t *testing.T) {
+	idp, r := newSAMLTestServer(t)
+
+	requestID, cookie := startSAMLLogin(t, idp, r)
+	if w := postSAMLResponse(t, idp, r, requestID, cookie); w.Code != http.StatusOK {
+		t.Fatalf("ACS = %d %s, want 200", w.Code, w.Body)
+	}
+	findUser(t, "jdoe@example.org")
+
+	// Each request is answered once
+	if w := postSAMLResponse(t, idp, r, requestID, cookie); w.Code != http.StatusBadRequest {
+		t.Errorf("replayed ACS = %d %s, want 400", w.Code, w.Body)
+	}
+}
+
+func TestSAMLACSRejectsUnknownRequests(t *testing.T) {
+	idp, r := newSAMLTestServer(t)
+	requestID, cookie := startSAMLLogin(t, idp, r)
+	_, otherCookie := startSAMLLogin(t, idp, r)
+
+	tests := []struct {
+		name         string
+		inResponseTo string
+		cookie       *http.Cookie
+	}{
+		{"unknown request", "_unknown", cookie},
+		{"IdP-initiated", "", cookie},
+		// Login CSRF: the attacker's own response posted by the victim's browser
+		{"another browser", requestID, nil},
+		{"cookie of another login", requestID, otherCookie},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if w := postSAMLResponse(t, idp, r, test.inResponseTo, test.cookie); w.Code != http.StatusBadRequest {
+				t.Errorf("ACS = %d %s, want 400", w.Code, w.Body)
+			}
+		})
+	}
+}
@@ -0,0 +1,904 @@
+package controller
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"jwt/initializers"
+	"jwt/models"
+	"jwt/utils"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// SCIM 2.0 (RFC 7643 / RFC 7644) provisioning API on top of users, groups and user_groups
+
+const (
+	scimUserSchema   = "urn:ietf:params:scim:schemas:core:2.0:User"
+	scimGroupSchema  = "urn:ietf:params:scim:schemas:core:2.0:Group"
+	scimListSchema   = "urn:ietf:params:scim:api:messages:2.0:ListResponse"
+	scimPatchSchema  = "urn:ietf:params:scim:api:messages:2.0:PatchOp"
+	scimErrorSchema  = "urn:ietf:params:scim:api:messages:2.0:Error"
+	scimMaxResults   = 200
+	scimContentType  = "application/scim+json"
+	scimMemberFilter = "groups.id IN (SELECT group_id FROM user_groups WHERE CAST(user_id AS TEXT) = ?)"
+	scimGroupFilter  = "users.id IN (SELECT user_id FROM user_groups WHERE CAST(group_id AS TEXT) = ?)"
+)
+
+// Filterable attributes of the resource types
+var (
+	scimUserAttributes = map[string]scimAttribute{
+		"id":           {column: "users.id", caseExact: true},
+		"username":     {column: "users.name"},
+		"emails":       {column: "users.email"},
+		"emails.value": {column: "users.email"},
+		"groups":       {membership: scimGroupFilter},
+		"groups.value": {membership: scimGroupFilter},
+	}
+	scimGroupAttributes = map[string]scimAttribute{
+		"id":            {column: "groups.id", caseExact: true},
+		"displayname":   {column: "groups.name"},
+		"members":       {membership: scimMemberFilter},
+		"members.value": {membership: scimMemberFilter},
+	}
+)
+
+// scimMemberPath matches the value path of a single member, e.g. members[value eq "2"]
+var scimMemberPath = regexp.MustCompile(`(?i)^members\[\s*value\s+eq\s+"([^"]*)"\s*\]$`)
+
+type scimMultiValue struct {
+	Value   string `json:"value"`
+	Display string `json:"display,omitempty"`
+	Type    string `json:"type,omitempty"`
+	Primary bool   `json:"primary,omitempty"`
+}
+
+type scimUserData struct {
+	UserName string           `json:"userName"`
+	Password string           `json:"password"`
+	Active   *bool            `json:"active"`
+	Emails   []scimMultiValue `json:"emails"`
+}
+
+type scimGroupData struct {
+	DisplayName string           `json:"displayName"`
+	Members     []scimMultiValue `json:"members"`
+}
+
+type scimPatchData struct {
+	Schemas    []string             `json:"schemas"`
+	Operations []scimPatchOperation `json:"Operations"`
+}
+
+type scimPatchOperation struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	Value json.RawMessage `json:"value"`
+}
+
+// scimBadRequest is a client error with a SCIM error type (RFC 7644, section 3.12)
+type scimBadRequest struct {
+	scimType string
+	detail   string
+}
+
+func (e scimBadRequest) Error() string { return e.detail }
+
+// scimJSON writes a SCIM response body
+func scimJSON(c *gin.Context, status int, body interface{}) {
+	c.Header("Content-Type", scimContentType)
+	c.JSON(status, body)
+}
+
+// scimError writes a SCIM error response
+func scimError(c *gin.Context, status int, scimType string, detail string) {
+	body := gin.H{
+		"schemas": []string{scimErrorSchema},
+		"status":  strconv.Itoa(status),
+		"detail":  detail,
+	}
+	if scimType != "" {
+		body["scimType"] = scimType
+	}
+	scimJSON(c, status, body)
+}
+
+// scimFail writes the SCIM error response matching err
+func scimFail(c *gin.Context, err error) {
+	var badRequest scimBadRequest
+	if errors.As(err, &badRequest) {
+		scimError(c, http.StatusBadRequest, badRequest.scimType, badRequest.detail)
+		return
+	}
+	var conflict *RoleConflictError
+	if errors.As(err, &conflict) {
+		scimError(c, http.StatusConflict, "", conflict.Error())
+		return
+	}
+	scimError(c, http.StatusInternalServerError, "", err.Error())
+}
+
+// scimLocation returns the absolute URL of a SCIM resource
+func scimLocation(c *gin.Context, resourceType string, id uint) string {
+	scheme := "http"
+	if c.Request.TLS != nil || c.GetHeader("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	return fmt.Sprintf("%s://%s%s/scim/v2/%s/%d", scheme, c.Request.Host, tenantPrefix(c), resourceType, id)
+}
+
+// scimUser maps a user to the SCIM User resource
+func scimUser(c *gin.Context, user models.User) gin.H {
+	groups := []gin.H{}
+	for _, group := range user.Groups {
+		groups = append(groups, gin.H{
+			"value":   strconv.FormatUint(uint64(group.ID), 10),
+			"display": group.Name,
+			"$ref":    scimLocation(c, "Groups", group.ID),
+		})
+	}
+	return gin.H{
+		"schemas":  []string{scimUserSchema},
+		"id":       strconv.FormatUint(uint64(user.ID), 10),
+		"userName": user.Name,
+		"active":   user.Active,
+		"emails":   []scimMultiValue{{Value: user.Email, Type: "work", Primary: true}},
+		"groups":   groups,
+		"meta": gin.H{
+			"resourceType": "User",
+			"location":     scimLocation(c, "Users", user.ID),
+		},
+	}
+}
+
+// scimGroup maps a group to the SCIM Group resource
+func scimGroup(c *gin.Context, group models.Group) gin.H {
+	members := []gin.H{}
+	for _, member := range group.Members {
+		members = append(members, gin.H{
+			"value":   strconv.FormatUint(uint64(member.ID), 10),
+			"display": member.Name,
+			"$ref":    scimLocation(c, "Users", member.ID),
+		})
+	}
+	return gin.H{
+		"schemas":     []string{scimGroupSchema},
+		"id":          strconv.FormatUint(uint64(group.ID), 10),
+		"displayName": group.Name,
+		"members":     members,
+		"meta": gin.H{
+			"resourceType": "Group",
+			"location":     scimLocation(c, "Groups", group.ID),
+		},
+	}
+}
+
+// scimList applies filter and pagination parameters to the query and writes a ListResponse
+func scimList(c *gin.Context, db *gorm.DB, attributes map[string]scimAttribute, schema string,
+	find func(db *gorm.DB) ([]gin.H, error)) {
+	if filter := c.Query("filter"); filter != "" {
+		condition, err := parseSCIMFilter(filter, attributes, schema)
+		if err != nil {
+			scimError(c, http.StatusBadRequest, "invalidFilter", err.Error())
+			return
+		}
+		db = db.Where(condition.SQL, condition.Args...)
+	}
+	// The query is used for both counting and fetching
+	db = db.Session(&gorm.Session{})
+
+	startIndex, err := strconv.Atoi(c.DefaultQuery("startIndex", "1"))
+	if err != nil || startIndex < 1 {
+		startIndex = 1
+	}
+	count, err := strconv.Atoi(c.DefaultQuery("count", strconv.Itoa(scimMaxResults)))
+	if err != nil || count < 0 || count > scimMaxResults {
+		count = scimMaxResults
+	}
+
+	var total int64
+	if err := db.Count(&total).Error; err != nil {
+		scimFail(c, err)
+		return
+	}
+
+	resources := []gin.H{}
+	if count > 0 {
+		resources, err = find(db.Offset(startIndex - 1).Limit(count))
+		if err != nil {
+			scimFail(c, err)
+			return
+		}
+	}
+
+	scimJSON(c, http.StatusOK, gin.H{
+		"schemas":      []string{scimListSchema},
+		"totalResults": total,
+		"startIndex":   startIndex,
+		"itemsPerPage": len(resources),
+		"Resources":    resources,
+	})
+}
+
+// bindSCIMPatch binds a PatchOp request body
+func bindSCIMPatch(c *gin.Context, input *scimPatchData) error {
+	if err := c.ShouldBindJSON(input); err != nil {
+		return scimBadRequest{"invalidSyntax", err.Error()}
+	}
+	for _, schema := range input.Schemas {
+		if schema == scimPatchSchema {
+			return nil
+		}
+	}
+	return scimBadRequest{"invalidSyntax", "PATCH requests must use the " + scimPatchSchema + " schema"}
+}
+
+// primaryEmail picks the primary email of a SCIM user, or the first one
+func primaryEmail(emails []scimMultiValue) string {
+	for _, email := range emails {
+		if email.Primary {
+			return email.Value
+		}
+	}
+	if len(emails) > 0 {
+		return emails[0].Value
+	}
+	return ""
+}
+
+// saveSCIMUser saves the changed fields of a user. Deactivating the user, the way identity providers
+// deprovision, ends the sessions and revokes the personal access tokens.
+func saveSCIMUser(user *models.User, wasActive bool) error {
+	return initializers.DBConn.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Omit("Groups", "Roles").Save(user).Error; err != nil {
+			return err
+		}
+		if wasActive && !user.Active {
+			_, err := revokeCredentials(tx, user.ID)
+			return err
+		}
+		return nil
+	})
+}
+
+// SCIMListUsers handles GET /scim/v2/Users
+func SCIMListUsers(c *gin.Context) {
+	scimList(c, tenantDB(c).Model(&models.User{}), scimUserAttributes, scimUserSchema, func(db *gorm.DB) ([]gin.H, error) {
+		var users []models.User
+		if err := db.Preload("Groups").Order("users.id").Find(&users).Error; err != nil {
+			return nil, err
+		}
+		resources := make([]gin.H, 0, len(users))
+		for _, user := range users {
+			resources = append(resources, scimUser(c, user))
+		}
+		return resources, nil
+	})
+}
+
+// SCIMGetUser handles GET /scim/v2/Users/:id
+func SCIMGetUser(c *gin.Context) {
+	var user models.User
+	if err := tenantDB(c).Preload("Groups").First(&user, c.Param("id")).Error; err != nil {
+		scimError(c, http.StatusNotFound, "", "User not found")
+		return
+	}
+	scimJSON(c, http.StatusOK, scimUser(c, user))
+}
+
+// SCIMCreateUser handles POST /scim/v2/Users
+func SCIMCreateUser(c *gin.Context) {
+	var input scimUserData
+	if err := c.ShouldBindJSON(&input); err != nil {
+		scimError(c, http.StatusBadRequest, "invalidSyntax", err.Error())
+		return
+	}
+	email := primaryEmail(input.Emails)
+	if input.UserName == "" || email == "" {
+		scimError(c, http.StatusBadRequest, "invalidValue", "userName and an email are required")
+		return
+	}
+
+	var existing int64
+	tenantDB(c).Model(&models.User{}).Where("name = ? OR email = ?", input.UserName, email).Count(&existing)
+	if existing > 0 {
+		scimError(c, http.StatusConflict, "uniqueness", "A user with this userName or email already exists")
+		return
+	}
+
+	// Provisioned users without a password can only sign in through other means
+	password := input.Password
+	if password == "" {
+		random, err := utils.GenerateRandomString(32)
+		if err != nil {
+			scimFail(c, err)
+			return
+		}
+		password = random
+	}
+	hashedPassword, err := utils.HashPassword(password)
+	if err != nil {
+		scimFail(c, err)
+		return
+	}
+
+	user := models.User{OrganizationID: tenantID(c), Name: input.UserName, Email: email, Password: hashedPassword}
+	if err := saveNewUser(initializers.DBConn, &user); err != nil {
+		scimFail(c, err)
+		return
+	}
+	// The column defaults to active, a new user has no credentials to revoke yet
+	if input.Active != nil && !*input.Active {
+		if err := initializers.DBConn.Model(&user).Update("active", false).Error; err != nil {
+			scimFail(c, err)
+			return
+		}
+	}
+
+	recordAudit(c, "user.create", "user", user.ID, nil, userSnapshot(user))
+	scimJSON(c, http.StatusCreated, scimUser(c, user))
+}
+
+// SCIMReplaceUser handles PUT /scim/v2/Users/:id
+func SCIMReplaceUser(c *gin.Context) {
+	var user models.User
+	if err := tenantDB(c).Preload("Groups").Preload("Roles").First(&user, c.Param("id")).Error; err != nil {
+		scimError(c, http.StatusNotFound, "", "User not found")
+		return
+	}
+
+	var input scimUserData
+	if err := c.ShouldBindJSON(&input); err != nil {
+		scimError(c, http.StatusBadRequest, "invalidSyntax", err.Error())
+		return
+	}
+	email := primaryEmail(input.Emails)
+	if input.UserName == "" || email == "" {
+		scimError(c, http.StatusBadRequest, "invalidValue", "userName and an email are required")
+		return
+	}
+
+	before := userSnapshot(user)
+	wasActive := user.Active
+	user.Name = input.UserName
+	user.Email = email
+	if input.Active != nil {
+		user.Active = *input.Active
+	}
+	if input.Password != "" {
+		hashedPassword, err := utils.HashPassword(input.Password)
+		if err != nil {
+			scimFail(c, err)
+			return
+		}
+		user.Password = hashedPassword
+	}
+
+	if err := saveSCIMUser(&user, wasActive); err != nil {
+		scimFail(c, err)
+		return
+	}
+
+	recordAudit(c, "user.update", "user", user.ID, before, userSnapshot(user))
+	scimJSON(c, http.StatusOK, scimUser(c, user))
+}
+
+// SCIMPatchUser handles PATCH /scim/v2/Users/:id
+func SCIMPatchUser(c *gin.Context) {
+	var user models.User
+	if err := tenantDB(c).Preload("Groups").Preload("Roles").First(&user, c.Param("id")).Error; err != nil {
+		scimError(c, http.StatusNotFound, "", "User not found")
+		return
+	}
+
+	var input scimPatchData
+	if err := bindSCIMPatch(c, &input); err != nil {
+		scimFail(c, err)
+		return
+	}
+
+	before := userSnapshot(user)
+	wasActive := user.Active
+	for _, operation := range input.Operations {
+		if err := applyUserPatch(&user, operation); err != nil {
+			scimFail(c, err)
+			return
+		}
+	}
+
+	if err := saveSCIMUser(&user, wasActive); err != nil {
+		scimFail(c, err)
+		return
+	}
+
+	recordAudit(c, "user.update", "user", user.ID, before, userSnapshot(user))
+	scimJSON(c, http.StatusOK, scimUser(c, user))
+}
+
+// applyUserPatch applies one PATCH operation to the user's userName, emails, password or active
+func applyUserPatch(user *models.User, operation scimPatchOperation) error {
+	op := strings.ToLower(operation.Op)
+	if op != "add" && op != "replace" {
+		return scimBadRequest{"mutability", "Only add and replace operations are supported for users"}
+	}
+
+	// Without a path the value holds the attributes to set
+	values := map[string]json.RawMessage{}
+	path := strings.TrimPrefix(strings.ToLower(operation.Path), strings.ToLower(scimUserSchema)+":")
+	if path == "" {
+		var object map[string]json.RawMessage
+		if err := json.Unmarshal(operation.Value, &object); err != nil {
+			return scimBadRequest{"invalidValue", "The value of an operation without path must be an object"}
+		}
+		for key, value := range object {
+			values[strings.ToLower(key)] = value
+		}
+	} else {
+		values[path] = operation.Value
+	}
+
+	for attribute, raw := range values {
+		switch {
+		case attribute == "username":
+			var name string
+			if err := json.Unmarshal(raw, &name); err != nil || name == "" {
+				return scimBadRequest{"invalidValue", "userName must be a non-empty string"}
+			}
+			user.Name = name
+		case attribute == "emails":
+			var emails []scimMultiValue
+			if err := json.Unmarshal(raw, &emails); err != nil || primaryEmail(emails) == "" {
+				return scimBadRequest{"invalidValue", "emails must contain at least one email"}
+			}
+			user.Email = primaryEmail(emails)
+		case strings.HasPrefix(attribute, "emails[") && strings.HasSuffix(attribute, "].value"):
+			// e.g. emails[type eq "work"].value, the user only has a single email
+			var email string
+			if err := json.Unmarshal(raw, &email); err != nil || email == "" {
+				return scimBadRequest{"invalidValue", "email must be a non-empty string"}
+			}
+			user.Email = email
+		case attribute == "password":
+			var password string
+			if err := json.Unmarshal(raw, &password); err != nil || password == "" {
+				return scimBadRequest{"invalidValue", "password must be a non-empty string"}
+			}
+			hashedPassword, err := utils.HashPassword(password)
+			if err != nil {
+				return err
+			}
+			user.Password = hashedPassword
+		case attribute == "active":
+			// Some clients send booleans as strings
+			var active interface{}
+			json.Unmarshal(raw, &active)
+			switch strings.ToLower(fmt.Sprint(active)) {
+			case "true":
+				user.Active = true
+			case "false":
+				user.Active = false
+			default:
+				return scimBadRequest{"invalidValue", "active must be a boolean"}
+			}
+		default:
+			return scimBadRequest{"invalidPath", "Unsupported attribute: " + attribute}
+		}
+	}
+	return nil
+}
+
+// SCIMDeleteUser handles DELETE /scim/v2/Users/:id
+func SCIMDeleteUser(c *gin.Context) {
+	var user models.User
+	if err := tenantDB(c).Preload("Groups").Preload("Roles").First(&user, c.Param("id")).Error; err != nil {
+		scimError(c, http.StatusNotFound, "", "User not found")
+		return
+	}
+
+	if err := deleteUserRecord(user); err != nil {
+		scimFail(c, err)
+		return
+	}
+
+	recordAudit(c, "user.delete", "user", user.ID, userSnapshot(user), nil)
+	c.Status(http.StatusNoContent)
+}
+
+// SCIMListGroups handles GET /scim/v2/Groups
+func SCIMListGroups(c *gin.Context) {
+	scimList(c, tenantDB(c).Model(&models.Group{}), scimGroupAttributes, scimGroupSchema, func(db *gorm.DB) ([]gin.H, error) {
+		var groups []models.Group
+		if err := db.Preload("Members").Order("groups.id").Find(&groups).Error; err != nil {
+			return nil, err
+		}
+		resources := make([]gin.H, 0, len(groups))
+		for _, group := range groups {
+			resources = append(resources, scimGroup(c, group))
+		}
+		return resources, nil
+	})
+}
+
+// SCIMGetGroup handles GET /scim/v2/Groups/:id
+func SCIMGetGroup(c *gin.Context) {
+	var group models.Group
+	if err := tenantDB(c).Preload("Members").First(&group, c.Param("id")).Error; err != nil {
+		scimError(c, http.StatusNotFound, "", "Group not found")
+		return
+	}
+	scimJSON(c, http.StatusOK, scimGroup(c, group))
+}
+
+// SCIMCreateGroup handles POST /scim/v2/Groups
+func SCIMCreateGroup(c *gin.Context) {
+	var input scimGroupData
+	if err := c.ShouldBindJSON(&input); err != nil {
+		scimError(c, http.StatusBadRequest, "invalidSyntax", err.Error())
+		return
+	}
+	if input.DisplayName == "" {
+		scimError(c, http.StatusBadRequest, "invalidValue", "displayName is required")
+		return
+	}
+
+	var existing int64
+	tenantDB(c).Model(&models.Group{}).Where("name = ?", input.DisplayName).Count(&existing)
+	if existing > 0 {
+		scimError(c, http.StatusConflict, "uniqueness", "A group with this displayName already exists")
+		return
+	}
+
+	members, err := scimMembers(initializers.DBConn, tenantID(c), input.Members)
+	if err != nil {
+		scimFail(c, err)
+		return
+	}
+
+	group := models.Group{OrganizationID: tenantID(c), Name: input.DisplayName, Members: members}
+	if err := initializers.DBConn.Create(&group).Error; err != nil {
+		scimFail(c, err)
+		return
+	}
+
+	recordAudit(c, "group.create", "group", group.ID, nil, groupSnapshot(group))
+	scimJSON(c, http.StatusCreated, scimGroup(c, group))
+}
+
+// SCIMReplaceGroup handles PUT /scim/v2/Groups/:id
+func SCIMReplaceGroup(c *gin.Context) {
+	var group models.Group
+	if err := tenantDB(c).Preload("Members").First(&group, c.Param("id")).Error; err != nil {
+		scimError(c, http.StatusNotFound, "", "Group not found")
+		return
+	}
+
+	var input scimGroupData
+	if err := c.ShouldBindJSON(&input); err != nil {
+		scimError(c, http.StatusBadRequest, "invalidSyntax", err.Error())
+		return
+	}
+	if input.DisplayName == "" {
+		scimError(c, http.StatusBadRequest, "invalidValue", "displayName is required")
+		return
+	}
+
+	members, err := scimMembers(initializers.DBConn, group.OrganizationID, input.Members)
+	if err != nil {
+		scimFail(c, err)
+		return
+	}
+
+	before := groupSnapshot(group)
+	err = initializers.DBConn.Transaction(func(tx *gorm.DB) error {
+		group.Name = input.DisplayName
+		if err := tx.Omit("Members").Save(&group).Error; err != nil {
+			return err
+		}
+		return tx.Model(&group).Association("Members").Replace(members)
+	})
+	if err != nil {
+		scimFail(c, err)
+		return
+	}
+
+	recordAudit(c, "group.update", "group", group.ID, before, groupSnapshot(group))
+	scimJSON(c, http.StatusOK, scimGroup(c, group))
+}
+
+// SCIMPatchGroup handles PATCH /scim/v2/Groups/:id
+func SCIMPatchGroup(c *gin.Context) {
+	var group models.Group
+	if err := tenantDB(c).First(&group, c.Param("id")).Error; err != nil {
+		scimError(c, http.StatusNotFound, "", "Group not found")
+		return
+	}
+
+	var input scimPatchData
+	if err := bindSCIMPatch(c, &input); err != nil {
+		scimFail(c, err)
+		return
+	}
+
+	before := groupSnapshot(group)
+	err := initializers.DBConn.Transaction(func(tx *gorm.DB) error {
+		for _, operation := range input.Operations {
+			if err := applyGroupPatch(tx, &group, operation); err != nil {
+				return err
+			}
+		}
+		return tx.Omit("Members").Save(&group).Error
+	})
+	if err != nil {
+		scimFail(c, err)
+		return
+	}
+
+	initializers.DBConn.Preload("Members").First(&group, group.ID)
+	recordAudit(c, "group.update", "group", group.ID, before, groupSnapshot(group))
+	scimJSON(c, http.StatusOK, scimGroup(c, group))
+}
+
+// applyGroupPatch applies one PATCH operation to the group's displayName or its members
+func applyGroupPatch(tx *gorm.DB, group *models.Group, operation scimPatchOperation) error {
+	op := strings.ToLower(operation.Op)
+	path := strings.TrimPrefix(operation.Path, scimGroupSchema+":")
+	members := tx.Model(group).Association("Members")
+
+	// Without a path the value holds the attributes to add or replace
+	if path == "" {
+		if op == "remove" {
+			return scimBadRequest{"noTarget", "remove operations need a path"}
+		}
+		var input scimGroupData
+		if err := json.Unmarshal(operation.Value, &input); err != nil {
+			return scimBadRequest{"invalidValue", "The value of an operation without path must be an object"}
+		}
+		if input.DisplayName != "" {
+			group.Name = input.DisplayName
+		}
+		if input.Members != nil {
+			users, err := scimMembers(tx, group.OrganizationID, input.Members)
+			if err != nil {
+				return err
+			}
+			if op == "replace" {
+				return members.Replace(users)
+			}
+			return members.Append(users)
+		}
+		return nil
+	}
+
+	switch {
+	case strings.EqualFold(path, "displayName"):
+		if op == "remove" {
+			return scimBadRequest{"mutability", "displayName is required"}
+		}
+		var name string
+		if err := json.Unmarshal(operation.Value, &name); err != nil || name == "" {
+			return scimBadRequest{"invalidValue", "displayName must be a non-empty string"}
+		}
+		group.Name = name
+		return nil
+
+	case strings.EqualFold(path, "members"):
+		var values []scimMultiValue
+		if len(operation.Value) > 0 {
+			if err := json.Unmarshal(operation.Value, &values); err != nil {
+				return scimBadRequest{"invalidValue", "members must be a list of members"}
+			}
+		}
+		users, err := scimMembers(tx, group.OrganizationID, values)
+		if err != nil {
+			return err
+		}
+		switch op {
+		case "add":
+			return members.Append(users)
+		case "replace":
+			return members.Replace(users)
+		case "remove":
+			// Without a value every member is removed
+			if len(values) == 0 {
+				return members.Clear()
+			}
+			return members.Delete(users)
+		}
+
+	case scimMemberPath.MatchString(path):
+		if op != "remove" {
+			return scimBadRequest{"invalidPath", "Member value paths are only supported for remove"}
+		}
+		users, err := scimMembers(tx, group.OrganizationID, []scimMultiValue{{Value: scimMemberPath.FindStringSubmatch(path)[1]}})
+		if err != nil {
+			return err
+		}
+		return members.Delete(users)
+
+	default:
+		return scimBadRequest{"invalidPath", "Unsupported attribute: " + path}
+	}
+	return scimBadRequest{"invalidSyntax", "Unsupported operation: " + operation.Op}
+}
+
+// scimMembers resolves SCIM member references to users of the organization
+func scimMembers(tx *gorm.DB, organizationID uint, values []scimMultiValue) ([]models.User, error) {
+	users := []models.User{}
+	for _, value := range values {
+		id, err := strconv.ParseUint(value.Value, 10, 64)
+		if err != nil {
+			return nil, scimBadRequest{"invalidValue", "Invalid member: " + value.Value}
+		}
+		var user models.User
+		if err := tx.Where("organization_id = ?", organizationID).First(&user, id).Error; err != nil {
+			return nil, scimBadRequest{"invalidValue", "Unknown member: " + value.Value}
+		}
+		users = append(users, user)
+	}
+	return users, nil
+}
+
+// SCIMDeleteGroup handles DELETE /scim/v2/Groups/:id
+func SCIMDeleteGroup(c *gin.Context) {
+	var group models.Group
+	if err := tenantDB(c).First(&group, c.Param("id")).Error; err != nil {
+		scimError(c, http.StatusNotFound, "", "Group not found")
+		return
+	}
+
+	err := initializers.DBConn.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&group).Association("Members").Clear(); err != nil {
+			return err
+		}
+		return tx.Delete(&models.Group{}, group.ID).Error
+	})
+	if err != nil {
+		scimFail(c, err)
+		return
+	}
+
+	recordAudit(c, "group.delete", "group", group.ID, groupSnapshot(group), nil)
+	c.Status(http.StatusNoContent)
+}
+
+// SCIMServiceProviderConfig handles GET /scim/v2/ServiceProviderConfig
+func SCIMServiceProviderConfig(c *gin.Context) {
+	scimJSON(c, http.StatusOK, gin.H{
+		"schemas":        []string{"urn:ietf:params:scim:schemas:core:2.0:ServiceProviderConfig"},
+		"patch":          gin.H{"supported": true},
+		"bulk":           gin.H{"supported": false, "maxOperations": 0, "maxPayloadSize": 0},
+		"filter":         gin.H{"supported": true, "maxResults": scimMaxResults},
+		"changePassword": gin.H{"supported": true},
+		"sort":           gin.H{"supported": false},
+		"etag":           gin.H{"supported": false},
+		"authenticationSchemes": []gin.H{{
+			"type":        "oauthbearertoken",
+			"name":        "Bearer Token",
+			"description": "A personal access token with the admin scope, or an admin JWT",
+			"primary":     true,
+		}},
+		"meta": gin.H{"resourceType": "ServiceProviderConfig"},
+	})
+}
+
+// scimResourceTypes describes the User and Group resource types
+func scimResourceTypes() []gin.H {
+	return []gin.H{
+		{
+			"schemas":     []string{"urn:ietf:params:scim:schemas:core:2.0:ResourceType"},
+			"id":          "User",
+			"name":        "User",
+			"endpoint":    "/Users",
+			"description": "User Account",
+			"schema":      scimUserSchema,
+			"meta":        gin.H{"resourceType": "ResourceType"},
+		},
+		{
+			"schemas":     []string{"urn:ietf:params:scim:schemas:core:2.0:ResourceType"},
+			"id":          "Group",
+			"name":        "Group",
+			"endpoint":    "/Groups",
+			"description": "Group",
+			"schema":      scimGroupSchema,
+			"meta":        gin.H{"resourceType": "ResourceType"},
+		},
+	}
+}
+
+// scimAttributeSchema describes a single attribute for the Schemas endpoint
+func scimAttributeSchema(name, attributeType string, multiValued, required bool, mutability, uniqueness string) gin.H {
+	return gin.H{
+		"name":        name,
+		"type":        attributeType,
+		"multiValued": multiValued,
+		"required":    required,
+		"caseExact":   false,
+		"mutability":  mutability,
+		"returned":    "default",
+		"uniqueness":  uniqueness,
+	}
+}
+
+// scimSchemas describes the supported attributes of the User and Group schemas
+func scimSchemas() []gin.H {
+	password := scimAttributeSchema("password", "string", false, false, "writeOnly", "none")
+	password["returned"] = "never"
+	return []gin.H{
+		{
+			"schemas":     []string{"urn:ietf:params:scim:schemas:core:2.0:Schema"},
+			"id":          scimUserSchema,
+			"name":        "User",
+			"description": "User Account",
+			"attributes": []gin.H{
+				scimAttributeSchema("userName", "string", false, true, "readWrite", "server"),
+				password,
+				scimAttributeSchema("active", "boolean", false, false, "readWrite", "none"),
+				scimAttributeSchema("emails", "complex", true, true, "readWrite", "server"),
+				scimAttributeSchema("groups", "complex", true, false, "readOnly", "none"),
+			},
+			"meta": gin.H{"resourceType": "Schema"},
+		},
+		{
+			"schemas":     []string{"urn:ietf:params:scim:schemas:core:2.0:Schema"},
+			"id":          scimGroupSchema,
+			"name":        "Group",
+			"description": "Group",
+			"attributes": []gin.H{
+				scimAttributeSchema("displayName", "string", false, true, "readWrite", "server"),
+				scimAttributeSchema("members", "complex", true, false, "readWrite", "none"),
+			},
+			"meta": gin.H{"resourceType": "Schema"},
+		},
+	}
+}
+
+// SCIMListResourceTypes handles GET /scim/v2/ResourceTypes
+func SCIMListResourceTypes(c *gin.Context) {
+	resourceTypes := scimResourceTypes()
+	scimJSON(c, http.StatusOK, gin.H{
+		"schemas":      []string{scimListSchema},
+		"totalResults": len(resourceTypes),
+		"startIndex":   1,
+		"itemsPerPage": len(resourceTypes),
+		"Resources":    resourceTypes,
+	})
+}
+
+// SCIMGetResourceType handles GET /scim/v2/ResourceTypes/:id
+func SCIMGetResourceType(c *gin.Context) {
+	for _, resourceType := range scimResourceTypes() {
+		if resourceType["id"] == c.Param("id") {
+			scimJSON(c, http.StatusOK, resourceType)
+			return
+		}
+	}
+	scimError(c, http.StatusNotFound, "", "Resource type not found")
+}
+
+// SCIMListSchemas handles GET /scim/v2/Schemas
+func SCIMListSchemas(c *gin.Context) {
+	schemas := scimSchemas()
+	scimJSON(c, http.StatusOK, gin.H{
+		"schemas":      []string{scimListSchema},
+		"totalResults": len(schemas),
+		"startIndex":   1,
+		"itemsPerPage": len(schemas),
+		"Resources":    schemas,
+	})
+}
+
+// SCIMGetSchema handles GET /scim/v2/Schemas/:id
+func SCIMGetSchema(c *gin.Context) {
+	for _, schema := range scimSchemas() {
+		if schema["id"] == c.Param("id") {
+			scimJSON(c, http.StatusOK, schema)
+			return
+		}
+	}
+	scimError(c, http.StatusNotFound, "", "Schema not found")
+}
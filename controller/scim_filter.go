@@ -0,0 +1,257 @@
+package controller
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// scimAttribute maps a SCIM attribute onto a SQL expression
+type scimAttribute struct {
+	column    string // SQL expression compared against the filter value
+	caseExact bool   // Whether string comparisons are case sensitive
+	// membership, when set, replaces the comparison for multi-valued references.
+	// It only supports "eq" and receives the filter value as its single argument.
+	membership string
+}
+
+// scimFilter is a parsed SCIM filter (RFC 7644, section 3.4.2.2) translated to a SQL condition
+type scimFilter struct {
+	SQL  string
+	Args []interface{}
+}
+
+// parseSCIMFilter parses a SCIM filter expression using the attribute mapping of a resource type
+func parseSCIMFilter(filter string, attributes map[string]scimAttribute, schemaURN string) (scimFilter, error) {
+	tokens, err := tokenizeSCIMFilter(filter)
+	if err != nil {
+		return scimFilter{}, err
+	}
+	p := &scimFilterParser{tokens: tokens, attributes: attributes, schemaURN: strings.ToLower(schemaURN)}
+	result, err := p.parseOr()
+	if err != nil {
+		return scimFilter{}, err
+	}
+	if p.pos != len(p.tokens) {
+		return scimFilter{}, fmt.Errorf("unexpected %q", p.tokens[p.pos].text)
+	}
+	return result, nil
+}
+
+type scimTokenKind int
+
+const (
+	scimWord   scimTokenKind = iota // attribute paths, operators and keywords
+	scimValue                       // JSON literals: strings, numbers, true, false, null
+	scimLParen                      // (
+	scimRParen                      // )
+)
+
+type scimToken struct {
+	kind  scimTokenKind
+	text  string
+	value interface{}
+}
+
+// tokenizeSCIMFilter splits a filter into words, JSON values and parentheses
+func tokenizeSCIMFilter(filter string) ([]scimToken, error) {
+	var tokens []scimToken
+	runes := []rune(filter)
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '(':
+			tokens = append(tokens, scimToken{kind: scimLParen, text: "("})
+			i++
+		case r == ')':
+			tokens = append(tokens, scimToken{kind: scimRParen, text: ")"})
+			i++
+		case r == '[' || r == ']':
+			return nil, errors.New("complex attribute filters are not supported")
+		case r == '"':
+			// Find the closing quote, honouring escapes, and decode the string as JSON
+			j := i + 1
+			for ; j < len(runes) && runes[j] != '"'; j++ {
+				if runes[j] == '\\' {
+					j++
+				}
+			}
+			if j >= len(runes) {
+				return nil, errors.New("unterminated string")
+			}
+			var value string
+			if err := json.Unmarshal([]byte(string(runes[i:j+1])), &value); err != nil {
+				return nil, fmt.Errorf("invalid string %s", string(runes[i:j+1]))
+			}
+			tokens = append(tokens, scimToken{kind: scimValue, text: string(runes[i : j+1]), value: value})
+			i = j + 1
+		default:
+			j := i
+			for j < len(runes) && !unicode.IsSpace(runes[j]) && runes[j] != '(' && runes[j] != ')' && runes[j] != '"' {
+				j++
+			}
+			word := string(runes[i:j])
+			var value interface{}
+			if word == "true" || word == "false" || word == "null" || (word[0] >= '0' && word[0] <= '9') || word[0] == '-' {
+				if err := json.Unmarshal([]byte(word), &value); err == nil {
+					tokens = append(tokens, scimToken{kind: scimValue, text: word, value: value})
+					i = j
+					continue
+				}
+			}
+			tokens = append(tokens, scimToken{kind: scimWord, text: word})
+			i = j
+		}
+	}
+	return tokens, nil
+}
+
+type scimFilterParser struct {
+	tokens     []scimToken
+	pos        int
+	attributes map[string]scimAttribute
+	schemaURN  string
+}
+
+func (p *scimFilterParser) peekWord(word string) bool {
+	return p.pos < len(p.tokens) && p.tokens[p.pos].kind == scimWord && strings.EqualFold(p.tokens[p.pos].text, word)
+}
+
+// parseOr parses: and-expression ("or" and-expression)*
+func (p *scimFilterParser) parseOr() (scimFilter, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return left, err
+	}
+	for p.peekWord("or") {
+		p.pos++
+		right, err := p.parseAnd()
+		if err != nil {
+			return right, err
+		}
+		left = scimFilter{SQL: "(" + left.SQL + " OR " + right.SQL + ")", Args: append(left.Args, right.Args...)}
+	}
+	return left, nil
+}
+
+// parseAnd parses: factor ("and" factor)*
+func (p *scimFilterParser) parseAnd() (scimFilter, error) {
+	left, err := p.parseFactor()
+	if err != nil {
+		return left, err
+	}
+	for p.peekWord("and") {
+		p.pos++
+		right, err := p.parseFactor()
+		if err != nil {
+			return right, err
+		}
+		left = scimFilter{SQL: "(" + left.SQL + " AND " + right.SQL + ")", Args: append(left.Args, right.Args...)}
+	}
+	return left, nil
+}
+
+// parseFactor parses: "not" "(" filter ")" | "(" filter ")" | attribute operator [value]
+func (p *scimFilterParser) parseFactor() (scimFilter, error) {
+	if p.pos >= len(p.tokens) {
+		return scimFilter{}, errors.New("unexpected end of filter")
+	}
+
+	negate := false
+	if p.peekWord("not") {
+		negate = true
+		p.pos++
+	}
+
+	if p.pos < len(p.tokens) && p.tokens[p.pos].kind == scimLParen {
+		p.pos++
+		inner, err := p.parseOr()
+		if err != nil {
+			return inner, err
+		}
+		if p.pos >= len(p.tokens) || p.tokens[p.pos].kind != scimRParen {
+			return scimFilter{}, errors.New("missing closing parenthesis")
+		}
+		p.pos++
+		inner.SQL = "(" + inner.SQL + ")"
+		if negate {
+			inner.SQL = "NOT " + inner.SQL
+		}
+		return inner, nil
+	}
+	if negate {
+		return scimFilter{}, errors.New(`"not" must be followed by a parenthesised filter`)
+	}
+
+	return p.parseComparison()
+}
+
+// parseComparison translates one "attribute operator value" expression to SQL
+func (p *scimFilterParser) parseComparison() (scimFilter, error) {
+	if p.pos+1 >= len(p.tokens) || p.tokens[p.pos].kind != scimWord || p.tokens[p.pos+1].kind != scimWord {
+		return scimFilter{}, fmt.Errorf("expected attribute and operator at %q", p.tokens[p.pos].text)
+	}
+	name := strings.ToLower(p.tokens[p.pos].text)
+	name = strings.TrimPrefix(name, p.schemaURN+":")
+	attribute, ok := p.attributes[name]
+	if !ok {
+		return scimFilter{}, fmt.Errorf("unsupported attribute %q", p.tokens[p.pos].text)
+	}
+	operator := strings.ToLower(p.tokens[p.pos+1].text)
+	p.pos += 2
+
+	if operator == "pr" {
+		if attribute.membership != "" {
+			return scimFilter{}, fmt.Errorf("operator pr is not supported for %q", name)
+		}
+		return scimFilter{SQL: "(" + attribute.column + " IS NOT NULL AND CAST(" + attribute.column + " AS TEXT) <> '')"}, nil
+	}
+
+	if p.pos >= len(p.tokens) || p.tokens[p.pos].kind != scimValue {
+		return scimFilter{}, fmt.Errorf("expected a value after %q", operator)
+	}
+	value := p.tokens[p.pos].value
+	p.pos++
+
+	if attribute.membership != "" {
+		if operator != "eq" {
+			return scimFilter{}, fmt.Errorf("only eq is supported for %q", name)
+		}
+		return scimFilter{SQL: attribute.membership, Args: []interface{}{fmt.Sprint(value)}}, nil
+	}
+
+	// Compare as text, so that numeric IDs can be matched with string values
+	column := "CAST(" + attribute.column + " AS TEXT)"
+	text := fmt.Sprint(value)
+	if !attribute.caseExact {
+		column = "LOWER(" + column + ")"
+		text = strings.ToLower(text)
+	}
+	like := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(text)
+
+	switch operator {
+	case "eq":
+		return scimFilter{SQL: column + " = ?", Args: []interface{}{text}}, nil
+	case "ne":
+		return scimFilter{SQL: column + " <> ?", Args: []interface{}{text}}, nil
+	case "co":
+		return scimFilter{SQL: column + " LIKE ?", Args: []interface{}{"%" + like + "%"}}, nil
+	case "sw":
+		return scimFilter{SQL: column + " LIKE ?", Args: []interface{}{like + "%"}}, nil
+	case "ew":
+		return scimFilter{SQL: column + " LIKE ?", Args: []interface{}{"%" + like}}, nil
+	case "gt":
+		return scimFilter{SQL: column + " > ?", Args: []interface{}{text}}, nil
+	case "ge":
+		return scimFilter{SQL: column + " >= ?", Args: []interface{}{text}}, nil
+	case "lt":
+		return scimFilter{SQL: column + " < ?", Args: []interface{}{text}}, nil
+	case "le":
+		return scimFilter{SQL: column + " <= ?", Args: []interface{}{text}}, nil
+	}
+	return scimFilter{}, fmt.Errorf("unsupported operator %q", operator)
+}
@@ -0,0 +1,128 @@
+package controller
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseSCIMFilter(t *testing.T) {
+	const (
+		userName = "LOWER(CAST(users.name AS TEXT))"
+		email    = "LOWER(CAST(users.email AS TEXT))"
+		userID   = "CAST(users.id AS TEXT)"
+	)
+	tests := []struct {
+		name     string
+		filter   string
+		wantSQL  string
+		wantArgs []interface{}
+	}{
+		// Operators, string values are compared in lower case unless the attribute is case exact
+		{"eq", `userName eq "JDoe"`, userName + " = ?", []interface{}{"jdoe"}},
+		{"ne", `userName ne "jdoe"`, userName + " <> ?", []interface{}{"jdoe"}},
+		{"co", `userName co "doe"`, userName + " LIKE ?", []interface{}{"%doe%"}},
+		{"sw", `userName sw "j"`, userName + " LIKE ?", []interface{}{"j%"}},
+		{"ew", `emails ew "@Example.org"`, email + " LIKE ?", []interface{}{"%@example.org"}},
+		{"gt", `id gt 10`, userID + " > ?", []interface{}{"10"}},
+		{"ge", `id ge "10"`, userID + " >= ?", []interface{}{"10"}},
+		{"lt", `id lt 10`, userID + " < ?", []interface{}{"10"}},
+		{"le", `id le 10`, userID + " <= ?", []interface{}{"10"}},
+		{"pr", `emails pr`, "(users.email IS NOT NULL AND CAST(users.email AS TEXT) <> '')", nil},
+		{"case exact attribute", `id eq "AbC"`, userID + " = ?", []interface{}{"AbC"}},
+		{"operator in upper case", `userName EQ "jdoe"`, userName + " = ?", []interface{}{"jdoe"}},
+		{"sub-attribute", `emails.value eq "jdoe@example.org"`, email + " = ?", []interface{}{"jdoe@example.org"}},
+		{"schema URN", `urn:ietf:params:scim:schemas:core:2.0:User:userName eq "jdoe"`, userName + " = ?", []interface{}{"jdoe"}},
+		{"escaped quote", `userName eq "j\"doe"`, userName + " = ?", []interface{}{`j"doe`}},
+		{"boolean value", `userName eq true`, userName + " = ?", []interface{}{"true"}},
+
+		// LIKE patterns escape their wildcards and the escape character
+		{"percent", `userName co "100%"`, userName + " LIKE ?", []interface{}{`%100\%%`}},
+		{"underscore", `userName sw "j_doe"`, userName + " LIKE ?", []interface{}{`j\_doe%`}},
+		{"backslash", `userName ew "corp\\jdoe"`, userName + " LIKE ?", []interface{}{`%corp\\jdoe`}},
+		{"no escaping for eq", `userName eq "j_doe%"`, userName + " = ?", []interface{}{"j_doe%"}},
+
+		// Precedence: not binds tighter than and, and tighter than or
+		{"and before or", `userName eq "a" or userName eq "b" and emails pr`,
+			"(" + userName + " = ? OR (" + userName + " = ? AND (users.email IS NOT NULL AND CAST(users.email AS TEXT) <> '')))",
+			[]interface{}{"a", "b"}},
+		{"parentheses", `(userName eq "a" or userName eq "b") and id eq 1`,
+			"(((" + userName + " = ? OR " + userName + " = ?)) AND " + userID + " = ?)",
+			[]interface{}{"a", "b", "1"}},
+		{"not", `not (userName eq "a") and id eq 1`,
+			"(NOT (" + userName + " = ?) AND " + userID + " = ?)",
+			[]interface{}{"a", "1"}},
+		{"left to right", `id eq 1 or id eq 2 or id eq 3`,
+			"((" + userID + " = ? OR " + userID + " = ?) OR " + userID + " = ?)",
+			[]interface{}{"1", "2", "3"}},
+		{"keywords in upper case", `userName eq "a" AND NOT (id eq 1)`,
+			"(" + userName + " = ? AND NOT (" + userID + " = ?))",
+			[]interface{}{"a", "1"}},
+
+		// Membership of multi-valued references becomes a subquery
+		{"groups", `groups eq "7"`, scimGroupFilter, []interface{}{"7"}},
+		{"groups.value with a number", `groups.value eq 7`, scimGroupFilter, []interface{}{"7"}},
+		{"membership combined", `groups eq "7" and not (groups eq "8")`,
+			"(" + scimGroupFilter + " AND NOT (" + scimGroupFilter + "))",
+			[]interface{}{"7", "8"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			filter, err := parseSCIMFilter(test.filter, scimUserAttributes, scimUserSchema)
+			if err != nil {
+				t.Fatalf("parseSCIMFilter(%s) = %v", test.filter, err)
+			}
+			if filter.SQL != test.wantSQL {
+				t.Errorf("SQL = %s\nwant  %s", filter.SQL, test.wantSQL)
+			}
+			if !reflect.DeepEqual(filter.Args, test.wantArgs) {
+				t.Errorf("Args = %q, want %q", filter.Args, test.wantArgs)
+			}
+		})
+	}
+
+	t.Run("group members", func(t *testing.T) {
+		filter, err := parseSCIMFilter(`displayName eq "Admins" and members.value eq "3"`, scimGroupAttributes, scimGroupSchema)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := "(LOWER(CAST(groups.name AS TEXT)) = ? AND " + scimMemberFilter + ")"
+		if filter.SQL != want || !reflect.DeepEqual(filter.Args, []interface{}{"admins", "3"}) {
+			t.Errorf("parseSCIMFilter() = %s %q", filter.SQL, filter.Args)
+		}
+	})
+}
+
+func TestParseSCIMFilterErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		filter  string
+		wantErr string
+	}{
+		{"unknown attribute", `nickName eq "jd"`, `unsupported attribute "nickName"`},
+		{"attribute of another schema", `urn:ietf:params:scim:schemas:core:2.0:Group:userName eq "jd"`, "unsupported attribute"},
+		{"unknown operator", `userName like "jd"`, `unsupported operator "like"`},
+		{"membership with another operator", `groups co "7"`, `only eq is supported for "groups"`},
+		{"membership present", `groups pr`, `operator pr is not supported for "groups"`},
+		{"missing value", `userName eq`, `expected a value after "eq"`},
+		{"value instead of an attribute", `"jdoe" eq userName`, "expected attribute and operator"},
+		{"missing operator", `userName`, "expected attribute and operator"},
+		{"empty", ``, "unexpected end of filter"},
+		{"dangling and", `userName eq "a" and`, "unexpected end of filter"},
+		{"trailing tokens", `userName eq "a" "b"`, `unexpected "\"b\""`},
+		{"missing parenthesis", `(userName eq "a"`, "missing closing parenthesis"},
+		{"extra parenthesis", `userName eq "a")`, `unexpected ")"`},
+		{"not without parentheses", `not userName eq "a"`, `"not" must be followed by a parenthesised filter`},
+		{"unterminated string", `userName eq "jdoe`, "unterminated string"},
+		{"invalid escape", `userName eq "\q"`, "invalid string"},
+		{"complex attribute filter", `emails[type eq "work"]`, "complex attribute filters are not supported"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := parseSCIMFilter(test.filter, scimUserAttributes, scimUserSchema)
+			if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Errorf("parseSCIMFilter(%s) = %v, want %q", test.filter, err, test.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,176 @@
+package controller
+
+import (
+	"jwt/initializers"
+	"jwt/models"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// createSession records a new login session for the user from the current request with the
+// roles chosen at login, nil for all roles
+func createSession(c *gin.Context, user models.User, device string, roles []string) (models.Session, error) {
+	userAgent := c.Request.UserAgent()
+	if device == "" {
+		device = deviceFromUserAgent(userAgent)
+	}
+
+	now := time.Now()
+	session := models.Session{
+		UserID:     user.ID,
+		Device:     device,
+		UserAgent:  userAgent,
+		IP:         c.ClientIP(),
+		LastSeenAt: now,
+		ExpiresAt:  now.Add(TokenLifetime),
+		Roles:      roles,
+	}
+	err := initializers.DBConn.Create(&session).Error
+	return session, err
+}
+
+// ActiveSession loads the session referenced by the "sid" claim if it is neither revoked nor expired
+func ActiveSession(claims map[string]interface{}) (models.Session, bool) {
+	sid, ok := claims["sid"].(float64)
+	if !ok {
+		return models.Session{}, false
+	}
+
+	var session models.Session
+	if err := initializers.DBConn.First(&session, uint(sid)).Error; err != nil {
+		return models.Session{}, false
+	}
+	if session.RevokedAt != nil || time.Now().After(session.ExpiresAt) {
+		return models.Session{}, false
+	}
+	return session, true
+}
+
+// revokeSessions revokes the active sessions of a user matching the optional extra condition
+func revokeSessions(userID uint, query string, args ...interface{}) error {
+	db := initializers.DBConn.Model(&models.Session{}).Where("user_id = ? AND revoked_at IS NULL", userID)
+	if query != "" {
+		db = db.Where(query, args...)
+	}
+	return db.Update("revoked_at", time.Now()).Error
+}
+
+// revokeCredentials ends every session of a user, revokes the personal access tokens and forgets the
+// stored JWT, returning the number of revoked access tokens
+func revokeCredentials(tx *gorm.DB, userID uint) (int64, error) {
+	now := time.Now()
+	result := tx.Model(&models.PersonalAccessToken{}).Where("user_id = ? AND revoked_at IS NULL", userID).Update("revoked_at", now)
+	if result.Error != nil {
+		return 0, result.Error
+	}
+	if err := tx.Model(&models.Session{}).Where("user_id = ? AND revoked_at IS NULL", userID).Update("revoked_at", now).Error; err != nil {
+		return 0, err
+	}
+	return result.RowsAffected, tx.Model(&models.User{}).Where("id = ?", userID).Update("jwt_token", "").Error
+}
+
+// deviceFromUserAgent derives a coarse device description from a user agent
+func deviceFromUserAgent(userAgent string) string {
+	ua := strings.ToLower(userAgent)
+	switch {
+	case ua == "":
+		return "Unknown"
+	case strings.Contains(ua, "iphone"), strings.Contains(ua, "ipad"):
+		return "iOS"
+	case strings.Contains(ua, "android"):
+		return "Android"
+	case strings.Contains(ua, "windows"):
+		return "Windows"
+	case strings.Contains(ua, "mac os"):
+		return "macOS"
+	case strings.Contains(ua, "linux"):
+		return "Linux"
+	case strings.Contains(ua, "curl"), strings.Contains(ua, "go-http-client"):
+		return "CLI"
+	}
+	return "Unknown"
+}
+
+// ListSessions retrieves the active sessions of the current user
+func ListSessions(c *gin.Context) {
+	user, ok := CurrentUser(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	var sessions []models.Session
+	if err := initializers.DBConn.Where("user_id = ? AND revoked_at IS NULL AND expires_at > ?", user.ID, time.Now()).
+		Order("last_seen_at DESC").Find(&sessions).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve sessions"})
+		return
+	}
+
+	currentID, _ := CurrentSessionID(c)
+	result := make([]gin.H, 0, len(sessions))
+	for _, session := range sessions {
+		result = append(result, gin.H{
+			"id":         session.ID,
+			"device":     session.Device,
+			"userAgent":  session.UserAgent,
+			"ip":         session.IP,
+			"createdAt":  session.CreatedAt,
+			"lastSeenAt": session.LastSeenAt,
+			"expiresAt":  session.ExpiresAt,
+			"current":    session.ID == currentID,
+		})
+	}
+	c.JSON(http.StatusOK, gin.H{"sessions": result})
+}
+
+// RevokeSession handles revoking one session of the current user by ID
+func RevokeSession(c *gin.Context) {
+	user, ok := CurrentUser(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	var session models.Session
+	id := c.Param("id")
+
+	if err := initializers.DBConn.Where("user_id = ?", user.ID).First(&session, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Session not found"})
+		return
+	}
+
+	if err := revokeSessions(user.ID, "id = ?", session.ID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke session"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Session revoked"})
+}
+
+// RevokeUserSessions handles revoking all sessions of any user of the organization by ID (admin only)
+func RevokeUserSessions(c *gin.Context) {
+	var user models.User
+	id := c.Param("id")
+
+	if err := tenantDB(c).First(&user, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+
+	if err := revokeSessions(user.ID, ""); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke sessions"})
+		return
+	}
+
+	// Forget the cached token so the next login starts a new session
+	if err := initializers.DBConn.Model(&user).Update("jwt_token", "").Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to clear the user's token"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "All sessions revoked"})
+}
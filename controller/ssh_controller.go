@@ -0,0 +1,257 @@
+package controller
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"jwt/initializers"
+	"jwt/models"
+	"jwt/sshca"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Extensions of the certificates when SSH_CERT_EXTENSIONS is not set, those ssh-keygen grants by default
+var defaultSSHExtensions = []string{
+	"permit-X11-forwarding", "permit-agent-forwarding", "permit-port-forwarding", "permit-pty", "permit-user-rc",
+}
+
+type SSHSignData struct {
+	PublicKey  string   `json:"publicKey" binding:"required"` // e.g. the content of ~/.ssh/id_ed25519.pub
+	Principals []string `json:"principals"`                   // Subset of the allowed principals, all of them by default
+	Validity   string   `json:"validity"`                     // e.g. "1h", at most SSH_CERT_VALIDITY
+}
+
+// SignSSHKey handles signing the SSH public key of the current user with the certificate authority
+// of the organization. The principals of the certificate are the user's name and the names of the
+// groups the user is a direct member of with SSH_GROUP_PRINCIPAL_PREFIX, so that sshd can map them
+// with AuthorizedPrincipalsFile.
+func SignSSHKey(c *gin.Context) {
+	var input SSHSignData
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	key, err := sshca.ParseAuthorizedKey(input.PublicKey)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid public key: " + err.Error()})
+		return
+	}
+
+	user, _ := CurrentUser(c)
+	allowed, err := sshPrincipals(user)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve the principals"})
+		return
+	}
+	principals := allowed
+	if len(input.Principals) > 0 {
+		principals = uniqueStrings(input.Principals)
+		for _, principal := range principals {
+			if !containsAny(allowed, []string{principal}) {
+				c.JSON(http.StatusForbidden, gin.H{"error": "Principal not allowed: " + principal})
+				return
+			}
+		}
+	}
+	// sshd accepts a certificate without principals for every account
+	if len(principals) == 0 {
+		c.JSON(http.StatusForbidden, gin.H{"error": "No principals allowed"})
+		return
+	}
+
+	maxValidity := sshMaxValidity()
+	validity := maxValidity
+	if input.Validity != "" {
+		validity, err = time.ParseDuration(input.Validity)
+		if err != nil || validity <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid validity: " + input.Validity})
+			return
+		}
+		if validity > maxValidity {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "The validity can be at most " + maxValidity.String()})
+			return
+		}
+	}
+
+	authority, err := sshAuthority(tenantID(c))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load the SSH certificate authority"})
+		return
+	}
+	signer, err := sshSigner(authority)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load the SSH certificate authority"})
+		return
+	}
+
+	var serial [8]byte
+	if _, err := rand.Read(serial[:]); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to sign the key"})
+		return
+	}
+	organization, _ := CurrentOrganization(c)
+	now := time.Now()
+	certificate := sshca.Certificate{
+		Key:             key,
+		Serial:          binary.BigEndian.Uint64(serial[:]),
+		CertType:        sshca.UserCert,
+		KeyID:           user.Name + "@" + organization.Name,
+		Principals:      principals,
+		ValidAfter:      now.Add(-5 * time.Minute), // Tolerate clocks of servers running behind
+		ValidBefore:     now.Add(validity),
+		CriticalOptions: sshCriticalOptions(),
+		Extensions:      sshExtensions(),
+	}
+	signed, err := certificate.Sign(signer)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to sign the key: " + err.Error()})
+		return
+	}
+
+	recordAudit(c, "ssh.sign", "user", user.ID, nil, gin.H{
+		"serial":      certificate.Serial,
+		"fingerprint": key.Fingerprint(),
+		"principals":  principals,
+		"validBefore": certificate.ValidBefore,
+	})
+	c.JSON(http.StatusOK, gin.H{
+		"certificate": signed.AuthorizedKey(),
+		"serial":      certificate.Serial,
+		"keyId":       certificate.KeyID,
+		"principals":  principals,
+		"validAfter":  certificate.ValidAfter,
+		"validBefore": certificate.ValidBefore,
+	})
+}
+
+// SSHCAPublicKey retrieves the public key of the organization's certificate authority as a line for
+// the TrustedUserCAKeys file of sshd
+func SSHCAPublicKey(c *gin.Context) {
+	authority, err := sshAuthority(tenantID(c))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load the SSH certificate authority"})
+		return
+	}
+	c.String(http.StatusOK, authority.PublicKey+"\n")
+}
+
+// sshAuthority returns the certificate authority of the organization, generating its key on first use
+func sshAuthority(organizationID uint) (models.SSHCertificateAuthority, error) {
+	var authority models.SSHCertificateAuthority
+	err := initializers.DBConn.Where("organization_id = ?", organizationID).First(&authority).Error
+	if err == nil {
+		return authority, nil
+	}
+
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return authority, err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		return authority, err
+	}
+	authority = models.SSHCertificateAuthority{
+		OrganizationID: organizationID,
+		PrivateKey:     string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})),
+		PublicKey:      sshca.Ed25519PublicKey(public, "ssh-ca").AuthorizedKey(),
+	}
+	if err := initializers.DBConn.Create(&authority).Error; err != nil {
+		// Another request generated the key at the same time, use that one
+		authority = models.SSHCertificateAuthority{}
+		return authority, initializers.DBConn.Where("organization_id = ?", organizationID).First(&authority).Error
+	}
+	return authority, nil
+}
+
+// sshSigner decodes the private key of the certificate authority
+func sshSigner(authority models.SSHCertificateAuthority) (ed25519.PrivateKey, error) {
+	block, _ := pem.Decode([]byte(authority.PrivateKey))
+	if block == nil {
+		return nil, errors.New("no PEM data")
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, errors.New("not an ed25519 key")
+	}
+	return signer, nil
+}
+
+// sshPrincipals returns the principals the user may get certificates for: the user's name and the
+// names of the groups the user is a direct member of with SSH_GROUP_PRINCIPAL_PREFIX ("group:" by
+// default). The user's name is left out when it equals the principal of a group of the organization,
+// the user would otherwise log in wherever the members of the group may.
+func sshPrincipals(user models.User) ([]string, error) {
+	prefix := envOrDefault("SSH_GROUP_PRINCIPAL_PREFIX", "group:")
+	var memberships []models.Group
+	if err := initializers.DBConn.Model(&user).Association("Groups").Find(&memberships); err != nil {
+		return nil, err
+	}
+
+	principals := []string{}
+	if groupName, isGroupPrincipal := strings.CutPrefix(user.Name, prefix); isGroupPrincipal {
+		var groups int64
+		err := initializers.DBConn.Model(&models.Group{}).
+			Where("organization_id = ? AND name = ?", user.OrganizationID, groupName).Count(&groups).Error
+		if err != nil {
+			return nil, err
+		}
+		if groups == 0 {
+			principals = append(principals, user.Name)
+		}
+	} else {
+		principals = append(principals, user.Name)
+	}
+	for _, group := range memberships {
+		principals = append(principals, prefix+group.Name)
+	}
+	return uniqueStrings(principals), nil
+}
+
+// sshMaxValidity returns SSH_CERT_VALIDITY, how long certificates are valid for at most, 8h by default
+func sshMaxValidity() time.Duration {
+	if configured, err := time.ParseDuration(os.Getenv("SSH_CERT_VALIDITY")); err == nil && configured > 0 {
+		return configured
+	}
+	return 8 * time.Hour
+}
+
+// sshExtensions returns the extensions of SSH_CERT_EXTENSIONS, a comma separated list, or the defaults.
+// "none" grants no extensions, e.g. for certificates limited to a forced command.
+func sshExtensions() map[string]string {
+	names := defaultSSHExtensions
+	if configured := os.Getenv("SSH_CERT_EXTENSIONS"); configured != "" {
+		names = strings.Split(configured, ",")
+	}
+	extensions := map[string]string{}
+	for _, name := range names {
+		if name = strings.TrimSpace(name); name != "" && name != "none" {
+			extensions[name] = ""
+		}
+	}
+	return extensions
+}
+
+// sshCriticalOptions returns the critical options of SSH_CERT_FORCE_COMMAND and SSH_CERT_SOURCE_ADDRESS
+func sshCriticalOptions() map[string]string {
+	options := map[string]string{}
+	if command := os.Getenv("SSH_CERT_FORCE_COMMAND"); command != "" {
+		options["force-command"] = command
+	}
+	if addresses := os.Getenv("SSH_CERT_SOURCE_ADDRESS"); addresses != "" {
+		options["source-address"] = addresses
+	}
+	return options
+}
@@ -0,0 +1,146 @@
+package controller
+
+import (
+	"jwt/initializers"
+	"jwt/models"
+	"jwt/utils"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// TokenScopes lists the scopes a personal access token can be granted.
+// "read" allows safe (GET) requests, "write" allows changes and "admin" allows the admin-only routes.
+// Each scope includes the ones before it.
+var TokenScopes = map[string]bool{
+	"read":  true,
+	"write": true,
+	"admin": true,
+}
+
+// scopesIncluding lists the scopes that include a scope
+var scopesIncluding = map[string][]string{
+	"read":  {"read", "write", "admin"},
+	"write": {"write", "admin"},
+	"admin": {"admin"},
+}
+
+type TokenData struct {
+	Name      string    `json:"name" binding:"required"`
+	Scopes    []string  `json:"scopes" binding:"required"`
+	ExpiresAt time.Time `json:"expiresAt" binding:"required"`
+}
+
+// CreateAccessToken handles creating a new personal access token for the current user
+func CreateAccessToken(c *gin.Context) {
+	user, ok := CurrentUser(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	// Tokens may only be created from a real login, never from another token
+	if _, isToken := CurrentScopes(c); isToken {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Personal access tokens cannot create tokens"})
+		return
+	}
+
+	var input TokenData
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	for _, scope := range input.Scopes {
+		if !TokenScopes[scope] {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid scope: " + scope})
+			return
+		}
+	}
+
+	if !input.ExpiresAt.After(time.Now()) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Expiry date must be in the future"})
+		return
+	}
+
+	token, hash, err := utils.GenerateAccessToken()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token"})
+		return
+	}
+
+	accessToken := models.PersonalAccessToken{
+		Name:      input.Name,
+		TokenHash: hash,
+		Prefix:    token[:len(utils.AccessTokenPrefix)+6],
+		Scopes:    input.Scopes,
+		UserID:    user.ID,
+		ExpiresAt: input.ExpiresAt,
+	}
+
+	if err := initializers.DBConn.Create(&accessToken).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save token"})
+		return
+	}
+
+	// The plain token is only ever returned here
+	c.JSON(http.StatusOK, gin.H{
+		"message":     "Token created successfully",
+		"token":       token,
+		"accessToken": accessToken,
+	})
+}
+
+// ListAccessTokens retrieves all personal access tokens of the current user
+func ListAccessTokens(c *gin.Context) {
+	user, ok := CurrentUser(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	var tokens []models.PersonalAccessToken
+	if err := initializers.DBConn.Where("user_id = ?", user.ID).Order("created_at").Find(&tokens).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve tokens"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"tokens": tokens})
+}
+
+// RevokeAccessToken handles revoking a personal access token of the current user by ID
+func RevokeAccessToken(c *gin.Context) {
+	user, ok := CurrentUser(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	var token models.PersonalAccessToken
+	id := c.Param("id")
+
+	if err := initializers.DBConn.Where("user_id = ?", user.ID).First(&token, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Token not found"})
+		return
+	}
+
+	if token.RevokedAt == nil {
+		now := time.Now()
+		token.RevokedAt = &now
+		if err := initializers.DBConn.Save(&token).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke token"})
+			return
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Token revoked"})
+}
+
+// tokenHasScope reports whether the scopes of a personal access token include the required scope
+func tokenHasScope(scopes []string, required string) bool {
+	including, known := scopesIncluding[required]
+	if !known {
+		including = []string{required}
+	}
+	return containsAny(scopes, including)
+}
@@ -1,13 +1,16 @@
 package controller
 
 import (
+	"errors"
 	"fmt"
 	"jwt/initializers"
 	"jwt/models"
 	"jwt/utils"
 	"net/http"
+	"reflect"
 
 	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
 )
 
 type SigninData struct {
@@ -16,6 +19,8 @@ type SigninData struct {
 	Password string   `json:"password" bindings:"required"`
 	Roles    []string `json:"roles"`
 	Groups   []string `json:"groups"`
+
+	Attributes map[string]string `json:"attributes"` // Free-form attributes for the policies, e.g. "department", admins only
 }
 
 type UpdateData struct {
@@ -23,9 +28,11 @@ type UpdateData struct {
 	Email    string   `json:"email"`
 	Roles    []string `json:"roles"`
 	Groups   []string `json:"groups"`
+
+	Attributes map[string]string `json:"attributes"` // Replaces the attributes when given, admins only
 }
 
-// CreateUser handles creating a new user
+// CreateUser handles creating a new user (admin only)
 func CreateUser(c *gin.Context) {
 	input := SigninData{}
 
@@ -34,6 +41,9 @@ func CreateUser(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
+	if !canSetAttributes(c, input.Attributes) {
+		return
+	}
 
 	// Hash the password before saving the user
 	hashedPassword, err := utils.HashPassword(input.Password)
@@ -43,9 +53,11 @@ func CreateUser(c *gin.Context) {
 	}
 
 	user := models.User{
-		Name:     input.Username,
-		Email:    input.Email,
-		Password: hashedPassword, // Store hashed password here
+		OrganizationID: tenantID(c),
+		Name:           input.Username,
+		Email:          input.Email,
+		Password:       hashedPassword, // Store hashed password here
+		Attributes:     input.Attributes,
 	}
 
 	// Update roles by name
@@ -53,7 +65,7 @@ func CreateUser(c *gin.Context) {
 		var roles []models.Role
 		for _, roleName := range input.Roles {
 			var role models.Role
-			if err := initializers.DBConn.Where("name = ?", roleName).First(&role).Error; err != nil {
+			if err := tenantDB(c).Where("name = ?", roleName).First(&role).Error; err != nil {
 				// Ensure roleName is treated as a string
 				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid role name: " + string(roleName)})
 				return
@@ -68,7 +80,7 @@ func CreateUser(c *gin.Context) {
 		var groups []models.Group
 		for _, groupName := range input.Groups {
 			var group models.Group
-			if err := initializers.DBConn.Where("name = ?", groupName).First(&group).Error; err != nil {
+			if err := tenantDB(c).Where("name = ?", groupName).First(&group).Error; err != nil {
 				// Ensure groupName is treated as a string
 				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid group name: " + string(groupName)})
 				return
@@ -78,32 +90,15 @@ func CreateUser(c *gin.Context) {
 		user.Groups = groups
 	}
 
-	// Save the user in the database
-	if err := initializers.DBConn.Create(&user).Error; err != nil {
+	if err := saveNewUser(initializers.DBConn, &user); err != nil {
+		if respondWithRoleConflict(c, err) {
+			return
+		}
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
-	// Generate RSA keys with expiration
-	privateKeyPEM, publicKeyPEM, expiresAt, err := utils.GenerateRSAKeys()
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate RSA keys"})
-		return
-	}
-
-	// Save RSA keys in the database
-	rsaKey := models.RSAKeyPair{
-		PrivateKey: privateKeyPEM,
-		PublicKey:  publicKeyPEM,
-		UserID:     user.ID,
-		ExpiresAt:  expiresAt,
-		IsActive:   true,
-	}
-
-	if err := initializers.DBConn.Create(&rsaKey).Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save RSA keys"})
-		return
-	}
+	recordAudit(c, "user.create", "user", user.ID, nil, userSnapshot(user))
 
 	c.JSON(http.StatusOK, gin.H{
 		"message": "User created successfully",
@@ -115,19 +110,71 @@ func CreateUser(c *gin.Context) {
 	})
 }
 
-// GetUser retrieves a single user by ID along with RSA key, groups, and roles
+// saveNewUser stores a new user together with a fresh RSA key pair and the "user.created" outbox event.
+// Pass a transaction to create the user as part of a larger change.
+func saveNewUser(db *gorm.DB, user *models.User) error {
+	// Generate RSA keys with expiration
+	privateKeyPEM, publicKeyPEM, expiresAt, err := utils.GenerateRSAKeys()
+	if err != nil {
+		return errors.New("failed to generate RSA keys")
+	}
+
+	// Save the user, the RSA keys and the outbox event in one transaction
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(user).Error; err != nil {
+			return err
+		}
+
+		rsaKey := models.RSAKeyPair{
+			PrivateKey:     privateKeyPEM,
+			PublicKey:      publicKeyPEM,
+			UserID:         user.ID,
+			OrganizationID: user.OrganizationID,
+			ExpiresAt:      expiresAt,
+			IsActive:       true,
+		}
+		if err := tx.Create(&rsaKey).Error; err != nil {
+			return err
+		}
+
+		return enqueueEvent(tx, "user.created", userSnapshot(*user))
+	})
+}
+
+// GetUser retrieves a single user by ID along with groups and roles
 func GetUser(c *gin.Context) {
 	var user models.User
 	id := c.Param("id")
 
 	// Preload related data
-	if err := initializers.DBConn.Preload("Groups").Preload("Roles").Preload("RSAKey").First(&user, id).Error; err != nil {
+	if err := tenantDB(c).Preload("Groups").Preload("Roles").First(&user, id).Error; err != nil {
 		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
 		return
 	}
 	c.JSON(http.StatusOK, user)
 }
 
+// GetUserProfile retrieves a user without credentials: name, email, roles, groups and attributes.
+// The policies decide who may read it, the route is protected by middleware.Authorize.
+func GetUserProfile(c *gin.Context) {
+	var user models.User
+	if err := tenantDB(c).Preload("Groups").Preload("Roles").First(&user, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+	c.JSON(http.StatusOK, userSnapshot(user))
+}
+
+// canSetAttributes responds with 403 unless the attributes are left out or the current user is an
+// admin. The policies trust the attributes, so users cannot declare their own.
+func canSetAttributes(c *gin.Context, attributes map[string]string) bool {
+	if attributes == nil || hasAdminRights(c) {
+		return true
+	}
+	c.JSON(http.StatusForbidden, gin.H{"error": "Only admins can set attributes"})
+	return false
+}
+
 // UpdateUser handles updating a user by ID
 func UpdateUser(c *gin.Context) {
 	var input UpdateData
@@ -135,7 +182,7 @@ func UpdateUser(c *gin.Context) {
 	id := c.Param("id")
 
 	// Fetch the existing user from the database
-	if err := initializers.DBConn.Preload("Roles").Preload("Groups").First(&user, id).Error; err != nil {
+	if err := tenantDB(c).Preload("Roles").Preload("Groups").First(&user, id).Error; err != nil {
 		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
 		return
 	}
@@ -145,17 +192,25 @@ func UpdateUser(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
+	if !canSetAttributes(c, input.Attributes) {
+		return
+	}
+
+	before := userSnapshot(user)
 
 	// Update user fields
 	user.Name = input.Username
 	user.Email = input.Email
+	if input.Attributes != nil {
+		user.Attributes = input.Attributes
+	}
 
 	// Update roles by name
 	if len(input.Roles) > 0 {
 		var roles []models.Role
 		for _, roleName := range input.Roles {
 			var role models.Role
-			if err := initializers.DBConn.Where("name = ?", roleName).First(&role).Error; err != nil {
+			if err := tenantDB(c).Where("name = ?", roleName).First(&role).Error; err != nil {
 				// Ensure roleName is treated as a string
 				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid role name: " + string(roleName)})
 				return
@@ -170,7 +225,7 @@ func UpdateUser(c *gin.Context) {
 		var groups []models.Group
 		for _, groupName := range input.Groups {
 			var group models.Group
-			if err := initializers.DBConn.Where("name = ?", groupName).First(&group).Error; err != nil {
+			if err := tenantDB(c).Where("name = ?", groupName).First(&group).Error; err != nil {
 				// Ensure groupName is treated as a string
 				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid group name: " + string(groupName)})
 				return
@@ -180,8 +235,27 @@ func UpdateUser(c *gin.Context) {
 		user.Groups = groups
 	}
 
-	// Save the updated user
-	if err := initializers.DBConn.Save(&user).Error; err != nil {
+	// Save the updated user, announcing role changes in the same transaction
+	after := userSnapshot(user)
+	err := initializers.DBConn.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Save(&user).Error; err != nil {
+			return err
+		}
+		if !reflect.DeepEqual(before["roles"], after["roles"]) {
+			if err := enqueueEvent(tx, "user.roles_changed", gin.H{
+				"user":     after,
+				"oldRoles": before["roles"],
+				"newRoles": after["roles"],
+			}); err != nil {
+				return err
+			}
+		}
+		return recordAuditTx(tx, c, "user.update", "user", user.ID, before, after)
+	})
+	if respondWithRoleConflict(c, err) {
+		return
+	}
+	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update user"})
 		return
 	}
@@ -191,22 +265,41 @@ func UpdateUser(c *gin.Context) {
 
 // DeleteUser handles deleting a user by ID
 func DeleteUser(c *gin.Context) {
+	var user models.User
 	id := c.Param("id")
 
-	if err := initializers.DBConn.Delete(&models.User{}, id).Error; err != nil {
+	// Fetch the user for the audit log
+	if err := tenantDB(c).Preload("Roles").Preload("Groups").First(&user, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+
+	if err := deleteUserRecord(user); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
+	recordAudit(c, "user.delete", "user", user.ID, userSnapshot(user), nil)
+
 	c.JSON(http.StatusOK, gin.H{"message": "User deleted"})
 }
 
-// ListUsers retrieves all users along with their associated groups, roles, and RSA keys
+// deleteUserRecord deletes a user together with the "user.deleted" outbox event
+func deleteUserRecord(user models.User) error {
+	return initializers.DBConn.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Delete(&models.User{}, user.ID).Error; err != nil {
+			return err
+		}
+		return enqueueEvent(tx, "user.deleted", userSnapshot(user))
+	})
+}
+
+// ListUsers retrieves all users along with their associated groups and roles
 func ListUsers(c *gin.Context) {
 	var users []models.User
 
 	// Preload related data and retrieve all users
-	if err := initializers.DBConn.Preload("Groups").Preload("Roles").Preload("RSAKey").Find(&users).Error; err != nil {
+	if err := tenantDB(c).Preload("Groups").Preload("Roles").Find(&users).Error; err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve users"})
 		return
 	}
@@ -216,9 +309,12 @@ func ListUsers(c *gin.Context) {
 // LoginUser handles user login
 func LoginUser(c *gin.Context) {
 	var input struct {
-		Email    string `json:"email"`
-		Password string `json:"password"`
-		ForceGen bool   `json:"forceTokenGen"`
+		Email    string   `json:"email"`
+		Password string   `json:"password"`
+		ForceGen bool     `json:"forceTokenGen"`
+		Cookie   bool     `json:"cookie"` // Deliver the token in an HttpOnly session cookie instead of the body
+		Device   string   `json:"device"` // Optional device name for the session list
+		Roles    []string `json:"roles"`  // Roles to activate for the session, all by default
 	}
 
 	// Bind JSON input to the struct
@@ -229,20 +325,36 @@ func LoginUser(c *gin.Context) {
 
 	var user models.User
 
-	// Find the user by email
-	if err := initializers.DBConn.Where("email = ?", input.Email).First(&user).Error; err != nil {
+	// Find the user by email within the organization of the route
+	if err := tenantDB(c).Where("email = ?", input.Email).First(&user).Error; err != nil {
+		recordAuditAs(c, nil, "login.failure", "user", "", nil, gin.H{"email": input.Email, "reason": "unknown email"})
+		enqueueLoginFailure(c, input.Email, "unknown email")
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid credentials"})
 		return
 	}
 
-	// Verify the password
-	if !utils.CheckPasswordHash(user.Password, input.Password) {
+	// Verify the password, against the directory for users imported from LDAP when LDAP_AUTH is set
+	valid, err := verifyPassword(user, input.Password)
+	if err != nil {
+		fmt.Println("LDAP bind error:", err)
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Directory is unavailable"})
+		return
+	}
+	if !valid {
+		reason := "wrong password"
+		if !user.Active {
+			reason = "user is deactivated"
+		}
+		recordAuditAs(c, nil, "login.failure", "user", user.ID, nil, gin.H{"email": input.Email, "reason": reason})
+		enqueueLoginFailure(c, input.Email, reason)
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid credentials"})
 		return
 	}
 
+	recordAuditAs(c, &user, "login.success", "user", user.ID, nil, nil)
+
 	// Check if JWTToken already exists and is valid
-	if user.JWTToken != "" && !input.ForceGen {
+	if user.JWTToken != "" && !input.ForceGen && input.Roles == nil {
 		// Fetch active RSA public key for the user
 		var activeRSAKey models.RSAKeyPair
 		if err := initializers.DBConn.Where("user_id = ? AND is_active = ?", user.ID, true).First(&activeRSAKey).Error; err != nil {
@@ -252,7 +364,25 @@ func LoginUser(c *gin.Context) {
 
 		// Validate the existing token
 		claims, err := ValidateJWT(user.JWTToken, string(activeRSAKey.PublicKey))
+		if organization, _ := CurrentOrganization(c); err == nil && claims["org"] != organization.Name {
+			// Tokens from before multi-tenancy carry no organization
+			err = errors.New("token was issued for another organization")
+		}
+		if err == nil && !hasKeyID(user.JWTToken) {
+			// Verifiers using the JWKS need the key ID of newer tokens
+			err = errors.New("token has no key ID")
+		}
 		if err == nil {
+			// Only reuse the token on the device its session was started from
+			if session, ok := ActiveSession(claims); !ok || session.UserAgent != c.Request.UserAgent() {
+				err = errors.New("token belongs to another or an ended session")
+			}
+		}
+		if err == nil {
+			if input.Cookie {
+				respondWithSessionCookie(c, user.JWTToken, "Login successful (existing token)")
+				return
+			}
 			// Token is valid, return the existing token
 			c.JSON(http.StatusOK, gin.H{
 				"message": "Login successful (existing token)",
@@ -261,21 +391,69 @@ func LoginUser(c *gin.Context) {
 			})
 			return
 		} else {
-			// Log validation error for debugging
+			// Log validation error for debugging, a new token is generated below
 			fmt.Println("Token validation error:", err)
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "Existing token is invalid or expired"})
 		}
 	}
 
 	// If JWT is invalid or expired, generate a new JWT token using the active RSA key
+	issueLoginToken(c, user, input.Device, input.Cookie, input.Roles)
+}
+
+// issueLoginToken starts a new session for an authenticated user and responds with a fresh JWT,
+// in the body or in a session cookie
+func issueLoginToken(c *gin.Context, user models.User, device string, cookie bool, roles []string) {
+	// Federated logins end here as well, the upstream provider does not know about the deactivation
+	if !user.Active {
+		c.JSON(http.StatusForbidden, gin.H{"error": "User is deactivated"})
+		return
+	}
+	// The token lists the roles active in the session, all of them unless some were chosen
+	if err := initializers.DBConn.Model(&user).Association("Roles").Find(&user.Roles); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve roles"})
+		return
+	}
+	DropExpiredRoles(&user)
+	// The token lists the groups the user is a direct member of
+	if err := initializers.DBConn.Model(&user).Association("Groups").Find(&user.Groups); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve groups"})
+		return
+	}
+	if roles != nil {
+		err := activateRoles(&user, roles)
+		var invalid membershipError
+		if errors.As(err, &invalid) {
+			c.JSON(invalid.status, gin.H{"error": invalid.message})
+			return
+		}
+		if respondWithRoleConflict(c, err) {
+			return
+		}
+	} else {
+		ApplyRoleActivation(&user, nil)
+	}
+
 	var activeRSAKey models.RSAKeyPair
 	if err := initializers.DBConn.Where("user_id = ? AND is_active = ?", user.ID, true).First(&activeRSAKey).Error; err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve RSA keys"})
 		return
 	}
 
+	// The token names the organization of the user
+	if err := initializers.DBConn.First(&user.Organization, user.OrganizationID).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve the organization"})
+		return
+	}
+
+	// Every new token starts a new session
+	session, err := createSession(c, user, device, roles)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create session"})
+		return
+	}
+
 	// Generate a new JWT token using the active RSA key
-	token, err := GenerateJWT(user, activeRSAKey)
+	token, err := GenerateJWT(user, activeRSAKey, session.ID)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate JWT token"})
 		return
@@ -283,14 +461,44 @@ func LoginUser(c *gin.Context) {
 
 	// Save the new JWT token to the user
 	user.JWTToken = token
-	if err := initializers.DBConn.Save(&user).Error; err != nil {
+	if err := initializers.DBConn.Model(&user).Update("jwt_token", token).Error; err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save the user with the new token"})
 		return
 	}
 
+	if cookie {
+		respondWithSessionCookie(c, token, "Login successful")
+		return
+	}
+
 	// Return the JWT token as a response
 	c.JSON(http.StatusOK, gin.H{
 		"message": "Login successful",
 		"token":   token,
 	})
 }
+
+// enqueueLoginFailure announces a failed login, there is no change to commit it with
+func enqueueLoginFailure(c *gin.Context, email string, reason string) {
+	err := enqueueEvent(initializers.DBConn, "login.failed", gin.H{
+		"email":  email,
+		"reason": reason,
+		"ip":     c.ClientIP(),
+	})
+	if err != nil {
+		fmt.Println("Failed to enqueue login.failed event:", err)
+	}
+}
+
+// respondWithSessionCookie finishes a cookie mode login, the token is kept out of the response body
+func respondWithSessionCookie(c *gin.Context, token string, message string) {
+	csrfToken, err := setSessionCookies(c, token)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate CSRF token"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"message":   message,
+		"csrfToken": csrfToken,
+	})
+}
@@ -0,0 +1,155 @@
+package controller
+
+import (
+	"jwt/initializers"
+	"jwt/models"
+	"jwt/utils"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// WebhookEventTypes lists the identity events a subscription can receive
+var WebhookEventTypes = map[string]bool{
+	"user.created":            true,
+	"user.deleted":            true,
+	"user.roles_changed":      true,
+	"role.created":            true,
+	"role.updated":            true,
+	"role.deleted":            true,
+	"login.failed":            true,
+	"organization.created":    true,
+	"organization.deleted":    true,
+	"access_request.created":  true,
+	"access_request.approved": true,
+	"access_request.denied":   true,
+}
+
+type WebhookData struct {
+	URL    string   `json:"url" binding:"required"`
+	Events []string `json:"events" binding:"required"`
+	Secret string   `json:"secret"` // Generated when empty
+}
+
+// enqueueEvent writes an identity event to the outbox. Pass the transaction of the change,
+// so that the event is only ever delivered if the change is committed.
+func enqueueEvent(tx *gorm.DB, eventType string, data interface{}) error {
+	event := models.OutboxEvent{
+		EventType: eventType,
+		Payload:   toJSON(data),
+	}
+	return tx.Create(&event).Error
+}
+
+// CreateWebhook handles creating a new webhook subscription
+func CreateWebhook(c *gin.Context) {
+	var input WebhookData
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if u, err := url.Parse(input.URL); err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid webhook URL: " + input.URL})
+		return
+	}
+
+	for _, eventType := range input.Events {
+		if eventType != "*" && !WebhookEventTypes[eventType] {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid event type: " + eventType})
+			return
+		}
+	}
+
+	if input.Secret == "" {
+		secret, err := utils.GenerateRandomString(32)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate secret"})
+			return
+		}
+		input.Secret = secret
+	}
+
+	subscription := models.WebhookSubscription{
+		URL:    input.URL,
+		Secret: input.Secret,
+		Events: input.Events,
+		Active: true,
+	}
+	if err := initializers.DBConn.Create(&subscription).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	// The secret is only ever returned here
+	c.JSON(http.StatusOK, gin.H{
+		"subscription": subscription,
+		"secret":       subscription.Secret,
+	})
+}
+
+// ListWebhooks retrieves all webhook subscriptions
+func ListWebhooks(c *gin.Context) {
+	var subscriptions []models.WebhookSubscription
+
+	initializers.DBConn.Find(&subscriptions)
+	c.JSON(http.StatusOK, subscriptions)
+}
+
+// DeleteWebhook handles deleting a webhook subscription by ID
+func DeleteWebhook(c *gin.Context) {
+	id := c.Param("id")
+
+	if err := initializers.DBConn.Delete(&models.WebhookSubscription{}, id).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Webhook deleted"})
+}
+
+// ListDeadLetters retrieves the deliveries that ran out of retries
+func ListDeadLetters(c *gin.Context) {
+	var deliveries []models.WebhookDelivery
+
+	if err := initializers.DBConn.Preload("OutboxEvent").Where("status = ?", DeliveryDead).Order("id DESC").Find(&deliveries).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve dead letters"})
+		return
+	}
+
+	result := make([]gin.H, 0, len(deliveries))
+	for _, delivery := range deliveries {
+		result = append(result, gin.H{
+			"delivery":  delivery,
+			"eventType": delivery.OutboxEvent.EventType,
+			"payload":   delivery.OutboxEvent.Payload,
+		})
+	}
+	c.JSON(http.StatusOK, gin.H{"deadLetters": result})
+}
+
+// RetryDeadLetter handles queueing a dead delivery for another round of attempts
+func RetryDeadLetter(c *gin.Context) {
+	var delivery models.WebhookDelivery
+	id := c.Param("id")
+
+	if err := initializers.DBConn.Where("status = ?", DeliveryDead).First(&delivery, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Dead letter not found"})
+		return
+	}
+
+	err := initializers.DBConn.Model(&delivery).Updates(map[string]interface{}{
+		"status":          DeliveryPending,
+		"attempts":        0,
+		"next_attempt_at": time.Now(),
+	}).Error
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retry delivery"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Delivery queued"})
+}
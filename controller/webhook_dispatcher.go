@@ -0,0 +1,201 @@
+package controller
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"jwt/initializers"
+	"jwt/models"
+	"log"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Delivery states
+const (
+	DeliveryPending   = "pending"
+	DeliveryDelivered = "delivered"
+	DeliveryDead      = "dead"
+)
+
+const (
+	webhookPollInterval = 5 * time.Second
+	webhookMaxAttempts  = 8                // Attempts before a delivery moves to the dead-letter list
+	webhookBaseBackoff  = 10 * time.Second // Delay after the first failure, doubled for every further failure
+	webhookMaxBackoff   = time.Hour
+	webhookLease        = time.Minute // How long a claimed delivery is hidden from other dispatchers
+)
+
+var webhookClient = &http.Client{Timeout: 10 * time.Second}
+
+// RunWebhookDispatcher turns outbox events into deliveries and sends due deliveries, forever.
+// Several instances may run at the same time, rows are claimed with SKIP LOCKED.
+func RunWebhookDispatcher() {
+	ticker := time.NewTicker(webhookPollInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := fanOutOutbox(); err != nil {
+			log.Println("Webhook dispatcher: failed to process outbox:", err)
+		}
+		if err := sendDueDeliveries(); err != nil {
+			log.Println("Webhook dispatcher: failed to send deliveries:", err)
+		}
+	}
+}
+
+// fanOutOutbox creates a delivery per matching subscription for every unprocessed outbox event
+func fanOutOutbox() error {
+	return initializers.DBConn.Transaction(func(tx *gorm.DB) error {
+		var events []models.OutboxEvent
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+			Where("processed_at IS NULL").Order("id").Limit(100).Find(&events).Error; err != nil {
+			return err
+		}
+		if len(events) == 0 {
+			return nil
+		}
+
+		var subscriptions []models.WebhookSubscription
+		if err := tx.Where("active = ?", true).Find(&subscriptions).Error; err != nil {
+			return err
+		}
+
+		now := time.Now()
+		for _, event := range events {
+			for _, subscription := range subscriptions {
+				if !subscribedTo(subscription, event.EventType) {
+					continue
+				}
+				delivery := models.WebhookDelivery{
+					SubscriptionID: subscription.ID,
+					OutboxEventID:  event.ID,
+					Status:         DeliveryPending,
+					NextAttemptAt:  now,
+				}
+				if err := tx.Create(&delivery).Error; err != nil {
+					return err
+				}
+			}
+			if err := tx.Model(&event).Update("processed_at", now).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// subscribedTo reports whether the subscription wants events of the given type
+func subscribedTo(subscription models.WebhookSubscription, eventType string) bool {
+	for _, e := range subscription.Events {
+		if e == "*" || e == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+// sendDueDeliveries claims the pending deliveries that are due and attempts to send them
+func sendDueDeliveries() error {
+	var deliveries []models.WebhookDelivery
+	err := initializers.DBConn.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+			Preload("Subscription").Preload("OutboxEvent").
+			Where("status = ? AND next_attempt_at <= ?", DeliveryPending, time.Now()).
+			Order("next_attempt_at").Limit(50).Find(&deliveries).Error; err != nil {
+			return err
+		}
+		if len(deliveries) == 0 {
+			return nil
+		}
+
+		// Lease the claimed deliveries, so no other dispatcher sends them while we do
+		ids := make([]uint, 0, len(deliveries))
+		for _, delivery := range deliveries {
+			ids = append(ids, delivery.ID)
+		}
+		return tx.Model(&models.WebhookDelivery{}).Where("id IN ?", ids).
+			Update("next_attempt_at", time.Now().Add(webhookLease)).Error
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, delivery := range deliveries {
+		updates := map[string]interface{}{"attempts": delivery.Attempts + 1}
+		if err := sendWebhook(delivery.Subscription, delivery.OutboxEvent); err != nil {
+			updates["last_error"] = err.Error()
+			if delivery.Attempts+1 >= webhookMaxAttempts || !delivery.Subscription.Active {
+				updates["status"] = DeliveryDead
+			} else {
+				updates["next_attempt_at"] = time.Now().Add(webhookBackoff(delivery.Attempts + 1))
+			}
+		} else {
+			updates["status"] = DeliveryDelivered
+			updates["delivered_at"] = time.Now()
+			updates["last_error"] = ""
+		}
+		if err := initializers.DBConn.Model(&delivery).Updates(updates).Error; err != nil {
+			log.Println("Webhook dispatcher: failed to update delivery", delivery.ID, ":", err)
+		}
+	}
+	return nil
+}
+
+// webhookBackoff returns the exponential delay before the next attempt, with up to 10% jitter
+func webhookBackoff(failures int) time.Duration {
+	delay := webhookBaseBackoff << (failures - 1)
+	if delay > webhookMaxBackoff || delay <= 0 {
+		delay = webhookMaxBackoff
+	}
+	return delay + time.Duration(rand.Int63n(int64(delay/10)+1))
+}
+
+// sendWebhook POSTs the event to the subscription with an HMAC-SHA256 signature.
+// The signature covers "<timestamp>.<body>" and is sent as "t=<timestamp>,v1=<hex>".
+func sendWebhook(subscription models.WebhookSubscription, event models.OutboxEvent) error {
+	data := json.RawMessage("null")
+	if event.Payload != "" {
+		data = json.RawMessage(event.Payload)
+	}
+	body, err := json.Marshal(map[string]interface{}{
+		"id":        event.ID,
+		"type":      event.EventType,
+		"createdAt": event.CreatedAt,
+		"data":      data,
+	})
+	if err != nil {
+		return err
+	}
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(subscription.Secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+
+	req, err := http.NewRequest(http.MethodPost, subscription.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Webhook-ID", strconv.FormatUint(uint64(event.ID), 10))
+	req.Header.Set("X-Webhook-Event", event.EventType)
+	req.Header.Set("X-Webhook-Signature", "t="+timestamp+",v1="+hex.EncodeToString(mac.Sum(nil)))
+
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("endpoint responded with status %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,266 @@
+package extauthz
+
+import (
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// checkRequest holds the parts of an envoy.service.auth.v3.CheckRequest the service looks at
+type checkRequest struct {
+	SourceAddress     string            // IP address of the downstream client
+	SourcePort        uint32            // Port of the downstream client
+	Method            string            // Method of the original request
+	Path              string            // Path and query of the original request
+	Host              string            // Host of the original request
+	Scheme            string            // Scheme of the original request
+	Headers           map[string]string // Headers of the original request, lower-case names
+	ContextExtensions map[string]string // Per-route settings of the Envoy filter
+}
+
+// checkResponse is an envoy.service.auth.v3.CheckResponse. A zero code allows the request with the
+// headers added to it, any other code denies it with the HTTP status, headers and body.
+type checkResponse struct {
+	Code       int32
+	Message    string
+	HTTPStatus int
+	Headers    [][2]string
+	Body       string
+}
+
+// Field numbers of the Envoy messages, see envoy/service/auth/v3 and envoy/config/core/v3
+const (
+	checkRequestAttributes = 1
+
+	attributeContextSource            = 1
+	attributeContextRequest           = 4
+	attributeContextContextExtensions = 10
+
+	peerAddress           = 1
+	addressSocketAddress  = 1
+	socketAddressAddress  = 2
+	socketAddressPort     = 3
+	requestHTTP           = 2
+	httpRequestMethod     = 2
+	httpRequestHeaders    = 3
+	httpRequestPath       = 4
+	httpRequestHost       = 5
+	httpRequestScheme     = 6
+	httpRequestHeaderMap  = 13
+	headerMapHeaders      = 1
+	headerValueKey        = 1
+	headerValueValue      = 2
+	headerValueRawValue   = 3
+	mapEntryKey           = 1
+	mapEntryValue         = 2
+	checkResponseStatus   = 1
+	checkResponseDenied   = 2
+	checkResponseOK       = 3
+	statusCode            = 1
+	statusMessage         = 2
+	deniedResponseStatus  = 1
+	deniedResponseHeaders = 2
+	deniedResponseBody    = 3
+	httpStatusCode        = 1
+	okResponseHeaders     = 2
+	okResponseRemove      = 5
+	headerOptionHeader    = 1
+)
+
+// parseCheckRequest decodes an envoy.service.auth.v3.CheckRequest
+func parseCheckRequest(data []byte) (checkRequest, error) {
+	request := checkRequest{Headers: map[string]string{}, ContextExtensions: map[string]string{}}
+	err := eachField(data, func(number protowire.Number, value []byte, _ uint64) error {
+		if number != checkRequestAttributes {
+			return nil
+		}
+		return eachField(value, func(number protowire.Number, value []byte, _ uint64) error {
+			switch number {
+			case attributeContextSource:
+				return request.parseSource(value)
+			case attributeContextRequest:
+				return eachField(value, func(number protowire.Number, value []byte, _ uint64) error {
+					if number != requestHTTP {
+						return nil
+					}
+					return request.parseHTTP(value)
+				})
+			case attributeContextContextExtensions:
+				return parseMapEntry(value, request.ContextExtensions)
+			}
+			return nil
+		})
+	})
+	return request, err
+}
+
+// parseSource decodes the socket address of the source peer
+func (request *checkRequest) parseSource(data []byte) error {
+	return eachField(data, func(number protowire.Number, value []byte, _ uint64) error {
+		if number != peerAddress {
+			return nil
+		}
+		return eachField(value, func(number protowire.Number, value []byte, _ uint64) error {
+			if number != addressSocketAddress {
+				return nil
+			}
+			return eachField(value, func(number protowire.Number, value []byte, varint uint64) error {
+				switch number {
+				case socketAddressAddress:
+					request.SourceAddress = string(value)
+				case socketAddressPort:
+					request.SourcePort = uint32(varint)
+				}
+				return nil
+			})
+		})
+	})
+}
+
+// parseHTTP decodes an AttributeContext.HttpRequest. Envoy sends the headers either as a map or,
+// with encode_raw_headers, as a header map.
+func (request *checkRequest) parseHTTP(data []byte) error {
+	return eachField(data, func(number protowire.Number, value []byte, _ uint64) error {
+		switch number {
+		case httpRequestMethod:
+			request.Method = string(value)
+		case httpRequestHeaders:
+			return parseMapEntry(value, request.Headers)
+		case httpRequestPath:
+			request.Path = string(value)
+		case httpRequestHost:
+			request.Host = string(value)
+		case httpRequestScheme:
+			request.Scheme = string(value)
+		case httpRequestHeaderMap:
+			return eachField(value, func(number protowire.Number, value []byte, _ uint64) error {
+				if number != headerMapHeaders {
+					return nil
+				}
+				var key, headerValue string
+				err := eachField(value, func(number protowire.Number, value []byte, _ uint64) error {
+					switch number {
+					case headerValueKey:
+						key = string(value)
+					case headerValueValue, headerValueRawValue:
+						headerValue = string(value)
+					}
+					return nil
+				})
+				request.Headers[key] = headerValue
+				return err
+			})
+		}
+		return nil
+	})
+}
+
+// parseMapEntry decodes an entry of a map<string, string> field into the map
+func parseMapEntry(data []byte, entries map[string]string) error {
+	var key, value string
+	err := eachField(data, func(number protowire.Number, field []byte, _ uint64) error {
+		switch number {
+		case mapEntryKey:
+			key = string(field)
+		case mapEntryValue:
+			value = string(field)
+		}
+		return nil
+	})
+	entries[key] = value
+	return err
+}
+
+// eachField calls the function for the length-delimited and varint fields of a message, with the
+// bytes or the number of the value. Other wire types are skipped.
+func eachField(data []byte, fn func(number protowire.Number, value []byte, varint uint64) error) error {
+	for len(data) > 0 {
+		number, wireType, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		data = data[n:]
+
+		var err error
+		switch wireType {
+		case protowire.BytesType:
+			var value []byte
+			value, n = protowire.ConsumeBytes(data)
+			if n >= 0 {
+				err = fn(number, value, 0)
+			}
+		case protowire.VarintType:
+			var value uint64
+			value, n = protowire.ConsumeVarint(data)
+			if n >= 0 {
+				err = fn(number, nil, value)
+			}
+		default:
+			n = protowire.ConsumeFieldValue(number, wireType, data)
+		}
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		if err != nil {
+			return err
+		}
+		data = data[n:]
+	}
+	return nil
+}
+
+// marshal encodes the response as an envoy.service.auth.v3.CheckResponse
+func (response checkResponse) marshal() []byte {
+	var status []byte
+	if response.Code != 0 {
+		status = protowire.AppendTag(status, statusCode, protowire.VarintType)
+		status = protowire.AppendVarint(status, uint64(response.Code))
+	}
+	if response.Message != "" {
+		status = protowire.AppendTag(status, statusMessage, protowire.BytesType)
+		status = protowire.AppendString(status, response.Message)
+	}
+	out := protowire.AppendTag(nil, checkResponseStatus, protowire.BytesType)
+	out = protowire.AppendBytes(out, status)
+
+	if response.Code == 0 {
+		// Headers without a value are removed, so that clients cannot set them themselves
+		var ok []byte
+		for _, header := range response.Headers {
+			if header[1] == "" {
+				ok = protowire.AppendTag(ok, okResponseRemove, protowire.BytesType)
+				ok = protowire.AppendString(ok, header[0])
+				continue
+			}
+			ok = protowire.AppendTag(ok, okResponseHeaders, protowire.BytesType)
+			ok = protowire.AppendBytes(ok, headerValueOption(header[0], header[1]))
+		}
+		out = protowire.AppendTag(out, checkResponseOK, protowire.BytesType)
+		return protowire.AppendBytes(out, ok)
+	}
+
+	httpStatus := protowire.AppendTag(nil, httpStatusCode, protowire.VarintType)
+	httpStatus = protowire.AppendVarint(httpStatus, uint64(response.HTTPStatus))
+	denied := protowire.AppendTag(nil, deniedResponseStatus, protowire.BytesType)
+	denied = protowire.AppendBytes(denied, httpStatus)
+	for _, header := range response.Headers {
+		denied = protowire.AppendTag(denied, deniedResponseHeaders, protowire.BytesType)
+		denied = protowire.AppendBytes(denied, headerValueOption(header[0], header[1]))
+	}
+	if response.Body != "" {
+		denied = protowire.AppendTag(denied, deniedResponseBody, protowire.BytesType)
+		denied = protowire.AppendString(denied, response.Body)
+	}
+	out = protowire.AppendTag(out, checkResponseDenied, protowire.BytesType)
+	return protowire.AppendBytes(out, denied)
+}
+
+// headerValueOption encodes a HeaderValueOption. Leaving append unset overwrites headers of the
+// original request with the same name.
+func headerValueOption(key, value string) []byte {
+	header := protowire.AppendTag(nil, headerValueKey, protowire.BytesType)
+	header = protowire.AppendString(header, key)
+	header = protowire.AppendTag(header, headerValueValue, protowire.BytesType)
+	header = protowire.AppendString(header, value)
+
+	option := protowire.AppendTag(nil, headerOptionHeader, protowire.BytesType)
+	return protowire.AppendBytes(option, header)
+}
@@ -0,0 +1,235 @@
+package extauthz
+
+import (
+	"reflect"
+	"testing"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// message concatenates encoded fields
+func message(fields ...[]byte) []byte {
+	var out []byte
+	for _, field := range fields {
+		out = append(out, field...)
+	}
+	return out
+}
+
+func bytesField(number protowire.Number, value []byte) []byte {
+	return protowire.AppendBytes(protowire.AppendTag(nil, number, protowire.BytesType), value)
+}
+
+func stringField(number protowire.Number, value string) []byte {
+	return bytesField(number, []byte(value))
+}
+
+func varintField(number protowire.Number, value uint64) []byte {
+	return protowire.AppendVarint(protowire.AppendTag(nil, number, protowire.VarintType), value)
+}
+
+func mapEntry(number protowire.Number, key, value string) []byte {
+	return bytesField(number, message(stringField(mapEntryKey, key), stringField(mapEntryValue, value)))
+}
+
+// decoded is a message split into its fields, for the assertions on responses
+type decoded map[protowire.Number][][]byte
+
+// decode splits a message, varints are kept in their wire encoding
+func decode(t *testing.T, data []byte) decoded {
+	t.Helper()
+	fields := decoded{}
+	for len(data) > 0 {
+		number, wireType, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			t.Fatalf("malformed message: %v", protowire.ParseError(n))
+		}
+		data = data[n:]
+		var value []byte
+		switch wireType {
+		case protowire.BytesType:
+			value, n = protowire.ConsumeBytes(data)
+		case protowire.VarintType:
+			_, n = protowire.ConsumeVarint(data)
+			value = data[:max(n, 0)]
+		default:
+			t.Fatalf("unexpected wire type %d of field %d", wireType, number)
+		}
+		if n < 0 {
+			t.Fatalf("malformed field %d: %v", number, protowire.ParseError(n))
+		}
+		fields[number] = append(fields[number], value)
+		data = data[n:]
+	}
+	return fields
+}
+
+// message returns the single occurrence of a field
+func (fields decoded) message(t *testing.T, number protowire.Number) decoded {
+	t.Helper()
+	if len(fields[number]) != 1 {
+		t.Fatalf("field %d occurs %d times, want once", number, len(fields[number]))
+	}
+	return decode(t, fields[number][0])
+}
+
+func (fields decoded) string(number protowire.Number) string {
+	if len(fields[number]) == 0 {
+		return ""
+	}
+	return string(fields[number][0])
+}
+
+func (fields decoded) varint(number protowire.Number) uint64 {
+	if len(fields[number]) == 0 {
+		return 0
+	}
+	value, _ := protowire.ConsumeVarint(fields[number][0])
+	return value
+}
+
+// headers decodes repeated HeaderValueOption fields
+func (fields decoded) headers(t *testing.T, number protowire.Number) [][2]string {
+	t.Helper()
+	var headers [][2]string
+	for _, option := range fields[number] {
+		header := decode(t, option).message(t, headerOptionHeader)
+		headers = append(headers, [2]string{header.string(headerValueKey), header.string(headerValueValue)})
+	}
+	return headers
+}
+
+// checkRequestMessage encodes a CheckRequest as Envoy sends it, with fields the service ignores
+func checkRequestMessage() []byte {
+	socketAddress := message(
+		varintField(1, 0), // protocol
+		stringField(socketAddressAddress, "203.0.113.7"),
+		varintField(socketAddressPort, 51234),
+	)
+	source := message(
+		bytesField(peerAddress, bytesField(addressSocketAddress, socketAddress)),
+		stringField(3, "spiffe://cluster.local/ns/shop/sa/frontend"), // principal
+	)
+	headerMap := message(
+		bytesField(headerMapHeaders, message(stringField(headerValueKey, "x-raw"), stringField(headerValueRawValue, "raw value"))),
+		bytesField(headerMapHeaders, message(stringField(headerValueKey, "x-plain"), stringField(headerValueValue, "plain value"))),
+	)
+	httpRequest := message(
+		stringField(1, "request-id"),
+		stringField(httpRequestMethod, "POST"),
+		mapEntry(httpRequestHeaders, "authorization", "Bearer token"),
+		mapEntry(httpRequestHeaders, ":path", "/orders?id=1"),
+		stringField(httpRequestPath, "/orders?id=1"),
+		stringField(httpRequestHost, "shop.example.org"),
+		stringField(httpRequestScheme, "https"),
+		varintField(10, 512), // size
+		stringField(11, "HTTP/2"),
+		bytesField(httpRequestHeaderMap, headerMap),
+	)
+	request := message(
+		bytesField(1, message(varintField(1, 1700000000))), // time
+		bytesField(requestHTTP, httpRequest),
+	)
+	attributes := message(
+		bytesField(attributeContextSource, source),
+		bytesField(2, stringField(3, "spiffe://cluster.local/ns/shop/sa/gateway")), // destination
+		bytesField(attributeContextRequest, request),
+		mapEntry(attributeContextContextExtensions, "role", "admin"),
+		mapEntry(attributeContextContextExtensions, "org", "acme"),
+	)
+	// A fixed32 field of a later version of the message
+	unknown := protowire.AppendFixed32(protowire.AppendTag(nil, 99, protowire.Fixed32Type), 7)
+	return message(bytesField(checkRequestAttributes, attributes), unknown)
+}
+
+func TestParseCheckRequest(t *testing.T) {
+	request, err := parseCheckRequest(checkRequestMessage())
+	if err != nil {
+		t.Fatalf("parseCheckRequest() = %v", err)
+	}
+	want := checkRequest{
+		SourceAddress: "203.0.113.7",
+		SourcePort:    51234,
+		Method:        "POST",
+		Path:          "/orders?id=1",
+		Host:          "shop.example.org",
+		Scheme:        "https",
+		Headers: map[string]string{
+			"authorization": "Bearer token",
+			":path":         "/orders?id=1",
+			"x-raw":         "raw value",
+			"x-plain":       "plain value",
+		},
+		ContextExtensions: map[string]string{"role": "admin", "org": "acme"},
+	}
+	if !reflect.DeepEqual(request, want) {
+		t.Errorf("parseCheckRequest() = %+v, want %+v", request, want)
+	}
+
+	valid := checkRequestMessage()
+	malformed := []struct {
+		name string
+		data []byte
+	}{
+		{"truncated", valid[:len(valid)-10]},
+		{"length beyond the message", bytesField(checkRequestAttributes, []byte{0x0a, 0x7f, 1})},
+		{"invalid tag", []byte{0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x01}},
+		{"field number zero", []byte{0x02, 0x00}},
+	}
+	for _, test := range malformed {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := parseCheckRequest(test.data); err == nil {
+				t.Error("parseCheckRequest() = nil, want an error")
+			}
+		})
+	}
+}
+
+func TestMarshalCheckResponse(t *testing.T) {
+	t.Run("allowed", func(t *testing.T) {
+		response := checkResponse{Code: codeOK, Headers: [][2]string{{"x-auth-user", "jdoe"}, {"x-auth-groups", ""}}}
+		fields := decode(t, response.marshal())
+		if status := fields.message(t, checkResponseStatus); status.varint(statusCode) != codeOK || len(status) != 0 {
+			t.Errorf("status = %v, want OK", status)
+		}
+		if fields[checkResponseDenied] != nil {
+			t.Error("an allowed response has a denied_response")
+		}
+		ok := fields.message(t, checkResponseOK)
+		if headers := ok.headers(t, okResponseHeaders); !reflect.DeepEqual(headers, [][2]string{{"x-auth-user", "jdoe"}}) {
+			t.Errorf("headers = %q", headers)
+		}
+		// Empty headers are removed rather than set
+		if removed := ok[okResponseRemove]; len(removed) != 1 || string(removed[0]) != "x-auth-groups" {
+			t.Errorf("headers_to_remove = %q, want [x-auth-groups]", removed)
+		}
+	})
+
+	t.Run("denied", func(t *testing.T) {
+		response := checkResponse{
+			Code:       codeUnauthenticated,
+			Message:    "Unauthorized",
+			HTTPStatus: 401,
+			Headers:    [][2]string{{"www-authenticate", "Bearer"}},
+			Body:       `{"error":"Unauthorized"}`,
+		}
+		fields := decode(t, response.marshal())
+		status := fields.message(t, checkResponseStatus)
+		if status.varint(statusCode) != codeUnauthenticated || status.string(statusMessage) != "Unauthorized" {
+			t.Errorf("status = %d %q", status.varint(statusCode), status.string(statusMessage))
+		}
+		if fields[checkResponseOK] != nil {
+			t.Error("a denied response has an ok_response")
+		}
+		denied := fields.message(t, checkResponseDenied)
+		if code := denied.message(t, deniedResponseStatus).varint(httpStatusCode); code != 401 {
+			t.Errorf("HTTP status = %d, want 401", code)
+		}
+		if headers := denied.headers(t, deniedResponseHeaders); !reflect.DeepEqual(headers, response.Headers) {
+			t.Errorf("headers = %q, want %q", headers, response.Headers)
+		}
+		if body := denied.string(deniedResponseBody); body != response.Body {
+			t.Errorf("body = %q", body)
+		}
+	})
+}
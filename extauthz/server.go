@@ -0,0 +1,221 @@
+package extauthz
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"jwt/controller"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// gRPC status codes used by the service
+const (
+	codeOK               = 0
+	codeInvalidArgument  = 3
+	codePermissionDenied = 7
+	codeUnimplemented    = 12
+	codeInternal         = 13
+	codeUnavailable      = 14
+	codeUnauthenticated  = 16
+)
+
+// Settings of the Envoy filter (context_extensions) that become requirements of the forward-auth endpoint
+var requirementKeys = []string{"role", "group", "scope", "action", "resource", "resourceId"}
+
+// Headers of the forward-auth endpoint passed on to the upstream of allowed requests
+var identityHeaders = []string{"X-Auth-User", "X-Auth-User-Id", "X-Auth-Email", "X-Auth-Organization", "X-Auth-Roles", "X-Auth-Groups"}
+
+// maxMessageSize limits the size of a request message
+const maxMessageSize = 4 << 20
+
+// Server implements the envoy.service.auth.v3.Authorization gRPC service and the gRPC health check.
+// It answers a check by asking the /auth/verify forward-auth endpoint of the HTTP handler, so the
+// tokens, sessions, roles and policies are verified exactly as for the other proxies.
+type Server struct {
+	Handler http.Handler // The gin engine of the service
+}
+
+// Run serves the gRPC API on EXT_AUTHZ_ADDR, e.g. ":9001", over cleartext HTTP/2 like Envoy's
+// clusters with http2_protocol_options expect. Without the address it returns at once.
+func Run(handler http.Handler) {
+	addr := os.Getenv("EXT_AUTHZ_ADDR")
+	if addr == "" {
+		return
+	}
+
+	server := &http.Server{Addr: addr, Handler: h2c.NewHandler(&Server{Handler: handler}, &http2.Server{})}
+	log.Println("Envoy ext_authz service listening on", addr)
+	if err := server.ListenAndServe(); err != nil {
+		log.Println("Envoy ext_authz service failed:", err)
+	}
+}
+
+// ServeHTTP dispatches a gRPC call
+func (server *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost || !strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+		http.Error(w, "This port only serves gRPC", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	message, err := readMessage(r.Body)
+	if err != nil {
+		writeResponse(w, nil, codeInvalidArgument, err.Error())
+		return
+	}
+
+	switch r.URL.Path {
+	case "/envoy.service.auth.v3.Authorization/Check":
+		request, err := parseCheckRequest(message)
+		if err != nil {
+			writeResponse(w, nil, codeInvalidArgument, "Malformed CheckRequest: "+err.Error())
+			return
+		}
+		writeResponse(w, server.check(r, request).marshal(), codeOK, "")
+	case "/grpc.health.v1.Health/Check":
+		// HealthCheckResponse with status SERVING
+		status := protowire.AppendTag(nil, 1, protowire.VarintType)
+		writeResponse(w, protowire.AppendVarint(status, 1), codeOK, "")
+	default:
+		writeResponse(w, nil, codeUnimplemented, "Unknown method "+r.URL.Path)
+	}
+}
+
+// check asks the forward-auth endpoint about the original request. The context extensions of the
+// route carry the requirements and, as "org", the organization.
+func (server *Server) check(r *http.Request, request checkRequest) checkResponse {
+	path := "/auth/verify"
+	if org := request.ContextExtensions["org"]; org != "" {
+		path = "/orgs/" + url.PathEscape(org) + "/auth/verify"
+	}
+	query := url.Values{}
+	for _, key := range requirementKeys {
+		if value := request.ContextExtensions[key]; value != "" {
+			query.Set(key, value)
+		}
+	}
+
+	verify, err := http.NewRequestWithContext(r.Context(), http.MethodGet, path+"?"+query.Encode(), nil)
+	if err != nil {
+		return checkResponse{Code: codeInternal, Message: err.Error(), HTTPStatus: http.StatusInternalServerError}
+	}
+	for name, value := range request.Headers {
+		if !strings.HasPrefix(name, ":") {
+			verify.Header.Set(name, value)
+		}
+	}
+	// Envoy describes the original request itself, headers of the client must not override it
+	verify.Header.Set(controller.ForwardAuthMethodHeader(), request.Method)
+	verify.Header.Set("X-Forwarded-Uri", request.Path)
+	verify.Header.Set("X-Forwarded-Host", request.Host)
+	verify.Header.Set("X-Forwarded-Proto", request.Scheme)
+	verify.Host = request.Host
+	if request.SourceAddress != "" {
+		verify.RemoteAddr = net.JoinHostPort(request.SourceAddress, strconv.FormatUint(uint64(request.SourcePort), 10))
+	}
+
+	recorder := &responseRecorder{header: http.Header{}, status: http.StatusOK}
+	server.Handler.ServeHTTP(recorder, verify)
+
+	if recorder.status == http.StatusOK {
+		response := checkResponse{Code: codeOK}
+		for _, name := range identityHeaders {
+			response.Headers = append(response.Headers, [2]string{strings.ToLower(name), recorder.header.Get(name)})
+		}
+		return response
+	}
+
+	response := checkResponse{
+		Code:       codePermissionDenied,
+		Message:    http.StatusText(recorder.status),
+		HTTPStatus: recorder.status,
+		Headers:    [][2]string{{"content-type", "application/json; charset=utf-8"}},
+		Body:       recorder.body.String(),
+	}
+	switch {
+	case recorder.status == http.StatusUnauthorized:
+		response.Code = codeUnauthenticated
+		response.Headers = append(response.Headers, [2]string{"www-authenticate", "Bearer"})
+	case recorder.status >= http.StatusInternalServerError:
+		response.Code = codeUnavailable
+	}
+	return response
+}
+
+// readMessage reads the single length-prefixed message of a unary call
+func readMessage(body io.Reader) ([]byte, error) {
+	var prefix [5]byte
+	if _, err := io.ReadFull(body, prefix[:]); err != nil {
+		return nil, errors.New("missing message")
+	}
+	if prefix[0] != 0 {
+		return nil, errors.New("compressed messages are not supported")
+	}
+	size := binary.BigEndian.Uint32(prefix[1:])
+	if size > maxMessageSize {
+		return nil, fmt.Errorf("message of %d bytes exceeds the limit", size)
+	}
+	message := make([]byte, size)
+	if _, err := io.ReadFull(body, message); err != nil {
+		return nil, errors.New("truncated message")
+	}
+	return message, nil
+}
+
+// writeResponse answers a unary call with the message, if any, and the status in the trailers
+func writeResponse(w http.ResponseWriter, message []byte, code int, description string) {
+	w.Header().Set("Content-Type", "application/grpc")
+	w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+	w.WriteHeader(http.StatusOK)
+	if message != nil {
+		var prefix [5]byte
+		binary.BigEndian.PutUint32(prefix[1:], uint32(len(message)))
+		w.Write(prefix[:])
+		w.Write(message)
+	}
+	w.Header().Set("Grpc-Status", strconv.Itoa(code))
+	w.Header().Set("Grpc-Message", percentEncode(description))
+}
+
+// percentEncode encodes a status message as the gRPC protocol demands for grpc-message
+func percentEncode(message string) string {
+	var out strings.Builder
+	for i := 0; i < len(message); i++ {
+		if b := message[i]; b < 0x20 || b > 0x7e || b == '%' {
+			fmt.Fprintf(&out, "%%%02X", b)
+		} else {
+			out.WriteByte(b)
+		}
+	}
+	return out.String()
+}
+
+// responseRecorder keeps the answer of the forward-auth endpoint
+type responseRecorder struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (recorder *responseRecorder) Header() http.Header {
+	return recorder.header
+}
+
+func (recorder *responseRecorder) Write(data []byte) (int, error) {
+	return recorder.body.Write(data)
+}
+
+func (recorder *responseRecorder) WriteHeader(status int) {
+	recorder.status = status
+}
@@ -0,0 +1,225 @@
+package extauthz
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"jwt/controller"
+	"jwt/initializers"
+	"jwt/initializers/dbtest"
+	"jwt/models"
+	"jwt/router"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// frame prefixes a message as gRPC sends it, uncompressed
+func frame(message []byte) []byte {
+	prefix := make([]byte, 5)
+	binary.BigEndian.PutUint32(prefix[1:], uint32(len(message)))
+	return append(prefix, message...)
+}
+
+// call makes a unary gRPC call and returns the response message, the status code and its message
+func call(t *testing.T, server *Server, method string, body []byte) ([]byte, int, string) {
+	t.Helper()
+	r := httptest.NewRequest(http.MethodPost, method, bytes.NewReader(body))
+	r.Header.Set("Content-Type", "application/grpc")
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, r)
+
+	result := w.Result()
+	if result.StatusCode != http.StatusOK || result.Header.Get("Content-Type") != "application/grpc" {
+		t.Fatalf("response = %d %s, want a gRPC response", result.StatusCode, result.Header.Get("Content-Type"))
+	}
+	data, _ := io.ReadAll(result.Body)
+	var message []byte
+	if len(data) > 0 {
+		if len(data) < 5 || data[0] != 0 || int(binary.BigEndian.Uint32(data[1:5])) != len(data)-5 {
+			t.Fatalf("malformed response frame %x", data)
+		}
+		message = data[5:]
+	}
+	code, err := strconv.Atoi(result.Trailer.Get("Grpc-Status"))
+	if err != nil {
+		t.Fatalf("grpc-status trailer = %q", result.Trailer.Get("Grpc-Status"))
+	}
+	return message, code, result.Trailer.Get("Grpc-Message")
+}
+
+// envoyCheck encodes the CheckRequest of a GET of the shop with the headers and context extensions
+func envoyCheck(headers map[string]string, extensions map[string]string) []byte {
+	httpRequest := message(
+		stringField(httpRequestMethod, "GET"),
+		stringField(httpRequestPath, "/orders"),
+		stringField(httpRequestHost, "shop.example.org"),
+		stringField(httpRequestScheme, "https"),
+	)
+	for name, value := range headers {
+		httpRequest = append(httpRequest, mapEntry(httpRequestHeaders, name, value)...)
+	}
+	attributes := bytesField(attributeContextRequest, bytesField(requestHTTP, httpRequest))
+	for key, value := range extensions {
+		attributes = append(attributes, mapEntry(attributeContextContextExtensions, key, value)...)
+	}
+	return bytesField(checkRequestAttributes, attributes)
+}
+
+func TestMalformedCalls(t *testing.T) {
+	// None of the calls gets as far as the forward-auth endpoint
+	server := &Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("forward-auth request %s", r.URL)
+	})}
+	const check = "/envoy.service.auth.v3.Authorization/Check"
+
+	compressed := frame(checkRequestMessage())
+	compressed[0] = 1
+	oversized := make([]byte, 5)
+	binary.BigEndian.PutUint32(oversized[1:], maxMessageSize+1)
+	valid := frame(checkRequestMessage())
+
+	tests := []struct {
+		name        string
+		method      string
+		body        []byte
+		wantCode    int
+		wantMessage string
+	}{
+		{"compressed message", check, compressed, codeInvalidArgument, "compressed messages are not supported"},
+		{"oversized message", check, oversized, codeInvalidArgument, "exceeds the limit"},
+		{"truncated message", check, valid[:len(valid)-1], codeInvalidArgument, "truncated message"},
+		{"no message", check, nil, codeInvalidArgument, "missing message"},
+		{"malformed CheckRequest", check, frame([]byte{0x0a, 0x7f}), codeInvalidArgument, "Malformed CheckRequest"},
+		{"unknown method", "/envoy.service.auth.v2.Authorization/Check", valid, codeUnimplemented, "Unknown method"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			message, code, description := call(t, server, test.method, test.body)
+			if code != test.wantCode || !strings.Contains(description, test.wantMessage) {
+				t.Errorf("status = %d %q, want %d %q", code, description, test.wantCode, test.wantMessage)
+			}
+			if message != nil {
+				t.Errorf("message = %x, want none", message)
+			}
+		})
+	}
+
+	t.Run("health check", func(t *testing.T) {
+		message, code, _ := call(t, server, "/grpc.health.v1.Health/Check", frame(nil))
+		if code != codeOK || decode(t, message).varint(1) != 1 {
+			t.Errorf("health = %d %x, want SERVING", code, message)
+		}
+	})
+
+	t.Run("not gRPC", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, httptest.NewRequest(http.MethodGet, check, nil))
+		if w.Code != http.StatusUnsupportedMediaType {
+			t.Errorf("status = %d, want 415", w.Code)
+		}
+	})
+}
+
+func TestCheck(t *testing.T) {
+	dbtest.Open(t)
+	var organization models.Organization
+	if err := initializers.DBConn.Where("name = ?", models.DefaultOrganization).First(&organization).Error; err != nil {
+		t.Fatal(err)
+	}
+	user, err := controller.CreateUserAccount("test", organization.ID, "jdoe", "jdoe@example.org", "jdoe-password", []string{"user"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gin.SetMode(gin.TestMode)
+	gin.DefaultWriter = io.Discard
+	handler := router.New()
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/users/login",
+		strings.NewReader(`{"email": "jdoe@example.org", "password": "jdoe-password", "forceTokenGen": true}`)))
+	var login struct {
+		Token string `json:"token"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &login); err != nil || login.Token == "" {
+		t.Fatalf("login = %d %s", w.Code, w.Body)
+	}
+	bearer := "Bearer " + login.Token
+	server := &Server{Handler: handler}
+
+	t.Run("allowed", func(t *testing.T) {
+		for _, extensions := range []map[string]string{nil, {"org": models.DefaultOrganization, "role": "user,admin"}} {
+			// A client cannot pass its own identity headers on
+			headers := map[string]string{"authorization": bearer, "x-auth-user": "admin"}
+			message, code, description := call(t, server, "/envoy.service.auth.v3.Authorization/Check", frame(envoyCheck(headers, extensions)))
+			if code != codeOK {
+				t.Fatalf("status = %d %q", code, description)
+			}
+			fields := decode(t, message)
+			if status := fields.message(t, checkResponseStatus); status.varint(statusCode) != codeOK {
+				t.Fatalf("CheckResponse status = %d %q", status.varint(statusCode), status.string(statusMessage))
+			}
+			ok := fields.message(t, checkResponseOK)
+			want := [][2]string{
+				{"x-auth-user", "jdoe"},
+				{"x-auth-user-id", strconv.FormatUint(uint64(user.ID), 10)},
+				{"x-auth-email", "jdoe@example.org"},
+				{"x-auth-organization", models.DefaultOrganization},
+				{"x-auth-roles", "user"},
+			}
+			if headers := ok.headers(t, okResponseHeaders); !reflect.DeepEqual(headers, want) {
+				t.Errorf("headers with %v = %q, want %q", extensions, headers, want)
+			}
+			if removed := ok[okResponseRemove]; len(removed) != 1 || string(removed[0]) != "x-auth-groups" {
+				t.Errorf("headers_to_remove = %q, want [x-auth-groups]", removed)
+			}
+		}
+	})
+
+	denied := []struct {
+		name       string
+		headers    map[string]string
+		extensions map[string]string
+		wantCode   uint64
+		wantStatus uint64
+		wantBody   string
+	}{
+		{"no token", nil, nil, codeUnauthenticated, http.StatusUnauthorized, ""},
+		{"invalid token", map[string]string{"authorization": "Bearer not-a-jwt"}, nil, codeUnauthenticated, http.StatusUnauthorized, ""},
+		{"missing role", map[string]string{"authorization": bearer}, map[string]string{"role": "admin"}, codePermissionDenied, http.StatusForbidden, "missing one of the roles admin"},
+		{"missing group", map[string]string{"authorization": bearer}, map[string]string{"group": "admin"}, codePermissionDenied, http.StatusForbidden, "not a member of one of the groups admin"},
+	}
+	for _, test := range denied {
+		t.Run(test.name, func(t *testing.T) {
+			message, code, _ := call(t, server, "/envoy.service.auth.v3.Authorization/Check", frame(envoyCheck(test.headers, test.extensions)))
+			// The call succeeds, the CheckResponse carries the decision
+			if code != codeOK {
+				t.Fatalf("gRPC status = %d, want OK", code)
+			}
+			fields := decode(t, message)
+			if status := fields.message(t, checkResponseStatus).varint(statusCode); status != test.wantCode {
+				t.Errorf("CheckResponse status = %d, want %d", status, test.wantCode)
+			}
+			if fields[checkResponseOK] != nil {
+				t.Error("a denied request has an ok_response")
+			}
+			response := fields.message(t, checkResponseDenied)
+			if status := response.message(t, deniedResponseStatus).varint(httpStatusCode); status != test.wantStatus {
+				t.Errorf("HTTP status = %d, want %d", status, test.wantStatus)
+			}
+			headers := response.headers(t, deniedResponseHeaders)
+			if test.wantStatus == http.StatusUnauthorized && !reflect.DeepEqual(headers[len(headers)-1], [2]string{"www-authenticate", "Bearer"}) {
+				t.Errorf("headers = %q, want a www-authenticate header", headers)
+			}
+			if body := response.string(deniedResponseBody); !strings.Contains(body, test.wantBody) {
+				t.Errorf("body = %q, want %q", body, test.wantBody)
+			}
+		})
+	}
+}
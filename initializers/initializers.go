@@ -26,36 +26,72 @@ func InitiazeDB() {
 	DBConn, err = gorm.Open(postgres.Open(dsn), &gorm.Config{})
 	if err != nil {
 		log.Println("Unable to connect to DataDase")
+		return
 	}
 	log.Println("Connected to DB..!")
+
+	// user_roles is an explicit model carrying who granted a role and until when
+	for _, join := range []struct {
+		model interface{}
+		field string
+	}{{&models.User{}, "Roles"}, {&models.Role{}, "Users"}} {
+		if err := DBConn.SetupJoinTable(join.model, join.field, &models.UserRole{}); err != nil {
+			log.Fatal("Failed to set up the user_roles join table: ", err)
+		}
+	}
 }
 
 func MigrateDB() {
-	DBConn.AutoMigrate(&models.User{}, &models.Group{}, &models.Role{}, &models.RSAKeyPair{})
+	DBConn.AutoMigrate(
+		&models.Organization{},
+		&models.User{}, &models.Group{}, &models.Role{}, &models.RSAKeyPair{},
+		&models.PersonalAccessToken{}, &models.Session{}, &models.AuditEvent{},
+		&models.WebhookSubscription{}, &models.OutboxEvent{}, &models.WebhookDelivery{},
+		&models.IdentityProvider{}, &models.ExternalIdentity{}, &models.OIDCLoginState{},
+		&models.SAMLProvider{}, &models.SAMLIdentity{}, &models.SAMLRequest{},
+		&models.GroupManager{}, &models.ElevationRequest{}, &models.AccessRequest{},
+		&models.AccessReview{}, &models.AccessReviewItem{}, &models.RoleConstraint{},
+		&models.Policy{}, &models.RegistryRule{}, &models.SSHCertificateAuthority{},
+	)
 	log.Println("Finished AutoMigration..!")
 }
 
-// SeedRoles seeds the database with initial roles, including Admin
-func SeedRoles() {
-	adminRole := models.Role{Name: "admin"}
-	userRole := models.Role{Name: "user"}
-
-	// Check if roles exist, if not, create them
-	if err := DBConn.FirstOrCreate(&adminRole, models.Role{Name: "admin"}).Error; err != nil {
-		log.Fatal("Failed to seed roles: ", err)
-	}
-	if err := DBConn.FirstOrCreate(&userRole, models.Role{Name: "user"}).Error; err != nil {
-		log.Fatal("Failed to seed roles: ", err)
+// SeedOrganizations creates the default organization and moves rows from before
+// multi-tenancy into it
+func SeedOrganizations() models.Organization {
+	organization := models.Organization{Name: models.DefaultOrganization, DisplayName: "Default"}
+	if err := DBConn.FirstOrCreate(&organization, models.Organization{Name: models.DefaultOrganization}).Error; err != nil {
+		log.Fatal("Failed to seed organizations: ", err)
 	}
 
-	adminGroup := models.Group{Name: "admin"}
-	userGroup := models.Group{Name: "user"}
+	for _, model := range []interface{}{&models.User{}, &models.Role{}, &models.Group{}, &models.RSAKeyPair{}} {
+		if err := DBConn.Model(model).Where("organization_id IS NULL OR organization_id = 0").
+			Update("organization_id", organization.ID).Error; err != nil {
+			log.Fatal("Failed to move existing data to the default organization: ", err)
+		}
+	}
+	return organization
+}
 
-	// Check if Group exist, if not, create them
-	if err := DBConn.FirstOrCreate(&adminGroup, models.Group{Name: "admin"}).Error; err != nil {
+// SeedRoles seeds the default organization with initial roles, including Admin
+func SeedRoles() {
+	if err := SeedOrganizationRoles(DBConn, SeedOrganizations()); err != nil {
 		log.Fatal("Failed to seed roles: ", err)
 	}
-	if err := DBConn.FirstOrCreate(&userGroup, models.Group{Name: "user"}).Error; err != nil {
-		log.Fatal("Failed to seed roles: ", err)
+}
+
+// SeedOrganizationRoles creates the admin and user roles and groups of an organization
+func SeedOrganizationRoles(db *gorm.DB, organization models.Organization) error {
+	for _, name := range []string{"admin", "user"} {
+		// Check if the role and group exist, if not, create them
+		role := models.Role{Name: name, OrganizationID: organization.ID}
+		if err := db.FirstOrCreate(&role, models.Role{Name: name, OrganizationID: organization.ID}).Error; err != nil {
+			return err
+		}
+		group := models.Group{Name: name, OrganizationID: organization.ID}
+		if err := db.FirstOrCreate(&group, models.Group{Name: name, OrganizationID: organization.ID}).Error; err != nil {
+			return err
+		}
 	}
+	return nil
 }
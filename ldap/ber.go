@@ -0,0 +1,193 @@
+package ldap
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+)
+
+// BER tag classes
+const (
+	ClassUniversal   byte = 0x00
+	ClassApplication byte = 0x40
+	ClassContext     byte = 0x80
+)
+
+// Universal tags used by LDAP
+const (
+	TagBoolean     = 0x01
+	TagInteger     = 0x02
+	TagOctetString = 0x04
+	TagNull        = 0x05
+	TagEnumerated  = 0x0a
+	TagSequence    = 0x10
+	TagSet         = 0x11
+)
+
+// maxPacketSize guards against peers announcing absurdly large packets
+const maxPacketSize = 16 << 20
+
+// Packet is a BER encoded element, either primitive with a Value or constructed with Children
+type Packet struct {
+	Class       byte
+	Constructed bool
+	Tag         int
+	Value       []byte
+	Children    []*Packet
+}
+
+// NewSequence returns a constructed packet with the given children
+func NewSequence(class byte, tag int, children ...*Packet) *Packet {
+	return &Packet{Class: class, Constructed: true, Tag: tag, Children: children}
+}
+
+// NewOctetString returns a primitive packet holding a string
+func NewOctetString(class byte, tag int, value string) *Packet {
+	return &Packet{Class: class, Tag: tag, Value: []byte(value)}
+}
+
+// NewInteger returns a primitive packet holding a two's complement integer
+func NewInteger(class byte, tag int, value int64) *Packet {
+	var buf []byte
+	for {
+		buf = append([]byte{byte(value)}, buf...)
+		value >>= 8
+		// Stop once the remaining bits are pure sign extension of the leading byte
+		if (value == 0 && buf[0]&0x80 == 0) || (value == -1 && buf[0]&0x80 != 0) {
+			break
+		}
+	}
+	return &Packet{Class: class, Tag: tag, Value: buf}
+}
+
+// NewBoolean returns a primitive packet holding a boolean
+func NewBoolean(class byte, tag int, value bool) *Packet {
+	if value {
+		return &Packet{Class: class, Tag: tag, Value: []byte{0xff}}
+	}
+	return &Packet{Class: class, Tag: tag, Value: []byte{0x00}}
+}
+
+// Int decodes the value of an INTEGER or ENUMERATED packet
+func (p *Packet) Int() int64 {
+	var value int64
+	for i, b := range p.Value {
+		if i == 0 && b&0x80 != 0 {
+			value = -1
+		}
+		value = value<<8 | int64(b)
+	}
+	return value
+}
+
+// Str returns the value of an OCTET STRING packet
+func (p *Packet) Str() string {
+	return string(p.Value)
+}
+
+// Bool decodes the value of a BOOLEAN packet
+func (p *Packet) Bool() bool {
+	return len(p.Value) > 0 && p.Value[0] != 0
+}
+
+// Is reports whether the packet has the given class and tag
+func (p *Packet) Is(class byte, tag int) bool {
+	return p.Class == class && p.Tag == tag
+}
+
+// Bytes encodes the packet
+func (p *Packet) Bytes() []byte {
+	content := p.Value
+	if p.Constructed {
+		content = nil
+		for _, child := range p.Children {
+			content = append(content, child.Bytes()...)
+		}
+	}
+
+	identifier := p.Class | byte(p.Tag&0x1f)
+	if p.Constructed {
+		identifier |= 0x20
+	}
+	out := []byte{identifier}
+	out = append(out, encodeLength(len(content))...)
+	return append(out, content...)
+}
+
+// encodeLength encodes a definite length in short or long form
+func encodeLength(length int) []byte {
+	if length < 0x80 {
+		return []byte{byte(length)}
+	}
+	var buf []byte
+	for l := length; l > 0; l >>= 8 {
+		buf = append([]byte{byte(l)}, buf...)
+	}
+	return append([]byte{0x80 | byte(len(buf))}, buf...)
+}
+
+// ReadPacket reads one BER element from r
+func ReadPacket(r *bufio.Reader) (*Packet, error) {
+	identifier, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	if identifier&0x1f == 0x1f {
+		return nil, errors.New("ldap: multi-byte tags are not supported")
+	}
+
+	first, err := r.ReadByte()
+	if err != nil {
+		return nil, io.ErrUnexpectedEOF
+	}
+	length := int(first)
+	if first&0x80 != 0 {
+		n := int(first & 0x7f)
+		if n == 0 || n > 4 {
+			return nil, errors.New("ldap: unsupported length encoding")
+		}
+		length = 0
+		for i := 0; i < n; i++ {
+			b, err := r.ReadByte()
+			if err != nil {
+				return nil, io.ErrUnexpectedEOF
+			}
+			length = length<<8 | int(b)
+		}
+	}
+	if length > maxPacketSize {
+		return nil, errors.New("ldap: packet too large")
+	}
+
+	content := make([]byte, length)
+	if _, err := io.ReadFull(r, content); err != nil {
+		return nil, err
+	}
+	return parsePacket(identifier, content)
+}
+
+// parsePacket builds a packet from its identifier and content, decoding children of constructed packets
+func parsePacket(identifier byte, content []byte) (*Packet, error) {
+	p := &Packet{
+		Class:       identifier & 0xc0,
+		Constructed: identifier&0x20 != 0,
+		Tag:         int(identifier & 0x1f),
+	}
+	if !p.Constructed {
+		p.Value = content
+		return p, nil
+	}
+
+	r := bufio.NewReader(bytes.NewReader(content))
+	for {
+		child, err := ReadPacket(r)
+		if err == io.EOF {
+			return p, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		p.Children = append(p.Children, child)
+	}
+}
@@ -0,0 +1,303 @@
+// Package ldap is a small LDAPv3 client covering what the directory sync and LDAP logins need:
+// simple binds and searches over ldap:// or ldaps://.
+package ldap
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Protocol operations (RFC 4511, section 4.2 onwards)
+const (
+	ApplicationBindRequest           = 0
+	ApplicationBindResponse          = 1
+	ApplicationUnbindRequest         = 2
+	ApplicationSearchRequest         = 3
+	ApplicationSearchResultEntry     = 4
+	ApplicationSearchResultDone      = 5
+	ApplicationSearchResultReference = 19
+)
+
+// Result codes
+const (
+	ResultSuccess            = 0
+	ResultNoSuchObject       = 32
+	ResultInvalidCredentials = 49
+)
+
+// Search scopes
+type Scope int
+
+const (
+	ScopeBaseObject   Scope = 0
+	ScopeSingleLevel  Scope = 1
+	ScopeWholeSubtree Scope = 2
+)
+
+// Timeout bounds every operation on a connection
+var Timeout = 30 * time.Second
+
+// Error is a non-success LDAP result
+type Error struct {
+	ResultCode int
+	Message    string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("ldap: result code %d: %s", e.ResultCode, e.Message)
+}
+
+// IsInvalidCredentials reports whether err is a failed bind because of a wrong DN or password
+func IsInvalidCredentials(err error) bool {
+	var ldapErr *Error
+	return errors.As(err, &ldapErr) && ldapErr.ResultCode == ResultInvalidCredentials
+}
+
+// Entry is a directory entry returned by a search
+type Entry struct {
+	DN         string
+	Attributes map[string][]string
+}
+
+// GetAttributeValues returns the values of an attribute, matching its name case-insensitively
+func (e Entry) GetAttributeValues(name string) []string {
+	for attribute, values := range e.Attributes {
+		if strings.EqualFold(attribute, name) {
+			return values
+		}
+	}
+	return nil
+}
+
+// GetAttributeValue returns the first value of an attribute or an empty string
+func (e Entry) GetAttributeValue(name string) string {
+	values := e.GetAttributeValues(name)
+	if len(values) == 0 {
+		return ""
+	}
+	return values[0]
+}
+
+// NormalizeDN lower-cases a DN and removes spaces around the separators, so DNs can be compared.
+// Escaped commas are not handled, directories rarely use them in the DNs that are compared here.
+func NormalizeDN(dn string) string {
+	parts := strings.Split(dn, ",")
+	for i, part := range parts {
+		pieces := strings.SplitN(part, "=", 2)
+		for j := range pieces {
+			pieces[j] = strings.TrimSpace(pieces[j])
+		}
+		parts[i] = strings.Join(pieces, "=")
+	}
+	return strings.ToLower(strings.Join(parts, ","))
+}
+
+// Conn is a connection to a directory server. Operations are serialised.
+type Conn struct {
+	mu        sync.Mutex
+	conn      net.Conn
+	reader    *bufio.Reader
+	messageID int64
+}
+
+// Dial connects to an ldap:// or ldaps:// URL. tlsConfig is only used for ldaps and may be nil.
+func Dial(rawURL string, tlsConfig *tls.Config) (*Conn, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+
+	dialer := &net.Dialer{Timeout: Timeout}
+	var conn net.Conn
+	switch u.Scheme {
+	case "ldap":
+		host := u.Host
+		if u.Port() == "" {
+			host = net.JoinHostPort(u.Hostname(), "389")
+		}
+		conn, err = dialer.Dial("tcp", host)
+	case "ldaps":
+		host := u.Host
+		if u.Port() == "" {
+			host = net.JoinHostPort(u.Hostname(), "636")
+		}
+		if tlsConfig == nil {
+			tlsConfig = &tls.Config{}
+		}
+		if tlsConfig.ServerName == "" {
+			tlsConfig = tlsConfig.Clone()
+			tlsConfig.ServerName = u.Hostname()
+		}
+		conn, err = tls.DialWithDialer(dialer, "tcp", host, tlsConfig)
+	default:
+		return nil, fmt.Errorf("ldap: unsupported scheme %q", u.Scheme)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return NewConn(conn), nil
+}
+
+// NewConn wraps an established network connection
+func NewConn(conn net.Conn) *Conn {
+	return &Conn{conn: conn, reader: bufio.NewReader(conn)}
+}
+
+// Close sends an unbind request and closes the connection
+func (c *Conn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.messageID++
+	c.conn.SetDeadline(time.Now().Add(Timeout))
+	c.conn.Write(envelope(c.messageID, &Packet{Class: ClassApplication, Tag: ApplicationUnbindRequest}).Bytes())
+	return c.conn.Close()
+}
+
+// Bind authenticates with a simple bind
+func (c *Conn) Bind(dn, password string) error {
+	// An empty password would be an unauthenticated bind, which servers accept without checking anything
+	if dn != "" && password == "" {
+		return &Error{ResultCode: ResultInvalidCredentials, Message: "empty password"}
+	}
+
+	request := NewSequence(ClassApplication, ApplicationBindRequest,
+		NewInteger(ClassUniversal, TagInteger, 3),
+		NewOctetString(ClassUniversal, TagOctetString, dn),
+		NewOctetString(ClassContext, 0, password),
+	)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	id, err := c.send(request)
+	if err != nil {
+		return err
+	}
+	response, err := c.receive(id)
+	if err != nil {
+		return err
+	}
+	if !response.Is(ClassApplication, ApplicationBindResponse) {
+		return errors.New("ldap: unexpected response to bind")
+	}
+	return resultError(response)
+}
+
+// Search runs a search and returns all entries. Referrals are ignored.
+func (c *Conn) Search(baseDN string, scope Scope, filter string, attributes []string) ([]Entry, error) {
+	compiled, err := CompileFilter(filter)
+	if err != nil {
+		return nil, err
+	}
+
+	attributeList := NewSequence(ClassUniversal, TagSequence)
+	for _, attribute := range attributes {
+		attributeList.Children = append(attributeList.Children, NewOctetString(ClassUniversal, TagOctetString, attribute))
+	}
+	request := NewSequence(ClassApplication, ApplicationSearchRequest,
+		NewOctetString(ClassUniversal, TagOctetString, baseDN),
+		NewInteger(ClassUniversal, TagEnumerated, int64(scope)),
+		NewInteger(ClassUniversal, TagEnumerated, 0), // neverDerefAliases
+		NewInteger(ClassUniversal, TagInteger, 0),    // no size limit
+		NewInteger(ClassUniversal, TagInteger, 0),    // no time limit
+		NewBoolean(ClassUniversal, TagBoolean, false),
+		compiled,
+		attributeList,
+	)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	id, err := c.send(request)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []Entry
+	for {
+		response, err := c.receive(id)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case response.Is(ClassApplication, ApplicationSearchResultEntry):
+			entry, err := parseEntry(response)
+			if err != nil {
+				return nil, err
+			}
+			entries = append(entries, entry)
+		case response.Is(ClassApplication, ApplicationSearchResultReference):
+			continue
+		case response.Is(ClassApplication, ApplicationSearchResultDone):
+			return entries, resultError(response)
+		default:
+			return nil, errors.New("ldap: unexpected response to search")
+		}
+	}
+}
+
+// send writes a request in an LDAPMessage envelope and returns its message ID
+func (c *Conn) send(operation *Packet) (int64, error) {
+	c.messageID++
+	c.conn.SetDeadline(time.Now().Add(Timeout))
+	_, err := c.conn.Write(envelope(c.messageID, operation).Bytes())
+	return c.messageID, err
+}
+
+// receive reads the next response for the given message ID and returns its protocol operation
+func (c *Conn) receive(id int64) (*Packet, error) {
+	for {
+		c.conn.SetDeadline(time.Now().Add(Timeout))
+		message, err := ReadPacket(c.reader)
+		if err != nil {
+			return nil, err
+		}
+		if len(message.Children) < 2 {
+			return nil, errors.New("ldap: malformed message")
+		}
+		if message.Children[0].Int() == id {
+			return message.Children[1], nil
+		}
+		// Unsolicited notifications (message ID 0) and stale responses are skipped
+	}
+}
+
+// envelope wraps a protocol operation in an LDAPMessage
+func envelope(id int64, operation *Packet) *Packet {
+	return NewSequence(ClassUniversal, TagSequence, NewInteger(ClassUniversal, TagInteger, id), operation)
+}
+
+// resultError turns an LDAPResult into an error unless it is a success
+func resultError(result *Packet) error {
+	if len(result.Children) < 3 {
+		return errors.New("ldap: malformed result")
+	}
+	code := int(result.Children[0].Int())
+	if code == ResultSuccess {
+		return nil
+	}
+	return &Error{ResultCode: code, Message: result.Children[2].Str()}
+}
+
+// parseEntry decodes a SearchResultEntry
+func parseEntry(packet *Packet) (Entry, error) {
+	if len(packet.Children) < 2 {
+		return Entry{}, errors.New("ldap: malformed search entry")
+	}
+	entry := Entry{DN: packet.Children[0].Str(), Attributes: map[string][]string{}}
+	for _, attribute := range packet.Children[1].Children {
+		if len(attribute.Children) < 2 {
+			return Entry{}, errors.New("ldap: malformed attribute")
+		}
+		name := attribute.Children[0].Str()
+		for _, value := range attribute.Children[1].Children {
+			entry.Attributes[name] = append(entry.Attributes[name], value.Str())
+		}
+	}
+	return entry, nil
+}
@@ -0,0 +1,133 @@
+package ldap_test
+
+import (
+	"jwt/ldap"
+	"jwt/ldap/ldaptest"
+	"sort"
+	"testing"
+)
+
+func newDirectory(t *testing.T) *ldaptest.Server {
+	t.Helper()
+	server, err := ldaptest.NewServer(
+		ldaptest.Entry("uid=jdoe,ou=people,dc=example,dc=org",
+			"objectClass", "inetOrgPerson", "uid", "jdoe", "mail", "jdoe@example.org", "userPassword", "secret"),
+		ldaptest.Entry("uid=asmith,ou=people,dc=example,dc=org",
+			"objectClass", "inetOrgPerson", "uid", "asmith", "mail", "asmith@example.org", "userPassword", "hunter2"),
+		ldaptest.Entry("cn=ops,ou=groups,dc=example,dc=org",
+			"objectClass", "groupOfNames", "cn", "ops", "member", "uid=jdoe,ou=people,dc=example,dc=org"),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { server.Close() })
+	return server
+}
+
+func dial(t *testing.T, server *ldaptest.Server) *ldap.Conn {
+	t.Helper()
+	conn, err := ldap.Dial(server.URL(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func TestBind(t *testing.T) {
+	server := newDirectory(t)
+
+	tests := []struct {
+		name     string
+		dn       string
+		password string
+		invalid  bool
+	}{
+		{"valid password", "uid=jdoe,ou=people,dc=example,dc=org", "secret", false},
+		{"DN in another spelling", "UID=jdoe, ou=People, dc=example, dc=org", "secret", false},
+		{"wrong password", "uid=jdoe,ou=people,dc=example,dc=org", "hunter2", true},
+		{"unknown DN", "uid=nobody,ou=people,dc=example,dc=org", "secret", true},
+		{"empty password", "uid=jdoe,ou=people,dc=example,dc=org", "", true},
+		{"anonymous", "", "", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := dial(t, server).Bind(test.dn, test.password)
+			if test.invalid {
+				if !ldap.IsInvalidCredentials(err) {
+					t.Fatalf("Bind() = %v, want invalid credentials", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Bind() = %v", err)
+			}
+		})
+	}
+}
+
+func TestSearch(t *testing.T) {
+	server := newDirectory(t)
+	conn := dial(t, server)
+
+	tests := []struct {
+		name   string
+		base   string
+		scope  ldap.Scope
+		filter string
+		want   []string
+	}{
+		{"all people", "ou=people,dc=example,dc=org", ldap.ScopeWholeSubtree, "(objectClass=inetOrgPerson)",
+			[]string{"uid=asmith,ou=people,dc=example,dc=org", "uid=jdoe,ou=people,dc=example,dc=org"}},
+		{"equality", "dc=example,dc=org", ldap.ScopeWholeSubtree, "(mail=jdoe@example.org)",
+			[]string{"uid=jdoe,ou=people,dc=example,dc=org"}},
+		{"substring and", "dc=example,dc=org", ldap.ScopeWholeSubtree, "(&(objectClass=inetOrgPerson)(uid=a*))",
+			[]string{"uid=asmith,ou=people,dc=example,dc=org"}},
+		{"not", "ou=people,dc=example,dc=org", ldap.ScopeWholeSubtree, "(!(uid=jdoe))",
+			[]string{"uid=asmith,ou=people,dc=example,dc=org"}},
+		{"group members", "ou=groups,dc=example,dc=org", ldap.ScopeSingleLevel, "(member=uid=jdoe,ou=people,dc=example,dc=org)",
+			[]string{"cn=ops,ou=groups,dc=example,dc=org"}},
+		{"base object", "cn=ops,ou=groups,dc=example,dc=org", ldap.ScopeBaseObject, "(objectClass=*)",
+			[]string{"cn=ops,ou=groups,dc=example,dc=org"}},
+		{"single level excludes the subtree", "dc=example,dc=org", ldap.ScopeSingleLevel, "(objectClass=*)", nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			entries, err := conn.Search(test.base, test.scope, test.filter, []string{"uid", "mail"})
+			if err != nil {
+				t.Fatalf("Search() = %v", err)
+			}
+			var got []string
+			for _, entry := range entries {
+				got = append(got, entry.DN)
+			}
+			sort.Strings(got)
+			if len(got) != len(test.want) {
+				t.Fatalf("Search() = %v, want %v", got, test.want)
+			}
+			for i := range got {
+				if got[i] != test.want[i] {
+					t.Fatalf("Search() = %v, want %v", got, test.want)
+				}
+			}
+		})
+	}
+}
+
+func TestSearchReturnsRequestedAttributesOnly(t *testing.T) {
+	conn := dial(t, newDirectory(t))
+
+	entries, err := conn.Search("ou=people,dc=example,dc=org", ldap.ScopeWholeSubtree, "(uid=jdoe)", []string{"mail"})
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("Search() = %v, %v", entries, err)
+	}
+	if got := entries[0].GetAttributeValue("mail"); got != "jdoe@example.org" {
+		t.Errorf("mail = %q", got)
+	}
+	if got := entries[0].GetAttributeValue("uid"); got != "" {
+		t.Errorf("uid = %q, want it left out", got)
+	}
+	if got := entries[0].GetAttributeValue("userPassword"); got != "" {
+		t.Errorf("userPassword = %q, want it never returned", got)
+	}
+}
@@ -0,0 +1,253 @@
+package ldap
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Filter choices (RFC 4511, section 4.5.1)
+const (
+	FilterAnd            = 0
+	FilterOr             = 1
+	FilterNot            = 2
+	FilterEqualityMatch  = 3
+	FilterSubstrings     = 4
+	FilterGreaterOrEqual = 5
+	FilterLessOrEqual    = 6
+	FilterPresent        = 7
+	FilterApproxMatch    = 8
+)
+
+// Substring choices
+const (
+	substringInitial = 0
+	substringAny     = 1
+	substringFinal   = 2
+)
+
+// EscapeFilter escapes a value for use inside a string filter (RFC 4515)
+func EscapeFilter(value string) string {
+	var b strings.Builder
+	for i := 0; i < len(value); i++ {
+		switch c := value[i]; c {
+		case '*', '(', ')', '\\', 0:
+			fmt.Fprintf(&b, `\%02x`, c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// CompileFilter encodes a string filter such as "(&(objectClass=person)(uid=jdoe))"
+func CompileFilter(filter string) (*Packet, error) {
+	packet, rest, err := compileFilter(strings.TrimSpace(filter))
+	if err != nil {
+		return nil, err
+	}
+	if strings.TrimSpace(rest) != "" {
+		return nil, fmt.Errorf("ldap: unexpected %q after filter", rest)
+	}
+	return packet, nil
+}
+
+// compileFilter compiles the filter at the start of s and returns the remaining input
+func compileFilter(s string) (*Packet, string, error) {
+	if !strings.HasPrefix(s, "(") {
+		return nil, "", errors.New("ldap: filter must start with '('")
+	}
+	s = s[1:]
+	if s == "" {
+		return nil, "", errors.New("ldap: unterminated filter")
+	}
+
+	switch s[0] {
+	case '&', '|':
+		tag := FilterAnd
+		if s[0] == '|' {
+			tag = FilterOr
+		}
+		set := NewSequence(ClassContext, tag)
+		s = s[1:]
+		for strings.HasPrefix(s, "(") {
+			child, rest, err := compileFilter(s)
+			if err != nil {
+				return nil, "", err
+			}
+			set.Children = append(set.Children, child)
+			s = rest
+		}
+		if !strings.HasPrefix(s, ")") {
+			return nil, "", errors.New("ldap: unterminated filter")
+		}
+		return set, s[1:], nil
+
+	case '!':
+		child, rest, err := compileFilter(s[1:])
+		if err != nil {
+			return nil, "", err
+		}
+		if !strings.HasPrefix(rest, ")") {
+			return nil, "", errors.New("ldap: unterminated filter")
+		}
+		return NewSequence(ClassContext, FilterNot, child), rest[1:], nil
+	}
+
+	end := strings.IndexByte(s, ')')
+	if end < 0 {
+		return nil, "", errors.New("ldap: unterminated filter")
+	}
+	item, rest := s[:end], s[end+1:]
+
+	eq := strings.IndexByte(item, '=')
+	if eq <= 0 {
+		return nil, "", fmt.Errorf("ldap: invalid filter item %q", item)
+	}
+	attribute, value := item[:eq], item[eq+1:]
+	tag := FilterEqualityMatch
+	switch attribute[len(attribute)-1] {
+	case '>':
+		tag, attribute = FilterGreaterOrEqual, attribute[:len(attribute)-1]
+	case '<':
+		tag, attribute = FilterLessOrEqual, attribute[:len(attribute)-1]
+	case '~':
+		tag, attribute = FilterApproxMatch, attribute[:len(attribute)-1]
+	}
+
+	if tag == FilterEqualityMatch && value == "*" {
+		return NewOctetString(ClassContext, FilterPresent, attribute), rest, nil
+	}
+
+	if tag == FilterEqualityMatch && strings.Contains(value, "*") {
+		parts := strings.Split(value, "*")
+		substrings := NewSequence(ClassUniversal, TagSequence)
+		for i, part := range parts {
+			if part == "" {
+				continue
+			}
+			unescaped, err := unescapeFilterValue(part)
+			if err != nil {
+				return nil, "", err
+			}
+			choice := substringAny
+			if i == 0 {
+				choice = substringInitial
+			} else if i == len(parts)-1 {
+				choice = substringFinal
+			}
+			substrings.Children = append(substrings.Children, NewOctetString(ClassContext, choice, unescaped))
+		}
+		return NewSequence(ClassContext, FilterSubstrings,
+			NewOctetString(ClassUniversal, TagOctetString, attribute),
+			substrings,
+		), rest, nil
+	}
+
+	unescaped, err := unescapeFilterValue(value)
+	if err != nil {
+		return nil, "", err
+	}
+	return NewSequence(ClassContext, tag,
+		NewOctetString(ClassUniversal, TagOctetString, attribute),
+		NewOctetString(ClassUniversal, TagOctetString, unescaped),
+	), rest, nil
+}
+
+// unescapeFilterValue decodes \XX escapes of a filter value
+func unescapeFilterValue(value string) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(value); i++ {
+		if value[i] != '\\' {
+			b.WriteByte(value[i])
+			continue
+		}
+		if i+2 >= len(value) {
+			return "", fmt.Errorf("ldap: invalid escape in %q", value)
+		}
+		decoded, err := hex.DecodeString(value[i+1 : i+3])
+		if err != nil {
+			return "", fmt.Errorf("ldap: invalid escape in %q", value)
+		}
+		b.Write(decoded)
+		i += 2
+	}
+	return b.String(), nil
+}
+
+// MatchFilter evaluates an encoded filter against an entry.
+// Values are compared case-insensitively, which suits the directory test server.
+func MatchFilter(filter *Packet, entry Entry) bool {
+	switch filter.Tag {
+	case FilterAnd:
+		for _, child := range filter.Children {
+			if !MatchFilter(child, entry) {
+				return false
+			}
+		}
+		return true
+	case FilterOr:
+		for _, child := range filter.Children {
+			if MatchFilter(child, entry) {
+				return true
+			}
+		}
+		return false
+	case FilterNot:
+		return len(filter.Children) == 1 && !MatchFilter(filter.Children[0], entry)
+	case FilterPresent:
+		return len(entry.GetAttributeValues(filter.Str())) > 0
+	case FilterSubstrings:
+		if len(filter.Children) != 2 {
+			return false
+		}
+		for _, value := range entry.GetAttributeValues(filter.Children[0].Str()) {
+			if matchSubstrings(strings.ToLower(value), filter.Children[1].Children) {
+				return true
+			}
+		}
+		return false
+	case FilterEqualityMatch, FilterApproxMatch, FilterGreaterOrEqual, FilterLessOrEqual:
+		if len(filter.Children) != 2 {
+			return false
+		}
+		want := strings.ToLower(filter.Children[1].Str())
+		for _, value := range entry.GetAttributeValues(filter.Children[0].Str()) {
+			value = strings.ToLower(value)
+			switch {
+			case filter.Tag == FilterGreaterOrEqual && value >= want,
+				filter.Tag == FilterLessOrEqual && value <= want,
+				(filter.Tag == FilterEqualityMatch || filter.Tag == FilterApproxMatch) && value == want:
+				return true
+			}
+		}
+		return false
+	}
+	return false
+}
+
+// matchSubstrings checks the initial, any and final parts of a substrings filter in order
+func matchSubstrings(value string, parts []*Packet) bool {
+	for _, part := range parts {
+		want := strings.ToLower(part.Str())
+		switch part.Tag {
+		case substringInitial:
+			if !strings.HasPrefix(value, want) {
+				return false
+			}
+			value = value[len(want):]
+		case substringAny:
+			i := strings.Index(value, want)
+			if i < 0 {
+				return false
+			}
+			value = value[i+len(want):]
+		case substringFinal:
+			if !strings.HasSuffix(value, want) {
+				return false
+			}
+		}
+	}
+	return true
+}
@@ -0,0 +1,219 @@
+// Package ldaptest provides an in-process LDAP server for testing the directory sync and LDAP logins.
+//
+//	server, err := ldaptest.NewServer(
+//		ldaptest.Entry("uid=jdoe,ou=people,dc=example,dc=org",
+//			"objectClass", "inetOrgPerson", "uid", "jdoe", "mail", "jdoe@example.org", "userPassword", "secret"),
+//	)
+//	defer server.Close()
+//	conn, err := ldap.Dial(server.URL(), nil)
+//
+// Binds succeed for entries whose userPassword matches, searches support all scopes and filters.
+package ldaptest
+
+import (
+	"bufio"
+	"jwt/ldap"
+	"net"
+	"strings"
+	"sync"
+)
+
+// Server is an LDAP server holding a fixed set of entries in memory
+type Server struct {
+	listener net.Listener
+	mu       sync.RWMutex
+	entries  []ldap.Entry
+	wg       sync.WaitGroup
+}
+
+// Entry builds an entry from a DN and attribute name/value pairs. Repeated names add values.
+func Entry(dn string, attributeValuePairs ...string) ldap.Entry {
+	entry := ldap.Entry{DN: dn, Attributes: map[string][]string{}}
+	for i := 0; i+1 < len(attributeValuePairs); i += 2 {
+		name := attributeValuePairs[i]
+		entry.Attributes[name] = append(entry.Attributes[name], attributeValuePairs[i+1])
+	}
+	return entry
+}
+
+// NewServer starts a server on a random local port
+func NewServer(entries ...ldap.Entry) (*Server, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{listener: listener, entries: entries}
+	s.wg.Add(1)
+	go s.serve()
+	return s, nil
+}
+
+// URL returns the ldap:// URL of the server
+func (s *Server) URL() string {
+	return "ldap://" + s.listener.Addr().String()
+}
+
+// AddEntry adds an entry while the server is running
+func (s *Server) AddEntry(entry ldap.Entry) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.entries = append(s.entries, entry)
+}
+
+// Close stops the server
+func (s *Server) Close() error {
+	err := s.listener.Close()
+	s.wg.Wait()
+	return err
+}
+
+func (s *Server) serve() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+// handle answers the requests of one client connection until it unbinds or disconnects
+func (s *Server) handle(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	for {
+		message, err := ldap.ReadPacket(reader)
+		if err != nil || len(message.Children) < 2 {
+			return
+		}
+		id := message.Children[0].Int()
+		operation := message.Children[1]
+
+		var responses []*ldap.Packet
+		switch {
+		case operation.Is(ldap.ClassApplication, ldap.ApplicationBindRequest):
+			responses = []*ldap.Packet{s.bind(operation)}
+		case operation.Is(ldap.ClassApplication, ldap.ApplicationSearchRequest):
+			responses = s.search(operation)
+		case operation.Is(ldap.ClassApplication, ldap.ApplicationUnbindRequest):
+			return
+		default:
+			return
+		}
+
+		for _, response := range responses {
+			envelope := ldap.NewSequence(ldap.ClassUniversal, ldap.TagSequence,
+				ldap.NewInteger(ldap.ClassUniversal, ldap.TagInteger, id), response)
+			if _, err := conn.Write(envelope.Bytes()); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// bind checks the password of a simple bind against the userPassword attribute
+func (s *Server) bind(request *ldap.Packet) *ldap.Packet {
+	if len(request.Children) < 3 {
+		return result(ldap.ApplicationBindResponse, 2, "malformed bind request") // protocolError
+	}
+	dn := request.Children[1].Str()
+	password := request.Children[2].Str()
+
+	// Anonymous binds are allowed
+	if dn == "" && password == "" {
+		return result(ldap.ApplicationBindResponse, ldap.ResultSuccess, "")
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, entry := range s.entries {
+		if ldap.NormalizeDN(entry.DN) != ldap.NormalizeDN(dn) {
+			continue
+		}
+		for _, value := range entry.GetAttributeValues("userPassword") {
+			if password != "" && value == password {
+				return result(ldap.ApplicationBindResponse, ldap.ResultSuccess, "")
+			}
+		}
+	}
+	return result(ldap.ApplicationBindResponse, ldap.ResultInvalidCredentials, "invalid credentials")
+}
+
+// search returns the matching entries followed by the SearchResultDone
+func (s *Server) search(request *ldap.Packet) []*ldap.Packet {
+	if len(request.Children) < 8 {
+		return []*ldap.Packet{result(ldap.ApplicationSearchResultDone, 2, "malformed search request")}
+	}
+	base := ldap.NormalizeDN(request.Children[0].Str())
+	scope := ldap.Scope(request.Children[1].Int())
+	filter := request.Children[6]
+	var attributes []string
+	for _, attribute := range request.Children[7].Children {
+		attributes = append(attributes, attribute.Str())
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var responses []*ldap.Packet
+	for _, entry := range s.entries {
+		if !inScope(ldap.NormalizeDN(entry.DN), base, scope) || !ldap.MatchFilter(filter, entry) {
+			continue
+		}
+		responses = append(responses, encodeEntry(entry, attributes))
+	}
+	return append(responses, result(ldap.ApplicationSearchResultDone, ldap.ResultSuccess, ""))
+}
+
+// inScope reports whether a DN lies within the search base for the given scope
+func inScope(dn, base string, scope ldap.Scope) bool {
+	switch scope {
+	case ldap.ScopeBaseObject:
+		return dn == base
+	case ldap.ScopeSingleLevel:
+		i := strings.IndexByte(dn, ',')
+		return i >= 0 && dn[i+1:] == base
+	default:
+		return base == "" || dn == base || strings.HasSuffix(dn, ","+base)
+	}
+}
+
+// encodeEntry encodes a SearchResultEntry with the requested attributes, or all but the password
+func encodeEntry(entry ldap.Entry, attributes []string) *ldap.Packet {
+	list := ldap.NewSequence(ldap.ClassUniversal, ldap.TagSequence)
+	for name, values := range entry.Attributes {
+		if !wanted(name, attributes) {
+			continue
+		}
+		set := ldap.NewSequence(ldap.ClassUniversal, ldap.TagSet)
+		for _, value := range values {
+			set.Children = append(set.Children, ldap.NewOctetString(ldap.ClassUniversal, ldap.TagOctetString, value))
+		}
+		list.Children = append(list.Children, ldap.NewSequence(ldap.ClassUniversal, ldap.TagSequence,
+			ldap.NewOctetString(ldap.ClassUniversal, ldap.TagOctetString, name), set))
+	}
+	return ldap.NewSequence(ldap.ClassApplication, ldap.ApplicationSearchResultEntry,
+		ldap.NewOctetString(ldap.ClassUniversal, ldap.TagOctetString, entry.DN), list)
+}
+
+// wanted reports whether an attribute was requested, an empty list or "*" means all user attributes
+func wanted(name string, attributes []string) bool {
+	if len(attributes) == 0 {
+		return !strings.EqualFold(name, "userPassword")
+	}
+	for _, attribute := range attributes {
+		if attribute == "*" && !strings.EqualFold(name, "userPassword") || strings.EqualFold(attribute, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// result encodes an LDAPResult for the given response operation
+func result(operation int, code int, message string) *ldap.Packet {
+	return ldap.NewSequence(ldap.ClassApplication, operation,
+		ldap.NewInteger(ldap.ClassUniversal, ldap.TagEnumerated, int64(code)),
+		ldap.NewOctetString(ldap.ClassUniversal, ldap.TagOctetString, ""),
+		ldap.NewOctetString(ldap.ClassUniversal, ldap.TagOctetString, message),
+	)
+}
@@ -2,10 +2,10 @@ package main
 
 import (
 	"jwt/controller"
+	"jwt/extauthz"
 	"jwt/initializers"
-	"jwt/middleware"
-
-	"github.com/gin-gonic/gin"
+	"jwt/router"
+	"log"
 )
 
 func init() {
@@ -13,40 +13,25 @@ func init() {
 	initializers.InitiazeDB()
 	initializers.MigrateDB()
 	initializers.SeedRoles()
+	// Separation of duties is checked on every membership write
+	if err := controller.RegisterRoleConstraintChecks(initializers.DBConn); err != nil {
+		log.Fatal("Failed to register the role constraint checks: ", err)
+	}
 }
 
 func main() {
-	r := gin.Default()
-
-	userGroup := r.Group("/users")
-	{
-		userGroup.POST("/", controller.CreateUser)
-		userGroup.POST("/login", controller.LoginUser)
-		userGroup.GET("/:id", controller.GetUser)
-		userGroup.PUT("/:id", controller.UpdateUser)
-		userGroup.DELETE("/:id", controller.DeleteUser)
-		userGroup.GET("/", controller.ListUsers)
-	}
-
-	groupGroup := r.Group("/groups")
-	groupGroup.Use(middleware.AdminRequired())
-	{
-		groupGroup.POST("/", controller.CreateGroup)
-		groupGroup.GET("/:id", controller.GetGroup)
-		groupGroup.PUT("/:id", controller.UpdateGroup)
-		groupGroup.DELETE("/:id", controller.DeleteGroup)
-		groupGroup.GET("/", controller.ListGroups)
-	}
-
-	roleGroup := r.Group("/roles")
-	roleGroup.Use(middleware.AdminRequired())
-	{
-		roleGroup.POST("/", controller.CreateRole)
-		roleGroup.GET("/:id", controller.GetRole)
-		roleGroup.PUT("/:id", controller.UpdateRole)
-		roleGroup.DELETE("/:id", controller.DeleteRole)
-		roleGroup.GET("/", controller.ListRoles)
-	}
+	r := router.New()
+
+	// Deliver outbox events to the webhook subscriptions in the background
+	go controller.RunWebhookDispatcher()
+	// Synchronise the LDAP directory in the background when LDAP_SYNC_INTERVAL is set
+	go controller.RunLDAPSync()
+	// Remove time-bound role grants that have ended
+	go controller.RunGrantExpiry()
+	// Load the access control policies and pick up changes made through other instances
+	go controller.RunPolicyReload()
+	// Answer Envoy ext_authz checks over gRPC when EXT_AUTHZ_ADDR is set
+	go extauthz.Run(r)
 
 	r.Run()
 }
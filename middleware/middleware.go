@@ -1,79 +1,79 @@
 package middleware
 
 import (
+	"crypto/subtle"
+	"errors"
 	"jwt/controller"
 	"jwt/initializers"
 	"jwt/models"
+	"jwt/utils"
 	"net/http"
 	"strings"
 
 	"log"
 
 	"github.com/gin-gonic/gin"
-	"github.com/golang-jwt/jwt/v5"
 )
 
-// AdminRequired middleware to protect admin routes
-func AdminRequired() gin.HandlerFunc {
+// RequestID middleware tags every request with an ID, reusing a sane incoming X-Request-ID header
+func RequestID() gin.HandlerFunc {
 	return func(c *gin.Context) {
-		// Extract the token from the authorization header
-		tokenString := c.GetHeader("Authorization")
-		if tokenString == "" || !strings.HasPrefix(tokenString, "Bearer ") {
-			log.Println("Unauthorized: Missing or invalid token")
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
-			c.Abort()
-			return
+		requestID := c.GetHeader("X-Request-ID")
+		if requestID == "" || len(requestID) > 128 {
+			requestID, _ = utils.GenerateRandomString(16)
 		}
+		c.Set(controller.RequestIDContextKey, requestID)
+		c.Header("X-Request-ID", requestID)
+		c.Next()
+	}
+}
 
-		// Remove the "Bearer " prefix
-		tokenString = strings.TrimPrefix(tokenString, "Bearer ")
-
-		// Decode the token to extract claims without validating
-		claims, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-			// We are not validating the token here; just decoding it
-			return nil, nil
-		})
+// Tenant middleware resolves the organization of the route from the :org parameter.
+// Routes without it belong to the default organization.
+func Tenant() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		name := c.Param("org")
+		if name == "" {
+			name = models.DefaultOrganization
+		}
 
-		// Extract user ID from claims
-		userIDFloat, ok := claims.Claims.(jwt.MapClaims)["user_id"].(float64)
-		if !ok {
-			log.Println("Unauthorized: Invalid user ID in claims")
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		var organization models.Organization
+		if err := initializers.DBConn.Where("name = ?", name).First(&organization).Error; err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Organization not found"})
 			c.Abort()
 			return
 		}
-		userID := uint(userIDFloat)
+		c.Set(controller.OrganizationContextKey, organization)
+		c.Next()
+	}
+}
 
-		// Fetch the user along with the RSA public key and roles
-		var user models.User
-		if err := initializers.DBConn.Preload("RSAKey").Preload("Roles").First(&user, userID).Error; err != nil {
-			log.Println("Unauthorized: User not found:", err)
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
-			c.Abort()
+// AuthRequired middleware to protect routes that need any authenticated user
+func AuthRequired() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if _, ok := authenticate(c); !ok {
 			return
 		}
+		c.Next()
+	}
+}
 
-		// Check if the user has a valid public key
-		if user.RSAKey.PublicKey == "" {
-			log.Println("Unauthorized: User does not have a valid public key")
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
-			c.Abort()
+// AdminRequired middleware to protect admin routes
+func AdminRequired() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user, ok := authenticate(c)
+		if !ok {
 			return
 		}
 
-		// Validate the token using the user's public key
-		validatedClaims, err := controller.ValidateJWT(tokenString, string(user.RSAKey.PublicKey)) // Validate with actual public key
-		if err != nil {
-			log.Println("Unauthorized: Token validation with public key failed:", err)
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		// Personal access tokens additionally need the admin scope
+		if scopes, isToken := controller.CurrentScopes(c); isToken && !hasScope(scopes, "admin") {
+			log.Println("Forbidden: Token does not have admin scope")
+			c.JSON(http.StatusForbidden, gin.H{"error": "Access denied"})
 			c.Abort()
 			return
 		}
 
-		// Here, you can use the validatedClaims if needed
-		log.Println(validatedClaims.GetIssuer())
-		// For instance, you could log or check additional claims.
-
 		// Check if the user has the Admin role
 		for _, role := range user.Roles {
 			if role.Name == "admin" {
@@ -88,3 +88,111 @@ func AdminRequired() gin.HandlerFunc {
 		c.Abort()
 	}
 }
+
+// ForwardAuth middleware authenticates the forward-auth requests of a reverse proxy like AuthRequired.
+// The CSRF check and the scope of personal access tokens follow the method of the original request.
+func ForwardAuth() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Set(controller.ForwardAuthContextKey, true)
+		if _, ok := authenticate(c); !ok {
+			return
+		}
+		c.Next()
+	}
+}
+
+// Authorize middleware lets the policies decide whether the authenticated user may perform the
+// action on the resource of the route, identified by its :id parameter
+func Authorize(action, resourceType string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if _, ok := authenticate(c); !ok {
+			return
+		}
+
+		resource := controller.ResourceAttributes(c, resourceType, c.Param("id"))
+		decision := controller.EvaluatePolicies(c, action, resourceType, resource)
+		if !decision.Allowed {
+			log.Println("Forbidden:", decision.Reason)
+			c.JSON(http.StatusForbidden, gin.H{"error": "Access denied", "reason": decision.Reason})
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// authenticate resolves the credential of the request to a user and stores it in the context.
+// It accepts JWTs and personal access tokens in the Authorization header, or a JWT in the session cookie.
+// On failure the request is aborted and false is returned.
+func authenticate(c *gin.Context) (models.User, bool) {
+	// Extract the token from the authorization header
+	tokenString := c.GetHeader("Authorization")
+	if tokenString == "" {
+		// Fall back to the browser session cookie
+		cookie, err := c.Cookie(controller.SessionCookieName)
+		if err != nil || cookie == "" {
+			log.Println("Unauthorized: Missing token")
+			return unauthorized(c)
+		}
+		if !validCSRF(c) {
+			log.Println("Forbidden: Missing or invalid CSRF token")
+			c.JSON(http.StatusForbidden, gin.H{"error": "Invalid CSRF token"})
+			c.Abort()
+			return models.User{}, false
+		}
+		tokenString = cookie
+	} else if strings.HasPrefix(tokenString, "Bearer ") {
+		// Remove the "Bearer " prefix
+		tokenString = strings.TrimPrefix(tokenString, "Bearer ")
+	} else {
+		log.Println("Unauthorized: Missing or invalid token")
+		return unauthorized(c)
+	}
+
+	user, err := controller.VerifyCredential(c, tokenString)
+	if err != nil {
+		log.Println(err)
+		var rejected *controller.CredentialError
+		if errors.As(err, &rejected) && rejected.Status == http.StatusForbidden {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Access denied"})
+			c.Abort()
+			return models.User{}, false
+		}
+		return unauthorized(c)
+	}
+
+	c.Set(controller.UserContextKey, user)
+	return user, true
+}
+
+// validCSRF checks the double-submit CSRF token for state-changing requests.
+// Safe methods are always allowed.
+func validCSRF(c *gin.Context) bool {
+	switch controller.RequestMethod(c) {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	}
+	cookie, err := c.Cookie(controller.CSRFCookieName)
+	if err != nil || cookie == "" {
+		return false
+	}
+	header := c.GetHeader(controller.CSRFHeaderName)
+	return subtle.ConstantTimeCompare([]byte(cookie), []byte(header)) == 1
+}
+
+// hasScope reports whether scope is one of scopes
+func hasScope(scopes []string, scope string) bool {
+	for _, s := range scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// unauthorized aborts the request with a 401 response
+func unauthorized(c *gin.Context) (models.User, bool) {
+	c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+	c.Abort()
+	return models.User{}, false
+}
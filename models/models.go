@@ -1,44 +1,383 @@
 package models
 
-import "time"
+import (
+	"jwt/policy"
+	"time"
+)
+
+// DefaultOrganization is the name of the organization existing data and the unprefixed routes belong to
+const DefaultOrganization = "default"
+
+// Organization is a tenant. Users, roles, groups and their signing keys belong to exactly one
+// organization, names only have to be unique within it.
+type Organization struct {
+	ID          uint      `gorm:"primaryKey"`
+	Name        string    `gorm:"unique;not null"` // Short name used in the routes and the "org" claim, e.g. "acme"
+	DisplayName string    // Human readable name of the organization
+	CreatedAt   time.Time // Time when the organization was created
+}
 
 // User represents a system user with associated JWT tokens, RSA key, groups, and roles.
 type User struct {
-	ID           uint       `gorm:"primaryKey"`
-	Name         string     `gorm:"unique;not null"`
-	Email        string     `gorm:"unique;not null"`
-	Password     string     `gorm:"not null"`
-	JWTToken     string     // JWT Token for the user
-	RefreshToken string     // Refresh token for the user
-	RSAKey       RSAKeyPair `gorm:"foreignKey:UserID;constraint:OnDelete:CASCADE"` // One-to-one relationship with RSAKey
-	Groups       []Group    `gorm:"many2many:user_groups;"`                        // Many-to-many relationship with groups
-	Roles        []Role     `gorm:"many2many:user_roles;"`                         // Many-to-many relationship with roles
+	ID             uint         `gorm:"primaryKey"`
+	OrganizationID uint         `gorm:"uniqueIndex:idx_users_org_name;uniqueIndex:idx_users_org_email"` // Foreign key to the Organization
+	Organization   Organization `gorm:"constraint:OnDelete:CASCADE" json:"-"`
+	Name           string       `gorm:"uniqueIndex:idx_users_org_name;not null"`  // Unique name within the organization
+	Email          string       `gorm:"uniqueIndex:idx_users_org_email;not null"` // Unique email within the organization
+	Password       string       `gorm:"not null"`
+	JWTToken       string       // JWT Token for the user
+	RefreshToken   string       // Refresh token for the user
+	RSAKey         RSAKeyPair   `gorm:"foreignKey:UserID;constraint:OnDelete:CASCADE"` // One-to-one relationship with RSAKey
+	Groups         []Group      `gorm:"many2many:user_groups;"`                        // Many-to-many relationship with groups
+	Roles          []Role       `gorm:"many2many:user_roles;"`                         // Many-to-many relationship with roles
+
+	AccessTokens []PersonalAccessToken `gorm:"foreignKey:UserID;constraint:OnDelete:CASCADE" json:"-"` // Personal access tokens owned by the user
+	Sessions     []Session             `gorm:"foreignKey:UserID;constraint:OnDelete:CASCADE" json:"-"` // Login sessions of the user
+
+	LDAPDN string `gorm:"column:ldap_dn;index"`  // DN of the directory entry for users imported by the LDAP sync
+	Active bool   `gorm:"not null;default:true"` // Deactivated users, e.g. deprovisioned through SCIM, cannot sign in
+
+	Attributes map[string]string `gorm:"serializer:json" json:",omitempty"` // Free-form attributes for the policies, e.g. "department"
 }
 
 // Group represents a group that a user can belong to, which can also have a parent group.
 type Group struct {
-	ID       uint   `gorm:"primaryKey"`
-	Name     string `gorm:"unique;not null"`        // Unique name for the group
-	Members  []User `gorm:"many2many:user_groups;"` // Many-to-many relationship with users
-	Parent   *Group // Pointer to the parent group
-	ParentID *uint  // Foreign key for the parent group (nullable)
+	ID             uint         `gorm:"primaryKey"`
+	OrganizationID uint         `gorm:"uniqueIndex:idx_groups_org_name"` // Foreign key to the Organization
+	Organization   Organization `gorm:"constraint:OnDelete:CASCADE" json:"-"`
+	Name           string       `gorm:"uniqueIndex:idx_groups_org_name;not null"` // Unique name within the organization
+	Members        []User       `gorm:"many2many:user_groups;"`                   // Many-to-many relationship with users
+	Parent         *Group       // Pointer to the parent group
+	ParentID       *uint        // Foreign key for the parent group (nullable)
+	LDAPDN         string       `gorm:"column:ldap_dn;index"` // DN of the directory entry for groups imported by the LDAP sync
 }
 
 // Role represents a role that a user can have, with possible associations to groups.
 type Role struct {
-	ID     uint    `gorm:"primaryKey"`
-	Name   string  `gorm:"unique;not null"`        // Unique name for the role
-	Users  []User  `gorm:"many2many:user_roles;"`  // Many-to-many relationship with users
-	Groups []Group `gorm:"many2many:role_groups;"` // Many-to-many relationship with groups
+	ID             uint         `gorm:"primaryKey"`
+	OrganizationID uint         `gorm:"uniqueIndex:idx_roles_org_name"` // Foreign key to the Organization
+	Organization   Organization `gorm:"constraint:OnDelete:CASCADE" json:"-"`
+	Name           string       `gorm:"uniqueIndex:idx_roles_org_name;not null"` // Unique name within the organization
+	Users          []User       `gorm:"many2many:user_roles;"`                   // Many-to-many relationship with users
+	Groups         []Group      `gorm:"many2many:role_groups;"`                  // Many-to-many relationship with groups
 }
 
 // RSAKey represents the RSA public and private keys associated with a user.
 type RSAKeyPair struct {
+	ID             uint      `gorm:"primaryKey"`
+	PrivateKey     string    `json:"-"` // RSA private key in PEM format
+	PublicKey      string    // RSA public key in PEM format
+	UserID         uint      `gorm:"unique"` // Foreign key to the User
+	OrganizationID uint      `gorm:"index"`  // Organization the key signs tokens for, that of the user
+	CreatedAt      time.Time // Time when the key was created
+	ExpiresAt      time.Time // Expiration time of the key
+	IsActive       bool      // Whether the key is active or not
+}
+
+// PersonalAccessToken represents a long-lived, scoped credential owned by a user.
+type PersonalAccessToken struct {
+	ID         uint       `gorm:"primaryKey"`
+	Name       string     `gorm:"not null"`                      // Human readable name of the token
+	TokenHash  string     `gorm:"uniqueIndex;not null" json:"-"` // SHA-256 hash of the token, the token itself is never stored
+	Prefix     string     // Leading characters of the token, used to recognise it in listings
+	Scopes     []string   `gorm:"serializer:json"` // Scopes granted to the token
+	UserID     uint       `gorm:"index;not null"`  // Foreign key to the User
+	CreatedAt  time.Time  // Time when the token was created
+	ExpiresAt  time.Time  // Expiration time of the token
+	LastUsedAt *time.Time // Last time the token was used (nullable)
+	RevokedAt  *time.Time // Time when the token was revoked (nullable)
+}
+
+// Session represents a login of a user on a device. Every issued JWT carries the ID of its session.
+type Session struct {
+	ID         uint       `gorm:"primaryKey"`
+	UserID     uint       `gorm:"index;not null"` // Foreign key to the User
+	Device     string     // Device name supplied at login or derived from the user agent
+	UserAgent  string     // User agent of the login request
+	IP         string     // Client IP of the login request
+	CreatedAt  time.Time  // Time when the session was created
+	LastSeenAt time.Time  // Last time a request was authenticated with the session
+	ExpiresAt  time.Time  // Expiration time of the session's token
+	RevokedAt  *time.Time // Time when the session was revoked (nullable)
+	Roles      []string   `gorm:"serializer:json"` // Names of the roles activated at login (nullable for all roles)
+}
+
+// AuditEvent is an append-only record of a change or login. Each entry stores the hash of the
+// previous entry, so rewriting or removing an entry breaks the chain.
+type AuditEvent struct {
 	ID         uint      `gorm:"primaryKey"`
-	PrivateKey string    // RSA private key in PEM format
-	PublicKey  string    // RSA public key in PEM format
-	UserID     uint      `gorm:"unique"` // Foreign key to the User
-	CreatedAt  time.Time // Time when the key was created
-	ExpiresAt  time.Time // Expiration time of the key
-	IsActive   bool      // Whether the key is active or not
+	ActorID    *uint     `gorm:"index"` // User that performed the action (nullable for anonymous requests)
+	ActorName  string    // Name of the actor at the time of the action
+	Action     string    `gorm:"index;not null"` // Action performed, e.g. "user.update" or "login.failure"
+	TargetType string    `gorm:"index"`          // Kind of the affected entity, e.g. "user"
+	TargetID   string    `gorm:"index"`          // ID of the affected entity
+	Before     string    `gorm:"type:text"`      // JSON snapshot of the target before the change
+	After      string    `gorm:"type:text"`      // JSON snapshot of the target after the change
+	Diff       string    `gorm:"type:text"`      // JSON object of the changed fields with their old and new values
+	IP         string    // Client IP of the request
+	RequestID  string    `gorm:"index"` // ID of the request that caused the event
+	CreatedAt  time.Time `gorm:"index"` // Time of the event, part of the hash
+	PrevHash   string    // Hash of the previous entry, empty for the first entry
+	Hash       string    `gorm:"uniqueIndex"` // SHA-256 over PrevHash and the fields above
+}
+
+// WebhookSubscription represents an endpoint that receives signed identity events.
+type WebhookSubscription struct {
+	ID        uint      `gorm:"primaryKey"`
+	URL       string    `gorm:"not null"`          // Endpoint the events are POSTed to
+	Secret    string    `gorm:"not null" json:"-"` // Shared secret for the HMAC signature
+	Events    []string  `gorm:"serializer:json"`   // Event types to deliver, "*" for all
+	Active    bool      // Whether new events are delivered to the subscription
+	CreatedAt time.Time // Time when the subscription was created
+}
+
+// OutboxEvent is an identity event written in the same transaction as the change that caused it.
+type OutboxEvent struct {
+	ID          uint       `gorm:"primaryKey"`
+	EventType   string     `gorm:"index;not null"` // Event type, e.g. "user.created"
+	Payload     string     `gorm:"type:text"`      // JSON data of the event
+	CreatedAt   time.Time  // Time when the event was written
+	ProcessedAt *time.Time `gorm:"index"` // Time when deliveries were created for the event (nullable)
+}
+
+// WebhookDelivery tracks sending one outbox event to one subscription.
+type WebhookDelivery struct {
+	ID             uint                `gorm:"primaryKey"`
+	SubscriptionID uint                `gorm:"index;not null"` // Foreign key to the WebhookSubscription
+	Subscription   WebhookSubscription `gorm:"constraint:OnDelete:CASCADE" json:"-"`
+	OutboxEventID  uint                `gorm:"index;not null"` // Foreign key to the OutboxEvent
+	OutboxEvent    OutboxEvent         `gorm:"constraint:OnDelete:CASCADE" json:"-"`
+	Status         string              `gorm:"index;not null"` // "pending", "delivered" or "dead"
+	Attempts       int                 // Number of failed or successful attempts
+	NextAttemptAt  time.Time           `gorm:"index"` // Earliest time of the next attempt
+	LastError      string              // Error of the last failed attempt
+	CreatedAt      time.Time           // Time when the delivery was created
+	DeliveredAt    *time.Time          // Time of the successful attempt (nullable)
+}
+
+// IdentityProvider is an upstream OpenID Connect provider users can sign in with.
+type IdentityProvider struct {
+	ID            uint      `gorm:"primaryKey"`
+	Name          string    `gorm:"unique;not null"` // Short name used in the login URLs, e.g. "corp"
+	DisplayName   string    // Name shown on the "Sign in with" button
+	Issuer        string    `gorm:"not null"`          // Issuer URL, the discovery document is read from it
+	ClientID      string    `gorm:"not null"`          // Client ID registered at the provider
+	ClientSecret  string    `gorm:"not null" json:"-"` // Client secret registered at the provider
+	Scopes        []string  `gorm:"serializer:json"`   // Scopes requested in addition to "openid"
+	AutoProvision bool      // Create unknown users on their first login
+	DefaultRoles  []string  `gorm:"serializer:json"` // Names of the roles given to provisioned users
+	DefaultGroups []string  `gorm:"serializer:json"` // Names of the groups given to provisioned users
+	CreatedAt     time.Time // Time when the provider was added
+}
+
+// ExternalIdentity links an account at an identity provider to a user.
+type ExternalIdentity struct {
+	ID          uint             `gorm:"primaryKey"`
+	ProviderID  uint             `gorm:"uniqueIndex:idx_provider_subject;not null"` // Foreign key to the IdentityProvider
+	Provider    IdentityProvider `gorm:"constraint:OnDelete:CASCADE" json:"-"`
+	Subject     string           `gorm:"uniqueIndex:idx_provider_subject;not null"` // "sub" claim at the provider
+	UserID      uint             `gorm:"index;not null"`                            // Foreign key to the User
+	User        User             `gorm:"constraint:OnDelete:CASCADE" json:"-"`
+	Email       string           // Email the provider reported at the last login
+	CreatedAt   time.Time        // Time when the identity was linked
+	LastLoginAt time.Time        // Time of the last login with the identity
+}
+
+// OIDCLoginState is a login started at an identity provider that has not come back yet.
+type OIDCLoginState struct {
+	ID           uint      `gorm:"primaryKey"`
+	State        string    `gorm:"uniqueIndex;not null"` // "state" parameter of the authorization request
+	Nonce        string    `gorm:"not null"`             // Nonce the ID token has to carry
+	CodeVerifier string    `gorm:"not null"`             // PKCE verifier sent with the code exchange
+	ProviderID   uint      `gorm:"not null"`             // Provider the login was started at
+	Device       string    // Device name for the session
+	Cookie       bool      // Deliver the token in a session cookie
+	ExpiresAt    time.Time `gorm:"index"` // The login has to finish before this time
+}
+
+// SAMLProvider is an upstream SAML 2.0 identity provider users can sign in with.
+type SAMLProvider struct {
+	ID                uint      `gorm:"primaryKey"`
+	Name              string    `gorm:"unique;not null"` // Short name used in the login URLs, e.g. "acme"
+	DisplayName       string    // Name shown on the "Sign in with" button
+	EntityID          string    `gorm:"not null"`           // Entity ID of the identity provider
+	SSOURL            string    `gorm:"not null"`           // Single sign-on URL (HTTP-Redirect binding)
+	Certificate       string    `gorm:"type:text;not null"` // PEM certificates the identity provider signs with
+	EmailAttribute    string    // Attribute holding the email, the NameID is used when empty
+	UsernameAttribute string    // Attribute holding the username, derived from the email when empty
+	RolesAttribute    string    // Attribute whose values are mapped to roles of the same name on every login
+	GroupsAttribute   string    // Attribute whose values are mapped to groups of the same name on every login
+	AutoProvision     bool      // Create unknown users on their first login
+	DefaultRoles      []string  `gorm:"serializer:json"` // Names of the roles given to provisioned users
+	DefaultGroups     []string  `gorm:"serializer:json"` // Names of the groups given to provisioned users
+	CreatedAt         time.Time // Time when the provider was added
+}
+
+// SAMLIdentity links a NameID at a SAML identity provider to a user.
+type SAMLIdentity struct {
+	ID          uint         `gorm:"primaryKey"`
+	ProviderID  uint         `gorm:"uniqueIndex:idx_saml_provider_name_id;not null"` // Foreign key to the SAMLProvider
+	Provider    SAMLProvider `gorm:"constraint:OnDelete:CASCADE" json:"-"`
+	NameID      string       `gorm:"uniqueIndex:idx_saml_provider_name_id;not null"` // NameID of the subject at the provider
+	UserID      uint         `gorm:"index;not null"`                                 // Foreign key to the User
+	User        User         `gorm:"constraint:OnDelete:CASCADE" json:"-"`
+	CreatedAt   time.Time    // Time when the identity was linked
+	LastLoginAt time.Time    // Time of the last login with the identity
+}
+
+// SAMLRequest is an AuthnRequest sent to an identity provider that has not been answered yet.
+type SAMLRequest struct {
+	ID         uint      `gorm:"primaryKey"`
+	RequestID  string    `gorm:"uniqueIndex;not null"` // ID of the AuthnRequest, the response's InResponseTo
+	ProviderID uint      `gorm:"not null"`             // Provider the request was sent to
+	Device     string    // Device name for the session
+	Cookie     bool      // Deliver the token in a session cookie
+	ExpiresAt  time.Time `gorm:"index"` // The login has to finish before this time
+}
+
+// GroupManager delegates the administration of a group and its subgroups to a user without the admin role.
+// Managers add and remove members, owners also appoint managers and owners.
+type GroupManager struct {
+	ID        uint      `gorm:"primaryKey"`
+	GroupID   uint      `gorm:"uniqueIndex:idx_group_manager;not null"` // Foreign key to the Group
+	Group     Group     `gorm:"constraint:OnDelete:CASCADE" json:"-"`
+	UserID    uint      `gorm:"uniqueIndex:idx_group_manager;not null"` // Foreign key to the User
+	User      User      `gorm:"constraint:OnDelete:CASCADE" json:"-"`
+	Role      string    `gorm:"not null"` // "owner" or "manager"
+	CreatedAt time.Time // Time when the user was appointed
+}
+
+// UserRole assigns a role to a user. Grants with an expiry are removed by the expiry job once they ended.
+type UserRole struct {
+	UserID      uint       `gorm:"primaryKey"` // Foreign key to the User
+	RoleID      uint       `gorm:"primaryKey"` // Foreign key to the Role
+	GrantedByID *uint      // User that granted the role (nullable for grants by sign-up, SCIM, LDAP or federation)
+	GrantedAt   time.Time  `gorm:"autoCreateTime"` // Time when the role was granted
+	ExpiresAt   *time.Time `gorm:"index"`          // End of a time-bound grant (nullable for permanent grants)
+	Reason      string     // Why the role was granted, e.g. the incident
+}
+
+// ElevationRequest is a user's request for a role for a limited time, e.g. admin during an incident.
+// An admin other than the requester approves or denies it.
+type ElevationRequest struct {
+	ID             uint       `gorm:"primaryKey"`
+	OrganizationID uint       `gorm:"index;not null"` // Organization of the user and the role
+	UserID         uint       `gorm:"index;not null"` // Foreign key to the requesting User
+	User           User       `gorm:"constraint:OnDelete:CASCADE" json:"-"`
+	RoleID         uint       `gorm:"not null"` // Foreign key to the requested Role
+	Role           Role       `gorm:"constraint:OnDelete:CASCADE" json:"-"`
+	Duration       int64      // Requested length of the grant in seconds
+	Reason         string     // Why the role is needed
+	Status         string     `gorm:"index;not null"` // "pending", "approved" or "denied"
+	DecidedByID    *uint      // Admin that approved or denied the request (nullable while pending)
+	DecisionNote   string     // Comment of the admin
+	CreatedAt      time.Time  // Time when the request was made
+	DecidedAt      *time.Time // Time when the request was approved or denied (nullable while pending)
+	ExpiresAt      *time.Time // End of the grant of an approved request (nullable)
+}
+
+// AccessRequest is a user's request to get a role or join a group. Approvers are the users with
+// the approver role and, for groups, the group's owners and managers.
+type AccessRequest struct {
+	ID             uint       `gorm:"primaryKey"`
+	OrganizationID uint       `gorm:"index;not null"` // Organization of the requester and the target
+	RequesterID    uint       `gorm:"index;not null"` // Foreign key to the requesting User
+	Requester      User       `gorm:"constraint:OnDelete:CASCADE" json:"-"`
+	RoleID         *uint      // Requested Role (nullable, set for role requests)
+	Role           *Role      `gorm:"constraint:OnDelete:CASCADE" json:"-"`
+	GroupID        *uint      // Requested Group (nullable, set for group requests)
+	Group          *Group     `gorm:"constraint:OnDelete:CASCADE" json:"-"`
+	Justification  string     // Why the requester needs the access
+	Status         string     `gorm:"index;not null"` // "pending", "approved", "denied" or "cancelled"
+	DecidedByID    *uint      // Approver that approved or denied the request (nullable)
+	DecisionNote   string     // Comment of the approver
+	CreatedAt      time.Time  // Time when the request was made
+	DecidedAt      *time.Time // Time when the request was decided or cancelled (nullable)
+}
+
+// AccessReview is a certification campaign. When it opens, the role and group memberships of the
+// organization are copied into items, and closing it removes the memberships reviewers decided to revoke.
+type AccessReview struct {
+	ID             uint               `gorm:"primaryKey"`
+	OrganizationID uint               `gorm:"index;not null"` // Organization whose memberships are reviewed
+	Name           string             `gorm:"not null"`       // e.g. "2024 Q3"
+	Status         string             `gorm:"index;not null"` // "open" or "closed"
+	DueAt          *time.Time         // Date the reviewers should be done by (nullable)
+	CreatedByID    *uint              // Admin that started the campaign
+	CreatedAt      time.Time          // Time when the memberships were copied
+	ClosedByID     *uint              // Admin that closed the campaign (nullable while open)
+	ClosedAt       *time.Time         // Time when the revocations were applied (nullable while open)
+	Items          []AccessReviewItem `gorm:"foreignKey:ReviewID;constraint:OnDelete:CASCADE" json:"-"` // Memberships under review
+}
+
+// AccessReviewItem is one membership under review. Names are copied, so the report stays
+// readable after users, roles or groups are deleted.
+type AccessReviewItem struct {
+	ID          uint       `gorm:"primaryKey"`
+	ReviewID    uint       `gorm:"index;not null"` // Foreign key to the AccessReview
+	UserID      uint       `gorm:"index;not null"` // User holding the membership
+	Username    string     // Name of the user when the campaign started
+	Kind        string     `gorm:"not null"` // "role" or "group"
+	TargetID    uint       `gorm:"not null"` // ID of the role or group
+	TargetName  string     // Name of the role or group when the campaign started
+	ReviewerID  *uint      `gorm:"index"` // User asked to review the item (nullable, then only admins decide)
+	Decision    string     `gorm:"index"` // "keep" or "revoke", empty while undecided
+	Comment     string     // Comment of the reviewer
+	DecidedByID *uint      // User that decided (nullable)
+	DecidedAt   *time.Time // Time of the decision (nullable)
+	AppliedAt   *time.Time // Time when the revocation was applied (nullable)
+}
+
+// RoleConstraint declares roles a user must not combine (separation of duties). A static constraint
+// limits how many of the roles a user holds, directly or through groups; a dynamic one how many are
+// active in one session.
+type RoleConstraint struct {
+	ID             uint      `gorm:"primaryKey"`
+	OrganizationID uint      `gorm:"uniqueIndex:idx_role_constraints_org_name;not null"` // Organization of the roles
+	Name           string    `gorm:"uniqueIndex:idx_role_constraints_org_name;not null"` // e.g. "payments"
+	Kind           string    `gorm:"not null"`                                           // "static" or "dynamic"
+	RoleIDs        []uint    `gorm:"serializer:json"`                                    // Roles that are mutually exclusive
+	MaxRoles       int       `gorm:"not null"`                                           // How many of the roles may be combined, usually 1
+	Description    string    // Why the roles conflict
+	CreatedAt      time.Time // Time when the constraint was declared
+}
+
+// Policy is an attribute-based access control rule of an organization. It allows or denies actions
+// on resource types when its condition over the attributes of subject, resource and context holds.
+type Policy struct {
+	ID             uint              `gorm:"primaryKey"`
+	OrganizationID uint              `gorm:"uniqueIndex:idx_policies_org_name;not null"` // Organization the policy applies to
+	Name           string            `gorm:"uniqueIndex:idx_policies_org_name;not null"` // e.g. "managers-read-department"
+	Description    string            // What the policy is for
+	Effect         string            `gorm:"not null"`        // "allow" or "deny"
+	Actions        []string          `gorm:"serializer:json"` // e.g. ["read"], "*" for all
+	Resources      []string          `gorm:"serializer:json"` // Resource types, e.g. ["user"], "*" for all
+	Condition      *policy.Condition `gorm:"serializer:json"` // Optional condition, see the policy package
+	Disabled       bool              // Disabled policies are kept but not evaluated
+	CreatedAt      time.Time
+	UpdatedAt      time.Time
+}
+
+// RegistryRule grants actions on resources of the container registry to the holders of a role, the
+// members of a group, or every signed-in user when neither is set
+type RegistryRule struct {
+	ID             uint      `gorm:"primaryKey"`
+	OrganizationID uint      `gorm:"index;not null"` // Organization the rule belongs to
+	Type           string    `gorm:"not null"`       // "repository", or "registry" for the catalog
+	Name           string    `gorm:"not null"`       // Pattern, "*" matches any text and "${username}" the user's name, e.g. "team-a/*"
+	RoleID         *uint     // Role whose holders get the actions
+	Role           *Role     `gorm:"constraint:OnDelete:CASCADE" json:"-"`
+	GroupID        *uint     // Group whose direct members get the actions
+	Group          *Group    `gorm:"constraint:OnDelete:CASCADE" json:"-"`
+	Actions        []string  `gorm:"serializer:json"` // e.g. ["pull", "push"], "*" for all
+	CreatedAt      time.Time // Time when the rule was added
+}
+
+// SSHCertificateAuthority is the ed25519 key an organization signs the SSH keys of its users with
+type SSHCertificateAuthority struct {
+	ID             uint      `gorm:"primaryKey"`
+	OrganizationID uint      `gorm:"uniqueIndex;not null"` // Organization the CA belongs to
+	PrivateKey     string    `json:"-"`                    // ed25519 private key in PKCS #8 PEM format
+	PublicKey      string    // Public key in the authorized_keys format, for TrustedUserCAKeys
+	CreatedAt      time.Time // Time when the key was generated
 }
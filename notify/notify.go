@@ -0,0 +1,105 @@
+package notify
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/smtp"
+	"os"
+	"strings"
+)
+
+// Message is a notification for a set of recipients, e.g. approvers of an access request
+type Message struct {
+	Event   string                 // Event that caused the message, e.g. "access_request.created"
+	To      []string               // Email addresses of the recipients
+	Subject string                 // Short summary
+	Body    string                 // Plain text body
+	Data    map[string]interface{} // Structured details for notifiers that do not send text
+}
+
+// Notifier delivers messages. Implementations decide on the channel: log, mail, chat and so on.
+type Notifier interface {
+	Notify(ctx context.Context, message Message) error
+}
+
+// NotifierFunc adapts a function to the Notifier interface
+type NotifierFunc func(ctx context.Context, message Message) error
+
+// Notify calls the function
+func (f NotifierFunc) Notify(ctx context.Context, message Message) error {
+	return f(ctx, message)
+}
+
+// LogNotifier writes messages to the log, the default when nothing else is configured
+type LogNotifier struct{}
+
+// Notify logs the message
+func (LogNotifier) Notify(ctx context.Context, message Message) error {
+	log.Printf("Notification %s to %s: %s", message.Event, strings.Join(message.To, ", "), message.Subject)
+	return nil
+}
+
+// SMTPNotifier sends messages as plain text mails
+type SMTPNotifier struct {
+	Addr     string // host:port of the mail server
+	From     string // Sender address
+	Username string // PLAIN auth user, no authentication when empty
+	Password string // PLAIN auth password
+}
+
+// Notify sends one mail to all recipients
+func (n SMTPNotifier) Notify(ctx context.Context, message Message) error {
+	if len(message.To) == 0 {
+		return nil
+	}
+	for _, address := range append([]string{n.From}, message.To...) {
+		if strings.ContainsAny(address, "\r\n") {
+			return errors.New("notify: invalid address " + address)
+		}
+	}
+
+	var auth smtp.Auth
+	if n.Username != "" {
+		host, _, err := net.SplitHostPort(n.Addr)
+		if err != nil {
+			return err
+		}
+		auth = smtp.PlainAuth("", n.Username, n.Password, host)
+	}
+
+	subject := strings.NewReplacer("\r", " ", "\n", " ").Replace(message.Subject)
+	mail := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n%s\r\n",
+		n.From, strings.Join(message.To, ", "), subject, strings.ReplaceAll(message.Body, "\n", "\r\n"))
+	return smtp.SendMail(n.Addr, auth, n.From, message.To, []byte(mail))
+}
+
+// Multi sends every message with each of the notifiers and joins their errors
+type Multi []Notifier
+
+// Notify calls all notifiers
+func (m Multi) Notify(ctx context.Context, message Message) error {
+	var errs []error
+	for _, notifier := range m {
+		if err := notifier.Notify(ctx, message); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// FromEnv builds the notifier configured by NOTIFIER: "smtp" mails with SMTP_ADDR, SMTP_FROM,
+// SMTP_USERNAME and SMTP_PASSWORD and also logs, anything else only logs
+func FromEnv() Notifier {
+	if os.Getenv("NOTIFIER") == "smtp" {
+		return Multi{LogNotifier{}, SMTPNotifier{
+			Addr:     os.Getenv("SMTP_ADDR"),
+			From:     os.Getenv("SMTP_FROM"),
+			Username: os.Getenv("SMTP_USERNAME"),
+			Password: os.Getenv("SMTP_PASSWORD"),
+		}}
+	}
+	return LogNotifier{}
+}
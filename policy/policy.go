@@ -0,0 +1,388 @@
+package policy
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Effects of a policy. A matching deny always wins over a matching allow.
+const (
+	Allow = "allow"
+	Deny  = "deny"
+)
+
+// Operators of a condition. The attribute is on the left, the value or referenced attribute on the right.
+var operators = map[string]bool{
+	"eq":       true, // equal, numbers by value and everything else by its text
+	"ne":       true, // not equal
+	"gt":       true, // greater than, for numbers and text
+	"gte":      true,
+	"lt":       true,
+	"lte":      true,
+	"in":       true, // the attribute is one of the values of a list
+	"contains": true, // the attribute is a list holding the value, or a text holding it
+	"prefix":   true, // the attribute is a text starting with the value
+	"exists":   true, // the attribute is set, or with value false not set
+}
+
+// Attributes describe the subject, the resource or the context of a request. Nested maps are
+// addressed with dots, e.g. "subject.manager.department".
+type Attributes map[string]interface{}
+
+// Condition is a declarative rule over attributes. Exactly one of All, Any, Not or a comparison of
+// Attr with Value or Ref is set, e.g.
+//
+//	{"all": [
+//		{"attr": "subject.roles", "op": "contains", "value": "manager"},
+//		{"attr": "subject.department", "op": "eq", "ref": "resource.department"},
+//		{"attr": "context.hour", "op": "gte", "value": 9},
+//		{"attr": "context.hour", "op": "lt", "value": 17}
+//	]}
+type Condition struct {
+	All   []Condition `json:"all,omitempty"`   // Every condition holds
+	Any   []Condition `json:"any,omitempty"`   // At least one condition holds
+	Not   *Condition  `json:"not,omitempty"`   // The condition does not hold
+	Attr  string      `json:"attr,omitempty"`  // Attribute path, starting with subject., resource. or context.
+	Op    string      `json:"op,omitempty"`    // One of the operators, e.g. "eq"
+	Value interface{} `json:"value,omitempty"` // Literal to compare with
+	Ref   string      `json:"ref,omitempty"`   // Attribute path to compare with instead of a literal
+}
+
+// Rule is a policy as the engine evaluates it
+type Rule struct {
+	ID             uint
+	OrganizationID uint
+	Name           string
+	Effect         string     // Allow or Deny
+	Actions        []string   // Actions the rule applies to, "*" for all, "users:*" for a prefix
+	Resources      []string   // Resource types the rule applies to, same patterns as the actions
+	Condition      *Condition // Further restriction, nil always holds
+}
+
+// Request is a question to the engine: may the subject perform the action on the resource
+type Request struct {
+	Action       string
+	ResourceType string
+	Subject      Attributes
+	Resource     Attributes
+	Context      Attributes
+}
+
+// Decision is the answer of the engine
+type Decision struct {
+	Allowed bool   `json:"allowed"`
+	Policy  string `json:"policy,omitempty"` // Name of the deciding rule, empty without a matching rule
+	Reason  string `json:"reason"`
+}
+
+// Validate checks that the condition is well formed
+func (condition Condition) Validate() error {
+	set := 0
+	if condition.All != nil {
+		set++
+	}
+	if condition.Any != nil {
+		set++
+	}
+	if condition.Not != nil {
+		set++
+	}
+	if condition.Attr != "" || condition.Op != "" {
+		set++
+	}
+	if set != 1 {
+		return errors.New("a condition needs exactly one of all, any, not or attr with op")
+	}
+
+	for _, list := range [][]Condition{condition.All, condition.Any} {
+		for _, child := range list {
+			if err := child.Validate(); err != nil {
+				return err
+			}
+		}
+	}
+	if condition.Not != nil {
+		return condition.Not.Validate()
+	}
+	if condition.Attr == "" {
+		return nil
+	}
+
+	if !operators[condition.Op] {
+		return fmt.Errorf("unknown operator %q", condition.Op)
+	}
+	if err := validPath(condition.Attr); err != nil {
+		return err
+	}
+	if condition.Ref != "" {
+		if condition.Value != nil {
+			return fmt.Errorf("condition on %s has both value and ref", condition.Attr)
+		}
+		return validPath(condition.Ref)
+	}
+	if condition.Value == nil && condition.Op != "exists" {
+		return fmt.Errorf("condition on %s needs a value or ref", condition.Attr)
+	}
+	if _, isList := condition.Value.([]interface{}); condition.Op == "in" && !isList {
+		return fmt.Errorf("condition on %s needs a list for in", condition.Attr)
+	}
+	return nil
+}
+
+// validPath checks that an attribute path names one of the attribute sets
+func validPath(path string) error {
+	root, rest, _ := strings.Cut(path, ".")
+	if rest == "" || (root != "subject" && root != "resource" && root != "context") {
+		return fmt.Errorf("invalid attribute %q, start with subject., resource. or context.", path)
+	}
+	return nil
+}
+
+// Holds evaluates the condition for the request
+func (condition Condition) Holds(request Request) bool {
+	switch {
+	case condition.All != nil:
+		for _, child := range condition.All {
+			if !child.Holds(request) {
+				return false
+			}
+		}
+		return true
+	case condition.Any != nil:
+		for _, child := range condition.Any {
+			if child.Holds(request) {
+				return true
+			}
+		}
+		return false
+	case condition.Not != nil:
+		return !condition.Not.Holds(request)
+	}
+
+	left, found := request.lookup(condition.Attr)
+	if condition.Op == "exists" {
+		want, isBool := condition.Value.(bool)
+		return found == (want || !isBool)
+	}
+	if !found {
+		return false
+	}
+	right := condition.Value
+	if condition.Ref != "" {
+		if right, found = request.lookup(condition.Ref); !found {
+			return false
+		}
+	}
+
+	switch condition.Op {
+	case "eq":
+		return equal(left, right)
+	case "ne":
+		return !equal(left, right)
+	case "gt":
+		order, ok := compare(left, right)
+		return ok && order > 0
+	case "gte":
+		order, ok := compare(left, right)
+		return ok && order >= 0
+	case "lt":
+		order, ok := compare(left, right)
+		return ok && order < 0
+	case "lte":
+		order, ok := compare(left, right)
+		return ok && order <= 0
+	case "in":
+		return listContains(right, left)
+	case "contains":
+		if text, isText := left.(string); isText {
+			return strings.Contains(text, fmt.Sprint(right))
+		}
+		return listContains(left, right)
+	case "prefix":
+		text, isText := left.(string)
+		return isText && strings.HasPrefix(text, fmt.Sprint(right))
+	}
+	return false
+}
+
+// lookup resolves an attribute path like "subject.department"
+func (request Request) lookup(path string) (interface{}, bool) {
+	root, rest, _ := strings.Cut(path, ".")
+	var current interface{}
+	switch root {
+	case "subject":
+		current = map[string]interface{}(request.Subject)
+	case "resource":
+		current = map[string]interface{}(request.Resource)
+	case "context":
+		current = map[string]interface{}(request.Context)
+	default:
+		return nil, false
+	}
+
+	for _, key := range strings.Split(rest, ".") {
+		var value interface{}
+		found := false
+		switch attributes := current.(type) {
+		case map[string]interface{}:
+			value, found = attributes[key]
+		case Attributes:
+			value, found = attributes[key]
+		case map[string]string:
+			value, found = attributes[key]
+		}
+		if !found {
+			return nil, false
+		}
+		current = value
+	}
+	return current, current != nil
+}
+
+// equal compares numbers by value and other values by their text
+func equal(left, right interface{}) bool {
+	if a, ok := number(left); ok {
+		if b, ok := number(right); ok {
+			return a == b
+		}
+	}
+	return fmt.Sprint(left) == fmt.Sprint(right)
+}
+
+// compare orders numbers by value and texts alphabetically, other values are not ordered
+func compare(left, right interface{}) (int, bool) {
+	if a, ok := number(left); ok {
+		b, ok := number(right)
+		switch {
+		case !ok:
+			return 0, false
+		case a < b:
+			return -1, true
+		case a > b:
+			return 1, true
+		}
+		return 0, true
+	}
+	a, leftText := left.(string)
+	b, rightText := right.(string)
+	if !leftText || !rightText {
+		return 0, false
+	}
+	return strings.Compare(a, b), true
+}
+
+// number converts the numeric kinds, and texts holding a number, to float64
+func number(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case string:
+		parsed, err := strconv.ParseFloat(v, 64)
+		return parsed, err == nil
+	}
+	reflected := reflect.ValueOf(value)
+	switch reflected.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(reflected.Int()), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(reflected.Uint()), true
+	case reflect.Float32, reflect.Float64:
+		return reflected.Float(), true
+	}
+	return 0, false
+}
+
+// listContains reports whether the list holds an element equal to the value
+func listContains(list, value interface{}) bool {
+	reflected := reflect.ValueOf(list)
+	if reflected.Kind() != reflect.Slice && reflected.Kind() != reflect.Array {
+		return false
+	}
+	for i := 0; i < reflected.Len(); i++ {
+		if equal(reflected.Index(i).Interface(), value) {
+			return true
+		}
+	}
+	return false
+}
+
+// matches reports whether the name fits one of the patterns: "*", a name, or a prefix ending in "*"
+func matches(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if pattern == "*" || pattern == name {
+			return true
+		}
+		if prefix, isPrefix := strings.CutSuffix(pattern, "*"); isPrefix && strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Engine holds the rules of all organizations and evaluates requests against them. It is safe for
+// concurrent use, Load swaps the rules without blocking evaluations for long.
+type Engine struct {
+	mu     sync.RWMutex
+	rules  map[uint][]Rule
+	loaded bool
+}
+
+// NewEngine returns an engine without rules, denying everything
+func NewEngine() *Engine {
+	return &Engine{rules: map[uint][]Rule{}}
+}
+
+// Load replaces all rules
+func (engine *Engine) Load(rules []Rule) {
+	byOrganization := map[uint][]Rule{}
+	for _, rule := range rules {
+		byOrganization[rule.OrganizationID] = append(byOrganization[rule.OrganizationID], rule)
+	}
+	for _, list := range byOrganization {
+		sort.SliceStable(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	}
+
+	engine.mu.Lock()
+	defer engine.mu.Unlock()
+	engine.rules = byOrganization
+	engine.loaded = true
+}
+
+// Loaded reports whether rules were loaded at least once
+func (engine *Engine) Loaded() bool {
+	engine.mu.RLock()
+	defer engine.mu.RUnlock()
+	return engine.loaded
+}
+
+// Evaluate decides the request with the rules of the organization. A matching deny rule wins,
+// otherwise a matching allow rule allows, and without any the request is denied.
+func (engine *Engine) Evaluate(organizationID uint, request Request) Decision {
+	engine.mu.RLock()
+	rules := engine.rules[organizationID]
+	engine.mu.RUnlock()
+
+	var allowedBy *Rule
+	for i, rule := range rules {
+		if !matches(rule.Actions, request.Action) || !matches(rule.Resources, request.ResourceType) {
+			continue
+		}
+		if rule.Condition != nil && !rule.Condition.Holds(request) {
+			continue
+		}
+		if rule.Effect == Deny {
+			return Decision{Allowed: false, Policy: rule.Name, Reason: "denied by policy " + rule.Name}
+		}
+		if allowedBy == nil {
+			allowedBy = &rules[i]
+		}
+	}
+
+	if allowedBy != nil {
+		return Decision{Allowed: true, Policy: allowedBy.Name, Reason: "allowed by policy " + allowedBy.Name}
+	}
+	return Decision{Allowed: false, Reason: "no policy allows " + request.Action + " on " + request.ResourceType}
+}
@@ -0,0 +1,171 @@
+package policy_test
+
+import (
+	"jwt/policy"
+	"testing"
+)
+
+// request is a manager of sales reading a user of sales during office hours
+func request() policy.Request {
+	return policy.Request{
+		Action:       "read",
+		ResourceType: "user",
+		Subject: policy.Attributes{
+			"id":         1,
+			"roles":      []string{"manager", "user"},
+			"department": "sales",
+			"level":      "5",
+			"manager":    map[string]interface{}{"department": "sales"},
+		},
+		Resource: policy.Attributes{"type": "user", "id": "12", "department": "sales"},
+		Context:  policy.Attributes{"hour": 10, "ip": "10.0.0.7", "weekday": "monday"},
+	}
+}
+
+func TestConditionHolds(t *testing.T) {
+	tests := []struct {
+		name      string
+		condition policy.Condition
+		want      bool
+	}{
+		{"eq", policy.Condition{Attr: "subject.department", Op: "eq", Value: "sales"}, true},
+		{"eq number and text", policy.Condition{Attr: "subject.level", Op: "eq", Value: 5}, true},
+		{"ne", policy.Condition{Attr: "subject.department", Op: "ne", Value: "sales"}, false},
+		{"gte", policy.Condition{Attr: "context.hour", Op: "gte", Value: 9}, true},
+		{"lt", policy.Condition{Attr: "context.hour", Op: "lt", Value: 10}, false},
+		{"gt between a number and a text", policy.Condition{Attr: "context.hour", Op: "gt", Value: "morning"}, false},
+		{"in", policy.Condition{Attr: "context.weekday", Op: "in", Value: []interface{}{"saturday", "monday"}}, true},
+		{"not in", policy.Condition{Attr: "context.weekday", Op: "in", Value: []interface{}{"saturday", "sunday"}}, false},
+		{"in with numbers", policy.Condition{Attr: "subject.id", Op: "in", Value: []interface{}{1.0, 2.0}}, true},
+		{"contains in a list", policy.Condition{Attr: "subject.roles", Op: "contains", Value: "manager"}, true},
+		{"contains missing from a list", policy.Condition{Attr: "subject.roles", Op: "contains", Value: "admin"}, false},
+		{"contains in a text", policy.Condition{Attr: "context.ip", Op: "contains", Value: "0.0"}, true},
+		{"prefix", policy.Condition{Attr: "context.ip", Op: "prefix", Value: "10."}, true},
+		{"nested attribute", policy.Condition{Attr: "subject.manager.department", Op: "eq", Value: "sales"}, true},
+
+		{"exists", policy.Condition{Attr: "subject.department", Op: "exists"}, true},
+		{"exists missing", policy.Condition{Attr: "subject.clearance", Op: "exists"}, false},
+		{"exists false", policy.Condition{Attr: "subject.clearance", Op: "exists", Value: false}, true},
+		{"exists false when set", policy.Condition{Attr: "subject.department", Op: "exists", Value: false}, false},
+
+		// A missing attribute never satisfies a comparison, not even a negative one
+		{"missing attribute eq", policy.Condition{Attr: "subject.clearance", Op: "eq", Value: "secret"}, false},
+		{"missing attribute ne", policy.Condition{Attr: "subject.clearance", Op: "ne", Value: "secret"}, false},
+		{"missing attribute in", policy.Condition{Attr: "subject.clearance", Op: "in", Value: []interface{}{"secret"}}, false},
+		{"missing nested attribute", policy.Condition{Attr: "subject.department.name", Op: "eq", Value: "sales"}, false},
+
+		{"ref", policy.Condition{Attr: "subject.department", Op: "eq", Ref: "resource.department"}, true},
+		{"ref differs", policy.Condition{Attr: "subject.department", Op: "eq", Ref: "resource.id"}, false},
+		{"ref missing", policy.Condition{Attr: "subject.department", Op: "ne", Ref: "resource.owner"}, false},
+
+		{"all", policy.Condition{All: []policy.Condition{
+			{Attr: "subject.roles", Op: "contains", Value: "manager"},
+			{Attr: "context.hour", Op: "lt", Value: 17},
+		}}, true},
+		{"all with one failing", policy.Condition{All: []policy.Condition{
+			{Attr: "subject.roles", Op: "contains", Value: "manager"},
+			{Attr: "context.hour", Op: "lt", Value: 9},
+		}}, false},
+		{"any", policy.Condition{Any: []policy.Condition{
+			{Attr: "subject.roles", Op: "contains", Value: "admin"},
+			{Attr: "subject.roles", Op: "contains", Value: "manager"},
+		}}, true},
+		{"not", policy.Condition{Not: &policy.Condition{Attr: "subject.roles", Op: "contains", Value: "manager"}}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := test.condition.Validate(); err != nil {
+				t.Fatalf("Validate() = %v", err)
+			}
+			if got := test.condition.Holds(request()); got != test.want {
+				t.Errorf("Holds() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestConditionValidate(t *testing.T) {
+	tests := []struct {
+		name      string
+		condition policy.Condition
+	}{
+		{"empty", policy.Condition{}},
+		{"two kinds", policy.Condition{Attr: "subject.id", Op: "eq", Value: 1, Not: &policy.Condition{}}},
+		{"unknown operator", policy.Condition{Attr: "subject.id", Op: "like", Value: 1}},
+		{"unknown root", policy.Condition{Attr: "user.id", Op: "eq", Value: 1}},
+		{"root only", policy.Condition{Attr: "subject", Op: "eq", Value: 1}},
+		{"value and ref", policy.Condition{Attr: "subject.id", Op: "eq", Value: 1, Ref: "resource.id"}},
+		{"invalid ref", policy.Condition{Attr: "subject.id", Op: "eq", Ref: "id"}},
+		{"no value", policy.Condition{Attr: "subject.id", Op: "eq"}},
+		{"in without a list", policy.Condition{Attr: "subject.id", Op: "in", Value: 1}},
+		{"invalid child", policy.Condition{All: []policy.Condition{{Attr: "subject.id", Op: "like", Value: 1}}}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := test.condition.Validate(); err == nil {
+				t.Error("Validate() succeeded, want an error")
+			}
+		})
+	}
+}
+
+func TestEngineEvaluate(t *testing.T) {
+	sameDepartment := &policy.Condition{Attr: "subject.department", Op: "eq", Ref: "resource.department"}
+	afterHours := &policy.Condition{Attr: "context.hour", Op: "gte", Value: 17}
+	allowRead := policy.Rule{Name: "managers-read", Effect: policy.Allow, Actions: []string{"read"}, Resources: []string{"user"}, Condition: sameDepartment}
+	denyAll := policy.Rule{Name: "a-deny-all", Effect: policy.Deny, Actions: []string{"*"}, Resources: []string{"*"}}
+
+	tests := []struct {
+		name       string
+		rules      []policy.Rule
+		request    func(*policy.Request)
+		wantAllow  bool
+		wantPolicy string
+	}{
+		{"no rules", nil, nil, false, ""},
+		{"allow", []policy.Rule{allowRead}, nil, true, "managers-read"},
+		{"deny wins over allow", []policy.Rule{allowRead, denyAll}, nil, false, "a-deny-all"},
+		{"deny wins in any order", []policy.Rule{
+			{Name: "z-deny", Effect: policy.Deny, Actions: []string{"read"}, Resources: []string{"user"}},
+			allowRead,
+		}, nil, false, "z-deny"},
+		{"deny whose condition fails", []policy.Rule{allowRead,
+			{Name: "deny-after-hours", Effect: policy.Deny, Actions: []string{"*"}, Resources: []string{"*"}, Condition: afterHours},
+		}, nil, true, "managers-read"},
+		{"condition fails", []policy.Rule{allowRead}, func(request *policy.Request) {
+			request.Resource["department"] = "finance"
+		}, false, ""},
+		{"condition on a missing attribute", []policy.Rule{allowRead}, func(request *policy.Request) {
+			delete(request.Subject, "department")
+		}, false, ""},
+		{"other action", []policy.Rule{allowRead}, func(request *policy.Request) {
+			request.Action = "delete"
+		}, false, ""},
+		{"other resource type", []policy.Rule{allowRead}, func(request *policy.Request) {
+			request.ResourceType = "group"
+		}, false, ""},
+		{"action prefix", []policy.Rule{
+			{Name: "users-any", Effect: policy.Allow, Actions: []string{"users:*"}, Resources: []string{"*"}},
+		}, func(request *policy.Request) {
+			request.Action = "users:read"
+		}, true, "users-any"},
+		{"rules of another organization", []policy.Rule{
+			{OrganizationID: 2, Name: "other", Effect: policy.Allow, Actions: []string{"*"}, Resources: []string{"*"}},
+		}, nil, false, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			engine := policy.NewEngine()
+			engine.Load(test.rules)
+			request := request()
+			if test.request != nil {
+				test.request(&request)
+			}
+
+			decision := engine.Evaluate(0, request)
+			if decision.Allowed != test.wantAllow || decision.Policy != test.wantPolicy {
+				t.Errorf("Evaluate() = %+v, want allowed %v by %q", decision, test.wantAllow, test.wantPolicy)
+			}
+		})
+	}
+}
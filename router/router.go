@@ -0,0 +1,265 @@
+// Package router registers the routes of the server on a Gin engine
+package router
+
+import (
+	"jwt/controller"
+	"jwt/middleware"
+
+	"github.com/gin-gonic/gin"
+)
+
+// New returns the engine with every route of the server
+func New() *gin.Engine {
+	r := gin.Default()
+	r.Use(middleware.RequestID())
+	r.Use(middleware.Tenant())
+
+	// The unprefixed routes act on the default organization, /orgs/:org on any other
+	tenantRoutes(r.Group("/"))
+	tenantRoutes(r.Group("/orgs/:org"))
+
+	// Organizations are managed by the admins of the default organization
+	organizationGroup := r.Group("/organizations")
+	organizationGroup.Use(middleware.AdminRequired())
+	{
+		organizationGroup.POST("/", controller.CreateOrganization)
+		organizationGroup.GET("/", controller.ListOrganizations)
+		organizationGroup.DELETE("/:id", controller.DeleteOrganization)
+	}
+
+	r.GET("/audit", middleware.AdminRequired(), controller.ListAuditEvents)
+
+	webhookGroup := r.Group("/webhooks")
+	webhookGroup.Use(middleware.AdminRequired())
+	{
+		webhookGroup.POST("/", controller.CreateWebhook)
+		webhookGroup.GET("/", controller.ListWebhooks)
+		webhookGroup.DELETE("/:id", controller.DeleteWebhook)
+		webhookGroup.GET("/dead-letters", controller.ListDeadLetters)
+		webhookGroup.POST("/dead-letters/:id/retry", controller.RetryDeadLetter)
+	}
+
+	identityProviderGroup := r.Group("/identity-providers")
+	identityProviderGroup.Use(middleware.AdminRequired())
+	{
+		identityProviderGroup.POST("/", controller.CreateIdentityProvider)
+		identityProviderGroup.GET("/", controller.ListIdentityProviders)
+		identityProviderGroup.DELETE("/:id", controller.DeleteIdentityProvider)
+	}
+
+	// Federated login with the upstream OIDC providers
+	oidcGroup := r.Group("/auth/oidc")
+	{
+		oidcGroup.GET("/", controller.ListLoginProviders)
+		oidcGroup.GET("/:provider/login", controller.StartOIDCLogin)
+		oidcGroup.GET("/:provider/callback", controller.OIDCCallback)
+	}
+
+	samlProviderGroup := r.Group("/saml-providers")
+	samlProviderGroup.Use(middleware.AdminRequired())
+	{
+		samlProviderGroup.POST("/", controller.CreateSAMLProvider)
+		samlProviderGroup.GET("/", controller.ListSAMLProviders)
+		samlProviderGroup.DELETE("/:id", controller.DeleteSAMLProvider)
+	}
+
+	// SAML 2.0 login with the upstream identity providers
+	samlGroup := r.Group("/auth/saml")
+	{
+		samlGroup.GET("/", controller.ListSAMLLoginProviders)
+		samlGroup.GET("/:provider/metadata", controller.SAMLMetadata)
+		samlGroup.GET("/:provider/login", controller.StartSAMLLogin)
+		samlGroup.POST("/:provider/acs", controller.SAMLACS)
+	}
+
+	r.POST("/ldap/sync", middleware.AdminRequired(), controller.TriggerLDAPSync)
+
+	return r
+}
+
+// tenantRoutes registers the routes that act on the users, roles and groups of one organization
+func tenantRoutes(r *gin.RouterGroup) {
+	userGroup := r.Group("/users")
+	{
+		userGroup.POST("/login", controller.LoginUser)
+		userGroup.POST("/logout", middleware.AuthRequired(), controller.LogoutUser)
+	}
+
+	// Only admins create, read and change other users, the first admin is created with cmd/admin
+	userAdminGroup := r.Group("/users")
+	userAdminGroup.Use(middleware.AdminRequired())
+	{
+		userAdminGroup.POST("/", controller.CreateUser)
+		userAdminGroup.GET("/:id", controller.GetUser)
+		userAdminGroup.PUT("/:id", controller.UpdateUser)
+		userAdminGroup.DELETE("/:id", controller.DeleteUser)
+		userAdminGroup.GET("/", controller.ListUsers)
+	}
+
+	meGroup := r.Group("/users/me")
+	meGroup.Use(middleware.AuthRequired())
+	{
+		meGroup.POST("/tokens", controller.CreateAccessToken)
+		meGroup.GET("/tokens", controller.ListAccessTokens)
+		meGroup.DELETE("/tokens/:id", controller.RevokeAccessToken)
+		meGroup.GET("/sessions", controller.ListSessions)
+		meGroup.DELETE("/sessions/:id", controller.RevokeSession)
+		meGroup.POST("/elevations", controller.RequestElevation)
+		meGroup.GET("/elevations", controller.ListMyElevations)
+		meGroup.GET("/access-requests", controller.ListMyAccessRequests)
+		meGroup.DELETE("/access-requests/:id", controller.CancelAccessRequest)
+		meGroup.GET("/reviews", controller.ListMyReviewItems)
+	}
+
+	// The policies decide who reads the profile of a user, e.g. the managers of the department
+	r.GET("/users/:id/profile", middleware.Authorize("read", "user"), controller.GetUserProfile)
+
+	// Admins can end every session of any user
+	r.DELETE("/users/:id/sessions", middleware.AdminRequired(), controller.RevokeUserSessions)
+
+	// POST adds, DELETE removes and PUT replaces memberships by name
+	membershipGroup := r.Group("/")
+	membershipGroup.Use(middleware.AdminRequired())
+	{
+		membershipGroup.POST("/users/:id/roles", controller.UpdateUserRoles)
+		membershipGroup.PUT("/users/:id/roles", controller.UpdateUserRoles)
+		membershipGroup.DELETE("/users/:id/roles", controller.UpdateUserRoles)
+		membershipGroup.POST("/users/:id/groups", controller.UpdateUserGroups)
+		membershipGroup.PUT("/users/:id/groups", controller.UpdateUserGroups)
+		membershipGroup.DELETE("/users/:id/groups", controller.UpdateUserGroups)
+		membershipGroup.POST("/roles/:id/groups", controller.UpdateRoleGroups)
+		membershipGroup.PUT("/roles/:id/groups", controller.UpdateRoleGroups)
+		membershipGroup.DELETE("/roles/:id/groups", controller.UpdateRoleGroups)
+		membershipGroup.POST("/memberships", controller.ApplyMemberships)
+	}
+
+	// Roles granted for a duration end by themselves, users request them through elevations
+	grantGroup := r.Group("/")
+	grantGroup.Use(middleware.AdminRequired())
+	{
+		grantGroup.POST("/users/:id/grants", controller.GrantRole)
+		grantGroup.GET("/users/:id/grants", controller.ListRoleGrants)
+		grantGroup.GET("/elevations", controller.ListElevations)
+		grantGroup.POST("/elevations/:id/approve", controller.ApproveElevation)
+		grantGroup.POST("/elevations/:id/deny", controller.DenyElevation)
+	}
+
+	// Anyone asks for a role or group, approvers decide: the approver role and the group's managers
+	accessRequestGroup := r.Group("/access-requests")
+	accessRequestGroup.Use(middleware.AuthRequired())
+	{
+		accessRequestGroup.POST("/", controller.CreateAccessRequest)
+		accessRequestGroup.GET("/", controller.ListAccessRequests)
+		accessRequestGroup.POST("/:id/approve", controller.ApproveAccessRequest)
+		accessRequestGroup.POST("/:id/deny", controller.DenyAccessRequest)
+	}
+
+	accessReviewGroup := r.Group("/access-reviews")
+	accessReviewGroup.Use(middleware.AdminRequired())
+	{
+		accessReviewGroup.POST("/", controller.CreateAccessReview)
+		accessReviewGroup.GET("/", controller.ListAccessReviews)
+		accessReviewGroup.GET("/:id", controller.GetAccessReview)
+		accessReviewGroup.POST("/:id/close", controller.CloseAccessReview)
+		accessReviewGroup.GET("/:id/report", controller.AccessReviewReport)
+	}
+	// Reviewers decide the items assigned to them without the admin role
+	r.POST("/access-reviews/:id/decisions", middleware.AuthRequired(), controller.DecideReviewItems)
+
+	policyGroup := r.Group("/policies")
+	policyGroup.Use(middleware.AdminRequired())
+	{
+		policyGroup.POST("/", controller.CreatePolicy)
+		policyGroup.GET("/", controller.ListPolicies)
+		policyGroup.GET("/:id", controller.GetPolicy)
+		policyGroup.PUT("/:id", controller.UpdatePolicy)
+		policyGroup.DELETE("/:id", controller.DeletePolicy)
+	}
+	// Any authenticated user or service may ask for a decision
+	r.POST("/authz/check", middleware.AuthRequired(), controller.CheckAuthorization)
+	// Forward auth for reverse proxies, the subrequest keeps the method of the original request with nginx
+	r.Any("/auth/verify", middleware.ForwardAuth(), controller.VerifyAuth)
+	// Webhook token authentication of the Kubernetes API server, which authenticates with K8S_WEBHOOK_TOKEN
+	r.POST("/k8s/tokenreview", controller.TokenReview)
+
+	registryRuleGroup := r.Group("/registry-rules")
+	registryRuleGroup.Use(middleware.AdminRequired())
+	{
+		registryRuleGroup.POST("/", controller.CreateRegistryRule)
+		registryRuleGroup.GET("/", controller.ListRegistryRules)
+		registryRuleGroup.DELETE("/:id", controller.DeleteRegistryRule)
+	}
+	// Token authentication of the Docker registry, clients sign in with Basic auth
+	r.GET("/v2/token", controller.RegistryToken)
+	r.GET("/v2/token/certificate", controller.RegistryCertificate)
+
+	// SSH certificates for the groups of the user, servers trust the CA key of the organization
+	r.POST("/ssh/sign", middleware.AuthRequired(), controller.SignSSHKey)
+	r.GET("/ssh/ca.pub", controller.SSHCAPublicKey)
+
+	// Public keys of the JWTs for services verifying them without asking, see the verifier package
+	r.GET("/.well-known/jwks.json", controller.JWKS)
+
+	roleConstraintGroup := r.Group("/role-constraints")
+	roleConstraintGroup.Use(middleware.AdminRequired())
+	{
+		roleConstraintGroup.POST("/", controller.CreateRoleConstraint)
+		roleConstraintGroup.GET("/", controller.ListRoleConstraints)
+		roleConstraintGroup.GET("/violations", controller.RoleConstraintViolations)
+		roleConstraintGroup.DELETE("/:id", controller.DeleteRoleConstraint)
+	}
+
+	groupGroup := r.Group("/groups")
+	groupGroup.Use(middleware.AdminRequired())
+	{
+		groupGroup.POST("/", controller.CreateGroup)
+		groupGroup.GET("/:id", controller.GetGroup)
+		groupGroup.PUT("/:id", controller.UpdateGroup)
+		groupGroup.DELETE("/:id", controller.DeleteGroup)
+		groupGroup.GET("/", controller.ListGroups)
+	}
+
+	// Owners and managers of a group administer its members without the admin role
+	groupMemberGroup := r.Group("/groups/:id")
+	groupMemberGroup.Use(middleware.AuthRequired())
+	{
+		groupMemberGroup.GET("/members", controller.ListGroupMembers)
+		groupMemberGroup.POST("/members", controller.AddGroupMember)
+		groupMemberGroup.DELETE("/members/:userId", controller.RemoveGroupMember)
+		groupMemberGroup.GET("/managers", controller.ListGroupManagers)
+		groupMemberGroup.PUT("/managers/:userId", controller.SetGroupManager)
+		groupMemberGroup.DELETE("/managers/:userId", controller.RemoveGroupManager)
+	}
+
+	roleGroup := r.Group("/roles")
+	roleGroup.Use(middleware.AdminRequired())
+	{
+		roleGroup.POST("/", controller.CreateRole)
+		roleGroup.GET("/:id", controller.GetRole)
+		roleGroup.PUT("/:id", controller.UpdateRole)
+		roleGroup.DELETE("/:id", controller.DeleteRole)
+		roleGroup.GET("/", controller.ListRoles)
+	}
+
+	scimGroup := r.Group("/scim/v2")
+	scimGroup.Use(middleware.AdminRequired())
+	{
+		scimGroup.GET("/Users", controller.SCIMListUsers)
+		scimGroup.POST("/Users", controller.SCIMCreateUser)
+		scimGroup.GET("/Users/:id", controller.SCIMGetUser)
+		scimGroup.PUT("/Users/:id", controller.SCIMReplaceUser)
+		scimGroup.PATCH("/Users/:id", controller.SCIMPatchUser)
+		scimGroup.DELETE("/Users/:id", controller.SCIMDeleteUser)
+		scimGroup.GET("/Groups", controller.SCIMListGroups)
+		scimGroup.POST("/Groups", controller.SCIMCreateGroup)
+		scimGroup.GET("/Groups/:id", controller.SCIMGetGroup)
+		scimGroup.PUT("/Groups/:id", controller.SCIMReplaceGroup)
+		scimGroup.PATCH("/Groups/:id", controller.SCIMPatchGroup)
+		scimGroup.DELETE("/Groups/:id", controller.SCIMDeleteGroup)
+		scimGroup.GET("/ServiceProviderConfig", controller.SCIMServiceProviderConfig)
+		scimGroup.GET("/ResourceTypes", controller.SCIMListResourceTypes)
+		scimGroup.GET("/ResourceTypes/:id", controller.SCIMGetResourceType)
+		scimGroup.GET("/Schemas", controller.SCIMListSchemas)
+		scimGroup.GET("/Schemas/:id", controller.SCIMGetSchema)
+	}
+}
@@ -0,0 +1,158 @@
+package saml
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Canonicalization algorithms
+const (
+	AlgorithmExcC14N            = "http://www.w3.org/2001/10/xml-exc-c14n#"
+	AlgorithmEnvelopedSignature = "http://www.w3.org/2000/09/xmldsig#enveloped-signature"
+)
+
+// Canonicalize serializes an element with exclusive XML canonicalization without comments
+// (https://www.w3.org/TR/xml-exc-c14n/). The skip element, usually an enveloped signature, is left
+// out. inclusivePrefixes is the InclusiveNamespaces PrefixList, "#default" stands for the default namespace.
+func Canonicalize(el *Element, skip *Element, inclusivePrefixes []string) ([]byte, error) {
+	inclusive := map[string]bool{}
+	for _, prefix := range inclusivePrefixes {
+		if prefix == "#default" {
+			prefix = ""
+		}
+		inclusive[prefix] = true
+	}
+
+	var b strings.Builder
+	if err := canonicalize(&b, el, skip, inclusive, map[string]string{}); err != nil {
+		return nil, err
+	}
+	return []byte(b.String()), nil
+}
+
+// canonicalize writes one element, rendered holds the namespace declarations of the output ancestors
+func canonicalize(b *strings.Builder, el *Element, skip *Element, inclusive map[string]bool, rendered map[string]string) error {
+	// Namespaces visibly utilized by the element and its attributes, plus the inclusive ones in scope
+	utilized := map[string]bool{el.Prefix: true}
+	for _, attr := range el.Attrs {
+		if attr.Prefix != "" && attr.Prefix != "xmlns" && attr.Prefix != "xml" {
+			utilized[attr.Prefix] = true
+		}
+	}
+	for prefix := range inclusive {
+		if _, ok := el.LookupNamespace(prefix); ok {
+			utilized[prefix] = true
+		}
+	}
+
+	type declaration struct{ prefix, uri string }
+	var declarations []declaration
+	scope := make(map[string]string, len(rendered))
+	for prefix, uri := range rendered {
+		scope[prefix] = uri
+	}
+	for prefix := range utilized {
+		uri, ok := el.LookupNamespace(prefix)
+		if !ok {
+			return fmt.Errorf("saml: unbound namespace prefix %q", prefix)
+		}
+		previous, wasRendered := rendered[prefix]
+		if prefix == "" && uri == "" && !wasRendered {
+			// An empty default namespace only needs undeclaring if an ancestor declared one
+			continue
+		}
+		if wasRendered && previous == uri {
+			continue
+		}
+		declarations = append(declarations, declaration{prefix, uri})
+		scope[prefix] = uri
+	}
+	sort.Slice(declarations, func(i, j int) bool { return declarations[i].prefix < declarations[j].prefix })
+
+	type attribute struct{ namespace, name, value string }
+	var attributes []attribute
+	for _, attr := range el.Attrs {
+		if attr.Prefix == "xmlns" || (attr.Prefix == "" && attr.Local == "xmlns") {
+			continue
+		}
+		namespace, name := "", attr.Local
+		if attr.Prefix != "" {
+			var ok bool
+			if namespace, ok = el.LookupNamespace(attr.Prefix); !ok {
+				return fmt.Errorf("saml: unbound namespace prefix %q", attr.Prefix)
+			}
+			name = attr.Prefix + ":" + attr.Local
+		}
+		attributes = append(attributes, attribute{namespace, name, attr.Value})
+	}
+	// Attributes sort by namespace URI, then local name, attributes without namespace come first
+	sort.Slice(attributes, func(i, j int) bool {
+		if attributes[i].namespace != attributes[j].namespace {
+			return attributes[i].namespace < attributes[j].namespace
+		}
+		return localName(attributes[i].name) < localName(attributes[j].name)
+	})
+
+	name := qualifiedName(el.Prefix, el.Local)
+	b.WriteString("<" + name)
+	for _, d := range declarations {
+		if d.prefix == "" {
+			b.WriteString(` xmlns="` + escapeAttr(d.uri) + `"`)
+		} else {
+			b.WriteString(" xmlns:" + d.prefix + `="` + escapeAttr(d.uri) + `"`)
+		}
+	}
+	for _, a := range attributes {
+		b.WriteString(" " + a.name + `="` + escapeAttr(a.value) + `"`)
+	}
+	b.WriteString(">")
+
+	for _, child := range el.Children {
+		switch c := child.(type) {
+		case string:
+			b.WriteString(escapeText(c))
+		case ProcInst:
+			b.WriteString("<?" + c.Target)
+			if c.Inst != "" {
+				b.WriteString(" " + c.Inst)
+			}
+			b.WriteString("?>")
+		case *Element:
+			if c == skip {
+				continue
+			}
+			if err := canonicalize(b, c, skip, inclusive, scope); err != nil {
+				return err
+			}
+		default:
+			return errors.New("saml: unexpected node")
+		}
+	}
+	b.WriteString("</" + name + ">")
+	return nil
+}
+
+func qualifiedName(prefix, local string) string {
+	if prefix == "" {
+		return local
+	}
+	return prefix + ":" + local
+}
+
+func localName(name string) string {
+	if i := strings.IndexByte(name, ':'); i >= 0 {
+		return name[i+1:]
+	}
+	return name
+}
+
+var (
+	textEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;", "\r", "&#xD;")
+	attrEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", `"`, "&quot;", "\t", "&#x9;", "\n", "&#xA;", "\r", "&#xD;")
+)
+
+func escapeText(s string) string { return textEscaper.Replace(s) }
+
+func escapeAttr(s string) string { return attrEscaper.Replace(s) }
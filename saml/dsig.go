@@ -0,0 +1,252 @@
+package saml
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+)
+
+// Signature and digest algorithms. SHA-1 is deliberately missing.
+const (
+	AlgorithmRSASHA256   = "http://www.w3.org/2001/04/xmldsig-more#rsa-sha256"
+	AlgorithmRSASHA512   = "http://www.w3.org/2001/04/xmldsig-more#rsa-sha512"
+	AlgorithmECDSASHA256 = "http://www.w3.org/2001/04/xmldsig-more#ecdsa-sha256"
+	AlgorithmECDSASHA512 = "http://www.w3.org/2001/04/xmldsig-more#ecdsa-sha512"
+	AlgorithmSHA256      = "http://www.w3.org/2001/04/xmlenc#sha256"
+	AlgorithmSHA512      = "http://www.w3.org/2001/04/xmlenc#sha512"
+)
+
+var (
+	signatureHashes = map[string]crypto.Hash{
+		AlgorithmRSASHA256:   crypto.SHA256,
+		AlgorithmRSASHA512:   crypto.SHA512,
+		AlgorithmECDSASHA256: crypto.SHA256,
+		AlgorithmECDSASHA512: crypto.SHA512,
+	}
+	digestHashes = map[string]crypto.Hash{
+		AlgorithmSHA256: crypto.SHA256,
+		AlgorithmSHA512: crypto.SHA512,
+	}
+)
+
+// ErrNotSigned is returned by VerifySignature for an element without an enveloped signature
+var ErrNotSigned = errors.New("saml: element is not signed")
+
+// VerifySignature checks the enveloped signature of an element against the trusted certificates.
+// The signature has to be a direct child and reference the element itself by its ID, so a valid
+// signature of some other part of the document is never accepted. KeyInfo is ignored.
+func VerifySignature(el *Element, certificates []*x509.Certificate) error {
+	signatures := el.FindChildren(NamespaceDSig, "Signature")
+	if len(signatures) == 0 {
+		return ErrNotSigned
+	}
+	if len(signatures) > 1 {
+		return errors.New("saml: more than one signature")
+	}
+	signature := signatures[0]
+
+	signedInfo := signature.FindChild(NamespaceDSig, "SignedInfo")
+	if signedInfo == nil {
+		return errors.New("saml: signature without SignedInfo")
+	}
+	c14nMethod := signedInfo.FindChild(NamespaceDSig, "CanonicalizationMethod")
+	if c14nMethod == nil || c14nMethod.Attr("Algorithm") != AlgorithmExcC14N {
+		return errors.New("saml: unsupported canonicalization method")
+	}
+	signatureMethod := signedInfo.FindChild(NamespaceDSig, "SignatureMethod")
+	if signatureMethod == nil {
+		return errors.New("saml: signature without SignatureMethod")
+	}
+	hash, ok := signatureHashes[signatureMethod.Attr("Algorithm")]
+	if !ok {
+		return fmt.Errorf("saml: unsupported signature method %q", signatureMethod.Attr("Algorithm"))
+	}
+
+	references := signedInfo.FindChildren(NamespaceDSig, "Reference")
+	if len(references) != 1 {
+		return errors.New("saml: signature has to have exactly one reference")
+	}
+	reference := references[0]
+	id := el.Attr("ID")
+	if id == "" || reference.Attr("URI") != "#"+id {
+		return errors.New("saml: signature does not reference the signed element")
+	}
+
+	// Only the enveloped signature and exclusive canonicalization transforms are accepted
+	var inclusivePrefixes []string
+	canonicalized := false
+	if transforms := reference.FindChild(NamespaceDSig, "Transforms"); transforms != nil {
+		for _, transform := range transforms.FindChildren(NamespaceDSig, "Transform") {
+			switch transform.Attr("Algorithm") {
+			case AlgorithmEnvelopedSignature:
+			case AlgorithmExcC14N:
+				canonicalized = true
+				inclusivePrefixes = prefixList(transform)
+			default:
+				return fmt.Errorf("saml: unsupported transform %q", transform.Attr("Algorithm"))
+			}
+		}
+	}
+	if !canonicalized {
+		return errors.New("saml: reference is not canonicalized")
+	}
+
+	digestMethod := reference.FindChild(NamespaceDSig, "DigestMethod")
+	digestValue := reference.FindChild(NamespaceDSig, "DigestValue")
+	if digestMethod == nil || digestValue == nil {
+		return errors.New("saml: reference without digest")
+	}
+	digestHash, ok := digestHashes[digestMethod.Attr("Algorithm")]
+	if !ok {
+		return fmt.Errorf("saml: unsupported digest method %q", digestMethod.Attr("Algorithm"))
+	}
+	expectedDigest, err := decodeBase64(digestValue.Text())
+	if err != nil {
+		return errors.New("saml: invalid digest value")
+	}
+
+	content, err := Canonicalize(el, signature, inclusivePrefixes)
+	if err != nil {
+		return err
+	}
+	digest := digestHash.New()
+	digest.Write(content)
+	if subtle.ConstantTimeCompare(digest.Sum(nil), expectedDigest) != 1 {
+		return errors.New("saml: digest mismatch, the signed element was modified")
+	}
+
+	signatureValue := signature.FindChild(NamespaceDSig, "SignatureValue")
+	if signatureValue == nil {
+		return errors.New("saml: signature without SignatureValue")
+	}
+	value, err := decodeBase64(signatureValue.Text())
+	if err != nil {
+		return errors.New("saml: invalid signature value")
+	}
+
+	signedInfoContent, err := Canonicalize(signedInfo, nil, prefixList(c14nMethod))
+	if err != nil {
+		return err
+	}
+	h := hash.New()
+	h.Write(signedInfoContent)
+	hashed := h.Sum(nil)
+
+	for _, certificate := range certificates {
+		if verifyHash(certificate.PublicKey, hash, hashed, value) {
+			return nil
+		}
+	}
+	return errors.New("saml: signature is not from a trusted certificate")
+}
+
+// verifyHash checks an RSA PKCS #1 v1.5 or ECDSA signature, XML signatures encode ECDSA as r || s
+func verifyHash(publicKey crypto.PublicKey, hash crypto.Hash, hashed, signature []byte) bool {
+	switch key := publicKey.(type) {
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(key, hash, hashed, signature) == nil
+	case *ecdsa.PublicKey:
+		size := (key.Curve.Params().BitSize + 7) / 8
+		if len(signature) != 2*size {
+			return false
+		}
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		return ecdsa.Verify(key, hashed, r, s)
+	}
+	return false
+}
+
+// prefixList reads the InclusiveNamespaces PrefixList of a transform or canonicalization method
+func prefixList(el *Element) []string {
+	inclusive := el.FindChild(AlgorithmExcC14N, "InclusiveNamespaces")
+	if inclusive == nil {
+		return nil
+	}
+	return strings.Fields(inclusive.Attr("PrefixList"))
+}
+
+// decodeBase64 decodes base64 that may be wrapped over several lines
+func decodeBase64(value string) ([]byte, error) {
+	value = strings.Map(func(r rune) rune {
+		if r == ' ' || r == '\t' || r == '\n' || r == '\r' {
+			return -1
+		}
+		return r
+	}, value)
+	return base64.StdEncoding.DecodeString(value)
+}
+
+// Sign adds an enveloped RSA-SHA256 signature to an element, which needs an ID attribute.
+// The signature is inserted at position index among the element's children, SAML wants it right
+// after the Issuer. Used by identity providers, see the samltest package.
+func Sign(el *Element, index int, key *rsa.PrivateKey, certificate *x509.Certificate) error {
+	id := el.Attr("ID")
+	if id == "" {
+		return errors.New("saml: element to sign has no ID")
+	}
+
+	content, err := Canonicalize(el, nil, nil)
+	if err != nil {
+		return err
+	}
+	digest := crypto.SHA256.New()
+	digest.Write(content)
+
+	signature, err := ParseXML([]byte(`<ds:Signature xmlns:ds="` + NamespaceDSig + `">` +
+		`<ds:SignedInfo>` +
+		`<ds:CanonicalizationMethod Algorithm="` + AlgorithmExcC14N + `"></ds:CanonicalizationMethod>` +
+		`<ds:SignatureMethod Algorithm="` + AlgorithmRSASHA256 + `"></ds:SignatureMethod>` +
+		`<ds:Reference URI="#` + escapeAttr(id) + `">` +
+		`<ds:Transforms>` +
+		`<ds:Transform Algorithm="` + AlgorithmEnvelopedSignature + `"></ds:Transform>` +
+		`<ds:Transform Algorithm="` + AlgorithmExcC14N + `"></ds:Transform>` +
+		`</ds:Transforms>` +
+		`<ds:DigestMethod Algorithm="` + AlgorithmSHA256 + `"></ds:DigestMethod>` +
+		`<ds:DigestValue>` + base64.StdEncoding.EncodeToString(digest.Sum(nil)) + `</ds:DigestValue>` +
+		`</ds:Reference>` +
+		`</ds:SignedInfo>` +
+		`<ds:SignatureValue></ds:SignatureValue>` +
+		`<ds:KeyInfo><ds:X509Data><ds:X509Certificate>` + base64.StdEncoding.EncodeToString(certificate.Raw) + `</ds:X509Certificate></ds:X509Data></ds:KeyInfo>` +
+		`</ds:Signature>`))
+	if err != nil {
+		return err
+	}
+	el.InsertChild(index, signature)
+
+	signedInfoContent, err := Canonicalize(signature.FindChild(NamespaceDSig, "SignedInfo"), nil, nil)
+	if err != nil {
+		return err
+	}
+	hashed := crypto.SHA256.New()
+	hashed.Write(signedInfoContent)
+	value, err := rsa.SignPKCS1v15(nil, key, crypto.SHA256, hashed.Sum(nil))
+	if err != nil {
+		return err
+	}
+	signatureValue := signature.FindChild(NamespaceDSig, "SignatureValue")
+	signatureValue.Children = []interface{}{base64.StdEncoding.EncodeToString(value)}
+	return nil
+}
+
+// Serialize writes an element tree as XML. The canonical form is used, which is well-formed XML.
+func Serialize(el *Element) ([]byte, error) {
+	content, err := Canonicalize(el, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.Join([][]byte{[]byte(xmlHeader), content}, nil), nil
+}
+
+const xmlHeader = `<?xml version="1.0" encoding="UTF-8"?>`
@@ -0,0 +1,222 @@
+// Package samltest provides an identity provider with a locally generated keypair for testing
+// SAML logins without a real IdP.
+//
+//	idp, err := samltest.NewIdentityProvider("https://idp.test", "https://idp.test/sso")
+//	// register idp.EntityID, idp.SSOURL and idp.CertificatePEM() as the provider
+//	requestID, acsURL, err := idp.ParseAuthnRequest(loginRedirectURL)
+//	samlResponse, err := idp.Response(samltest.Login{SPEntityID: spEntityID, ACSURL: acsURL,
+//		InResponseTo: requestID, NameID: "jdoe@example.org"})
+//	// POST SAMLResponse=samlResponse to the ACS URL
+package samltest
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"encoding/xml"
+	"errors"
+	"io"
+	"jwt/saml"
+	"math/big"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// IdentityProvider signs SAML responses with its own key
+type IdentityProvider struct {
+	EntityID    string
+	SSOURL      string
+	Key         *rsa.PrivateKey
+	Certificate *x509.Certificate
+}
+
+// Login describes the response to issue
+type Login struct {
+	SPEntityID    string              // Audience of the assertion
+	ACSURL        string              // Destination and recipient
+	InResponseTo  string              // ID of the AuthnRequest, empty for an IdP initiated login
+	NameID        string              // Subject of the assertion
+	NameIDFormat  string              // Defaults to the email address format
+	Attributes    map[string][]string // Attribute statement
+	Lifetime      time.Duration       // Validity of the assertion, defaults to five minutes
+	SignResponse  bool                // Sign the response instead of the assertion
+	SignBoth      bool                // Sign the response and the assertion
+	Unsigned      bool                // Do not sign at all
+	IssueInstant  time.Time           // Defaults to now
+	StatusCode    string              // Defaults to success
+	SessionIndex  string              // Defaults to the assertion ID
+	AssertionHook func(*saml.Element) // Called with the assertion after signing, to tamper with it in tests
+}
+
+// NewIdentityProvider generates a 2048 bit RSA key and a self-signed certificate
+func NewIdentityProvider(entityID, ssoURL string) (*IdentityProvider, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: entityID},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(365 * 24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	certificate, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	return &IdentityProvider{EntityID: entityID, SSOURL: ssoURL, Key: key, Certificate: certificate}, nil
+}
+
+// CertificatePEM returns the signing certificate in PEM format
+func (idp *IdentityProvider) CertificatePEM() string {
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: idp.Certificate.Raw}))
+}
+
+// ParseAuthnRequest decodes the AuthnRequest of an HTTP-Redirect binding URL
+func (idp *IdentityProvider) ParseAuthnRequest(redirectURL string) (requestID string, acsURL string, err error) {
+	u, err := url.Parse(redirectURL)
+	if err != nil {
+		return "", "", err
+	}
+	compressed, err := base64.StdEncoding.DecodeString(u.Query().Get("SAMLRequest"))
+	if err != nil {
+		return "", "", err
+	}
+	data, err := io.ReadAll(flate.NewReader(bytes.NewReader(compressed)))
+	if err != nil {
+		return "", "", err
+	}
+	request, err := saml.ParseXML(data)
+	if err != nil {
+		return "", "", err
+	}
+	if !request.Is(saml.NamespaceProtocol, "AuthnRequest") {
+		return "", "", errors.New("samltest: not an AuthnRequest")
+	}
+	return request.Attr("ID"), request.Attr("AssertionConsumerServiceURL"), nil
+}
+
+// Response returns a base64 encoded, signed SAMLResponse as POSTed by the HTTP-POST binding
+func (idp *IdentityProvider) Response(login Login) (string, error) {
+	now := login.IssueInstant
+	if now.IsZero() {
+		now = time.Now()
+	}
+	lifetime := login.Lifetime
+	if lifetime == 0 {
+		lifetime = 5 * time.Minute
+	}
+	nameIDFormat := login.NameIDFormat
+	if nameIDFormat == "" {
+		nameIDFormat = saml.NameIDFormatEmail
+	}
+	statusCode := login.StatusCode
+	if statusCode == "" {
+		statusCode = saml.StatusSuccess
+	}
+	responseID, err := saml.NewID()
+	if err != nil {
+		return "", err
+	}
+	assertionID, err := saml.NewID()
+	if err != nil {
+		return "", err
+	}
+	sessionIndex := login.SessionIndex
+	if sessionIndex == "" {
+		sessionIndex = assertionID
+	}
+
+	instant := now.UTC().Format(time.RFC3339)
+	expires := now.Add(lifetime).UTC().Format(time.RFC3339)
+	inResponseTo := ""
+	if login.InResponseTo != "" {
+		inResponseTo = ` InResponseTo="` + escape(login.InResponseTo) + `"`
+	}
+
+	var attributes strings.Builder
+	if len(login.Attributes) > 0 {
+		names := make([]string, 0, len(login.Attributes))
+		for name := range login.Attributes {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		attributes.WriteString(`<saml:AttributeStatement>`)
+		for _, name := range names {
+			attributes.WriteString(`<saml:Attribute Name="` + escape(name) + `" NameFormat="urn:oasis:names:tc:SAML:2.0:attrname-format:basic">`)
+			for _, value := range login.Attributes[name] {
+				attributes.WriteString(`<saml:AttributeValue xmlns:xs="http://www.w3.org/2001/XMLSchema" xmlns:xsi="http://www.w3.org/2001/XMLSchema-instance" xsi:type="xs:string">` + escape(value) + `</saml:AttributeValue>`)
+			}
+			attributes.WriteString(`</saml:Attribute>`)
+		}
+		attributes.WriteString(`</saml:AttributeStatement>`)
+	}
+
+	document := `<samlp:Response xmlns:samlp="` + saml.NamespaceProtocol + `" xmlns:saml="` + saml.NamespaceAssertion + `"` +
+		` ID="` + responseID + `" Version="2.0" IssueInstant="` + instant + `" Destination="` + escape(login.ACSURL) + `"` + inResponseTo + `>` +
+		`<saml:Issuer>` + escape(idp.EntityID) + `</saml:Issuer>` +
+		`<samlp:Status><samlp:StatusCode Value="` + escape(statusCode) + `"/></samlp:Status>` +
+		`<saml:Assertion ID="` + assertionID + `" Version="2.0" IssueInstant="` + instant + `">` +
+		`<saml:Issuer>` + escape(idp.EntityID) + `</saml:Issuer>` +
+		`<saml:Subject>` +
+		`<saml:NameID Format="` + escape(nameIDFormat) + `">` + escape(login.NameID) + `</saml:NameID>` +
+		`<saml:SubjectConfirmation Method="` + saml.ConfirmationBearer + `">` +
+		`<saml:SubjectConfirmationData` + inResponseTo + ` NotOnOrAfter="` + expires + `" Recipient="` + escape(login.ACSURL) + `"/>` +
+		`</saml:SubjectConfirmation>` +
+		`</saml:Subject>` +
+		`<saml:Conditions NotBefore="` + instant + `" NotOnOrAfter="` + expires + `">` +
+		`<saml:AudienceRestriction><saml:Audience>` + escape(login.SPEntityID) + `</saml:Audience></saml:AudienceRestriction>` +
+		`</saml:Conditions>` +
+		`<saml:AuthnStatement AuthnInstant="` + instant + `" SessionIndex="` + escape(sessionIndex) + `">` +
+		`<saml:AuthnContext><saml:AuthnContextClassRef>urn:oasis:names:tc:SAML:2.0:ac:classes:PasswordProtectedTransport</saml:AuthnContextClassRef></saml:AuthnContext>` +
+		`</saml:AuthnStatement>` +
+		attributes.String() +
+		`</saml:Assertion>` +
+		`</samlp:Response>`
+
+	response, err := saml.ParseXML([]byte(document))
+	if err != nil {
+		return "", err
+	}
+	assertion := response.FindChild(saml.NamespaceAssertion, "Assertion")
+
+	// The signature goes right after the Issuer, the first child
+	if !login.Unsigned && (!login.SignResponse || login.SignBoth) {
+		if err := saml.Sign(assertion, 1, idp.Key, idp.Certificate); err != nil {
+			return "", err
+		}
+	}
+	if !login.Unsigned && (login.SignResponse || login.SignBoth) {
+		if err := saml.Sign(response, 1, idp.Key, idp.Certificate); err != nil {
+			return "", err
+		}
+	}
+	if login.AssertionHook != nil {
+		login.AssertionHook(assertion)
+	}
+
+	out, err := saml.Serialize(response)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(out), nil
+}
+
+// escape escapes text for use in element content and attribute values
+func escape(s string) string {
+	var b strings.Builder
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
@@ -0,0 +1,372 @@
+// Package saml implements the service provider side of SAML 2.0 web browser SSO: metadata,
+// AuthnRequests with the HTTP-Redirect binding and validation of signed responses received
+// with the HTTP-POST binding. Encrypted assertions are not supported.
+package saml
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Bindings and formats
+const (
+	BindingHTTPPost     = "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST"
+	BindingHTTPRedirect = "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-Redirect"
+	NameIDFormatEmail   = "urn:oasis:names:tc:SAML:1.1:nameid-format:emailAddress"
+	NameIDFormatAny     = "urn:oasis:names:tc:SAML:1.1:nameid-format:unspecified"
+	StatusSuccess       = "urn:oasis:names:tc:SAML:2.0:status:Success"
+	ConfirmationBearer  = "urn:oasis:names:tc:SAML:2.0:cm:bearer"
+)
+
+// MaxClockSkew is the tolerance for the time conditions of assertions
+var MaxClockSkew = 3 * time.Minute
+
+// ServiceProvider holds this service's side of the trust relationship with one identity provider
+type ServiceProvider struct {
+	EntityID       string              // Entity ID of this service, usually the metadata URL
+	ACSURL         string              // Assertion consumer service URL, responses are POSTed here
+	IdPEntityID    string              // Entity ID of the identity provider, the expected Issuer
+	IdPSSOURL      string              // Single sign-on URL of the identity provider (HTTP-Redirect binding)
+	IdPCertificate []*x509.Certificate // Certificates the identity provider signs with
+}
+
+// Assertion is the validated content of a SAML response
+type Assertion struct {
+	ID           string
+	NameID       string
+	NameIDFormat string
+	SessionIndex string
+	InResponseTo string              // ID of the AuthnRequest the response answers
+	Attributes   map[string][]string // Attribute values by Name, and by FriendlyName where given
+}
+
+// ParseCertificates decodes the PEM certificates of an identity provider, several are allowed for key rollover.
+// Bare base64 as found in IdP metadata is accepted as well.
+func ParseCertificates(data string) ([]*x509.Certificate, error) {
+	var certificates []*x509.Certificate
+	rest := []byte(data)
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		certificate, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certificates = append(certificates, certificate)
+	}
+	if len(certificates) == 0 {
+		der, err := decodeBase64(data)
+		if err != nil {
+			return nil, errors.New("saml: no certificate found")
+		}
+		certificate, err := x509.ParseCertificate(der)
+		if err != nil {
+			return nil, err
+		}
+		certificates = append(certificates, certificate)
+	}
+	return certificates, nil
+}
+
+// Metadata returns the SP metadata document to register at the identity provider
+func (sp *ServiceProvider) Metadata() ([]byte, error) {
+	type assertionConsumerService struct {
+		Binding   string `xml:"Binding,attr"`
+		Location  string `xml:"Location,attr"`
+		Index     int    `xml:"index,attr"`
+		IsDefault bool   `xml:"isDefault,attr"`
+	}
+	type spSSODescriptor struct {
+		AuthnRequestsSigned        bool                     `xml:"AuthnRequestsSigned,attr"`
+		WantAssertionsSigned       bool                     `xml:"WantAssertionsSigned,attr"`
+		ProtocolSupportEnumeration string                   `xml:"protocolSupportEnumeration,attr"`
+		NameIDFormat               []string                 `xml:"NameIDFormat"`
+		AssertionConsumerService   assertionConsumerService `xml:"AssertionConsumerService"`
+	}
+	metadata := struct {
+		XMLName         xml.Name        `xml:"urn:oasis:names:tc:SAML:2.0:metadata EntityDescriptor"`
+		EntityID        string          `xml:"entityID,attr"`
+		SPSSODescriptor spSSODescriptor `xml:"SPSSODescriptor"`
+	}{
+		EntityID: sp.EntityID,
+		SPSSODescriptor: spSSODescriptor{
+			WantAssertionsSigned:       true,
+			ProtocolSupportEnumeration: NamespaceProtocol,
+			NameIDFormat:               []string{NameIDFormatEmail, NameIDFormatAny},
+			AssertionConsumerService: assertionConsumerService{
+				Binding:   BindingHTTPPost,
+				Location:  sp.ACSURL,
+				IsDefault: true,
+			},
+		},
+	}
+	out, err := xml.MarshalIndent(metadata, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), out...), nil
+}
+
+// AuthnRequestURL builds the URL that sends the user to the identity provider with a new
+// AuthnRequest. The request ID has to be remembered to check InResponseTo of the response.
+func (sp *ServiceProvider) AuthnRequestURL(relayState string) (redirectURL string, requestID string, err error) {
+	requestID, err = NewID()
+	if err != nil {
+		return "", "", err
+	}
+
+	type nameIDPolicy struct {
+		Format      string `xml:"Format,attr"`
+		AllowCreate bool   `xml:"AllowCreate,attr"`
+	}
+	request := struct {
+		XMLName                     xml.Name     `xml:"urn:oasis:names:tc:SAML:2.0:protocol AuthnRequest"`
+		ID                          string       `xml:"ID,attr"`
+		Version                     string       `xml:"Version,attr"`
+		IssueInstant                string       `xml:"IssueInstant,attr"`
+		Destination                 string       `xml:"Destination,attr"`
+		AssertionConsumerServiceURL string       `xml:"AssertionConsumerServiceURL,attr"`
+		ProtocolBinding             string       `xml:"ProtocolBinding,attr"`
+		Issuer                      string       `xml:"urn:oasis:names:tc:SAML:2.0:assertion Issuer"`
+		NameIDPolicy                nameIDPolicy `xml:"NameIDPolicy"`
+	}{
+		ID:                          requestID,
+		Version:                     "2.0",
+		IssueInstant:                time.Now().UTC().Format(time.RFC3339),
+		Destination:                 sp.IdPSSOURL,
+		AssertionConsumerServiceURL: sp.ACSURL,
+		ProtocolBinding:             BindingHTTPPost,
+		Issuer:                      sp.EntityID,
+		NameIDPolicy:                nameIDPolicy{Format: NameIDFormatAny, AllowCreate: true},
+	}
+	out, err := xml.Marshal(request)
+	if err != nil {
+		return "", "", err
+	}
+
+	// HTTP-Redirect binding: raw DEFLATE, base64, then URL encoding
+	var compressed bytes.Buffer
+	writer, err := flate.NewWriter(&compressed, flate.BestCompression)
+	if err != nil {
+		return "", "", err
+	}
+	writer.Write(out)
+	writer.Close()
+
+	query := url.Values{"SAMLRequest": {base64.StdEncoding.EncodeToString(compressed.Bytes())}}
+	if relayState != "" {
+		query.Set("RelayState", relayState)
+	}
+	separator := "?"
+	if strings.Contains(sp.IdPSSOURL, "?") {
+		separator = "&"
+	}
+	return sp.IdPSSOURL + separator + query.Encode(), requestID, nil
+}
+
+// NewID returns a random identifier usable as an XML ID
+func NewID() (string, error) {
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return "_" + hex.EncodeToString(b), nil
+}
+
+// ParseResponse decodes and validates the base64 SAMLResponse form value of the HTTP-POST binding.
+// Either the response or the assertion has to be signed by the identity provider, only data
+// covered by a valid signature is returned. The caller checks InResponseTo against its requests.
+func (sp *ServiceProvider) ParseResponse(samlResponse string, now time.Time) (*Assertion, error) {
+	data, err := decodeBase64(samlResponse)
+	if err != nil {
+		return nil, errors.New("saml: response is not base64")
+	}
+	response, err := ParseXML(data)
+	if err != nil {
+		return nil, err
+	}
+	if !response.Is(NamespaceProtocol, "Response") {
+		return nil, errors.New("saml: not a SAML response")
+	}
+
+	// Duplicate IDs are the basis of signature wrapping attacks
+	ids := map[string]bool{}
+	duplicate := false
+	response.walk(func(el *Element) {
+		if id := el.Attr("ID"); id != "" {
+			duplicate = duplicate || ids[id]
+			ids[id] = true
+		}
+	})
+	if duplicate {
+		return nil, errors.New("saml: duplicate IDs in response")
+	}
+
+	if destination := response.Attr("Destination"); destination != "" && destination != sp.ACSURL {
+		return nil, fmt.Errorf("saml: response is for %q", destination)
+	}
+	if issuer := response.FindChild(NamespaceAssertion, "Issuer"); issuer != nil && strings.TrimSpace(issuer.Text()) != sp.IdPEntityID {
+		return nil, errors.New("saml: response is from another issuer")
+	}
+	statusCode := response.FindPath(NamespaceProtocol, "Status", "StatusCode")
+	if statusCode == nil {
+		return nil, errors.New("saml: response without status")
+	}
+	if statusCode.Attr("Value") != StatusSuccess {
+		message := ""
+		if statusMessage := response.FindPath(NamespaceProtocol, "Status", "StatusMessage"); statusMessage != nil {
+			message = ": " + statusMessage.Text()
+		}
+		return nil, fmt.Errorf("saml: login failed with status %s%s", statusCode.Attr("Value"), message)
+	}
+
+	if len(response.FindChildren(NamespaceAssertion, "EncryptedAssertion")) > 0 {
+		return nil, errors.New("saml: encrypted assertions are not supported")
+	}
+	assertions := response.FindChildren(NamespaceAssertion, "Assertion")
+	if len(assertions) != 1 {
+		return nil, errors.New("saml: response has to contain exactly one assertion")
+	}
+	assertion := assertions[0]
+
+	// A signature that is present has to be valid, and at least one has to be present
+	responseErr := VerifySignature(response, sp.IdPCertificate)
+	if responseErr != nil && responseErr != ErrNotSigned {
+		return nil, responseErr
+	}
+	assertionErr := VerifySignature(assertion, sp.IdPCertificate)
+	if assertionErr != nil && assertionErr != ErrNotSigned {
+		return nil, assertionErr
+	}
+	if responseErr == ErrNotSigned && assertionErr == ErrNotSigned {
+		return nil, errors.New("saml: neither the response nor the assertion is signed")
+	}
+
+	return sp.validateAssertion(assertion, response.Attr("InResponseTo"), now)
+}
+
+// validateAssertion checks the issuer, subject confirmation, conditions and audience of an assertion
+func (sp *ServiceProvider) validateAssertion(assertion *Element, inResponseTo string, now time.Time) (*Assertion, error) {
+	issuer := assertion.FindChild(NamespaceAssertion, "Issuer")
+	if issuer == nil || strings.TrimSpace(issuer.Text()) != sp.IdPEntityID {
+		return nil, errors.New("saml: assertion is from another issuer")
+	}
+
+	nameID := assertion.FindPath(NamespaceAssertion, "Subject", "NameID")
+	if nameID == nil || strings.TrimSpace(nameID.Text()) == "" {
+		return nil, errors.New("saml: assertion without NameID")
+	}
+
+	// A bearer confirmation for our ACS URL that has not expired
+	confirmed := false
+	subject := assertion.FindChild(NamespaceAssertion, "Subject")
+	for _, confirmation := range subject.FindChildren(NamespaceAssertion, "SubjectConfirmation") {
+		data := confirmation.FindChild(NamespaceAssertion, "SubjectConfirmationData")
+		if confirmation.Attr("Method") != ConfirmationBearer || data == nil {
+			continue
+		}
+		if data.Attr("Recipient") != sp.ACSURL || !before(now, data.Attr("NotOnOrAfter"), true) {
+			continue
+		}
+		if data.Attr("NotBefore") != "" {
+			continue // Bearer confirmations must not carry NotBefore
+		}
+		confirmationInResponseTo := data.Attr("InResponseTo")
+		if inResponseTo != "" && confirmationInResponseTo != inResponseTo {
+			continue
+		}
+		inResponseTo = confirmationInResponseTo
+		confirmed = true
+		break
+	}
+	if !confirmed {
+		return nil, errors.New("saml: no valid bearer subject confirmation for this service")
+	}
+
+	conditions := assertion.FindChild(NamespaceAssertion, "Conditions")
+	if conditions == nil {
+		return nil, errors.New("saml: assertion without conditions")
+	}
+	if notBefore := conditions.Attr("NotBefore"); notBefore != "" {
+		t, err := time.Parse(time.RFC3339Nano, notBefore)
+		if err != nil || now.Add(MaxClockSkew).Before(t) {
+			return nil, errors.New("saml: assertion is not valid yet")
+		}
+	}
+	if !before(now, conditions.Attr("NotOnOrAfter"), false) {
+		return nil, errors.New("saml: assertion has expired")
+	}
+	// Every AudienceRestriction has to name this service
+	restrictions := conditions.FindChildren(NamespaceAssertion, "AudienceRestriction")
+	if len(restrictions) == 0 {
+		return nil, errors.New("saml: assertion without audience restriction")
+	}
+	for _, restriction := range restrictions {
+		found := false
+		for _, audience := range restriction.FindChildren(NamespaceAssertion, "Audience") {
+			found = found || strings.TrimSpace(audience.Text()) == sp.EntityID
+		}
+		if !found {
+			return nil, errors.New("saml: assertion is for another audience")
+		}
+	}
+
+	result := &Assertion{
+		ID:           assertion.Attr("ID"),
+		NameID:       strings.TrimSpace(nameID.Text()),
+		NameIDFormat: nameID.Attr("Format"),
+		InResponseTo: inResponseTo,
+		Attributes:   map[string][]string{},
+	}
+	if authnStatement := assertion.FindChild(NamespaceAssertion, "AuthnStatement"); authnStatement != nil {
+		result.SessionIndex = authnStatement.Attr("SessionIndex")
+	}
+	for _, statement := range assertion.FindChildren(NamespaceAssertion, "AttributeStatement") {
+		for _, attribute := range statement.FindChildren(NamespaceAssertion, "Attribute") {
+			var values []string
+			for _, value := range attribute.FindChildren(NamespaceAssertion, "AttributeValue") {
+				values = append(values, strings.TrimSpace(value.Text()))
+			}
+			result.Attributes[attribute.Attr("Name")] = append(result.Attributes[attribute.Attr("Name")], values...)
+			if friendlyName := attribute.Attr("FriendlyName"); friendlyName != "" && friendlyName != attribute.Attr("Name") {
+				result.Attributes[friendlyName] = append(result.Attributes[friendlyName], values...)
+			}
+		}
+	}
+	return result, nil
+}
+
+// before reports whether now lies before the timestamp, allowing for clock skew.
+// An empty timestamp counts as satisfied unless it is required.
+func before(now time.Time, timestamp string, required bool) bool {
+	if timestamp == "" {
+		return !required
+	}
+	t, err := time.Parse(time.RFC3339Nano, timestamp)
+	if err != nil {
+		return false
+	}
+	return now.Before(t.Add(MaxClockSkew))
+}
+
+// Attribute returns the first value of an attribute or an empty string
+func (a *Assertion) Attribute(name string) string {
+	if values := a.Attributes[name]; len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
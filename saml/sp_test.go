@@ -0,0 +1,350 @@
+package saml_test
+
+import (
+	"encoding/base64"
+	"jwt/saml"
+	"jwt/saml/samltest"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	spEntityID = "https://sp.test/auth/saml/idp/metadata"
+	acsURL     = "https://sp.test/auth/saml/idp/acs"
+	requestID  = "_request"
+)
+
+func newProvider(t *testing.T) (*samltest.IdentityProvider, *saml.ServiceProvider) {
+	t.Helper()
+	idp, err := samltest.NewIdentityProvider("https://idp.test", "https://idp.test/sso")
+	if err != nil {
+		t.Fatal(err)
+	}
+	certificates, err := saml.ParseCertificates(idp.CertificatePEM())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return idp, &saml.ServiceProvider{
+		EntityID:       spEntityID,
+		ACSURL:         acsURL,
+		IdPEntityID:    idp.EntityID,
+		IdPSSOURL:      idp.SSOURL,
+		IdPCertificate: certificates,
+	}
+}
+
+// login is a valid login for the service provider, tests change what they need
+func login() samltest.Login {
+	return samltest.Login{
+		SPEntityID:   spEntityID,
+		ACSURL:       acsURL,
+		InResponseTo: requestID,
+		NameID:       "jdoe@example.org",
+		Attributes:   map[string][]string{"groups": {"ops", "dev"}},
+	}
+}
+
+func respond(t *testing.T, idp *samltest.IdentityProvider, login samltest.Login) string {
+	t.Helper()
+	response, err := idp.Response(login)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return response
+}
+
+// mutate changes a response after it was signed
+func mutate(t *testing.T, response string, change func(response, assertion *saml.Element)) string {
+	t.Helper()
+	data, err := base64.StdEncoding.DecodeString(response)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, err := saml.ParseXML(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	change(root, root.FindChild(saml.NamespaceAssertion, "Assertion"))
+	out, err := saml.Serialize(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return base64.StdEncoding.EncodeToString(out)
+}
+
+// resign changes an unsigned response and signs the assertion afterwards, so that the validation
+// of the changed content is tested rather than the signature
+func resign(t *testing.T, idp *samltest.IdentityProvider, login samltest.Login, change func(response, assertion *saml.Element)) string {
+	t.Helper()
+	login.Unsigned = true
+	return mutate(t, respond(t, idp, login), func(response, assertion *saml.Element) {
+		change(response, assertion)
+		if err := saml.Sign(assertion, 1, idp.Key, idp.Certificate); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+// clone copies an element with its descendants
+func clone(t *testing.T, el *saml.Element) *saml.Element {
+	t.Helper()
+	data, err := saml.Serialize(el)
+	if err != nil {
+		t.Fatal(err)
+	}
+	copied, err := saml.ParseXML(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return copied
+}
+
+func setText(el *saml.Element, text string) {
+	el.Children = []interface{}{text}
+}
+
+// removeChild removes a child element, returning it
+func removeChild(parent *saml.Element, child *saml.Element) *saml.Element {
+	for i, c := range parent.Children {
+		if c == child {
+			parent.Children = append(parent.Children[:i], parent.Children[i+1:]...)
+			break
+		}
+	}
+	return child
+}
+
+func TestParseResponseValid(t *testing.T) {
+	idp, sp := newProvider(t)
+
+	tests := []struct {
+		name   string
+		change func(*samltest.Login)
+	}{
+		{"signed assertion", func(*samltest.Login) {}},
+		{"signed response", func(login *samltest.Login) { login.SignResponse = true }},
+		{"both signed", func(login *samltest.Login) { login.SignBoth = true }},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			login := login()
+			test.change(&login)
+			assertion, err := sp.ParseResponse(respond(t, idp, login), time.Now())
+			if err != nil {
+				t.Fatalf("ParseResponse() = %v", err)
+			}
+			if assertion.NameID != "jdoe@example.org" || assertion.InResponseTo != requestID {
+				t.Errorf("assertion = %+v", assertion)
+			}
+			if groups := assertion.Attributes["groups"]; len(groups) != 2 || groups[0] != "ops" || groups[1] != "dev" {
+				t.Errorf("groups = %v, want [ops dev]", groups)
+			}
+		})
+	}
+}
+
+func TestParseResponseRejects(t *testing.T) {
+	idp, sp := newProvider(t)
+	other, err := samltest.NewIdentityProvider(idp.EntityID, idp.SSOURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		response func(t *testing.T) string
+		want     string // Part of the error
+	}{
+		{"unsigned", func(t *testing.T) string {
+			login := login()
+			login.Unsigned = true
+			return respond(t, idp, login)
+		}, "neither the response nor the assertion is signed"},
+
+		{"signed by another key", func(t *testing.T) string {
+			return respond(t, other, login())
+		}, "not from a trusted certificate"},
+
+		{"tampered NameID", func(t *testing.T) string {
+			login := login()
+			login.AssertionHook = func(assertion *saml.Element) {
+				setText(assertion.FindPath(saml.NamespaceAssertion, "Subject", "NameID"), "admin@example.org")
+			}
+			return respond(t, idp, login)
+		}, "digest mismatch"},
+
+		{"tampered attribute", func(t *testing.T) string {
+			login := login()
+			login.AssertionHook = func(assertion *saml.Element) {
+				value := assertion.FindPath(saml.NamespaceAssertion, "AttributeStatement", "Attribute", "AttributeValue")
+				setText(value, "admin")
+			}
+			return respond(t, idp, login)
+		}, "digest mismatch"},
+
+		{"tampered signed response", func(t *testing.T) string {
+			login := login()
+			login.SignResponse = true
+			return mutate(t, respond(t, idp, login), func(_, assertion *saml.Element) {
+				setText(assertion.FindPath(saml.NamespaceAssertion, "Subject", "NameID"), "admin@example.org")
+			})
+		}, "digest mismatch"},
+
+		{"tampered signature value", func(t *testing.T) string {
+			return mutate(t, respond(t, idp, login()), func(_, assertion *saml.Element) {
+				// Flip a bit of the signature itself, the text stays valid base64
+				signatureValue := assertion.FindPath(saml.NamespaceDSig, "Signature", "SignatureValue")
+				value, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(signatureValue.Text()), ""))
+				if err != nil {
+					t.Fatal(err)
+				}
+				value[10] ^= 1
+				setText(signatureValue, base64.StdEncoding.EncodeToString(value))
+			})
+		}, "not from a trusted certificate"},
+
+		{"wrapping with a second assertion", func(t *testing.T) string {
+			return mutate(t, respond(t, idp, login()), func(response, assertion *saml.Element) {
+				evil := clone(t, assertion)
+				evil.SetAttr("ID", "_evil")
+				removeChild(evil, evil.FindChild(saml.NamespaceDSig, "Signature"))
+				setText(evil.FindPath(saml.NamespaceAssertion, "Subject", "NameID"), "admin@example.org")
+				response.InsertChild(2, evil)
+			})
+		}, "exactly one assertion"},
+
+		{"wrapping with the signed assertion hidden in the forged one", func(t *testing.T) string {
+			return mutate(t, respond(t, idp, login()), func(response, assertion *saml.Element) {
+				evil := clone(t, assertion)
+				removeChild(evil, evil.FindChild(saml.NamespaceDSig, "Signature"))
+				setText(evil.FindPath(saml.NamespaceAssertion, "Subject", "NameID"), "admin@example.org")
+				removeChild(response, assertion)
+				evil.FindChild(saml.NamespaceAssertion, "Subject").InsertChild(0, assertion)
+				response.InsertChild(2, evil)
+			})
+		}, "duplicate IDs"},
+
+		{"wrapping with the signature moved to the forged assertion", func(t *testing.T) string {
+			return mutate(t, respond(t, idp, login()), func(response, assertion *saml.Element) {
+				evil := clone(t, assertion)
+				evil.SetAttr("ID", "_evil")
+				removeChild(evil, evil.FindChild(saml.NamespaceDSig, "Signature"))
+				setText(evil.FindPath(saml.NamespaceAssertion, "Subject", "NameID"), "admin@example.org")
+				evil.InsertChild(1, removeChild(assertion, assertion.FindChild(saml.NamespaceDSig, "Signature")))
+				removeChild(response, assertion)
+				response.InsertChild(2, evil)
+			})
+		}, "does not reference the signed element"},
+
+		{"duplicate IDs", func(t *testing.T) string {
+			return mutate(t, respond(t, idp, login()), func(response, assertion *saml.Element) {
+				response.SetAttr("ID", assertion.Attr("ID"))
+			})
+		}, "duplicate IDs"},
+
+		{"wrong audience", func(t *testing.T) string {
+			login := login()
+			login.SPEntityID = "https://other.test/metadata"
+			return respond(t, idp, login)
+		}, "another audience"},
+
+		{"wrong destination", func(t *testing.T) string {
+			login := login()
+			login.ACSURL = "https://other.test/acs"
+			return respond(t, idp, login)
+		}, "response is for"},
+
+		{"wrong recipient", func(t *testing.T) string {
+			login := login()
+			login.ACSURL = "https://other.test/acs"
+			// The unsigned Destination of the response is easy to fix up, the recipient is signed
+			return mutate(t, respond(t, idp, login), func(response, _ *saml.Element) {
+				response.SetAttr("Destination", acsURL)
+			})
+		}, "no valid bearer subject confirmation"},
+
+		{"expired subject confirmation", func(t *testing.T) string {
+			login := login()
+			login.IssueInstant = time.Now().Add(-time.Hour)
+			return respond(t, idp, login)
+		}, "no valid bearer subject confirmation"},
+
+		{"expired conditions", func(t *testing.T) string {
+			return resign(t, idp, login(), func(_, assertion *saml.Element) {
+				expired := time.Now().Add(-time.Hour).UTC().Format(time.RFC3339)
+				assertion.FindChild(saml.NamespaceAssertion, "Conditions").SetAttr("NotOnOrAfter", expired)
+			})
+		}, "assertion has expired"},
+
+		{"not valid yet", func(t *testing.T) string {
+			return resign(t, idp, login(), func(_, assertion *saml.Element) {
+				future := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+				assertion.FindChild(saml.NamespaceAssertion, "Conditions").SetAttr("NotBefore", future)
+			})
+		}, "not valid yet"},
+
+		{"InResponseTo swapped in the unsigned response", func(t *testing.T) string {
+			return mutate(t, respond(t, idp, login()), func(response, _ *saml.Element) {
+				response.SetAttr("InResponseTo", "_other")
+			})
+		}, "no valid bearer subject confirmation"},
+
+		{"another issuer", func(t *testing.T) string {
+			return resign(t, idp, login(), func(_, assertion *saml.Element) {
+				setText(assertion.FindChild(saml.NamespaceAssertion, "Issuer"), "https://evil.test")
+			})
+		}, "assertion is from another issuer"},
+
+		{"failed status", func(t *testing.T) string {
+			login := login()
+			login.StatusCode = "urn:oasis:names:tc:SAML:2.0:status:Responder"
+			return respond(t, idp, login)
+		}, "login failed with status"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := sp.ParseResponse(test.response(t), time.Now())
+			if err == nil {
+				t.Fatalf("ParseResponse() succeeded, want an error with %q", test.want)
+			}
+			if !strings.Contains(err.Error(), test.want) {
+				t.Fatalf("ParseResponse() = %v, want an error with %q", err, test.want)
+			}
+		})
+	}
+}
+
+func TestParseResponseIdPInitiated(t *testing.T) {
+	idp, sp := newProvider(t)
+	login := login()
+	login.InResponseTo = ""
+
+	// The SP package accepts the response, the caller rejects it for lack of a request
+	assertion, err := sp.ParseResponse(respond(t, idp, login), time.Now())
+	if err != nil {
+		t.Fatalf("ParseResponse() = %v", err)
+	}
+	if assertion.InResponseTo != "" {
+		t.Errorf("InResponseTo = %q, want none", assertion.InResponseTo)
+	}
+}
+
+func TestAuthnRequestURL(t *testing.T) {
+	idp, sp := newProvider(t)
+
+	redirectURL, id, err := sp.AuthnRequestURL("state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(redirectURL, idp.SSOURL+"?") || !strings.Contains(redirectURL, "RelayState=state") {
+		t.Errorf("redirect URL = %s", redirectURL)
+	}
+	parsedID, parsedACS, err := idp.ParseAuthnRequest(redirectURL)
+	if err != nil {
+		t.Fatalf("ParseAuthnRequest() = %v", err)
+	}
+	if parsedID != id || parsedACS != acsURL {
+		t.Errorf("request ID %q and ACS URL %q, want %q and %q", parsedID, parsedACS, id, acsURL)
+	}
+}
@@ -0,0 +1,213 @@
+package saml
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// XML namespaces used by SAML and XML signatures
+const (
+	NamespaceXML       = "http://www.w3.org/XML/1998/namespace"
+	NamespaceAssertion = "urn:oasis:names:tc:SAML:2.0:assertion"
+	NamespaceProtocol  = "urn:oasis:names:tc:SAML:2.0:protocol"
+	NamespaceMetadata  = "urn:oasis:names:tc:SAML:2.0:metadata"
+	NamespaceDSig      = "http://www.w3.org/2000/09/xmldsig#"
+)
+
+// Element is a node of a parsed XML document. Namespace prefixes and declarations are kept as
+// written, canonicalization needs them.
+type Element struct {
+	Prefix   string
+	Local    string
+	Attrs    []Attr
+	Children []interface{} // *Element, string (character data) or ProcInst
+	Parent   *Element
+}
+
+// ProcInst is a processing instruction inside the root element
+type ProcInst struct {
+	Target string
+	Inst   string
+}
+
+// Attr is an attribute as written, namespace declarations included
+type Attr struct {
+	Prefix string
+	Local  string
+	Value  string
+}
+
+// ParseXML parses a document into an element tree. Comments and anything outside the root
+// element are dropped, document type declarations are rejected.
+func ParseXML(data []byte) (*Element, error) {
+	decoder := xml.NewDecoder(bytes.NewReader(data))
+	var root, current *Element
+	for {
+		token, err := decoder.RawToken()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		switch t := token.(type) {
+		case xml.StartElement:
+			el := &Element{Prefix: t.Name.Space, Local: t.Name.Local, Parent: current}
+			for _, attr := range t.Attr {
+				el.Attrs = append(el.Attrs, Attr{Prefix: attr.Name.Space, Local: attr.Name.Local, Value: attr.Value})
+			}
+			if current == nil {
+				if root != nil {
+					return nil, errors.New("saml: more than one root element")
+				}
+				root = el
+			} else {
+				current.Children = append(current.Children, el)
+			}
+			current = el
+		case xml.EndElement:
+			if current == nil || t.Name.Space != current.Prefix || t.Name.Local != current.Local {
+				return nil, fmt.Errorf("saml: unexpected end element %s", t.Name.Local)
+			}
+			current = current.Parent
+		case xml.CharData:
+			if current != nil {
+				current.Children = append(current.Children, string(t))
+			} else if strings.TrimSpace(string(t)) != "" {
+				return nil, errors.New("saml: text outside of the root element")
+			}
+		case xml.ProcInst:
+			if current != nil {
+				current.Children = append(current.Children, ProcInst{Target: t.Target, Inst: string(t.Inst)})
+			}
+		case xml.Directive:
+			return nil, errors.New("saml: document type declarations are not allowed")
+		}
+	}
+	if root == nil || current != nil {
+		return nil, errors.New("saml: incomplete document")
+	}
+	return root, nil
+}
+
+// LookupNamespace resolves a prefix ("" for the default namespace) in the scope of the element
+func (e *Element) LookupNamespace(prefix string) (string, bool) {
+	if prefix == "xml" {
+		return NamespaceXML, true
+	}
+	for el := e; el != nil; el = el.Parent {
+		for _, attr := range el.Attrs {
+			if (prefix == "" && attr.Prefix == "" && attr.Local == "xmlns") || (prefix != "" && attr.Prefix == "xmlns" && attr.Local == prefix) {
+				return attr.Value, true
+			}
+		}
+	}
+	return "", prefix == ""
+}
+
+// Namespace returns the namespace URI of the element
+func (e *Element) Namespace() string {
+	uri, _ := e.LookupNamespace(e.Prefix)
+	return uri
+}
+
+// Is reports whether the element has the given namespace and local name
+func (e *Element) Is(namespace, local string) bool {
+	return e.Local == local && e.Namespace() == namespace
+}
+
+// Attr returns the value of an attribute without prefix
+func (e *Element) Attr(local string) string {
+	for _, attr := range e.Attrs {
+		if attr.Prefix == "" && attr.Local == local {
+			return attr.Value
+		}
+	}
+	return ""
+}
+
+// SetAttr sets an attribute without prefix
+func (e *Element) SetAttr(local, value string) {
+	for i, attr := range e.Attrs {
+		if attr.Prefix == "" && attr.Local == local {
+			e.Attrs[i].Value = value
+			return
+		}
+	}
+	e.Attrs = append(e.Attrs, Attr{Local: local, Value: value})
+}
+
+// ChildElements returns the element children
+func (e *Element) ChildElements() []*Element {
+	var children []*Element
+	for _, child := range e.Children {
+		if el, ok := child.(*Element); ok {
+			children = append(children, el)
+		}
+	}
+	return children
+}
+
+// FindChildren returns the children with the given namespace and local name
+func (e *Element) FindChildren(namespace, local string) []*Element {
+	var found []*Element
+	for _, child := range e.ChildElements() {
+		if child.Is(namespace, local) {
+			found = append(found, child)
+		}
+	}
+	return found
+}
+
+// FindChild returns the first child with the given namespace and local name
+func (e *Element) FindChild(namespace, local string) *Element {
+	for _, child := range e.ChildElements() {
+		if child.Is(namespace, local) {
+			return child
+		}
+	}
+	return nil
+}
+
+// FindPath follows a path of child names in one namespace, e.g. FindPath(ns, "Subject", "NameID")
+func (e *Element) FindPath(namespace string, path ...string) *Element {
+	el := e
+	for _, local := range path {
+		if el = el.FindChild(namespace, local); el == nil {
+			return nil
+		}
+	}
+	return el
+}
+
+// Text returns the character data of the element, without that of its descendants
+func (e *Element) Text() string {
+	var b strings.Builder
+	for _, child := range e.Children {
+		if text, ok := child.(string); ok {
+			b.WriteString(text)
+		}
+	}
+	return b.String()
+}
+
+// InsertChild inserts a child element at the given position among all children
+func (e *Element) InsertChild(index int, child *Element) {
+	child.Parent = e
+	e.Children = append(e.Children, nil)
+	copy(e.Children[index+1:], e.Children[index:])
+	e.Children[index] = child
+}
+
+// walk calls fn for the element and all its descendant elements
+func (e *Element) walk(fn func(*Element)) {
+	fn(e)
+	for _, child := range e.ChildElements() {
+		child.walk(fn)
+	}
+}
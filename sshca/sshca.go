@@ -0,0 +1,231 @@
+package sshca
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/big"
+	"sort"
+	"strings"
+	"time"
+)
+
+// UserCert is the certificate type of user certificates
+const UserCert = 1
+
+// minRSABits is the smallest RSA modulus accepted for certificates
+const minRSABits = 2048
+
+// Public key types that can be certified, with the fields following the type name in their blobs
+var keyFields = map[string][]string{
+	"ssh-ed25519":                        {"string"},
+	"ssh-rsa":                            {"mpint", "mpint"},
+	"ecdsa-sha2-nistp256":                {"string", "string"},
+	"ecdsa-sha2-nistp384":                {"string", "string"},
+	"ecdsa-sha2-nistp521":                {"string", "string"},
+	"sk-ssh-ed25519@openssh.com":         {"string", "string"},
+	"sk-ecdsa-sha2-nistp256@openssh.com": {"string", "string", "string"},
+}
+
+// PublicKey is an OpenSSH public key
+type PublicKey struct {
+	Type    string // e.g. "ssh-ed25519"
+	Blob    []byte // Wire encoding, starting with the type
+	Comment string
+}
+
+// Certificate is an OpenSSH certificate as described in PROTOCOL.certkeys
+type Certificate struct {
+	Key             PublicKey
+	Serial          uint64
+	CertType        uint32
+	KeyID           string
+	Principals      []string
+	ValidAfter      time.Time
+	ValidBefore     time.Time
+	CriticalOptions map[string]string // e.g. "force-command", "source-address"
+	Extensions      map[string]string // e.g. "permit-pty" with an empty value
+}
+
+// ParseAuthorizedKey parses a public key in the authorized_keys format, "type base64 [comment]",
+// and checks that the blob is well formed for its type
+func ParseAuthorizedKey(line string) (PublicKey, error) {
+	fields := strings.Fields(strings.TrimSpace(line))
+	if len(fields) < 2 {
+		return PublicKey{}, errors.New("expected a public key like \"ssh-ed25519 AAAA... comment\"")
+	}
+	blob, err := base64.StdEncoding.DecodeString(fields[1])
+	if err != nil {
+		return PublicKey{}, errors.New("the public key is not valid base64")
+	}
+
+	reader := &wireReader{data: blob}
+	keyType := string(reader.string())
+	layout, supported := keyFields[keyType]
+	if !supported {
+		return PublicKey{}, fmt.Errorf("unsupported key type %q", keyType)
+	}
+	if keyType != fields[0] {
+		return PublicKey{}, fmt.Errorf("the key is of type %s, not %s", keyType, fields[0])
+	}
+
+	var values [][]byte
+	for range layout {
+		values = append(values, reader.string())
+	}
+	if reader.err != nil || len(reader.data) > 0 {
+		return PublicKey{}, errors.New("malformed public key")
+	}
+	switch {
+	case keyType == "ssh-ed25519" && len(values[0]) != ed25519.PublicKeySize:
+		return PublicKey{}, errors.New("malformed ed25519 public key")
+	case keyType == "ssh-rsa" && new(big.Int).SetBytes(values[1]).BitLen() < minRSABits:
+		return PublicKey{}, fmt.Errorf("RSA keys need at least %d bits", minRSABits)
+	}
+
+	return PublicKey{Type: keyType, Blob: blob, Comment: strings.Join(fields[2:], " ")}, nil
+}
+
+// Ed25519PublicKey returns the OpenSSH public key of an ed25519 key
+func Ed25519PublicKey(key ed25519.PublicKey, comment string) PublicKey {
+	var blob bytes.Buffer
+	writeString(&blob, []byte("ssh-ed25519"))
+	writeString(&blob, key)
+	return PublicKey{Type: "ssh-ed25519", Blob: blob.Bytes(), Comment: comment}
+}
+
+// AuthorizedKey formats the key for authorized_keys and TrustedUserCAKeys
+func (key PublicKey) AuthorizedKey() string {
+	line := key.Type + " " + base64.StdEncoding.EncodeToString(key.Blob)
+	if key.Comment != "" {
+		line += " " + key.Comment
+	}
+	return line
+}
+
+// Fingerprint returns the SHA256 fingerprint of the key as ssh-keygen -l shows it
+func (key PublicKey) Fingerprint() string {
+	sum := sha256.Sum256(key.Blob)
+	return "SHA256:" + base64.RawStdEncoding.EncodeToString(sum[:])
+}
+
+// Sign signs the certificate with the ed25519 key of the CA and returns it as a public key of the
+// certificate type, e.g. "ssh-ed25519-cert-v01@openssh.com"
+func (cert Certificate) Sign(ca ed25519.PrivateKey) (PublicKey, error) {
+	if _, supported := keyFields[cert.Key.Type]; !supported {
+		return PublicKey{}, fmt.Errorf("unsupported key type %q", cert.Key.Type)
+	}
+	certType := certificateType(cert.Key.Type)
+
+	nonce := make([]byte, 32)
+	if _, err := rand.Read(nonce); err != nil {
+		return PublicKey{}, err
+	}
+
+	var out bytes.Buffer
+	writeString(&out, []byte(certType))
+	writeString(&out, nonce)
+	// The fields of the certified key follow its type name
+	keyType := &wireReader{data: cert.Key.Blob}
+	keyType.string()
+	out.Write(keyType.data)
+	writeUint64(&out, cert.Serial)
+	writeUint32(&out, cert.CertType)
+	writeString(&out, []byte(cert.KeyID))
+
+	var principals bytes.Buffer
+	for _, principal := range cert.Principals {
+		writeString(&principals, []byte(principal))
+	}
+	writeString(&out, principals.Bytes())
+	writeUint64(&out, uint64(cert.ValidAfter.Unix()))
+	writeUint64(&out, uint64(cert.ValidBefore.Unix()))
+	writeString(&out, encodeOptions(cert.CriticalOptions))
+	writeString(&out, encodeOptions(cert.Extensions))
+	writeString(&out, nil) // reserved
+	writeString(&out, Ed25519PublicKey(ca.Public().(ed25519.PublicKey), "").Blob)
+
+	var signature bytes.Buffer
+	writeString(&signature, []byte("ssh-ed25519"))
+	writeString(&signature, ed25519.Sign(ca, out.Bytes()))
+	writeString(&out, signature.Bytes())
+
+	return PublicKey{Type: certType, Blob: out.Bytes(), Comment: cert.KeyID}, nil
+}
+
+// certificateType returns the certificate type of a key type, e.g.
+// "sk-ssh-ed25519-cert-v01@openssh.com" for "sk-ssh-ed25519@openssh.com"
+func certificateType(keyType string) string {
+	name, _ := strings.CutSuffix(keyType, "@openssh.com")
+	return name + "-cert-v01@openssh.com"
+}
+
+// encodeOptions encodes critical options or extensions, sorted by name. Values other than the
+// empty one of flags are strings themselves.
+func encodeOptions(options map[string]string) []byte {
+	names := make([]string, 0, len(options))
+	for name := range options {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var out bytes.Buffer
+	for _, name := range names {
+		writeString(&out, []byte(name))
+		if options[name] == "" {
+			writeString(&out, nil)
+			continue
+		}
+		var value bytes.Buffer
+		writeString(&value, []byte(options[name]))
+		writeString(&out, value.Bytes())
+	}
+	return out.Bytes()
+}
+
+func writeString(out *bytes.Buffer, value []byte) {
+	writeUint32(out, uint32(len(value)))
+	out.Write(value)
+}
+
+func writeUint32(out *bytes.Buffer, value uint32) {
+	var buf [4]byte
+	binary.BigEndian.PutUint32(buf[:], value)
+	out.Write(buf[:])
+}
+
+func writeUint64(out *bytes.Buffer, value uint64) {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], value)
+	out.Write(buf[:])
+}
+
+// wireReader reads the SSH wire encoding, remembering the first error
+type wireReader struct {
+	data []byte
+	err  error
+}
+
+// string reads a length-prefixed string, which also covers mpints
+func (reader *wireReader) string() []byte {
+	if reader.err != nil {
+		return nil
+	}
+	if len(reader.data) < 4 {
+		reader.err = errors.New("truncated")
+		return nil
+	}
+	length := binary.BigEndian.Uint32(reader.data)
+	if uint64(len(reader.data)-4) < uint64(length) {
+		reader.err = errors.New("truncated")
+		return nil
+	}
+	value := reader.data[4 : 4+length]
+	reader.data = reader.data[4+length:]
+	return value
+}
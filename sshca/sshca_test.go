@@ -0,0 +1,264 @@
+package sshca_test
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/binary"
+	"jwt/sshca"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Keys written by ssh-keygen
+const (
+	ed25519Fixture = "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIAoTMyzhwqanjAh5zhy3ihk6LY7jv9+oU6v5AmZw0nN8 jdoe@laptop"
+	ecdsaFixture   = "ecdsa-sha2-nistp256 AAAAE2VjZHNhLXNoYTItbmlzdHAyNTYAAAAIbmlzdHAyNTYAAABBBLBIaz2rlWo+2DAo2lgKet3aakTut8V5O22XEfek86PSFnrMnmKiFdMDby4icYVCqcuUxvSCK4uNuJdZVPDHyNU= ec"
+	rsa1024Fixture = "ssh-rsa AAAAB3NzaC1yc2EAAAADAQABAAAAgQCbs/SgXJXi1BK1ni0A+UjkPMJJ2POqvT61VPUSv6YGLHWjtLa3R2MmxsWgiraf4yku5jxgtsZblsN4dNOcAXWESvLrancYOq9BU7AOCY8ZdahVl8mTUhp7kvb49C/HZTbQNaLVHS0w4Ac1u9eVANgNnj6teIVQDZ9Wmto22BUpmw== old"
+)
+
+// wire reads the SSH wire encoding of a certificate, failing the test on truncated data
+type wire struct {
+	t    *testing.T
+	data []byte
+}
+
+func (w *wire) next(n int) []byte {
+	w.t.Helper()
+	if len(w.data) < n {
+		w.t.Fatalf("truncated, %d bytes left, want %d", len(w.data), n)
+	}
+	value := w.data[:n]
+	w.data = w.data[n:]
+	return value
+}
+
+func (w *wire) uint32() uint32 { return binary.BigEndian.Uint32(w.next(4)) }
+func (w *wire) uint64() uint64 { return binary.BigEndian.Uint64(w.next(8)) }
+func (w *wire) string() []byte { return w.next(int(w.uint32())) }
+
+// options decodes critical options or extensions, keeping their order
+func (w *wire) options() [][2]string {
+	var options [][2]string
+	list := &wire{t: w.t, data: w.string()}
+	for len(list.data) > 0 {
+		name, value := string(list.string()), list.string()
+		if len(value) > 0 {
+			// Non-empty values are strings themselves
+			inner := &wire{t: w.t, data: value}
+			value = inner.string()
+			if len(inner.data) > 0 {
+				w.t.Errorf("option %s has trailing data", name)
+			}
+		}
+		options = append(options, [2]string{name, string(value)})
+	}
+	return options
+}
+
+// keyLine formats a blob as an authorized_keys line
+func keyLine(keyType string, parts ...[]byte) string {
+	var blob []byte
+	for _, part := range parts {
+		blob = append(binary.BigEndian.AppendUint32(blob, uint32(len(part))), part...)
+	}
+	return keyType + " " + base64.StdEncoding.EncodeToString(blob)
+}
+
+func newCertificate(t *testing.T) (sshca.Certificate, ed25519.PrivateKey) {
+	t.Helper()
+	ca := ed25519.NewKeyFromSeed(bytes.Repeat([]byte{7}, ed25519.SeedSize))
+	key, err := sshca.ParseAuthorizedKey(ed25519Fixture)
+	if err != nil {
+		t.Fatal(err)
+	}
+	validAfter := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	return sshca.Certificate{
+		Key:         key,
+		Serial:      42,
+		CertType:    sshca.UserCert,
+		KeyID:       "jdoe@example.org",
+		Principals:  []string{"jdoe", "deploy"},
+		ValidAfter:  validAfter,
+		ValidBefore: validAfter.Add(8 * time.Hour),
+		CriticalOptions: map[string]string{
+			"source-address": "10.0.0.0/8",
+			"force-command":  "/usr/bin/uptime",
+		},
+		Extensions: map[string]string{"permit-pty": "", "permit-agent-forwarding": ""},
+	}, ca
+}
+
+func TestSign(t *testing.T) {
+	cert, ca := newCertificate(t)
+	signed, err := cert.Sign(ca)
+	if err != nil {
+		t.Fatalf("Sign() = %v", err)
+	}
+	if signed.Type != "ssh-ed25519-cert-v01@openssh.com" || signed.Comment != "jdoe@example.org" {
+		t.Errorf("Sign() = %s %s", signed.Type, signed.Comment)
+	}
+
+	w := &wire{t: t, data: signed.Blob}
+	if certType := string(w.string()); certType != signed.Type {
+		t.Errorf("type = %q, want %q", certType, signed.Type)
+	}
+	if nonce := w.string(); len(nonce) != 32 {
+		t.Errorf("nonce of %d bytes, want 32", len(nonce))
+	}
+	key := &wire{t: t, data: cert.Key.Blob}
+	key.string()
+	if public := w.string(); !bytes.Equal(public, key.string()) {
+		t.Errorf("certified key = %x, want the key of the user", public)
+	}
+	if serial := w.uint64(); serial != 42 {
+		t.Errorf("serial = %d, want 42", serial)
+	}
+	if certType := w.uint32(); certType != sshca.UserCert {
+		t.Errorf("certificate type = %d, want a user certificate", certType)
+	}
+	if keyID := string(w.string()); keyID != "jdoe@example.org" {
+		t.Errorf("key ID = %q", keyID)
+	}
+	var principals []string
+	for list := (&wire{t: t, data: w.string()}); len(list.data) > 0; {
+		principals = append(principals, string(list.string()))
+	}
+	if !reflect.DeepEqual(principals, cert.Principals) {
+		t.Errorf("principals = %v, want %v", principals, cert.Principals)
+	}
+	if validAfter, validBefore := int64(w.uint64()), int64(w.uint64()); validAfter != cert.ValidAfter.Unix() || validBefore != cert.ValidBefore.Unix() {
+		t.Errorf("validity = %d to %d, want %d to %d", validAfter, validBefore, cert.ValidAfter.Unix(), cert.ValidBefore.Unix())
+	}
+	// Options are sorted by name
+	wantOptions := [][2]string{{"force-command", "/usr/bin/uptime"}, {"source-address", "10.0.0.0/8"}}
+	if options := w.options(); !reflect.DeepEqual(options, wantOptions) {
+		t.Errorf("critical options = %q, want %q", options, wantOptions)
+	}
+	wantExtensions := [][2]string{{"permit-agent-forwarding", ""}, {"permit-pty", ""}}
+	if extensions := w.options(); !reflect.DeepEqual(extensions, wantExtensions) {
+		t.Errorf("extensions = %q, want %q", extensions, wantExtensions)
+	}
+	if reserved := w.string(); len(reserved) != 0 {
+		t.Errorf("reserved = %x, want empty", reserved)
+	}
+	caKey := sshca.Ed25519PublicKey(ca.Public().(ed25519.PublicKey), "")
+	if signatureKey := w.string(); !bytes.Equal(signatureKey, caKey.Blob) {
+		t.Errorf("signature key = %x, want the CA", signatureKey)
+	}
+
+	// The signature covers everything before it
+	body := signed.Blob[:len(signed.Blob)-len(w.data)]
+	signature := &wire{t: t, data: w.string()}
+	if len(w.data) > 0 {
+		t.Errorf("%d bytes after the signature", len(w.data))
+	}
+	if format := string(signature.string()); format != "ssh-ed25519" {
+		t.Errorf("signature format = %q", format)
+	}
+	blob := signature.string()
+	if !ed25519.Verify(ca.Public().(ed25519.PublicKey), body, blob) {
+		t.Error("the signature does not verify with the CA key")
+	}
+	tampered := bytes.Clone(body)
+	tampered[len(tampered)-1] ^= 1
+	if ed25519.Verify(ca.Public().(ed25519.PublicKey), tampered, blob) {
+		t.Error("the signature verifies a changed body")
+	}
+}
+
+// TestSignWithSSHKeygen has OpenSSH parse the certificate, which also checks the CA signature
+func TestSignWithSSHKeygen(t *testing.T) {
+	sshKeygen, err := exec.LookPath("ssh-keygen")
+	if err != nil {
+		t.Skip("ssh-keygen is not installed")
+	}
+	cert, ca := newCertificate(t)
+	signed, err := cert.Sign(ca)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "id_ed25519-cert.pub")
+	if err := os.WriteFile(path, []byte(signed.AuthorizedKey()+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	command := exec.Command(sshKeygen, "-L", "-f", path)
+	command.Env = append(os.Environ(), "TZ=UTC") // The validity is shown in local time
+	output, err := command.CombinedOutput()
+	if err != nil {
+		t.Fatalf("ssh-keygen -L = %v: %s", err, output)
+	}
+	caKey := sshca.Ed25519PublicKey(ca.Public().(ed25519.PublicKey), "")
+	for _, want := range []string{
+		"Type: ssh-ed25519-cert-v01@openssh.com user certificate",
+		"Signing CA: ED25519 " + caKey.Fingerprint(),
+		`Key ID: "jdoe@example.org"`,
+		"Serial: 42",
+		"Valid: from 2026-01-02T03:04:05 to 2026-01-02T11:04:05",
+		"jdoe\n",
+		"deploy\n",
+		"force-command /usr/bin/uptime",
+		"source-address 10.0.0.0/8",
+		"permit-agent-forwarding",
+		"permit-pty",
+	} {
+		if !strings.Contains(string(output), want) {
+			t.Errorf("ssh-keygen -L output lacks %q:\n%s", want, output)
+		}
+	}
+}
+
+func TestParseAuthorizedKey(t *testing.T) {
+	fixture := strings.Fields(ed25519Fixture)
+	blob, _ := base64.StdEncoding.DecodeString(fixture[1])
+	tests := []struct {
+		name        string
+		line        string
+		wantType    string
+		wantComment string
+		wantErr     string
+	}{
+		{"ed25519", ed25519Fixture, "ssh-ed25519", "jdoe@laptop", ""},
+		{"ecdsa", ecdsaFixture, "ecdsa-sha2-nistp256", "ec", ""},
+		{"comment with spaces", fixture[0] + " " + fixture[1] + "  John   Doe ", "ssh-ed25519", "John Doe", ""},
+		{"no comment", "\t" + fixture[0] + " " + fixture[1] + "\n", "ssh-ed25519", "", ""},
+		{"only the type", "ssh-ed25519", "", "", "expected a public key"},
+		{"empty", "", "", "", "expected a public key"},
+		{"not base64", "ssh-ed25519 AAAA!!!!", "", "", "not valid base64"},
+		{"type differs from the blob", "ssh-rsa " + fixture[1], "", "", "the key is of type ssh-ed25519, not ssh-rsa"},
+		{"unsupported type", keyLine("ssh-dss", []byte("ssh-dss"), []byte{1}, []byte{2}, []byte{3}, []byte{4}), "", "", `unsupported key type "ssh-dss"`},
+		{"truncated key", fixture[0] + " " + base64.StdEncoding.EncodeToString(blob[:len(blob)-5]), "", "", "malformed public key"},
+		{"truncated type", fixture[0] + " " + base64.StdEncoding.EncodeToString(blob[:6]), "", "", "unsupported key type"},
+		{"length beyond the blob", fixture[0] + " " + base64.StdEncoding.EncodeToString(append(bytes.Clone(blob[:15]), 0xff, 0xff, 0xff, 0xff)), "", "", "malformed public key"},
+		{"trailing data", fixture[0] + " " + base64.StdEncoding.EncodeToString(append(bytes.Clone(blob), 0)), "", "", "malformed public key"},
+		{"short ed25519 key", keyLine("ssh-ed25519", []byte("ssh-ed25519"), make([]byte, 31)), "", "", "malformed ed25519 public key"},
+		{"small RSA key", rsa1024Fixture, "", "", "RSA keys need at least 2048 bits"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			key, err := sshca.ParseAuthorizedKey(test.line)
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Errorf("ParseAuthorizedKey() = %v, want %q", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseAuthorizedKey() = %v", err)
+			}
+			if key.Type != test.wantType || key.Comment != test.wantComment {
+				t.Errorf("ParseAuthorizedKey() = %s %q, want %s %q", key.Type, key.Comment, test.wantType, test.wantComment)
+			}
+			// The key is written back as it was read
+			if line := strings.Join(strings.Fields(key.AuthorizedKey())[:2], " "); line != strings.Join(strings.Fields(test.line)[:2], " ") {
+				t.Errorf("AuthorizedKey() = %q", line)
+			}
+		})
+	}
+}
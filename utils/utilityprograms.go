@@ -3,8 +3,14 @@ package utils
 import (
 	"crypto/rand"
 	"crypto/rsa"
+	"crypto/sha256"
 	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
 	"encoding/pem"
+	"jwt/models"
+	"strconv"
 	"time"
 
 	"golang.org/x/crypto/bcrypt"
@@ -51,3 +57,56 @@ func GenerateRSAKeys() (privateKeyPEM, publicKeyPEM string, expiresAt time.Time,
 
 	return privateKeyPEM, publicKeyPEM, expiresAt, nil
 }
+
+// AccessTokenPrefix marks personal access tokens so they can be told apart from JWTs
+const AccessTokenPrefix = "pat_"
+
+// GenerateRandomString returns n random bytes encoded as URL-safe base64
+func GenerateRandomString(n int) (string, error) {
+	buf := make([]byte, n)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+// GenerateAccessToken generates a random personal access token and its SHA-256 hash
+func GenerateAccessToken() (token, hash string, err error) {
+	random, err := GenerateRandomString(32)
+	if err != nil {
+		return "", "", err
+	}
+	token = AccessTokenPrefix + random
+	return token, HashToken(token), nil
+}
+
+// HashToken hashes a token using SHA-256 so that only the hash needs to be stored
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// AuditHash computes the chained hash of an audit event from its fields and the previous hash
+func AuditHash(event models.AuditEvent) string {
+	actorID := ""
+	if event.ActorID != nil {
+		actorID = strconv.FormatUint(uint64(*event.ActorID), 10)
+	}
+	// Encoding the fields as a JSON array keeps the boundaries between them unambiguous
+	data, _ := json.Marshal([]string{
+		event.PrevHash,
+		actorID,
+		event.ActorName,
+		event.Action,
+		event.TargetType,
+		event.TargetID,
+		event.Before,
+		event.After,
+		event.Diff,
+		event.IP,
+		event.RequestID,
+		event.CreatedAt.UTC().Format(time.RFC3339Nano),
+	})
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,175 @@
+package verifier
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ClaimsContextKey is the gin context key of the claims of the request
+const ClaimsContextKey = "claims"
+
+// claimsKey is the key of the claims in the context of a request
+type claimsKey struct{}
+
+// requirement checks the claims of a request, returning the reason of a denial
+type requirement func(claims *Claims) (bool, string)
+
+// FromContext returns the claims the middleware stored in the context of the request
+func FromContext(ctx context.Context) (*Claims, bool) {
+	claims, ok := ctx.Value(claimsKey{}).(*Claims)
+	return claims, ok
+}
+
+// Middleware verifies the bearer token of requests to a net/http handler and stores its claims in
+// the request context. Requests without a valid token get 401.
+func (v *Verifier) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		claims, err := v.verifyRequest(r)
+		if err != nil {
+			log.Println("Unauthorized:", err)
+			writeError(w, http.StatusUnauthorized, "Unauthorized")
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), claimsKey{}, claims)))
+	})
+}
+
+// RequireRole wraps a handler behind Middleware so that it needs one of the roles
+func RequireRole(roles ...string) func(http.Handler) http.Handler {
+	return require(roleRequirement(roles))
+}
+
+// RequireGroup wraps a handler behind Middleware so that it needs membership of one of the groups
+func RequireGroup(groups ...string) func(http.Handler) http.Handler {
+	return require(groupRequirement(groups))
+}
+
+// RequireScope wraps a handler behind Middleware so that a scoped token needs all of the scopes
+func RequireScope(scopes ...string) func(http.Handler) http.Handler {
+	return require(scopeRequirement(scopes))
+}
+
+// Gin verifies the bearer token of requests to gin handlers and stores its claims in the context,
+// under ClaimsContextKey and for FromContext. Requests without a valid token get 401.
+func (v *Verifier) Gin() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		claims, err := v.verifyRequest(c.Request)
+		if err != nil {
+			log.Println("Unauthorized:", err)
+			c.Header("WWW-Authenticate", "Bearer")
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+			c.Abort()
+			return
+		}
+		c.Set(ClaimsContextKey, claims)
+		c.Request = c.Request.WithContext(context.WithValue(c.Request.Context(), claimsKey{}, claims))
+		c.Next()
+	}
+}
+
+// GinClaims returns the claims the Gin middleware stored in the context
+func GinClaims(c *gin.Context) (*Claims, bool) {
+	value, exists := c.Get(ClaimsContextKey)
+	if !exists {
+		return nil, false
+	}
+	claims, ok := value.(*Claims)
+	return claims, ok
+}
+
+// GinRequireRole lets requests that passed Gin through when one of the roles is active
+func GinRequireRole(roles ...string) gin.HandlerFunc {
+	return ginRequire(roleRequirement(roles))
+}
+
+// GinRequireGroup lets requests that passed Gin through when the user is in one of the groups
+func GinRequireGroup(groups ...string) gin.HandlerFunc {
+	return ginRequire(groupRequirement(groups))
+}
+
+// GinRequireScope lets requests that passed Gin through when a scoped token has all of the scopes
+func GinRequireScope(scopes ...string) gin.HandlerFunc {
+	return ginRequire(scopeRequirement(scopes))
+}
+
+func roleRequirement(roles []string) requirement {
+	return func(claims *Claims) (bool, string) {
+		return claims.HasRole(roles...), "missing one of the roles " + strings.Join(roles, ", ")
+	}
+}
+
+func groupRequirement(groups []string) requirement {
+	return func(claims *Claims) (bool, string) {
+		return claims.InGroup(groups...), "not a member of one of the groups " + strings.Join(groups, ", ")
+	}
+}
+
+func scopeRequirement(scopes []string) requirement {
+	return func(claims *Claims) (bool, string) {
+		return claims.HasScopes(scopes...), "token is missing one of the scopes " + strings.Join(scopes, ", ")
+	}
+}
+
+// require turns a requirement into a net/http middleware
+func require(check requirement) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			claims, ok := FromContext(r.Context())
+			if !ok {
+				log.Println("Unauthorized: No verified token, the handler is not behind the middleware")
+				writeError(w, http.StatusUnauthorized, "Unauthorized")
+				return
+			}
+			if allowed, reason := check(claims); !allowed {
+				log.Println("Forbidden:", reason)
+				writeError(w, http.StatusForbidden, "Access denied")
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// ginRequire turns a requirement into a gin middleware
+func ginRequire(check requirement) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		claims, ok := GinClaims(c)
+		if !ok {
+			log.Println("Unauthorized: No verified token, the route is not behind the middleware")
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+			c.Abort()
+			return
+		}
+		if allowed, reason := check(claims); !allowed {
+			log.Println("Forbidden:", reason)
+			c.JSON(http.StatusForbidden, gin.H{"error": "Access denied"})
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// verifyRequest verifies the token of the Authorization header
+func (v *Verifier) verifyRequest(r *http.Request) (*Claims, error) {
+	tokenString, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !found || tokenString == "" {
+		return nil, errMissingToken
+	}
+	return v.Verify(r.Context(), tokenString)
+}
+
+// writeError responds with an error in the JSON format of the server
+func writeError(w http.ResponseWriter, status int, message string) {
+	if status == http.StatusUnauthorized {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": message})
+}
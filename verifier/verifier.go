@@ -0,0 +1,323 @@
+// Package verifier verifies the JWTs of this server in other Go services without access to its
+// database. The public keys come from the JWKS of an organization, e.g.
+// https://auth.example/orgs/acme/.well-known/jwks.json, and are cached and refetched when they
+// get old or a token names an unknown key. Every user signs with a key of their own, which the JWKS
+// lists with its owner: a token is only accepted with the key of the user and organization it names.
+//
+// The tokens are checked offline: a session revoked on the server stays valid here until the
+// token expires. Personal access tokens are opaque and cannot be verified this way.
+package verifier
+
+import (
+	"context"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Defaults of the Verifier settings
+const (
+	DefaultCacheTTL    = 5 * time.Minute  // The server lets the JWKS be cached for 5 minutes
+	DefaultRefreshWait = 30 * time.Second // Limits refetching for tokens naming unknown keys
+)
+
+// errMissingToken is returned for requests without a bearer token
+var errMissingToken = errors.New("missing bearer token")
+
+// maxJWKSSize limits the JWKS response, which holds one key per user of the organization
+const maxJWKSSize = 64 << 20
+
+// Claims are the claims of the JWTs issued at login
+type Claims struct {
+	UserID       uint   `json:"user_id"`
+	Username     string `json:"username"`
+	Email        string `json:"email"`
+	Organization string `json:"org"`
+	SessionID    uint   `json:"sid"`
+	Roles        Names  `json:"roles"`  // Roles active in the session
+	Groups       Names  `json:"groups"` // Groups the user is a direct member of
+	Scopes       Scopes `json:"scope"`  // Empty for session tokens, which are not restricted
+	jwt.RegisteredClaims
+}
+
+// Names are the role or group names of a token. The server puts the role and group objects into
+// the token, Names keeps their names; plain strings are accepted as well.
+type Names []string
+
+// UnmarshalJSON decodes a list of names or of objects with a "Name"
+func (names *Names) UnmarshalJSON(data []byte) error {
+	var entries []json.RawMessage
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return err
+	}
+	decoded := Names{}
+	for _, entry := range entries {
+		var name string
+		if json.Unmarshal(entry, &name) == nil {
+			decoded = append(decoded, name)
+			continue
+		}
+		var object struct{ Name string }
+		if err := json.Unmarshal(entry, &object); err != nil {
+			return err
+		}
+		decoded = append(decoded, object.Name)
+	}
+	*names = decoded
+	return nil
+}
+
+// Scopes are the scopes of the space separated "scope" claim (RFC 9068)
+type Scopes []string
+
+// UnmarshalJSON decodes a space separated string or a list of scopes
+func (scopes *Scopes) UnmarshalJSON(data []byte) error {
+	var joined string
+	if err := json.Unmarshal(data, &joined); err == nil {
+		*scopes = strings.Fields(joined)
+		return nil
+	}
+	var list []string
+	if err := json.Unmarshal(data, &list); err != nil {
+		return err
+	}
+	*scopes = list
+	return nil
+}
+
+// HasRole reports whether one of the roles is active for the token
+func (claims *Claims) HasRole(roles ...string) bool {
+	return containsAny(claims.Roles, roles)
+}
+
+// InGroup reports whether the user is a direct member of one of the groups
+func (claims *Claims) InGroup(groups ...string) bool {
+	return containsAny(claims.Groups, groups)
+}
+
+// HasScopes reports whether the token has all of the scopes. Tokens without scopes, the session
+// tokens of the server, are not restricted, like the server itself treats them.
+func (claims *Claims) HasScopes(scopes ...string) bool {
+	if len(claims.Scopes) == 0 {
+		return true
+	}
+	for _, scope := range scopes {
+		if !containsAny(claims.Scopes, []string{scope}) {
+			return false
+		}
+	}
+	return true
+}
+
+// Verifier verifies tokens with the keys of a JWKS. Set the fields before the first use.
+type Verifier struct {
+	JWKSURL      string        // e.g. "https://auth.example/orgs/acme/.well-known/jwks.json"
+	Organization string        // When set, the "org" claim has to match
+	Client       *http.Client  // http.DefaultClient when nil
+	CacheTTL     time.Duration // How long fetched keys are used before refetching, DefaultCacheTTL when 0
+	RefreshWait  time.Duration // Minimal time between two fetches, DefaultRefreshWait when 0
+	Leeway       time.Duration // Tolerated clock skew for the expiry
+
+	mu        sync.RWMutex
+	keys      map[string]signingKey
+	fetched   time.Time // Time of the last successful fetch
+	attempted time.Time // Time of the last fetch, also a failed one
+}
+
+// signingKey is a key of the JWKS with the user it belongs to
+type signingKey struct {
+	key          *rsa.PublicKey
+	userID       uint
+	organization string
+}
+
+// New returns a verifier for the keys of the JWKS at jwksURL
+func New(jwksURL string) *Verifier {
+	return &Verifier{JWKSURL: jwksURL}
+}
+
+// Verify checks the signature and expiry of a token and that the key belongs to the user and
+// organization of the claims, and returns the claims
+func (v *Verifier) Verify(ctx context.Context, tokenString string) (*Claims, error) {
+	claims := &Claims{}
+	var signer signingKey
+	_, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		if kid == "" {
+			return nil, errors.New("token has no key ID, it was issued before the JWKS")
+		}
+		var err error
+		signer, err = v.key(ctx, kid)
+		return signer.key, err
+	},
+		jwt.WithValidMethods([]string{"RS256"}),
+		jwt.WithExpirationRequired(),
+		jwt.WithLeeway(v.Leeway),
+	)
+	if err != nil {
+		return nil, err
+	}
+	// Any user can sign any claims with their own key
+	if claims.UserID != signer.userID || claims.Organization != signer.organization {
+		return nil, fmt.Errorf("token of user %d in %q is signed with the key of user %d in %q",
+			claims.UserID, claims.Organization, signer.userID, signer.organization)
+	}
+	if v.Organization != "" && claims.Organization != v.Organization {
+		return nil, fmt.Errorf("token was issued for the organization %q", claims.Organization)
+	}
+	return claims, nil
+}
+
+// Refresh fetches the keys now, e.g. at startup to fail early on a wrong URL
+func (v *Verifier) Refresh(ctx context.Context) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.refresh(ctx)
+}
+
+// key returns the key with the ID, refetching the JWKS when the cache is old or the key is unknown.
+// When the server cannot be reached, the cached keys are used on.
+func (v *Verifier) key(ctx context.Context, kid string) (signingKey, error) {
+	v.mu.RLock()
+	key, known := v.keys[kid]
+	fresh := time.Since(v.fetched) < v.cacheTTL()
+	v.mu.RUnlock()
+	if known && fresh {
+		return key, nil
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	// Another request may have refetched in the meantime
+	key, known = v.keys[kid]
+	if known && time.Since(v.fetched) < v.cacheTTL() {
+		return key, nil
+	}
+	if time.Since(v.attempted) < v.refreshWait() {
+		if known {
+			return key, nil
+		}
+		return signingKey{}, fmt.Errorf("unknown signing key %q", kid)
+	}
+
+	if err := v.refresh(ctx); err != nil {
+		if known {
+			return key, nil
+		}
+		return signingKey{}, err
+	}
+	if key, known = v.keys[kid]; known {
+		return key, nil
+	}
+	return signingKey{}, fmt.Errorf("unknown signing key %q", kid)
+}
+
+// refresh fetches the JWKS and replaces the cached keys, the caller holds the lock
+func (v *Verifier) refresh(ctx context.Context) error {
+	v.attempted = time.Now()
+	keys, err := v.fetch(ctx)
+	if err != nil {
+		return fmt.Errorf("fetching the signing keys failed: %w", err)
+	}
+	v.keys, v.fetched = keys, time.Now()
+	return nil
+}
+
+// fetch downloads the JWKS and decodes its RSA signing keys by key ID. Keys without an owner are
+// left out, no token could be checked against them.
+func (v *Verifier) fetch(ctx context.Context) (map[string]signingKey, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, v.JWKSURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	client := v.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	var set struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Use string `json:"use"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+
+			UserID       uint   `json:"user_id"` // Owner of the key
+			Organization string `json:"org"`     // Organization of the owner
+		} `json:"keys"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxJWKSSize)).Decode(&set); err != nil {
+		return nil, err
+	}
+
+	keys := map[string]signingKey{}
+	for _, jwk := range set.Keys {
+		if jwk.Kty != "RSA" || jwk.Kid == "" || (jwk.Use != "" && jwk.Use != "sig") || jwk.UserID == 0 || jwk.Organization == "" {
+			continue
+		}
+		n, err := base64.RawURLEncoding.DecodeString(jwk.N)
+		if err != nil {
+			continue
+		}
+		e, err := base64.RawURLEncoding.DecodeString(jwk.E)
+		if err != nil || len(e) == 0 || len(e) > 4 {
+			continue
+		}
+		exponent := 0
+		for _, b := range e {
+			exponent = exponent<<8 | int(b)
+		}
+		keys[jwk.Kid] = signingKey{
+			key:          &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: exponent},
+			userID:       jwk.UserID,
+			organization: jwk.Organization,
+		}
+	}
+	return keys, nil
+}
+
+func (v *Verifier) cacheTTL() time.Duration {
+	if v.CacheTTL > 0 {
+		return v.CacheTTL
+	}
+	return DefaultCacheTTL
+}
+
+func (v *Verifier) refreshWait() time.Duration {
+	if v.RefreshWait > 0 {
+		return v.RefreshWait
+	}
+	return DefaultRefreshWait
+}
+
+// containsAny reports whether one of wanted is in values
+func containsAny(values []string, wanted []string) bool {
+	for _, value := range values {
+		for _, w := range wanted {
+			if value == w {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,194 @@
+package verifier_test
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"jwt/verifier"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// testKey is a signing key of a user, published in the JWKS with its owner
+type testKey struct {
+	kid          string
+	private      *rsa.PrivateKey
+	userID       uint
+	organization string
+}
+
+func newKey(t *testing.T, kid string, userID uint, organization string) testKey {
+	t.Helper()
+	private, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return testKey{kid: kid, private: private, userID: userID, organization: organization}
+}
+
+// serveJWKS publishes the keys like the server's JWKS route
+func serveJWKS(t *testing.T, keys ...testKey) *httptest.Server {
+	t.Helper()
+	set := []map[string]interface{}{}
+	for _, key := range keys {
+		jwk := map[string]interface{}{
+			"kty": "RSA",
+			"use": "sig",
+			"alg": "RS256",
+			"kid": key.kid,
+			"n":   base64.RawURLEncoding.EncodeToString(key.private.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.private.E)).Bytes()),
+		}
+		if key.userID != 0 {
+			jwk["user_id"] = key.userID
+		}
+		if key.organization != "" {
+			jwk["org"] = key.organization
+		}
+		set = append(set, jwk)
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": set})
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+// sign issues a token like the server's login, for the user and organization of the claims
+func sign(t *testing.T, key testKey, claims jwt.MapClaims) string {
+	t.Helper()
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = key.kid
+	signed, err := token.SignedString(key.private)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed
+}
+
+func claimsOf(userID uint, organization string) jwt.MapClaims {
+	return jwt.MapClaims{
+		"user_id":  userID,
+		"username": "alice",
+		"email":    "alice@example.org",
+		"org":      organization,
+		"sid":      7,
+		"roles":    []map[string]interface{}{{"ID": 1, "Name": "admin"}},
+		"groups":   []string{"ops"},
+		"exp":      time.Now().Add(time.Hour).Unix(),
+	}
+}
+
+func TestVerify(t *testing.T) {
+	alice := newKey(t, "alice-key", 1, "acme")
+	bob := newKey(t, "bob-key", 2, "acme")
+	other := newKey(t, "other-key", 1, "globex")
+	ownerless := newKey(t, "ownerless-key", 0, "")
+	unpublished := newKey(t, "unpublished-key", 1, "acme")
+	server := serveJWKS(t, alice, bob, other, ownerless)
+
+	expired := claimsOf(1, "acme")
+	expired["exp"] = time.Now().Add(-time.Hour).Unix()
+	noExpiry := claimsOf(1, "acme")
+	delete(noExpiry, "exp")
+
+	tests := []struct {
+		name  string
+		token func() string
+		want  string // Part of the error, empty for a valid token
+	}{
+		{"own key", func() string { return sign(t, alice, claimsOf(1, "acme")) }, ""},
+		{"another user's claims with an own key", func() string { return sign(t, bob, claimsOf(1, "acme")) }, "signed with the key of user 2"},
+		{"another organization's claims", func() string { return sign(t, other, claimsOf(1, "acme")) }, `signed with the key of user 1 in "globex"`},
+		{"claims of another organization with the user's key", func() string { return sign(t, alice, claimsOf(1, "globex")) }, `signed with the key of user 1 in "acme"`},
+		{"key without an owner", func() string { return sign(t, ownerless, claimsOf(1, "acme")) }, "unknown signing key"},
+		{"unknown key", func() string { return sign(t, unpublished, claimsOf(1, "acme")) }, "unknown signing key"},
+		{"expired", func() string { return sign(t, alice, expired) }, "expired"},
+		{"without expiry", func() string { return sign(t, alice, noExpiry) }, "exp"},
+		{"HMAC with the public key", func() string {
+			token := jwt.NewWithClaims(jwt.SigningMethodHS256, claimsOf(1, "acme"))
+			token.Header["kid"] = alice.kid
+			signed, err := token.SignedString(alice.private.N.Bytes())
+			if err != nil {
+				t.Fatal(err)
+			}
+			return signed
+		}, "signing method"},
+		{"without key ID", func() string {
+			signed, err := jwt.NewWithClaims(jwt.SigningMethodRS256, claimsOf(1, "acme")).SignedString(alice.private)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return signed
+		}, "no key ID"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			v := verifier.New(server.URL)
+			claims, err := v.Verify(context.Background(), test.token())
+			if test.want == "" {
+				if err != nil {
+					t.Fatalf("Verify() = %v", err)
+				}
+				if claims.UserID != 1 || claims.Organization != "acme" || !claims.HasRole("admin") || !claims.InGroup("ops") {
+					t.Errorf("claims = %+v", claims)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), test.want) {
+				t.Fatalf("Verify() = %v, want an error with %q", err, test.want)
+			}
+		})
+	}
+}
+
+func TestVerifyOrganization(t *testing.T) {
+	alice := newKey(t, "alice-key", 1, "acme")
+	v := verifier.New(serveJWKS(t, alice).URL)
+	v.Organization = "globex"
+
+	if _, err := v.Verify(context.Background(), sign(t, alice, claimsOf(1, "acme"))); err == nil {
+		t.Fatal("Verify() accepted a token of another organization")
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	alice := newKey(t, "alice-key", 1, "acme")
+	bob := newKey(t, "bob-key", 2, "acme")
+	v := verifier.New(serveJWKS(t, alice, bob).URL)
+	handler := v.Middleware(verifier.RequireRole("admin")(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		claims, _ := verifier.FromContext(r.Context())
+		w.Write([]byte(claims.Username))
+	})))
+
+	tests := []struct {
+		name          string
+		authorization string
+		want          int
+	}{
+		{"valid", "Bearer " + sign(t, alice, claimsOf(1, "acme")), http.StatusOK},
+		{"forged with another user's key", "Bearer " + sign(t, bob, claimsOf(1, "acme")), http.StatusUnauthorized},
+		{"missing", "", http.StatusUnauthorized},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			if test.authorization != "" {
+				req.Header.Set("Authorization", test.authorization)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+			if w.Code != test.want {
+				t.Errorf("status = %d %s, want %d", w.Code, w.Body, test.want)
+			}
+		})
+	}
+}